@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrUnauthorized = errors.New("handshake request is not authenticated")
+	ErrForbidden    = errors.New("handshake request is forbidden")
+)
+
+// Principal 是 Upgrader.Authenticate 认证出来的身份，例如用户或者服务账号，具体的类型由应用决定
+type Principal any
+
+type principalKey struct{}
+
+// PrincipalOf 返回 ws 握手时 Upgrader.Authenticate 返回的 Principal，没有的时候返回 nil
+func PrincipalOf(ws WebSocket) Principal {
+	return ws.Value(principalKey{})
+}
+
+// authenticate 调用 u.Authenticate，拒绝的时候返回需要发送给客户端的 *HandshakeError
+func (u *Upgrader) authenticate(request *http.Request) (Principal, *HandshakeError) {
+	if u.Authenticate == nil {
+		return nil, nil
+	}
+	principal, err := u.Authenticate(request)
+	if err == nil {
+		return principal, nil
+	}
+	var e *HandshakeError
+	if errors.As(err, &e) {
+		if e.Err == nil {
+			e = &HandshakeError{Status: e.Status, Header: e.Header, Err: ErrUnauthorized}
+		}
+		return nil, e
+	}
+	status := http.StatusUnauthorized
+	if errors.Is(err, ErrForbidden) {
+		status = http.StatusForbidden
+	}
+	return nil, &HandshakeError{Status: status, Err: err}
+}
+
+// challengeError 表示服务器用带有 WWW-Authenticate 的 401 响应拒绝了握手，需要 Dialer.AuthChallenge 提供认证信息
+type challengeError struct {
+	response *http.Response
+}
+
+func (e *challengeError) Error() string {
+	return e.response.Status
+}
+
+// responseError 返回不再重试认证时的错误
+func (e *challengeError) responseError() *ResponseError {
+	return &ResponseError{Response: e.response, Err: errors.New(e.response.Status)}
+}
+
+// answerChallenge 调用 AuthChallenge 为 request 的副本设置认证信息，返回重新握手使用的请求
+func (d *Dialer) answerChallenge(ctx context.Context, request *http.Request, challenge *challengeError) (*http.Request, error) {
+	next := request.Clone(request.Context())
+	err := d.AuthChallenge(ctx, challenge.response, next)
+	if err != nil {
+		return nil, &ResponseError{Response: challenge.response, Err: err}
+	}
+	return next, nil
+}
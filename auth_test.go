@@ -0,0 +1,211 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// basicAuthServer 返回一个要求 Basic 认证的 WebSocket 服务器的 URL，principals 接收认证出来的用户名。
+// challenge 为 false 时 401 响应不带 WWW-Authenticate。
+func basicAuthServer(t *testing.T, challenge bool, principals chan<- Principal) string {
+	t.Helper()
+	upgrader := &Upgrader{Authenticate: func(request *http.Request) (Principal, error) {
+		username, password, ok := request.BasicAuth()
+		if ok && username == "banned" {
+			return nil, ErrForbidden
+		}
+		if !ok || username != "user" || password != "pass" {
+			header := http.Header{}
+			if challenge {
+				header.Set("WWW-Authenticate", `Basic realm="test"`)
+			}
+			return nil, &HandshakeError{Status: http.StatusUnauthorized, Header: header}
+		}
+		return username, nil
+	}}
+	server := httptest.NewServer(upgrader.Handler(func(ws WebSocket) {
+		principals <- PrincipalOf(ws)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// basicChallenge 返回使用 username 和 password 回应 challenge 的 AuthChallenge，calls 记录调用的次数
+func basicChallenge(t *testing.T, username, password string, calls *atomic.Int32) func(ctx context.Context, response *http.Response, request *http.Request) error {
+	return func(ctx context.Context, response *http.Response, request *http.Request) error {
+		calls.Add(1)
+		if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") != `Basic realm="test"` {
+			t.Errorf("AuthChallenge got %d with WWW-Authenticate %q", response.StatusCode, response.Header.Get("WWW-Authenticate"))
+		}
+		if len(request.Header.Get("Authorization")) > 0 {
+			t.Error("AuthChallenge got a request with the previous Authorization")
+		}
+		request.SetBasicAuth(username, password)
+		return nil
+	}
+}
+
+func dialStatus(err error) int {
+	var responseErr *ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.Response.StatusCode
+	}
+	return 0
+}
+
+func TestAuthChallenge(t *testing.T) {
+	principals := make(chan Principal, 1)
+	url := basicAuthServer(t, true, principals)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := &atomic.Int32{}
+	ws, err := (&Dialer{AuthChallenge: basicChallenge(t, "user", "pass", calls)}).Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	if principal := <-principals; principal != "user" || calls.Load() != 1 {
+		t.Fatalf("principal = %v after %d challenges, want user after 1", principal, calls.Load())
+	}
+
+	// 重新握手仍然是 401 的时候不会再次调用 AuthChallenge
+	calls.Store(0)
+	_, err = (&Dialer{AuthChallenge: basicChallenge(t, "user", "wrong", calls)}).Dial(ctx, url)
+	if dialStatus(err) != http.StatusUnauthorized || calls.Load() != 1 {
+		t.Fatalf("Dial() = %v after %d challenges, want a 401 after 1", err, calls.Load())
+	}
+
+	// 重新握手的其他拒绝原样返回
+	calls.Store(0)
+	_, err = (&Dialer{AuthChallenge: basicChallenge(t, "banned", "pass", calls)}).Dial(ctx, url)
+	if dialStatus(err) != http.StatusForbidden || calls.Load() != 1 {
+		t.Fatalf("Dial() = %v after %d challenges, want a 403 after 1", err, calls.Load())
+	}
+
+	// AuthChallenge 返回的错误被包装在 *ResponseError 中
+	giveUp := errors.New("no credentials")
+	_, err = (&Dialer{AuthChallenge: func(ctx context.Context, response *http.Response, request *http.Request) error {
+		return giveUp
+	}}).Dial(ctx, url)
+	if !errors.Is(err, giveUp) || dialStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Dial() error = %v, want %v with the 401 response", err, giveUp)
+	}
+
+	if _, err = (&Dialer{}).Dial(ctx, url); dialStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Dial() without AuthChallenge error = %v, want a 401", err)
+	}
+}
+
+func TestAuthChallengeRequiresWWWAuthenticate(t *testing.T) {
+	url := basicAuthServer(t, false, make(chan Principal, 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	calls := &atomic.Int32{}
+	_, err := (&Dialer{AuthChallenge: basicChallenge(t, "user", "pass", calls)}).Dial(ctx, url)
+	if dialStatus(err) != http.StatusUnauthorized || calls.Load() != 0 {
+		t.Fatalf("Dial() = %v after %d challenges, want a 401 without a challenge", err, calls.Load())
+	}
+}
+
+// tokenAuthenticate 是测试中的 Authenticate，X-Token 是 "user" 时认证通过，"banned" 时拒绝，没有 X-Token 时要求认证
+func tokenAuthenticate(request *http.Request) (Principal, error) {
+	switch request.Header.Get("X-Token") {
+	case "user":
+		return "user", nil
+	case "banned":
+		return nil, ErrForbidden
+	case "":
+		return nil, &HandshakeError{Status: http.StatusUnauthorized, Header: http.Header{"Www-Authenticate": {`Bearer realm="test"`}}}
+	case "busy":
+		return nil, &HandshakeError{Status: http.StatusServiceUnavailable, Err: errors.New("busy")}
+	}
+	return nil, errors.New("invalid token")
+}
+
+func TestUpgraderAuthenticate(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		status    int
+		err       error
+		challenge string
+	}{
+		{name: "no credentials", status: http.StatusUnauthorized, err: ErrUnauthorized, challenge: `Bearer realm="test"`},
+		{name: "forbidden", token: "banned", status: http.StatusForbidden, err: ErrForbidden},
+		{name: "invalid", token: "wrong", status: http.StatusUnauthorized},
+		{name: "handshake error", token: "busy", status: http.StatusServiceUnavailable},
+		// ResponseRecorder 不能 Hijack，认证通过的请求会在 Hijack 的时候失败
+		{name: "authenticated", token: "user", status: http.StatusInternalServerError, err: ErrHijackResponseWriterFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if len(test.token) > 0 {
+				request.Header.Set("X-Token", test.token)
+			}
+			recorder := httptest.NewRecorder()
+			_, err := (&Upgrader{Authenticate: tokenAuthenticate}).Upgrade(recorder, request)
+			if test.status != http.StatusInternalServerError {
+				var e *HandshakeError
+				if !errors.As(err, &e) || e.Status != test.status {
+					t.Fatalf("Upgrade() error = %v, want a *HandshakeError with status %d", err, test.status)
+				}
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("Upgrade() error = %v, want %v", err, test.err)
+			}
+			if recorder.Code != test.status {
+				t.Fatalf("response status %d, want %d", recorder.Code, test.status)
+			}
+			if challenge := recorder.Header().Get("WWW-Authenticate"); challenge != test.challenge {
+				t.Fatalf("WWW-Authenticate = %q, want %q", challenge, test.challenge)
+			}
+		})
+	}
+}
+
+func TestUpgradeStreamAuthenticate(t *testing.T) {
+	upgrader := &Upgrader{Authenticate: tokenAuthenticate}
+	ws, response, err := upgradeRaw(t, upgrader, handshakeRequest("X-Token: user\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || PrincipalOf(ws) != "user" {
+		t.Fatalf("UpgradeStream() = %d with principal %v, want 101 with user", response.StatusCode, PrincipalOf(ws))
+	}
+
+	ws, response, err = upgradeRaw(t, upgrader, handshakeRequest(""))
+	if ws != nil || !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("UpgradeStream() = %v, %v, want %v", ws, err, ErrUnauthorized)
+	}
+	if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") != `Bearer realm="test"` {
+		t.Fatalf("response %d with WWW-Authenticate %q", response.StatusCode, response.Header.Get("WWW-Authenticate"))
+	}
+
+	// 没有通过校验的握手请求不会调用 Authenticate
+	called := false
+	upgrader = &Upgrader{Authenticate: func(request *http.Request) (Principal, error) {
+		called = true
+		return nil, nil
+	}}
+	if _, _, err = upgradeRaw(t, upgrader, strings.Replace(handshakeRequest(""), "Sec-WebSocket-Version: 13", "Sec-WebSocket-Version: 8", 1)); err == nil || called {
+		t.Fatalf("UpgradeStream() error = %v, Authenticate called %v", err, called)
+	}
+
+	// 没有 Authenticate 的时候 PrincipalOf 返回 nil
+	ws, _, err = upgradeRaw(t, &Upgrader{}, handshakeRequest(""))
+	if err != nil || PrincipalOf(ws) != nil {
+		t.Fatalf("UpgradeStream() = %v with principal %v, want no principal", err, PrincipalOf(ws))
+	}
+}
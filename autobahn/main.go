@@ -0,0 +1,130 @@
+// autobahn 是用于运行 Autobahn TestSuite（https://github.com/crossbario/autobahn-testsuite）的测试程序。
+//
+// 测试服务端的时候，先启动回显服务，再用 fuzzingclient 连接它：
+//
+//	go run ./autobahn -mode server -address 127.0.0.1:9001
+//	docker run --rm --network host -v "$PWD/autobahn:/autobahn" crossbario/autobahn-testsuite \
+//		wstest -m fuzzingclient -s /autobahn/config/fuzzingclient.json
+//
+// 测试客户端的时候，先启动 fuzzingserver，再用这个程序连接它：
+//
+//	docker run --rm --network host -v "$PWD/autobahn:/autobahn" crossbario/autobahn-testsuite \
+//		wstest -m fuzzingserver -s /autobahn/config/fuzzingserver.json
+//	go run ./autobahn -mode client -address 127.0.0.1:9001
+//
+// 测试报告会输出到 autobahn/reports 目录。
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/RommHui/websocket"
+)
+
+const agent = "RommHui/websocket"
+
+func main() {
+	mode := flag.String("mode", "server", "server or client")
+	address := flag.String("address", "127.0.0.1:9001", "address to listen on in server mode, or address of the fuzzingserver in client mode")
+	flag.Parse()
+
+	switch *mode {
+	case "server":
+		log.Fatal(serve(*address))
+	case "client":
+		err := runClient(*address)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown mode %q", *mode)
+	}
+}
+
+// serve 启动一个回显服务，供 fuzzingclient 测试服务端
+func serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("echo server listening on %s", listener.Addr())
+	server := &websocket.Server{
+		Handler:  echo,
+		Upgrader: &websocket.Upgrader{Timeouts: &websocket.Timeouts{}},
+	}
+	return server.Serve(listener)
+}
+
+// echo 把收到的每个数据 Message 原样发送回去，直到连接关闭
+func echo(ws websocket.WebSocket) {
+	for {
+		message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		err = ws.SendMessage(message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// runClient 依次运行 fuzzingserver 的所有测试用例，最后让它生成报告
+func runClient(address string) error {
+	count, err := caseCount(address)
+	if err != nil {
+		return err
+	}
+	log.Printf("running %d cases against %s", count, address)
+	for i := 1; i <= count; i++ {
+		ws, err := dial(address, "/runCase", url.Values{"case": {strconv.Itoa(i)}, "agent": {agent}})
+		if err != nil {
+			log.Printf("case %d: %v", i, err)
+			continue
+		}
+		echo(ws)
+		_ = ws.Close()
+	}
+	ws, err := dial(address, "/updateReports", url.Values{"agent": {agent}})
+	if err != nil {
+		return err
+	}
+	_, _ = ws.ReadMessage()
+	return ws.Close()
+}
+
+func caseCount(address string) (int, error) {
+	ws, err := dial(address, "/getCaseCount", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer ws.Close()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	body, err := io.ReadAll(message)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+func dial(address string, path string, query url.Values) (websocket.WebSocket, error) {
+	target := (&url.URL{Scheme: "ws", Host: address, Path: path, RawQuery: query.Encode()}).String()
+	dialer := &websocket.Dialer{Timeouts: &websocket.Timeouts{}}
+	ws, err := dialer.Dial(context.Background(), target)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", target, err)
+	}
+	return ws, nil
+}
@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// backgroundReader 是 WebSocket 对象在后台读取模式下唯一的读取者。
+// 它会把收到的数据 Message 完整读入内存之后放入队列，控制帧则交给 handleControl 处理。
+type backgroundReader struct {
+	messages chan *Message
+	done     chan struct{}
+	err      error
+}
+
+// BackgroundRead 开启后台读取模式，queueSize 是数据 Message 队列的长度。
+// 开启之后，WebSocket 对象会使用一个后台 goroutine 来读取所有的帧，
+// ReadMessage 会从队列中获取数据 Message，Ping 会等待后台 goroutine 收到的 Pong，
+// 所以 Ping、ReadMessage 和自动回复 Pong 可以在多个 goroutine 中同时使用。
+// 当队列满了之后，后台 goroutine 会停止读取，直到 ReadMessage 取走 Message。
+// 这个方法需要在使用 WebSocket 对象之前调用，重复调用不会有效果。
+func (w *webSocket) BackgroundRead(queueSize int) {
+	if w.background != nil {
+		return
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	w.background = &backgroundReader{
+		messages: make(chan *Message, queueSize),
+		done:     make(chan struct{}),
+	}
+	go w.backgroundRead()
+}
+
+func (w *webSocket) backgroundRead() {
+	bg := w.background
+	defer close(bg.done)
+	closed := w.Done()
+	for {
+		message, err := w.readMessage()
+		if err != nil {
+			bg.err = err
+			return
+		}
+		if w.handled(message) {
+			err = w.handleControl(message)
+		} else {
+			message, err = bufferMessage(message)
+			if err == nil {
+				// 队列满了的时候等待 ReadMessage，连接被关闭之后不再等待，避免后台 goroutine 泄漏
+				select {
+				case bg.messages <- message:
+				case <-closed:
+					err = w.closedError()
+				}
+			}
+		}
+		if err != nil {
+			bg.err = err
+			return
+		}
+	}
+}
+
+func (bg *backgroundReader) readMessage() (*Message, error) {
+	select {
+	case message := <-bg.messages:
+		return message, nil
+	case <-bg.done:
+		select {
+		case message := <-bg.messages:
+			return message, nil
+		default:
+			return nil, bg.err
+		}
+	}
+}
+
+func (bg *backgroundReader) waitPong(ctx context.Context, pong <-chan struct{}) error {
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-bg.done:
+		return bg.err
+	}
+}
+
+// bufferMessage 把 Message 的内容完整读入内存
+func bufferMessage(message *Message) (*Message, error) {
+	buf := &bytes.Buffer{}
+	_, err := io.Copy(buf, message)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Reader: buf,
+		OpCode: message.OpCode,
+	}, nil
+}
@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// backgroundPair 返回通过 net.Pipe 连接的客户端和服务端 WebSocket，两端都开启了后台读取模式
+func backgroundPair(t *testing.T, queueSize int) (client WebSocket, server WebSocket) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	client = NewWebSocket(a, a, true)
+	server = NewWebSocket(b, b, false)
+	client.BackgroundRead(queueSize)
+	server.BackgroundRead(queueSize)
+	return client, server
+}
+
+func readText(t *testing.T, ws WebSocket) string {
+	t.Helper()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	data, err := io.ReadAll(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBackgroundReadConcurrentPing(t *testing.T) {
+	client, server := backgroundPair(t, 4)
+	const count = 10
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := server.Send("message"); err != nil {
+				return
+			}
+		}
+	}()
+	received := make(chan string, count)
+	go func() {
+		for i := 0; i < count; i++ {
+			message, err := client.ReadMessage()
+			if err != nil {
+				close(received)
+				return
+			}
+			data, _ := io.ReadAll(message)
+			received <- string(data)
+		}
+	}()
+	// 后台读取的时候 Ping 等待后台 goroutine 收到的 Pong，不会读走数据 Message
+	for i := 0; i < 3; i++ {
+		if err := client.Ping(); err != nil {
+			t.Fatalf("Ping() error = %v", err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		if data, ok := <-received; !ok || data != "message" {
+			t.Fatalf("message %d = %q, want message", i, data)
+		}
+	}
+}
+
+func TestBackgroundReadQueuedBeforeClose(t *testing.T) {
+	client, server := backgroundPair(t, 4)
+	for _, text := range []string{"a", "b"} {
+		if err := server.Send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		_ = server.Close()
+	}()
+	// 关闭之前已经放入队列的 Message 仍然可以读取
+	if data := readText(t, client); data != "a" {
+		t.Fatalf("ReadMessage() = %q, want a", data)
+	}
+	if data := readText(t, client); data != "b" {
+		t.Fatalf("ReadMessage() = %q, want b", data)
+	}
+	if message, err := client.ReadMessage(); err == nil {
+		t.Fatalf("ReadMessage() after close = %v, want an error", message)
+	}
+	if err := client.Ping(); err == nil {
+		t.Fatal("Ping() after close succeeded")
+	}
+}
+
+func TestHandshakeBackgroundRead(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	servers := make(chan WebSocket, 1)
+	go func() {
+		ws, err := (&Upgrader{BackgroundRead: true, BackgroundQueueSize: 2}).UpgradeStream(a, a)
+		if err != nil {
+			close(servers)
+			return
+		}
+		servers <- ws
+	}()
+	dialer := &Dialer{
+		BackgroundRead:      true,
+		BackgroundQueueSize: 1,
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return b, nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := dialer.Dial(ctx, "ws://example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-servers
+	if !ok {
+		t.Fatal("UpgradeStream() failed")
+	}
+	for _, test := range []struct {
+		ws   WebSocket
+		size int
+	}{{ws: client, size: 1}, {ws: server, size: 2}} {
+		bg := test.ws.(*webSocket).background
+		if bg == nil || cap(bg.messages) != test.size {
+			t.Fatalf("background reader = %+v, want a queue of %d", bg, test.size)
+		}
+	}
+
+	// 客户端不调用 ReadMessage，后台 goroutine 仍然会回复 Ping
+	if err = server.Ping(); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	// 队列满了之后连接被关闭，后台 goroutine 不会一直等待 ReadMessage
+	for _, text := range []string{"a", "b"} {
+		if err = server.Send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = client.Close()
+	select {
+	case <-client.(*webSocket).background.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background reader did not exit after close")
+	}
+}
@@ -0,0 +1,310 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/RommHui/websocket"
+)
+
+// allocLimits 是每种收发方式每个 Message 允许的最多内存分配次数
+var allocLimits = map[string]float64{
+	"client send":              6,
+	"server send":              6,
+	"client receive":           6,
+	"server receive":           6,
+	"server receive fragments": 6,
+	// 往返包括客户端和服务端各自的发送和接收，经过真实的连接，留出少量的余量
+	"round trip":            26,
+	"round trip compressed": 56,
+}
+
+func BenchmarkEcho(b *testing.B) {
+	b.Run("1KiB", benchEcho(1024, false))
+	b.Run("1KiB/Compressed", benchEcho(1024, true))
+	b.Run("64KiB", benchEcho(64*1024, false))
+}
+
+func BenchmarkStream(b *testing.B) {
+	b.Run("16MiB", benchStream(16<<20, 0))
+	b.Run("16MiB/SingleFrame", benchStream(16<<20, websocket.NoFragmentation))
+}
+
+func BenchmarkMask(b *testing.B) {
+	const size = 64 * 1024
+	data := make([]byte, size)
+	key := []byte{1, 2, 3, 4}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frame := &websocket.Frame{
+			Fin:     true,
+			Mask:    true,
+			MaskKey: key,
+			OpCode:  websocket.BinaryFrame,
+			Payload: &io.LimitedReader{R: bytes.NewReader(data), N: size},
+		}
+		if _, err := io.Copy(io.Discard, frame.Encode()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAllocLimits(t *testing.T) {
+	for name, limit := range allocLimits {
+		name, limit := name, limit
+		t.Run(name, func(t *testing.T) {
+			allocs, err := measureAllocs(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allocs > limit {
+				t.Fatalf("%.1f allocs/message, want at most %.0f", allocs, limit)
+			}
+		})
+	}
+}
+
+// dialPair 在本地的 TCP 端口上完成握手，返回客户端和服务端的 WebSocket 对象
+func dialPair(dialer *websocket.Dialer, upgrader *websocket.Upgrader) (client, server websocket.WebSocket, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+	servers := make(chan websocket.WebSocket, 1)
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(rw, r)
+			if err != nil {
+				close(servers)
+				return
+			}
+			servers <- ws
+		}))
+	}()
+	client, err = dialer.Dial(context.Background(), "ws://"+listener.Addr().String()+"/")
+	if err != nil {
+		return nil, nil, err
+	}
+	server, ok := <-servers
+	if !ok {
+		_ = client.Close()
+		return nil, nil, fmt.Errorf("upgrade failed")
+	}
+	return client, server, nil
+}
+
+// echo 把收到的每个 Message 原样发送回去，直到连接关闭
+func echo(ws websocket.WebSocket) {
+	for {
+		message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		err = ws.SendMessage(message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func benchEcho(size int, compress bool) func(b *testing.B) {
+	return func(b *testing.B) {
+		client, server, err := dialPair(
+			&websocket.Dialer{EnableCompression: compress},
+			&websocket.Upgrader{EnableCompression: compress},
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.Close()
+		go echo(server)
+		data := bytes.Repeat([]byte("websocket "), size/10+1)[:size]
+		buf := make([]byte, size)
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err = client.WriteMessage(websocket.BinaryFrame, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			message, err := client.ReadMessage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = io.ReadFull(message, buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, message)
+		}
+	}
+}
+
+func benchStream(size int, fragmentSize int) func(b *testing.B) {
+	return func(b *testing.B) {
+		client, server, err := dialPair(&websocket.Dialer{}, &websocket.Upgrader{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.Close()
+		client.SetFragmentSize(fragmentSize)
+		data := make([]byte, size)
+		received := make(chan error, 1)
+		go func() {
+			for {
+				message, err := server.ReadMessage()
+				if err != nil {
+					return
+				}
+				_, err = io.Copy(io.Discard, message)
+				received <- err
+			}
+		}()
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err = client.SendMessage(&websocket.Message{
+				OpCode: websocket.BinaryFrame,
+				Reader: bytes.NewReader(data),
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = <-received
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// discardStream 是丢弃写入内容的 io.WriteCloser
+type discardStream struct{}
+
+func (discardStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardStream) Close() error {
+	return nil
+}
+
+// repeatStream 循环读取同一段编码好的帧
+type repeatStream struct {
+	data   []byte
+	offset int
+}
+
+func (r *repeatStream) Read(p []byte) (int, error) {
+	if r.offset == len(r.data) {
+		r.offset = 0
+	}
+	n := copy(p, r.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+func (r *repeatStream) Close() error {
+	return nil
+}
+
+// encodeMessage 按照 role 的掩码规则把 data 编码成 fragments 个帧
+func encodeMessage(data []byte, fragments int, mask bool) []byte {
+	var buf bytes.Buffer
+	size := len(data) / fragments
+	for i := 0; i < fragments; i++ {
+		opCode := websocket.BinaryFrame
+		if i > 0 {
+			opCode = websocket.ContinuationFrame
+		}
+		part := data[i*size : (i+1)*size]
+		frame := &websocket.Frame{
+			Fin:     i == fragments-1,
+			Mask:    mask,
+			OpCode:  opCode,
+			Payload: &io.LimitedReader{R: bytes.NewReader(part), N: int64(len(part))},
+		}
+		_, _ = io.Copy(&buf, frame.Encode())
+	}
+	return buf.Bytes()
+}
+
+// measureAllocs 测量 name 对应的收发方式每个 Message 的内存分配次数
+func measureAllocs(name string) (float64, error) {
+	data := bytes.Repeat([]byte("websocket "), 100)
+	sink := make([]byte, len(data))
+	const runs = 1000
+	switch name {
+	case "client send", "server send":
+		role := websocket.RoleClient
+		if name == "server send" {
+			role = websocket.RoleServer
+		}
+		ws := websocket.NewWebSocketWithRole(discardStream{}, &repeatStream{}, role)
+		var err error
+		allocs := testing.AllocsPerRun(runs, func() {
+			if sendErr := ws.WriteMessage(websocket.BinaryFrame, data); sendErr != nil {
+				err = sendErr
+			}
+		})
+		return allocs, err
+	case "client receive", "server receive", "server receive fragments":
+		role, fragments := websocket.RoleClient, 1
+		if name != "client receive" {
+			role = websocket.RoleServer
+		}
+		if name == "server receive fragments" {
+			fragments = 10
+		}
+		stream := &repeatStream{data: encodeMessage(data, fragments, role == websocket.RoleServer)}
+		ws := websocket.NewWebSocketWithRole(discardStream{}, stream, role)
+		var err error
+		allocs := testing.AllocsPerRun(runs, func() {
+			err = readInto(ws, sink, err)
+		})
+		return allocs, err
+	case "round trip", "round trip compressed":
+		compress := name == "round trip compressed"
+		client, server, err := dialPair(
+			&websocket.Dialer{EnableCompression: compress},
+			&websocket.Upgrader{EnableCompression: compress},
+		)
+		if err != nil {
+			return 0, err
+		}
+		defer client.Close()
+		go echo(server)
+		allocs := testing.AllocsPerRun(runs, func() {
+			if sendErr := client.WriteMessage(websocket.BinaryFrame, data); sendErr != nil && err == nil {
+				err = sendErr
+			}
+			err = readInto(client, sink, err)
+		})
+		return allocs, err
+	}
+	return 0, fmt.Errorf("unknown measurement %q", name)
+}
+
+// readInto 读取下一个 Message 到 sink，保留之前已经出现的错误
+func readInto(ws websocket.WebSocket, sink []byte, err error) error {
+	message, readErr := ws.ReadMessage()
+	if readErr == nil {
+		_, readErr = io.ReadFull(message, sink)
+	}
+	if readErr == nil {
+		_, readErr = io.Copy(io.Discard, message)
+	}
+	if err != nil {
+		return err
+	}
+	return readErr
+}
@@ -0,0 +1,9 @@
+// Package bench 是测量 WebSocket 性能的基准测试，包括回显的吞吐量、大 Message 的传输速度、掩码的速度，
+// 以及客户端和服务端收发每个 Message 的内存分配次数。
+//
+//	go test ./bench -bench .
+//	go test ./bench -bench Echo -benchtime 5s
+//
+// TestAllocLimits 检查每个 Message 的内存分配次数没有超过 allocLimits 中记录的上限，
+// 修改收发的代码之后运行 go test 就可以发现性能的退化。确实需要更多分配的改动需要同时修改 allocLimits。
+package bench
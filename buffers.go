@@ -0,0 +1,227 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// maxFrameHeaderLength 是帧头的最大长度：2 个字节的基本头、8 个字节的扩展长度和 4 个字节的掩码 key
+const maxFrameHeaderLength = 14
+
+// fragmentSize 是 sendMessage 每个分片的最大长度，也是写入帧时暂存数据的缓冲区大小
+const fragmentSize = 2048
+
+// headerPool 缓存编码和解码帧头使用的缓冲区
+var headerPool = &sync.Pool{
+	New: func() any {
+		return new([maxFrameHeaderLength]byte)
+	},
+}
+
+// fragmentPool 缓存 sendMessage 读取分片和 frameReader 写入数据时使用的缓冲区
+var fragmentPool = &sync.Pool{
+	New: func() any {
+		return new([fragmentSize]byte)
+	},
+}
+
+// frameDecoder 是每个连接自己的帧解码器，复用 Frame、io.LimitedReader、maskingReader 和帧头的缓冲区，读取帧不会产生新的对象。
+// readLock 保证同一时间只有一个 Message 在被读取，Message 只有在上一个帧的内容读完之后才会读取下一个帧，
+// 所以 readFrame 返回的 Frame 在下一次调用 readFrame 之后就不能再使用了。
+type frameDecoder struct {
+	frame   Frame
+	payload io.LimitedReader
+	masking maskingReader
+	header  [maxFrameHeaderLength]byte
+}
+
+// decode 解码下一个帧，返回的 Frame 会在下一次调用 decode 的时候被覆盖
+func (d *frameDecoder) decode(ctx context.Context, reader io.Reader) (*Frame, error) {
+	d.frame = Frame{}
+	err := d.frame.decode(ctx, reader, &d.header, &d.payload, &d.masking)
+	if err != nil {
+		return nil, err
+	}
+	return &d.frame, nil
+}
+
+// frameEncoder 是每个连接自己的 sendMessage 状态，复用 Frame 和每个分片的 Payload，发送 Message 不会因为分片的数量产生新的对象。
+// sendLock 保证同一时间只有一个 Message 在被发送，sendFrame 在返回之前就写完了帧，所以下一个分片可以直接覆盖它们。
+type frameEncoder struct {
+	frame   Frame
+	payload io.LimitedReader
+	data    bytesBuffer
+	carry   [1]byte
+}
+
+// frameReader 是 Frame.Encode 返回的 io.Reader，先返回帧头再返回内容，帧头读完之后缓冲区会被放回 headerPool。
+// 它实现了 io.WriterTo，io.Copy 会使用缓存的缓冲区把帧头和内容合并写入，不需要每次分配新的缓冲区。
+type frameReader struct {
+	header  *[maxFrameHeaderLength]byte
+	length  int
+	offset  int
+	payload io.Reader
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.header == nil {
+		return r.payload.Read(p)
+	}
+	n := copy(p, r.header[r.offset:r.length])
+	r.offset += n
+	if r.offset >= r.length {
+		headerPool.Put(r.header)
+		r.header = nil
+	}
+	return n, nil
+}
+
+func (r *frameReader) WriteTo(w io.Writer) (int64, error) {
+	buf := fragmentPool.Get().(*[fragmentSize]byte)
+	defer fragmentPool.Put(buf)
+	n := 0
+	if r.header != nil {
+		n = copy(buf[:], r.header[r.offset:r.length])
+		headerPool.Put(r.header)
+		r.header = nil
+	}
+	var written int64
+	for {
+		m, err := r.payload.Read(buf[n:])
+		n += m
+		if n == len(buf) || err != nil && n > 0 {
+			k, writeErr := w.Write(buf[:n])
+			written += int64(k)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			n = 0
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// writeFrameData 把帧头和 frame.data 一起写入 writer，frame.data 会在原地加上掩码。
+// 帧比较小的时候合并成一次写入；writer 是 TCP 或者 Unix 连接的时候使用 net.Buffers，会通过 writev 一次写入；
+// 其他的 writer（例如 TLS 连接）分别写入帧头和内容，避免复制大的内容。
+func writeFrameData(writer io.Writer, frame *Frame) error {
+	header := headerPool.Get().(*[maxFrameHeaderLength]byte)
+	defer headerPool.Put(header)
+	headerLen, maskKey := frame.encodeHeader(header)
+	data := frame.data
+	if frame.Mask {
+		maskBytes(maskKey, 0, data)
+	}
+	if headerLen+len(data) <= fragmentSize {
+		buf := fragmentPool.Get().(*[fragmentSize]byte)
+		defer fragmentPool.Put(buf)
+		n := copy(buf[:], header[:headerLen])
+		n += copy(buf[n:], data)
+		_, err := writer.Write(buf[:n])
+		return err
+	}
+	switch writer.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		buffers := net.Buffers{header[:headerLen], data}
+		_, err := buffers.WriteTo(writer)
+		return err
+	}
+	_, err := writer.Write(header[:headerLen])
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+// writeFrameStream 先写入帧头，再把 frame.Payload 直接写入 writer，不经过暂存的缓冲区。
+// 需要掩码的时候内容会复制到缓存的缓冲区中加上掩码，不会修改 Reader 中的数据。
+func writeFrameStream(writer io.Writer, frame *Frame) error {
+	header := headerPool.Get().(*[maxFrameHeaderLength]byte)
+	defer headerPool.Put(header)
+	headerLen, maskKey := frame.encodeHeader(header)
+	_, err := writer.Write(header[:headerLen])
+	if err != nil {
+		return err
+	}
+	length := frame.Payload.N
+	var n int64
+	if frame.Mask {
+		masking := &maskingWriter{writer: writer}
+		copy(masking.key[:], maskKey)
+		n, err = masking.ReadFrom(frame.Payload)
+	} else {
+		n, err = copyPayload(writer, frame.Payload)
+	}
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyPayload 把 payload 写入 writer。内容正好是 Reader 剩下的全部数据的时候使用 Reader 的 WriteTo，不需要复制；
+// 文件使用 io.Copy，TCP 连接可以通过 sendfile 发送；其他的 Reader 使用缓存的缓冲区复制。
+func copyPayload(writer io.Writer, payload *io.LimitedReader) (int64, error) {
+	if r, ok := payload.R.(interface {
+		io.WriterTo
+		Len() int
+	}); ok && int64(r.Len()) == payload.N {
+		n, err := r.WriteTo(writer)
+		payload.N -= n
+		return n, err
+	}
+	if _, ok := payload.R.(*os.File); ok {
+		return io.Copy(writer, payload)
+	}
+	buf := fragmentPool.Get().(*[fragmentSize]byte)
+	defer fragmentPool.Put(buf)
+	return io.CopyBuffer(writerOnly{writer}, payload, buf[:])
+}
+
+// writerOnly 隐藏 writer 的 ReadFrom，避免 io.CopyBuffer 绕过传入的缓冲区
+type writerOnly struct {
+	io.Writer
+}
+
+// maskingWriter 把内容加上掩码之后写入 writer，内容会先复制到缓存的缓冲区中，不会修改调用者的数据
+type maskingWriter struct {
+	key    [4]byte
+	pos    int
+	writer io.Writer
+}
+
+func (m *maskingWriter) Write(p []byte) (int, error) {
+	n, err := m.ReadFrom(&bytesBuffer{data: p})
+	return int(n), err
+}
+
+func (m *maskingWriter) ReadFrom(reader io.Reader) (int64, error) {
+	buf := fragmentPool.Get().(*[fragmentSize]byte)
+	defer fragmentPool.Put(buf)
+	var written int64
+	for {
+		n, err := reader.Read(buf[:])
+		if n > 0 {
+			m.pos = maskBytes(m.key[:], m.pos, buf[:n])
+			k, writeErr := m.writer.Write(buf[:n])
+			written += int64(k)
+			if writeErr != nil {
+				return written, writeErr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
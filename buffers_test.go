@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingWriter 记录每次 Write 写入的长度
+type countingWriter struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+// dataFrame 返回内容保存在 data 中的帧
+func dataFrame(payload string, mask bool) *Frame {
+	data := []byte(payload)
+	frame := &Frame{
+		Fin:     true,
+		Mask:    mask,
+		OpCode:  BinaryFrame,
+		Payload: &io.LimitedReader{R: bytes.NewReader(data), N: int64(len(data))},
+		data:    data,
+	}
+	if mask {
+		frame.MaskKey = []byte{1, 2, 3, 4}
+	}
+	return frame
+}
+
+func TestWriteFrameData(t *testing.T) {
+	small := strings.Repeat("a", 100)
+	large := strings.Repeat("websocket", fragmentSize/4)
+	tests := []struct {
+		name    string
+		payload string
+		mask    bool
+		writes  int
+	}{
+		// 小的帧合并成一次写入
+		{name: "small", payload: small, writes: 1},
+		{name: "small masked", payload: small, mask: true, writes: 1},
+		// 大的帧分别写入帧头和内容
+		{name: "large", payload: large, writes: 2},
+		{name: "large masked", payload: large, mask: true, writes: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := &countingWriter{}
+			if err := writeFrameData(writer, dataFrame(test.payload, test.mask)); err != nil {
+				t.Fatal(err)
+			}
+			if len(writer.writes) != test.writes {
+				t.Fatalf("writes = %v, want %d writes", writer.writes, test.writes)
+			}
+			frames := decodeFrames(t, writer.Bytes())
+			if len(frames) != 1 || frames[0].Mask != test.mask || string(frames[0].Payload) != test.payload {
+				t.Fatalf("decoded %d frames, want the written payload", len(frames))
+			}
+		})
+	}
+}
+
+func TestWriteFrameDataTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TCP 连接通过 net.Buffers 一次写入帧头和内容
+	payload := strings.Repeat("websocket", fragmentSize/4)
+	err = writeFrameData(conn, dataFrame(payload, true))
+	_ = conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, <-received)
+	if len(frames) != 1 || string(frames[0].Payload) != payload {
+		t.Fatalf("decoded %d frames, want the written payload", len(frames))
+	}
+}
+
+func TestSendMessageMasksOwnBuffer(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), true)
+	// Message 的内容被复制到发送缓冲区之后才加上掩码，不会修改调用者的数据
+	data := []byte(strings.Repeat("payload ", 1000))
+	original := string(data)
+	if err := ws.SendMessage(&Message{Reader: bytes.NewReader(data), OpCode: BinaryFrame}); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != original {
+		t.Fatal("SendMessage() modified the message data")
+	}
+	var sent []byte
+	for _, frame := range decodeFrames(t, output.Bytes()) {
+		sent = append(sent, frame.Payload...)
+	}
+	if string(sent) != original {
+		t.Fatalf("sent %d bytes, want %d", len(sent), len(original))
+	}
+}
+
+func TestFrameDecoder(t *testing.T) {
+	// 两个带掩码的帧，掩码 key 不同
+	input := []byte{0x81, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2, 0x82, 0x83, 5, 6, 7, 8, 1 ^ 5, 2 ^ 6, 3 ^ 7}
+	reader := bytes.NewReader(input)
+	decoder := &frameDecoder{}
+	tests := []struct {
+		opCode  OpCode
+		maskKey []byte
+		payload []byte
+	}{
+		{opCode: TextFrame, maskKey: []byte{1, 2, 3, 4}, payload: []byte("hi")},
+		{opCode: BinaryFrame, maskKey: []byte{5, 6, 7, 8}, payload: []byte{1, 2, 3}},
+	}
+	var previous *Frame
+	for _, test := range tests {
+		frame, err := decoder.decode(context.Background(), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 每次返回的都是同一个 Frame
+		if previous != nil && frame != previous {
+			t.Fatal("decode() returned a new Frame")
+		}
+		previous = frame
+		payload, err := io.ReadAll(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.OpCode != test.opCode || !bytes.Equal(frame.MaskKey, test.maskKey) || !bytes.Equal(payload, test.payload) {
+			t.Fatalf("decode() = %s % x % x, want %d % x % x", frame, frame.MaskKey, payload, test.opCode, test.maskKey, test.payload)
+		}
+	}
+	if _, err := decoder.decode(context.Background(), reader); err == nil {
+		t.Fatal("decode() succeeded at the end of the input")
+	}
+}
+
+func TestFrameDecoderAllocations(t *testing.T) {
+	frame := []byte{0x82, 0x84, 1, 2, 3, 4, 0, 0, 0, 0}
+	reader := bytes.NewReader(nil)
+	decoder := &frameDecoder{}
+	buf := make([]byte, 4)
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(frame)
+		f, err := decoder.decode(context.Background(), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(f.Payload, buf); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("decode() allocated %v times per frame, want 0", allocs)
+	}
+}
+
+var benchmarkSizes = []int{16, 1024, 64 * 1024}
+
+func BenchmarkFrameEncode(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, mask := range []bool{false, true} {
+			name := strconv.Itoa(size)
+			if mask {
+				name += "/Masked"
+			}
+			b.Run(name, func(b *testing.B) {
+				data := make([]byte, size)
+				reader := bytes.NewReader(data)
+				payload := &io.LimitedReader{}
+				frame := &Frame{Fin: true, OpCode: BinaryFrame, Mask: mask, MaskKey: []byte{1, 2, 3, 4}, Payload: payload}
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					reader.Reset(data)
+					payload.R, payload.N = reader, int64(size)
+					if _, err := io.Copy(io.Discard, frame.Encode()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkFrameDecode(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, mask := range []bool{false, true} {
+			name := strconv.Itoa(size)
+			if mask {
+				name += "/Masked"
+			}
+			b.Run(name, func(b *testing.B) {
+				frame := &Frame{Fin: true, OpCode: BinaryFrame, Mask: mask, MaskKey: []byte{1, 2, 3, 4}, Payload: &io.LimitedReader{
+					R: bytes.NewReader(make([]byte, size)),
+					N: int64(size),
+				}}
+				encoded, err := io.ReadAll(frame.Encode())
+				if err != nil {
+					b.Fatal(err)
+				}
+				reader := bytes.NewReader(encoded)
+				decoder := &frameDecoder{}
+				ctx := context.Background()
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					reader.Reset(encoded)
+					f, err := decoder.decode(ctx, reader)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err = io.Copy(io.Discard, f.Payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSendMessage(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		for _, role := range []Role{RoleServer, RoleClient} {
+			name := strconv.Itoa(size)
+			if role == RoleClient {
+				name += "/Masked"
+			}
+			b.Run(name, func(b *testing.B) {
+				ws := NewWebSocketWithRole(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), role).(*webSocket)
+				data := make([]byte, size)
+				reader := bytes.NewReader(data)
+				message := &Message{OpCode: BinaryFrame}
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					reader.Reset(data)
+					message.Reader = reader
+					if err := ws.sendMessage(message); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFrameEncodeRoundTrip(t *testing.T) {
+	frame := &Frame{Fin: true, OpCode: BinaryFrame}
+	for _, size := range []int{0, 125, 126, 1<<16 - 1, 1 << 16} {
+		for _, mask := range []bool{false, true} {
+			data := bytes.Repeat([]byte{'x'}, size)
+			// 同一个 Frame 重复 Encode，每次使用新的 Payload
+			frame.Mask = mask
+			frame.Payload = &io.LimitedReader{R: bytes.NewReader(data), N: int64(size)}
+			encoded, err := io.ReadAll(frame.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := (&frameDecoder{}).decode(context.Background(), bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("size %d mask %v: %v", size, mask, err)
+			}
+			payload, err := io.ReadAll(decoded.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.Mask != mask || !bytes.Equal(payload, data) {
+				t.Fatalf("size %d mask %v: decoded a different frame", size, mask)
+			}
+		}
+	}
+	// Payload 已经读完之后再次 Encode 不能让掩码的 reader 读取它自己
+	if _, err := io.ReadAll(frame.Encode()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameEncodeNilPayloadConcurrently(t *testing.T) {
+	// 没有 Payload 的帧各自使用新的空 Payload，并发 Encode 不能修改共享的对象，需要用 -race 运行
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				frame := &Frame{Fin: true, Mask: true, OpCode: Ping}
+				encoded, err := io.ReadAll(frame.Encode())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// 帧头 2 个字节加上 4 个字节的掩码 key，没有内容
+				if len(encoded) != 6 || encoded[0] != 0x89 || encoded[1] != 0x80 {
+					t.Errorf("encoded % x, want an empty masked ping", encoded)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if emptyReader.R != nil || emptyReader.N != 0 {
+		t.Fatalf("emptyReader was modified: %+v", emptyReader)
+	}
+}
@@ -0,0 +1,113 @@
+package websocket
+
+// messageChannels 是 Incoming、Outgoing 和 Done 使用的 channel，第一次使用的时候创建
+type messageChannels struct {
+	incomingSize int
+	outgoingSize int
+
+	incoming chan *Message
+	outgoing chan *Message
+	done     chan struct{}
+}
+
+// SetChannelBuffers 设置 Incoming 和 Outgoing 返回的 channel 的缓冲长度，默认都是 0。
+// 需要在第一次调用 Incoming、Outgoing 或者 Done 之前调用，之后调用不会有效果。
+func (w *webSocket) SetChannelBuffers(incoming, outgoing int) {
+	if incoming < 0 {
+		incoming = 0
+	}
+	if outgoing < 0 {
+		outgoing = 0
+	}
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+	if w.channels.done != nil {
+		return
+	}
+	w.channels.incomingSize = incoming
+	w.channels.outgoingSize = outgoing
+}
+
+// getChannels 返回 messageChannels，第一次调用的时候创建 Done 使用的 channel
+func (w *webSocket) getChannels() *messageChannels {
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+	if w.channels.done == nil {
+		done := make(chan struct{})
+		w.channels.done = done
+		w.addCloseHook(func() {
+			close(done)
+		})
+	}
+	return &w.channels
+}
+
+// Incoming 返回收到的 Message 的 channel，第一次调用的时候会启动一个读取的 goroutine。
+// Message 的内容已经完整地读入了内存，读取出错之后连接和 channel 都会被关闭，关闭的原因可以通过 CloseReason 获取。
+// 使用 Incoming 之后不能再调用 ReadMessage 这类读取方法。
+func (w *webSocket) Incoming() <-chan *Message {
+	c := w.getChannels()
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+	if c.incoming == nil {
+		c.incoming = make(chan *Message, c.incomingSize)
+		go w.pumpIncoming(c.incoming, c.done)
+	}
+	return c.incoming
+}
+
+// Outgoing 返回发送 Message 的 channel，第一次调用的时候会启动一个发送的 goroutine，Message 会按照放入的顺序发送。
+// 发送出错的时候连接会被关闭，错误可以通过 CloseReason 获取；关闭这个 channel 可以停止发送的 goroutine。
+// 连接关闭之后放入的 Message 不会被取走，放入的时候需要同时等待 Done。
+func (w *webSocket) Outgoing() chan<- *Message {
+	c := w.getChannels()
+	w.channelsLock.Lock()
+	defer w.channelsLock.Unlock()
+	if c.outgoing == nil {
+		c.outgoing = make(chan *Message, c.outgoingSize)
+		go w.pumpOutgoing(c.outgoing, c.done)
+	}
+	return c.outgoing
+}
+
+// Done 返回一个在 WebSocket 关闭之后被关闭的 channel
+func (w *webSocket) Done() <-chan struct{} {
+	return w.getChannels().done
+}
+
+func (w *webSocket) pumpIncoming(incoming chan<- *Message, done <-chan struct{}) {
+	defer close(incoming)
+	for {
+		message, err := w.ReadMessage()
+		if err == nil {
+			message, err = bufferMessage(message)
+		}
+		if err != nil {
+			_ = w.abort(err)
+			return
+		}
+		select {
+		case incoming <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (w *webSocket) pumpOutgoing(outgoing <-chan *Message, done <-chan struct{}) {
+	for {
+		select {
+		case message, ok := <-outgoing:
+			if !ok {
+				return
+			}
+			err := w.SendMessage(message)
+			if err != nil {
+				_ = w.abort(err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// channelPair 返回通过 net.Pipe 连接的客户端和服务端 WebSocket
+func channelPair(t *testing.T) (client WebSocket, server WebSocket) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return NewWebSocket(a, a, true), NewWebSocket(b, b, false)
+}
+
+func TestIncomingOutgoing(t *testing.T) {
+	client, server := channelPair(t)
+	incoming := server.Incoming()
+	outgoing := client.Outgoing()
+	// 放入的 Message 按照顺序发送
+	go func() {
+		for i := 0; i < 3; i++ {
+			outgoing <- &Message{Reader: bytes.NewReader([]byte(strconv.Itoa(i))), OpCode: TextFrame}
+		}
+		outgoing <- &Message{Reader: bytes.NewReader([]byte{0xff}), OpCode: BinaryFrame}
+	}()
+	for i := 0; i < 3; i++ {
+		message := <-incoming
+		data, err := io.ReadAll(message)
+		if err != nil || message.OpCode != TextFrame || string(data) != strconv.Itoa(i) {
+			t.Fatalf("message %d = %d %q, %v", i, message.OpCode, data, err)
+		}
+	}
+	message := <-incoming
+	if data, _ := io.ReadAll(message); message.OpCode != BinaryFrame || !bytes.Equal(data, []byte{0xff}) {
+		t.Fatalf("message = %d % x, want a binary ff", message.OpCode, data)
+	}
+	// 多次调用返回同一个 channel
+	if server.Incoming() != incoming || client.Outgoing() != outgoing {
+		t.Fatal("Incoming() or Outgoing() returned a new channel")
+	}
+}
+
+func TestIncomingClosedWithConnection(t *testing.T) {
+	client, server := channelPair(t)
+	incoming := server.Incoming()
+	done := server.Done()
+	go func() {
+		_ = client.Send("last")
+		_ = client.Close()
+	}()
+	if message := <-incoming; message == nil {
+		t.Fatal("Incoming() closed before the last message")
+	}
+	select {
+	case _, ok := <-incoming:
+		if ok {
+			t.Fatal("Incoming() received a message after close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Incoming() was not closed with the connection")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done() was not closed with the connection")
+	}
+	if info := server.CloseReason(); info == nil || info.Initiator != CloseByPeer {
+		t.Fatalf("CloseReason() = %+v, want a close by the peer", info)
+	}
+}
+
+func TestOutgoingStopsWhenClosed(t *testing.T) {
+	client, server := channelPair(t)
+	go func() {
+		_, _ = io.Copy(io.Discard, server.NetConn())
+	}()
+	outgoing := client.Outgoing()
+	outgoing <- &Message{Reader: bytes.NewReader([]byte("a")), OpCode: TextFrame}
+	// 关闭 channel 之后发送的 goroutine 退出，连接不受影响
+	close(outgoing)
+	if err := client.Send("b"); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done() was not closed")
+	}
+}
+
+func TestSetChannelBuffers(t *testing.T) {
+	client, _ := channelPair(t)
+	client.SetChannelBuffers(4, -1)
+	if size := cap(client.Incoming()); size != 4 {
+		t.Fatalf("cap(Incoming()) = %d, want 4", size)
+	}
+	if size := cap(client.Outgoing()); size != 0 {
+		t.Fatalf("cap(Outgoing()) = %d, want 0", size)
+	}
+	// 使用之后再设置没有效果
+	other, _ := channelPair(t)
+	_ = other.Done()
+	other.SetChannelBuffers(8, 8)
+	if size := cap(other.Incoming()); size != 0 {
+		t.Fatalf("cap(Incoming()) = %d after the channels were created, want 0", size)
+	}
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// ChecksumExtension 是这个库自定义的扩展，开启之后每个数据 Message 的末尾会附加 4 字节大端序的 CRC32（IEEE）校验值，
+// 接收方会校验并去掉这 4 个字节，校验失败时使用 CloseInvalidFramePayloadData 关闭连接。
+// 只有两端都使用这个库的时候才能协商成功，用于 TCP 校验和无法发现数据损坏的长距离链路。
+const ChecksumExtension = "x-rommhui-crc32"
+
+const checksumLength = 4
+
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+// checksumReader 在 reader 的数据之后追加 CRC32 校验值
+type checksumReader struct {
+	reader  io.Reader
+	hash    hash.Hash32
+	trailer []byte
+}
+
+func newChecksumReader(reader io.Reader) io.Reader {
+	return &checksumReader{
+		reader: reader,
+		hash:   crc32.NewIEEE(),
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.trailer == nil {
+		n, err := r.reader.Read(p)
+		r.hash.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		r.trailer = binary.BigEndian.AppendUint32(nil, r.hash.Sum32())
+		if n > 0 {
+			return n, nil
+		}
+	}
+	if len(r.trailer) < 1 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.trailer)
+	r.trailer = r.trailer[n:]
+	return n, nil
+}
+
+// checksumVerifier 读取 reader 的数据时保留最后 4 个字节，在读到 EOF 的时候用它们校验前面的数据
+type checksumVerifier struct {
+	reader   io.Reader
+	hash     hash.Hash32
+	tail     [checksumLength]byte
+	tailLen  int
+	mismatch func() error
+}
+
+func (v *checksumVerifier) Read(p []byte) (int, error) {
+	if len(p) < 1 {
+		return 0, nil
+	}
+	for {
+		n, err := v.reader.Read(p)
+		// 把 tail 和 p[:n] 看作一段连续的数据，最后 4 个字节作为新的 tail，其余的输出到 p
+		total := v.tailLen + n
+		out := total - checksumLength
+		if out < 0 {
+			out = 0
+		}
+		at := func(i int) byte {
+			if i < v.tailLen {
+				return v.tail[i]
+			}
+			return p[i-v.tailLen]
+		}
+		var tail [checksumLength]byte
+		for i := out; i < total; i++ {
+			tail[i-out] = at(i)
+		}
+		if out > v.tailLen {
+			copy(p[v.tailLen:out], p[:out-v.tailLen])
+			copy(p, v.tail[:v.tailLen])
+		} else {
+			copy(p[:out], v.tail[:out])
+		}
+		v.tail = tail
+		v.tailLen = total - out
+		v.hash.Write(p[:out])
+
+		if err == io.EOF {
+			if v.tailLen < checksumLength || binary.BigEndian.Uint32(v.tail[:]) != v.hash.Sum32() {
+				return out, v.mismatch()
+			}
+			return out, io.EOF
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// verifyChecksum 用于在开启 ChecksumExtension 的时候校验收到的数据 Message
+func (w *webSocket) verifyChecksum(reader io.Reader) io.Reader {
+	return &checksumVerifier{
+		reader: reader,
+		hash:   crc32.NewIEEE(),
+		mismatch: func() error {
+			_ = w.fail(CloseInvalidFramePayloadData, ErrChecksumMismatch.Error())
+			return ErrChecksumMismatch
+		},
+	}
+}
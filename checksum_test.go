@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 3, 4, 5, 100, 10000} {
+		data := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+		// 分别按照任意长度和每次一个字节读取，校验值可能被分在多次读取之间
+		for _, oneByte := range []bool{false, true} {
+			var reader io.Reader = newChecksumReader(bytes.NewReader(data))
+			if oneByte {
+				reader = iotest.OneByteReader(reader)
+			}
+			encoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded) != size+checksumLength {
+				t.Fatalf("size %d: encoded %d bytes, want %d", size, len(encoded), size+checksumLength)
+			}
+			var source io.Reader = bytes.NewReader(encoded)
+			if oneByte {
+				source = iotest.OneByteReader(source)
+			}
+			ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+			decoded, err := io.ReadAll(ws.verifyChecksum(source))
+			if err != nil {
+				t.Fatalf("size %d one byte %v: %v", size, oneByte, err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Fatalf("size %d one byte %v: decoded a different message", size, oneByte)
+			}
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	encoded, err := io.ReadAll(newChecksumReader(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), encoded...)
+	corrupted[1] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "corrupted data", data: corrupted},
+		{name: "corrupted checksum", data: append(append([]byte(nil), encoded[:len(encoded)-1]...), encoded[len(encoded)-1]^1)},
+		{name: "shorter than the checksum", data: encoded[:checksumLength-1]},
+		{name: "empty", data: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+			if _, err := io.ReadAll(ws.verifyChecksum(bytes.NewReader(test.data))); err != ErrChecksumMismatch {
+				t.Fatalf("ReadAll() error = %v, want %v", err, ErrChecksumMismatch)
+			}
+			if info := ws.CloseReason(); info == nil || info.Code != CloseInvalidFramePayloadData {
+				t.Fatalf("CloseReason() = %+v, want code %d", info, CloseInvalidFramePayloadData)
+			}
+		})
+	}
+}
+
+func TestChecksumInterop(t *testing.T) {
+	checksums := make(chan bool, 1)
+	upgrader := &Upgrader{EnableCompression: true}
+	server := httptest.NewServer(upgrader.Handler(func(ws WebSocket) {
+		checksums <- ws.(*webSocket).checksum
+		for {
+			message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = ws.SendMessage(message); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, compression := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ws, err := (&Dialer{Checksum: true, EnableCompression: compression}).Dial(ctx, url)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ws.(*webSocket).checksum || !<-checksums {
+			t.Fatal("checksum extension was not negotiated")
+		}
+		for _, message := range [][]byte{benchmarkText, []byte("hi"), {}} {
+			if err = ws.WriteMessage(BinaryFrame, message); err != nil {
+				t.Fatal(err)
+			}
+			_, data, err := ws.ReadAllMessage()
+			if err != nil {
+				t.Fatalf("compression %v: %v", compression, err)
+			}
+			if !bytes.Equal(data, message) {
+				t.Fatalf("compression %v: echoed %d bytes, want %d", compression, len(data), len(message))
+			}
+		}
+		_ = ws.Close()
+	}
+}
+
+func TestChecksumMismatchOnTheWire(t *testing.T) {
+	receiver, conn := newPipeWebSocket(t)
+	receiver.(*webSocket).checksum = true
+	// 对方没有开启校验，发送的 Message 末尾不是正确的校验值
+	peer := NewWebSocketWithRole(conn, conn, RoleClient)
+	closed := make(chan error, 1)
+	go func() {
+		_ = peer.WriteMessage(BinaryFrame, []byte("hello\x00\x00\x00\x00"))
+		_, _, err := peer.ReadAllMessage()
+		closed <- err
+	}()
+	if _, _, err := receiver.ReadAllMessage(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadAllMessage() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	select {
+	case err := <-closed:
+		if !IsCloseError(err, CloseInvalidFramePayloadData) {
+			t.Fatalf("peer error = %v, want code %d", err, CloseInvalidFramePayloadData)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer did not receive the close frame")
+	}
+}
@@ -0,0 +1,416 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// 关闭状态码，参考 RFC 6455 7.4.1
+const (
+	CloseNormalClosure           uint16 = 1000
+	CloseGoingAway               uint16 = 1001
+	CloseProtocolError           uint16 = 1002
+	CloseUnsupportedData         uint16 = 1003
+	CloseNoStatusReceived        uint16 = 1005
+	CloseAbnormalClosure         uint16 = 1006
+	CloseInvalidFramePayloadData uint16 = 1007
+	ClosePolicyViolation         uint16 = 1008
+	CloseMessageTooBig           uint16 = 1009
+	CloseMandatoryExtension      uint16 = 1010
+	CloseInternalServerErr       uint16 = 1011
+	CloseServiceRestart          uint16 = 1012
+	CloseTryAgainLater           uint16 = 1013
+	CloseBadGateway              uint16 = 1014
+	CloseTLSHandshake            uint16 = 1015
+)
+
+// maxControlPayloadLength 是控制帧内容的最大长度
+const maxControlPayloadLength = 125
+
+// CloseError 表示 WebSocket 连接被关闭时的状态码和原因
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if len(e.Reason) < 1 {
+		return "WebSocket closed with code " + strconv.Itoa(int(e.Code))
+	}
+	return "WebSocket closed with code " + strconv.Itoa(int(e.Code)) + ": " + e.Reason
+}
+
+// Is 让 errors.Is(err, ErrClosedStatus) 对 *CloseError 也成立
+func (e *CloseError) Is(target error) bool {
+	return target == ErrClosedStatus
+}
+
+// IsCloseError 判断 err 是否带有 codes 中任意一个状态码的 *CloseError
+func IsCloseError(err error, codes ...uint16) bool {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return false
+	}
+	for _, code := range codes {
+		if closeErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUnexpectedCloseError 判断 err 是否 *CloseError，并且状态码不在 expectedCodes 中。
+// 例如 IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway) 可以用来判断连接是否异常关闭。
+func IsUnexpectedCloseError(err error, expectedCodes ...uint16) bool {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return false
+	}
+	for _, code := range expectedCodes {
+		if closeErr.Code == code {
+			return false
+		}
+	}
+	return true
+}
+
+// CloseMode 表示关闭 WebSocket 的时候如何处理输出流和输入流。
+// 使用 NewWebSocket 把两条独立的单向流组合成一个 WebSocket 的时候，调用方可能需要自己管理其中一条或者两条流。
+type CloseMode uint32
+
+const (
+	// CloseBothStreams 关闭输出流和输入流，这是默认的行为
+	CloseBothStreams CloseMode = iota
+	// CloseWriterOnly 只关闭输出流，输入流由调用方管理
+	CloseWriterOnly
+	// CloseNoStreams 不关闭任何流，两条流都由调用方管理
+	CloseNoStreams
+)
+
+func (w *webSocket) SetCloseMode(mode CloseMode) {
+	w.closeMode.Store(uint32(mode))
+}
+
+// StreamCloseError 记录关闭输出流和输入流时各自的错误，已经关闭的流不会产生错误
+type StreamCloseError struct {
+	Writer error
+	Reader error
+}
+
+func (e *StreamCloseError) Error() string {
+	switch {
+	case e.Writer != nil && e.Reader != nil:
+		return "close writer: " + e.Writer.Error() + "; close reader: " + e.Reader.Error()
+	case e.Writer != nil:
+		return "close writer: " + e.Writer.Error()
+	default:
+		return "close reader: " + e.Reader.Error()
+	}
+}
+
+// CloseInitiator 表示连接是被谁关闭的
+type CloseInitiator uint8
+
+const (
+	// CloseByLocal 表示连接是由本地关闭的，包括本地发现对方违反协议的情况
+	CloseByLocal CloseInitiator = iota + 1
+	// CloseByPeer 表示连接是由对方发送 ConnectionClose 关闭的
+	CloseByPeer
+	// CloseByTransport 表示连接是因为底层的流出错而关闭的
+	CloseByTransport
+)
+
+func (i CloseInitiator) String() string {
+	switch i {
+	case CloseByLocal:
+		return "local"
+	case CloseByPeer:
+		return "peer"
+	case CloseByTransport:
+		return "transport"
+	default:
+		return "unknown"
+	}
+}
+
+// CloseInfo 记录了连接关闭的原因
+type CloseInfo struct {
+	// Initiator 是关闭连接的一方
+	Initiator CloseInitiator
+	// Code 是关闭状态码，底层的流出错时是 CloseAbnormalClosure
+	Code uint16
+	// Reason 是关闭原因
+	Reason string
+	// Err 是导致连接关闭的错误，正常关闭时为 nil
+	Err error
+}
+
+// closedError 是 WebSocket 关闭之后读取返回的错误。
+// 连接是通过 ConnectionClose 关闭的时候返回对应的 *CloseError，否则返回 ErrClosedStatus。
+func (w *webSocket) closedError() error {
+	w.closeInfoLock.Lock()
+	defer w.closeInfoLock.Unlock()
+	if w.closeInfo == nil || w.closeInfo.Initiator == CloseByTransport {
+		return ErrClosedStatus
+	}
+	return &CloseError{
+		Code:   w.closeInfo.Code,
+		Reason: w.closeInfo.Reason,
+	}
+}
+
+func (w *webSocket) CloseReason() *CloseInfo {
+	if w.state() != CLOSED {
+		return nil
+	}
+	w.closeInfoLock.Lock()
+	defer w.closeInfoLock.Unlock()
+	return w.closeInfo
+}
+
+// setCloseInfo 记录连接关闭的原因，只有第一次记录的原因会被保留
+func (w *webSocket) setCloseInfo(info *CloseInfo) {
+	w.closeInfoLock.Lock()
+	defer w.closeInfoLock.Unlock()
+	if w.closeInfo == nil {
+		w.closeInfo = info
+	}
+}
+
+// abort 在底层的流出错之后关闭连接，返回原来的错误
+func (w *webSocket) abort(err error) error {
+	if w.state() == CLOSED {
+		return err
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByTransport,
+		Code:      CloseAbnormalClosure,
+		Err:       err,
+	})
+	_ = w.closeStreams()
+	return err
+}
+
+var (
+	ErrInvalidClosePayload = errors.New("invalid close frame payload")
+	ErrInvalidCloseCode    = errors.New("close code can not be sent in a close frame")
+	ErrNotControlOpCode    = errors.New("opcode is not a control opcode")
+	// ErrCloseNotAcknowledged 表示连接在收到对方回复的 ConnectionClose 之前就关闭了
+	ErrCloseNotAcknowledged = errors.New("connection closed before the peer acknowledged the close frame")
+)
+
+// CloseWithCode 发送带有状态码和原因的 ConnectionClose 帧，然后关闭 WebSocket。
+// code 为 CloseNoStatusReceived 时和 Close 一样发送不带内容的 ConnectionClose 帧，
+// 其他只能在本地使用的状态码（1006、1015）和协议保留的状态码会返回 ErrInvalidCloseCode。
+// reason 超过 123 字节的部分会被截断。
+func (w *webSocket) CloseWithCode(code uint16, reason string) error {
+	if code != CloseNoStatusReceived && !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+	if code == CloseNoStatusReceived {
+		reason = ""
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByLocal,
+		Code:      code,
+		Reason:    reason,
+	})
+	return w.closeWithCode(code, reason)
+}
+
+// CloseContext 发送带有状态码和原因的 ConnectionClose 帧，等待对方回复 ConnectionClose 之后再关闭流，
+// 完成 RFC 6455 7.1.2 的关闭握手。对方在 ctx 结束之前回复了返回 nil，
+// ctx 结束的时候会直接关闭流并返回 ctx.Err()，连接在收到回复之前因为其他原因关闭的时候返回 ErrCloseNotAcknowledged。
+// 发送 ConnectionClose 之后就不能再发送任何帧了，等待期间收到的数据 Message 会被丢弃。
+//
+// 没有开启 BackgroundRead 的时候，CloseContext 会启动一个 goroutine 读取连接，
+// 如果有其他 goroutine 正在 ReadMessage，回复也可能被它读到，这时 ReadMessage 会返回对方的 *CloseError。
+func (w *webSocket) CloseContext(ctx context.Context, code uint16, reason string) error {
+	if code != CloseNoStatusReceived && !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+	if code == CloseNoStatusReceived {
+		reason = ""
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByLocal,
+		Code:      code,
+		Reason:    reason,
+	})
+	w.interruptWrite()
+	deadline, _ := ctx.Deadline()
+	err := w.sendControlDeadline(ConnectionClose, closePayload(code, reason), deadline)
+	if err != nil {
+		return err
+	}
+	if w.background == nil {
+		go w.drainUntilClose()
+	}
+	select {
+	case <-w.Done():
+	case <-ctx.Done():
+		_ = w.closeStreams()
+		return ctx.Err()
+	}
+	if !w.closeReceived.Load() {
+		return ErrCloseNotAcknowledged
+	}
+	return nil
+}
+
+// drainUntilClose 丢弃收到的数据 Message，直到收到对方的 ConnectionClose 或者读取出错
+func (w *webSocket) drainUntilClose() {
+	for {
+		message, err := w.readMessage()
+		if err != nil {
+			return
+		}
+		if w.handled(message) {
+			err = w.handleControl(message)
+		} else {
+			_, err = io.Copy(blackHole, message)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WriteControl 发送一个控制帧，deadline 是写入的截止时间，为零值时使用 Timeouts 中的 Write。
+// 控制帧只需要等待正在写入的帧，不需要等待正在发送的 Message 结束。
+func (w *webSocket) WriteControl(opCode OpCode, payload []byte, deadline time.Time) error {
+	if _, ok := w.reservedAllowed(opCode); !opCode.IsControl() || opCode.IsReserved() && !ok {
+		return ErrNotControlOpCode
+	}
+	if opCode != ConnectionClose {
+		return w.sendControlDeadline(opCode, payload, deadline)
+	}
+	closeErr, err := parseClosePayload(payload)
+	if err != nil {
+		return err
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByLocal,
+		Code:      closeErr.Code,
+		Reason:    closeErr.Reason,
+	})
+	err = w.sendControlDeadline(ConnectionClose, payload, deadline)
+	if err != nil {
+		return err
+	}
+	return w.closeStreams()
+}
+
+// validCloseCode 用于判断状态码能否出现在 ConnectionClose 帧中。
+// 1005、1006、1015 只能在本地使用，1004 和其他未分配的 1000-2999 是协议保留的，
+// 3000-4999 是给库、框架和应用使用的。
+func validCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// closePayload 把状态码和原因编码成 ConnectionClose 帧的内容
+func closePayload(code uint16, reason string) []byte {
+	if code == CloseNoStatusReceived {
+		return nil
+	}
+	if len(reason) > maxControlPayloadLength-2 {
+		reason = reason[:maxControlPayloadLength-2]
+		for len(reason) > 0 && !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	payload := make([]byte, 2+len(reason))
+	bigEndianUint64Pack(payload[:2], uint64(code))
+	copy(payload[2:], reason)
+	return payload
+}
+
+// parseClosePayload 解析并校验 ConnectionClose 帧的内容。
+// 没有内容的时候，状态码是 CloseNoStatusReceived。
+func parseClosePayload(payload []byte) (*CloseError, error) {
+	if len(payload) < 1 {
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	}
+	if len(payload) < 2 {
+		return nil, ErrInvalidClosePayload
+	}
+	code := uint16(bigEndianUint64Unpack(payload[:2]))
+	if !validCloseCode(code) {
+		return nil, ErrInvalidClosePayload
+	}
+	if !utf8.Valid(payload[2:]) {
+		return nil, ErrInvalidClosePayload
+	}
+	return &CloseError{
+		Code:   code,
+		Reason: string(payload[2:]),
+	}, nil
+}
+
+// responseClose 在收到对方的 ConnectionClose 之后，校验它的内容，回复 ConnectionClose 然后关闭 WebSocket。
+// 返回的错误是对方关闭连接的 *CloseError，如果对方的 ConnectionClose 不合法，
+// 会使用 CloseProtocolError 关闭连接，并返回对应的 *CloseError。
+func (w *webSocket) responseClose(message *Message) error {
+	payload, err := io.ReadAll(io.LimitReader(message, maxControlPayloadLength+1))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(blackHole, message)
+	if err != nil {
+		return err
+	}
+	closeErr, err := parseClosePayload(payload)
+	if err != nil || len(payload) > maxControlPayloadLength {
+		return w.fail(CloseProtocolError, ErrInvalidClosePayload.Error())
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByPeer,
+		Code:      closeErr.Code,
+		Reason:    closeErr.Reason,
+	})
+	w.closeReceived.Store(true)
+	var handlerErr error
+	if handler := w.getHandlers().close; handler != nil {
+		handlerErr = handler(closeErr.Code, closeErr.Reason)
+	}
+	// 对方可能在发送 ConnectionClose 之后就关闭了流，这时回复失败不影响结果
+	if w.closeWithCode(closeErr.Code, "") != nil {
+		_ = w.closeStreams()
+	}
+	if handlerErr != nil {
+		return handlerErr
+	}
+	return closeErr
+}
+
+// fail 用于在发现对方违反协议的时候，使用 code 关闭连接
+func (w *webSocket) fail(code uint16, reason string) error {
+	closeErr := &CloseError{
+		Code:   code,
+		Reason: reason,
+	}
+	w.setCloseInfo(&CloseInfo{
+		Initiator: CloseByLocal,
+		Code:      code,
+		Reason:    reason,
+		Err:       closeErr,
+	})
+	err := w.closeWithCode(code, reason)
+	if err != nil {
+		_ = w.closeStreams()
+	}
+	return closeErr
+}
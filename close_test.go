@@ -0,0 +1,381 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseInterruptsBlockedWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		// streams 返回 WebSocket 使用的流，对方不会读取任何数据
+		streams func() (io.WriteCloser, io.ReadCloser, func())
+	}{
+		{
+			name: "deadline",
+			streams: func() (io.WriteCloser, io.ReadCloser, func()) {
+				a, b := net.Pipe()
+				return a, a, func() { _ = b.Close() }
+			},
+		},
+		{
+			name: "no deadline",
+			streams: func() (io.WriteCloser, io.ReadCloser, func()) {
+				_, writer := io.Pipe()
+				reader, peer := io.Pipe()
+				return writer, reader, func() { _ = peer.Close() }
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer, reader, cleanup := test.streams()
+			defer cleanup()
+			ws := NewWebSocket(writer, reader, false)
+			written := make(chan error, 1)
+			go func() {
+				written <- ws.WriteMessage(BinaryFrame, bytes.Repeat([]byte{'a'}, 1<<20))
+			}()
+			// 等待写入阻塞在 frameLock 中
+			time.Sleep(50 * time.Millisecond)
+
+			closed := make(chan error, 1)
+			go func() {
+				closed <- ws.Close()
+			}()
+			select {
+			case <-closed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Close is blocked by the pending write")
+			}
+			select {
+			case err := <-written:
+				if err != ErrClosedStatus {
+					t.Fatalf("WriteMessage() error = %v, want %v", err, ErrClosedStatus)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("WriteMessage is still blocked after Close")
+			}
+			if ws.Status() != CLOSED {
+				t.Fatalf("Status() = %d, want CLOSED", ws.Status())
+			}
+		})
+	}
+}
+
+func TestCloseAfterCompletedWriteSendsCloseFrame(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.WriteMessage(TextFrame, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 文本帧 81 02 "hi"，之后是不带内容的 ConnectionClose 88 00
+	if want := []byte{0x81, 0x02, 'h', 'i', 0x88, 0x00}; !bytes.Equal(output.Bytes(), want) {
+		t.Fatalf("sent % x, want % x", output.Bytes(), want)
+	}
+}
+
+func TestReceivedCloseCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		// code 是收到的 ConnectionClose 合法时对方的状态码，为 0 时 ConnectionClose 不合法，需要使用 1002 关闭
+		code   uint16
+		reason string
+	}{
+		{name: "normal with reason", payload: append([]byte{0x03, 0xe8}, "bye"...), code: CloseNormalClosure, reason: "bye"},
+		{name: "empty", payload: nil, code: CloseNoStatusReceived},
+		{name: "application code", payload: []byte{0x0f, 0xa0}, code: 4000},
+		{name: "one byte", payload: []byte{0x03}},
+		{name: "no status on the wire", payload: []byte{0x03, 0xed}},
+		{name: "abnormal on the wire", payload: []byte{0x03, 0xee}},
+		{name: "tls on the wire", payload: []byte{0x03, 0xf7}},
+		{name: "reserved 1004", payload: []byte{0x03, 0xec}},
+		{name: "below 1000", payload: []byte{0x03, 0xe7}},
+		{name: "above 4999", payload: []byte{0x13, 0x88}},
+		{name: "invalid utf-8 reason", payload: []byte{0x03, 0xe8, 0xff, 0xfe}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			input := rawFrame(true, ConnectionClose, byte(len(test.payload)), test.payload)
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+			_, _, err := ws.ReadAllMessage()
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("ReadAllMessage() error = %v, want a *CloseError", err)
+			}
+			info := ws.CloseReason()
+			if test.code == 0 {
+				if closeErr.Code != CloseProtocolError || info.Initiator != CloseByLocal {
+					t.Fatalf("ReadAllMessage() error = %v, CloseReason() = %+v, want a local protocol error", err, info)
+				}
+				if code := sentCloseCode(t, output.Bytes()); code != CloseProtocolError {
+					t.Fatalf("sent close code %d, want %d", code, CloseProtocolError)
+				}
+				return
+			}
+			if closeErr.Code != test.code || closeErr.Reason != test.reason {
+				t.Fatalf("ReadAllMessage() error = %+v, want code %d reason %q", closeErr, test.code, test.reason)
+			}
+			if info.Initiator != CloseByPeer || info.Code != test.code {
+				t.Fatalf("CloseReason() = %+v, want the peer's code %d", info, test.code)
+			}
+			// 回复的 ConnectionClose 使用对方的状态码
+			if code := sentCloseCode(t, output.Bytes()); code != test.code {
+				t.Fatalf("sent close code %d, want %d", code, test.code)
+			}
+		})
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+		if info := ws.CloseReason(); info != nil {
+			t.Fatalf("CloseReason() = %+v before closing, want nil", info)
+		}
+		if err := ws.CloseWithCode(CloseGoingAway, "restart"); err != nil {
+			t.Fatal(err)
+		}
+		info := ws.CloseReason()
+		if info == nil || info.Initiator != CloseByLocal || info.Code != CloseGoingAway || info.Reason != "restart" || info.Err != nil {
+			t.Fatalf("CloseReason() = %+v, want a local going away", info)
+		}
+	})
+	t.Run("peer", func(t *testing.T) {
+		input := rawFrame(true, ConnectionClose, 5, append([]byte{0x03, 0xf3}, "bye"...))
+		ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+		_, _, _ = ws.ReadAllMessage()
+		info := ws.CloseReason()
+		if info == nil || info.Initiator != CloseByPeer || info.Code != CloseInternalServerErr || info.Reason != "bye" {
+			t.Fatalf("CloseReason() = %+v, want the peer's internal error", info)
+		}
+	})
+	t.Run("transport", func(t *testing.T) {
+		// 帧头声明了 5 个字节，但是流只剩 2 个字节
+		input := rawFrame(true, TextFrame, 5, []byte("he"))
+		ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+		_, _, err := ws.ReadAllMessage()
+		if err == nil {
+			t.Fatal("ReadAllMessage() succeeded with a truncated frame")
+		}
+		info := ws.CloseReason()
+		if info == nil || info.Initiator != CloseByTransport || info.Code != CloseAbnormalClosure || info.Err == nil {
+			t.Fatalf("CloseReason() = %+v, want an abnormal transport closure with its error", info)
+		}
+		// 流出错之后读取返回 ErrClosedStatus，而不是 *CloseError
+		if _, err = ws.ReadMessage(); err != ErrClosedStatus {
+			t.Fatalf("ReadMessage() after the transport error = %v, want %v", err, ErrClosedStatus)
+		}
+	})
+	t.Run("protocol error", func(t *testing.T) {
+		ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(rawFrame(true, ContinuationFrame, 0, nil))), false)
+		_, _, err := ws.ReadAllMessage()
+		info := ws.CloseReason()
+		if err != ErrUnexpectedContinuation || info == nil || info.Initiator != CloseByLocal || info.Code != CloseProtocolError || info.Err == nil {
+			t.Fatalf("ReadAllMessage() error = %v, CloseReason() = %+v, want a local protocol error", err, info)
+		}
+	})
+}
+
+// recordCloser 记录 Close 是否被调用，Close 返回 err
+type recordCloser struct {
+	io.Writer
+	io.Reader
+	closed bool
+	err    error
+}
+
+func (c *recordCloser) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestCloseMode(t *testing.T) {
+	tests := []struct {
+		mode           CloseMode
+		writer, reader bool
+	}{
+		{mode: CloseBothStreams, writer: true, reader: true},
+		{mode: CloseWriterOnly, writer: true},
+		{mode: CloseNoStreams},
+	}
+	for _, test := range tests {
+		writer := &recordCloser{Writer: io.Discard}
+		reader := &recordCloser{Reader: bytes.NewReader(nil)}
+		ws := NewWebSocket(writer, reader, false)
+		ws.SetCloseMode(test.mode)
+		if err := ws.Close(); err != nil {
+			t.Fatalf("mode %d: Close() error = %v", test.mode, err)
+		}
+		if writer.closed != test.writer || reader.closed != test.reader {
+			t.Fatalf("mode %d: closed writer %v reader %v, want %v %v", test.mode, writer.closed, reader.closed, test.writer, test.reader)
+		}
+		if ws.Status() != CLOSED {
+			t.Fatalf("mode %d: Status() = %d, want CLOSED", test.mode, ws.Status())
+		}
+	}
+}
+
+func TestCloseReportsStreamErrors(t *testing.T) {
+	writerErr, readerErr := errors.New("writer failed"), errors.New("reader failed")
+	writer := &recordCloser{Writer: io.Discard, err: writerErr}
+	reader := &recordCloser{Reader: bytes.NewReader(nil), err: readerErr}
+	ws := NewWebSocket(writer, reader, false)
+	err := ws.Close()
+	var streamErr *StreamCloseError
+	if !errors.As(err, &streamErr) || streamErr.Writer != writerErr || streamErr.Reader != readerErr {
+		t.Fatalf("Close() error = %v, want both stream errors", err)
+	}
+	// 已经关闭的流产生的错误会被忽略
+	writer = &recordCloser{Writer: io.Discard, err: io.ErrClosedPipe}
+	reader = &recordCloser{Reader: bytes.NewReader(nil), err: readerErr}
+	ws = NewWebSocket(writer, reader, false)
+	err = ws.Close()
+	if !errors.As(err, &streamErr) || streamErr.Writer != nil || streamErr.Reader != readerErr {
+		t.Fatalf("Close() error = %v, want only the reader error", err)
+	}
+	// 重复关闭不会再次关闭流
+	if err = ws.Close(); err != nil {
+		t.Fatalf("second Close() error = %v, want nil", err)
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	for _, code := range []uint16{0, 999, 1004, CloseAbnormalClosure, CloseTLSHandshake, 2000, 5000} {
+		if err := ws.CloseWithCode(code, ""); err != ErrInvalidCloseCode {
+			t.Fatalf("CloseWithCode(%d) error = %v, want %v", code, err, ErrInvalidCloseCode)
+		}
+	}
+	if ws.Status() != OPEN || output.Len() != 0 {
+		t.Fatalf("invalid codes changed the connection: status %d, sent % x", ws.Status(), output.Bytes())
+	}
+	// 原因超过 123 字节的部分被截断，不会截断在一个 UTF-8 字符的中间
+	reason := strings.Repeat("a", 122) + "é"
+	if err := ws.CloseWithCode(CloseGoingAway, reason); err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 1 || frames[0].OpCode != ConnectionClose {
+		t.Fatalf("sent frames %+v, want one close frame", frames)
+	}
+	payload := frames[0].Payload
+	if binary.BigEndian.Uint16(payload) != CloseGoingAway || string(payload[2:]) != strings.Repeat("a", 122) {
+		t.Fatalf("close payload % x, want code %d and the truncated reason", payload, CloseGoingAway)
+	}
+}
+
+func TestCloseErrorHelpers(t *testing.T) {
+	input := rawFrame(true, ConnectionClose, 6, append([]byte{0x03, 0xe9}, "away"...))
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	_, err := ws.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway || closeErr.Reason != "away" {
+		t.Fatalf("ReadMessage() error = %v, want the peer's going away", err)
+	}
+	if !errors.Is(err, ErrClosedStatus) {
+		t.Fatal("errors.Is(err, ErrClosedStatus) = false for a *CloseError")
+	}
+	if err.Error() != "WebSocket closed with code 1001: away" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+	// 关闭之后的读取仍然返回同样的 *CloseError
+	if _, again := ws.ReadMessage(); !IsCloseError(again, CloseGoingAway) {
+		t.Fatalf("ReadMessage() after closing error = %v, want the same close error", again)
+	}
+
+	wrapped := fmt.Errorf("read: %w", err)
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{name: "IsCloseError matching", got: IsCloseError(wrapped, CloseNormalClosure, CloseGoingAway), want: true},
+		{name: "IsCloseError other code", got: IsCloseError(wrapped, CloseNormalClosure), want: false},
+		{name: "IsCloseError plain error", got: IsCloseError(io.EOF, CloseGoingAway), want: false},
+		{name: "IsUnexpectedCloseError expected", got: IsUnexpectedCloseError(wrapped, CloseNormalClosure, CloseGoingAway), want: false},
+		{name: "IsUnexpectedCloseError unexpected", got: IsUnexpectedCloseError(wrapped, CloseNormalClosure), want: true},
+		{name: "IsUnexpectedCloseError plain error", got: IsUnexpectedCloseError(io.EOF), want: false},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	tests := []struct {
+		name string
+		// peer 读取到 ConnectionClose 之后的处理
+		peer func(conn net.Conn)
+		err  error
+	}{
+		{
+			name: "acknowledged",
+			peer: func(conn net.Conn) {
+				// 回复之前先发送一个数据 Message，它会被丢弃
+				_, _ = conn.Write(maskedFrame(TextFrame, []byte("late")))
+				_, _ = conn.Write(maskedFrame(ConnectionClose, []byte{0x03, 0xe8}))
+			},
+		},
+		{
+			name: "no reply",
+			peer: func(conn net.Conn) {
+				_, _ = io.Copy(io.Discard, conn)
+			},
+			err: context.DeadlineExceeded,
+		},
+		{
+			name: "transport closed",
+			peer: func(conn net.Conn) {
+				_ = conn.Close()
+			},
+			err: ErrCloseNotAcknowledged,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, peer := newPipeWebSocket(t)
+			reply := test.peer
+			go func() {
+				frame, err := (&frameDecoder{}).decode(context.Background(), peer)
+				if err != nil || frame.OpCode != ConnectionClose {
+					return
+				}
+				_, _ = io.Copy(io.Discard, frame.Payload)
+				reply(peer)
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := ws.CloseContext(ctx, CloseNormalClosure, "bye"); err != test.err {
+				t.Fatalf("CloseContext() error = %v, want %v", err, test.err)
+			}
+			if ws.Status() != CLOSED {
+				t.Fatalf("Status() = %d, want CLOSED", ws.Status())
+			}
+			if info := ws.CloseReason(); info.Initiator != CloseByLocal || info.Code != CloseNormalClosure {
+				t.Fatalf("CloseReason() = %+v, want a local normal closure", info)
+			}
+		})
+	}
+
+	ws, _ := newPipeWebSocket(t)
+	if err := ws.CloseContext(context.Background(), CloseAbnormalClosure, ""); err != ErrInvalidCloseCode {
+		t.Fatalf("CloseContext(%d) error = %v, want %v", CloseAbnormalClosure, err, ErrInvalidCloseCode)
+	}
+}
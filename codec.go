@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// Codec 用于把 T 类型的值编码成 Message 的内容，以及把收到的 Message 解码成 T 类型的值
+type Codec[T any] interface {
+	// OpCode 返回发送的 Message 使用的 OpCode
+	OpCode() OpCode
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte, v *T) error
+}
+
+var (
+	ErrUnexpectedOpCode     = errors.New("received message has an unexpected opcode")
+	ErrNotBinaryUnmarshaler = errors.New("value does not implement encoding.BinaryUnmarshaler")
+)
+
+// Send 把 v 编码成 JSON，使用 TextFrame 发送
+func Send[T any](ws WebSocket, v T) error {
+	return SendWith[T](ws, JSONCodec[T]{}, v)
+}
+
+// Receive 读取下一个 Message，把内容当作 JSON 解码成 T 类型的值
+func Receive[T any](ws WebSocket) (T, error) {
+	return ReceiveWith[T](ws, JSONCodec[T]{})
+}
+
+// SendWith 使用 codec 编码 v，然后发送
+func SendWith[T any](ws WebSocket, codec Codec[T], v T) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(codec.OpCode(), data)
+}
+
+// ReceiveWith 读取下一个 Message，使用 codec 解码。
+// 收到的 Message 的 OpCode 和 codec 的不一样时返回 ErrUnexpectedOpCode，例如用 JSONCodec 读取到了 BinaryFrame。
+func ReceiveWith[T any](ws WebSocket, codec Codec[T]) (T, error) {
+	var v T
+	opCode, data, err := ws.ReadAllMessage()
+	if err != nil {
+		return v, err
+	}
+	if opCode != codec.OpCode() {
+		return v, ErrUnexpectedOpCode
+	}
+	err = codec.Unmarshal(data, &v)
+	return v, err
+}
+
+// JSONCodec 使用 encoding/json 编码，发送 TextFrame
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) OpCode() OpCode {
+	return TextFrame
+}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+// BinaryCodec 使用 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler 编码，发送 BinaryFrame。
+// T 是指针类型的时候，解码之前会先创建一个新的值。
+type BinaryCodec[T encoding.BinaryMarshaler] struct{}
+
+func (BinaryCodec[T]) OpCode() OpCode {
+	return BinaryFrame
+}
+
+func (BinaryCodec[T]) Marshal(v T) ([]byte, error) {
+	return v.MarshalBinary()
+}
+
+func (BinaryCodec[T]) Unmarshal(data []byte, v *T) error {
+	if u, ok := any(v).(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	t := reflect.TypeOf(v).Elem()
+	if t.Kind() == reflect.Pointer && reflect.ValueOf(v).Elem().IsNil() {
+		reflect.ValueOf(v).Elem().Set(reflect.New(t.Elem()))
+	}
+	if u, ok := any(*v).(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	return ErrNotBinaryUnmarshaler
+}
+
+// FuncCodec 使用函数实现 Codec，用于接入其他的编码。
+// protobuf 和 msgpack 的 Codec 在 codec/protobuf 和 codec/msgpack 子包中，这样只有使用它们的程序才会依赖对应的第三方库。
+//
+// 使用 CBOR 的例子：
+//
+//	codec := websocket.FuncCodec[Event]{
+//		Op:            websocket.BinaryFrame,
+//		MarshalFunc:   func(v Event) ([]byte, error) { return cbor.Marshal(v) },
+//		UnmarshalFunc: func(data []byte, v *Event) error { return cbor.Unmarshal(data, v) },
+//	}
+//	err := websocket.SendWith[Event](ws, codec, event)
+type FuncCodec[T any] struct {
+	Op            OpCode
+	MarshalFunc   func(v T) ([]byte, error)
+	UnmarshalFunc func(data []byte, v *T) error
+}
+
+func (c FuncCodec[T]) OpCode() OpCode {
+	return c.Op
+}
+
+func (c FuncCodec[T]) Marshal(v T) ([]byte, error) {
+	return c.MarshalFunc(v)
+}
+
+func (c FuncCodec[T]) Unmarshal(data []byte, v *T) error {
+	return c.UnmarshalFunc(data, v)
+}
@@ -0,0 +1,37 @@
+// Package msgpack 提供使用 github.com/vmihailenco/msgpack/v5 编码的 websocket.Codec。
+//
+// 使用例子：
+//
+//	err := msgpack.Send(ws, Event{Name: "join"})
+//	event, err := msgpack.Receive[Event](ws)
+package msgpack
+
+import (
+	"github.com/RommHui/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec 使用 MessagePack 编码，发送 BinaryFrame，结构体字段可以用 msgpack 标签改名
+type Codec[T any] struct{}
+
+func (Codec[T]) OpCode() websocket.OpCode {
+	return websocket.BinaryFrame
+}
+
+func (Codec[T]) Marshal(v T) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (Codec[T]) Unmarshal(data []byte, v *T) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// Send 把 v 编码成 MessagePack，使用 BinaryFrame 发送
+func Send[T any](ws websocket.WebSocket, v T) error {
+	return websocket.SendWith[T](ws, Codec[T]{}, v)
+}
+
+// Receive 读取下一个 Message，把内容当作 MessagePack 解码成 T 类型的值
+func Receive[T any](ws websocket.WebSocket) (T, error) {
+	return websocket.ReceiveWith[T](ws, Codec[T]{})
+}
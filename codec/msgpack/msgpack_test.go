@@ -0,0 +1,39 @@
+package msgpack
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/RommHui/websocket"
+)
+
+type event struct {
+	Name  string   `msgpack:"name"`
+	Count int      `msgpack:"count"`
+	Tags  []string `msgpack:"tags"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	sender := websocket.NewWebSocket(a, a, false)
+	receiver := websocket.NewWebSocket(b, b, false)
+	defer a.Close()
+	defer b.Close()
+
+	want := event{Name: "join", Count: 3, Tags: []string{"a", "b"}}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Send(sender, want)
+	}()
+	got, err := Receive[event](receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Receive() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+// Package protobuf 提供使用 google.golang.org/protobuf 编码的 websocket.Codec。
+//
+// 使用例子：
+//
+//	err := protobuf.Send(ws, &pb.Event{Name: "join"})
+//	event, err := protobuf.Receive[*pb.Event](ws)
+package protobuf
+
+import (
+	"github.com/RommHui/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec 使用 protobuf 的二进制格式编码，发送 BinaryFrame。
+// T 是生成的消息类型的指针，例如 *pb.Event，解码到空指针的时候会先创建一个新的消息。
+type Codec[T proto.Message] struct{}
+
+func (Codec[T]) OpCode() websocket.OpCode {
+	return websocket.BinaryFrame
+}
+
+func (Codec[T]) Marshal(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (Codec[T]) Unmarshal(data []byte, v *T) error {
+	// 生成的消息类型在空指针上也可以调用 ProtoReflect，用它拿到消息的类型
+	if m := (*v).ProtoReflect(); !m.IsValid() {
+		*v = m.Type().New().Interface().(T)
+	}
+	return proto.Unmarshal(data, *v)
+}
+
+// Send 把 v 编码成 protobuf，使用 BinaryFrame 发送
+func Send[T proto.Message](ws websocket.WebSocket, v T) error {
+	return websocket.SendWith[T](ws, Codec[T]{}, v)
+}
+
+// Receive 读取下一个 Message，把内容当作 protobuf 解码成 T 类型的消息
+func Receive[T proto.Message](ws websocket.WebSocket) (T, error) {
+	return websocket.ReceiveWith[T](ws, Codec[T]{})
+}
@@ -0,0 +1,37 @@
+package protobuf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/RommHui/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+	sender := websocket.NewWebSocket(a, a, false)
+	receiver := websocket.NewWebSocket(b, b, false)
+	defer a.Close()
+	defer b.Close()
+
+	want, err := structpb.NewStruct(map[string]any{"name": "join", "count": 3.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- Send(sender, want)
+	}()
+	got, err := Receive[*structpb.Struct](receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Fatalf("Receive() = %v, want %v", got, want)
+	}
+}
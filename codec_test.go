@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codecPair 返回一个发送端和一个读取发送端已经写出的内容的接收端
+func codecPair() (WebSocket, func() WebSocket) {
+	output := &bytes.Buffer{}
+	sender := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	return sender, func() WebSocket {
+		return NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(output.Bytes())), false)
+	}
+}
+
+type codecEvent struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+}
+
+// codecPoint 只有指针类型实现了 encoding.BinaryMarshaler 和 encoding.BinaryUnmarshaler
+type codecPoint struct {
+	X, Y int32
+}
+
+func (p *codecPoint) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(p.X))
+	binary.BigEndian.PutUint32(data[4:], uint32(p.Y))
+	return data, nil
+}
+
+func (p *codecPoint) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("point must be 8 bytes")
+	}
+	p.X = int32(binary.BigEndian.Uint32(data))
+	p.Y = int32(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+// marshalOnly 只实现了 encoding.BinaryMarshaler
+type marshalOnly struct{}
+
+func (marshalOnly) MarshalBinary() ([]byte, error) {
+	return []byte{1}, nil
+}
+
+func TestJSONCodec(t *testing.T) {
+	sender, receiver := codecPair()
+	event := codecEvent{Name: "join", Count: 2, Tags: []string{"a", "b"}}
+	if err := Send(sender, event); err != nil {
+		t.Fatal(err)
+	}
+	if err := Send(sender, "text"); err != nil {
+		t.Fatal(err)
+	}
+	ws := receiver()
+	received, err := Receive[codecEvent](ws)
+	if err != nil || !reflect.DeepEqual(received, event) {
+		t.Fatalf("Receive() = %+v, %v, want %+v", received, err, event)
+	}
+	if text, err := Receive[string](ws); err != nil || text != "text" {
+		t.Fatalf("Receive() = %q, %v, want text", text, err)
+	}
+}
+
+func TestJSONCodecErrors(t *testing.T) {
+	sender, receiver := codecPair()
+	// 编码失败的时候不会发送任何内容
+	if err := Send(sender, func() {}); err == nil {
+		t.Fatal("Send() of a func succeeded")
+	}
+	if err := sender.WriteMessage(BinaryFrame, []byte(`{"name":"binary"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.WriteMessage(TextFrame, []byte(`{"name":`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.WriteMessage(TextFrame, []byte(`{"count":"two"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ws := receiver()
+	if _, err := Receive[codecEvent](ws); err != ErrUnexpectedOpCode {
+		t.Fatalf("Receive() of a binary message error = %v, want %v", err, ErrUnexpectedOpCode)
+	}
+	var syntaxErr *json.SyntaxError
+	if _, err := Receive[codecEvent](ws); !errors.As(err, &syntaxErr) {
+		t.Fatalf("Receive() of truncated JSON error = %v, want a *json.SyntaxError", err)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if _, err := Receive[codecEvent](ws); !errors.As(err, &typeErr) {
+		t.Fatalf("Receive() of a wrong type error = %v, want a *json.UnmarshalTypeError", err)
+	}
+	if _, err := Receive[codecEvent](ws); err == nil {
+		t.Fatal("Receive() at the end of the stream succeeded")
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	sender, receiver := codecPair()
+	point := &codecPoint{X: 1, Y: -2}
+	if err := SendWith[*codecPoint](sender, BinaryCodec[*codecPoint]{}, point); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := SendWith[time.Time](sender, BinaryCodec[time.Time]{}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendWith[marshalOnly](sender, BinaryCodec[marshalOnly]{}, marshalOnly{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.WriteMessage(BinaryFrame, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	ws := receiver()
+	// 指针类型在解码之前会先创建新的值
+	received, err := ReceiveWith[*codecPoint](ws, BinaryCodec[*codecPoint]{})
+	if err != nil || received == nil || *received != *point {
+		t.Fatalf("ReceiveWith() = %v, %v, want %v", received, err, point)
+	}
+	// 值类型使用指针的 UnmarshalBinary
+	if received, err := ReceiveWith[time.Time](ws, BinaryCodec[time.Time]{}); err != nil || !received.Equal(now) {
+		t.Fatalf("ReceiveWith() = %v, %v, want %v", received, err, now)
+	}
+	if _, err = ReceiveWith[marshalOnly](ws, BinaryCodec[marshalOnly]{}); err != ErrNotBinaryUnmarshaler {
+		t.Fatalf("ReceiveWith() error = %v, want %v", err, ErrNotBinaryUnmarshaler)
+	}
+	if _, err = ReceiveWith[*codecPoint](ws, BinaryCodec[*codecPoint]{}); err == nil {
+		t.Fatal("ReceiveWith() of a 3 byte point succeeded")
+	}
+}
+
+func TestFuncCodec(t *testing.T) {
+	codec := FuncCodec[string]{
+		Op: BinaryFrame,
+		MarshalFunc: func(v string) ([]byte, error) {
+			return []byte(strings.ToUpper(v)), nil
+		},
+		UnmarshalFunc: func(data []byte, v *string) error {
+			*v = strings.ToLower(string(data))
+			return nil
+		},
+	}
+	sender, receiver := codecPair()
+	if err := SendWith[string](sender, codec, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	ws := receiver()
+	if text, err := ReceiveWith[string](ws, codec); err != nil || text != "hello" {
+		t.Fatalf("ReceiveWith() = %q, %v, want hello", text, err)
+	}
+
+	// MarshalFunc 的错误会原样返回
+	errMarshal := errors.New("marshal failed")
+	codec.MarshalFunc = func(v string) ([]byte, error) {
+		return nil, errMarshal
+	}
+	if err := SendWith[string](sender, codec, "hello"); err != errMarshal {
+		t.Fatalf("SendWith() error = %v, want %v", err, errMarshal)
+	}
+}
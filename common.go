@@ -1,10 +1,20 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,16 +33,17 @@ func (rw rwFunc) Write(p []byte) (int, error) {
 	return rw(p)
 }
 
-func maskReader(maskKey []byte, reader io.Reader) io.Reader {
-	i := 0
-	return rwFunc(func(p []byte) (int, error) {
-		n, err := reader.Read(p)
-		for k := 0; k < n; k++ {
-			p[k] ^= maskKey[i]
-			i = (i + 1) & 0b11
-		}
-		return n, err
-	})
+// maskingReader 在读取的同时按照 key 去掉或者加上掩码，pos 是下一个字节在帧内容中的位置
+type maskingReader struct {
+	key    [4]byte
+	pos    int
+	reader io.Reader
+}
+
+func (r *maskingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pos = maskBytes(r.key[:], r.pos, p[:n])
+	return n, err
 }
 
 func contextReader(ctx context.Context, reader io.Reader) io.Reader {
@@ -71,8 +82,28 @@ var blackHole = rwFunc(func(b []byte) (int, error) {
 	return len(b), nil
 })
 
-func getSecWebsocketKey() string {
-	return base64.StdEncoding.EncodeToString([]byte(time.Now().Format("20060102_150405")))
+// secWebsocketKeyLength 是 Sec-WebSocket-Key 解码之后的长度，参考 RFC 6455 4.1
+const secWebsocketKeyLength = 16
+
+var ErrInvalidSecWebsocketKey = errors.New("request header `sec-websocket-key` is not a base64-encoded 16-byte value")
+
+// getSecWebsocketKey 从 source 读取 16 个字节的随机数，编码成 Sec-WebSocket-Key，source 为空时使用 crypto/rand
+func getSecWebsocketKey(source io.Reader) (string, error) {
+	if source == nil {
+		source = rand.Reader
+	}
+	nonce := make([]byte, secWebsocketKeyLength)
+	_, err := io.ReadFull(source, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// validSecWebsocketKey 用于判断客户端的 Sec-WebSocket-Key 是否 16 个字节的 base64 编码
+func validSecWebsocketKey(key string) bool {
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(nonce) == secWebsocketKeyLength
 }
 
 func getSecAcceptKey(SecWebsocketKey string) (string, error) {
@@ -90,15 +121,26 @@ func getSecAcceptKey(SecWebsocketKey string) (string, error) {
 }
 
 func newBytesBuffer(b []byte) io.Reader {
-	offset := 0
-	return rwFunc(func(p []byte) (int, error) {
-		if len(b) <= offset {
-			return 0, io.EOF
-		}
-		n := copy(p, b[offset:])
-		offset += n
-		return n, nil
-	})
+	return &bytesBuffer{data: b}
+}
+
+// bytesBuffer 是只读的 []byte，Len 返回还没有读取的长度，sendMessage 会用它决定分片
+type bytesBuffer struct {
+	data   []byte
+	offset int
+}
+
+func (b *bytesBuffer) Read(p []byte) (int, error) {
+	if len(b.data) <= b.offset {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.offset:])
+	b.offset += n
+	return n, nil
+}
+
+func (b *bytesBuffer) Len() int {
+	return len(b.data) - b.offset
 }
 
 func bigEndianUint64Unpack(p []byte) uint64 {
@@ -116,3 +158,206 @@ func bigEndianUint64Pack(p []byte, v uint64) {
 		v >>= 8
 	}
 }
+
+// writeHTTPError 用于在原始的流上直接写一个不带 body 的 HTTP 错误响应
+func writeHTTPError(writer io.Writer, status int, header http.Header) error {
+	response := []string{
+		"HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status),
+	}
+	for key, values := range header {
+		for _, value := range values {
+			response = append(response, key+": "+value)
+		}
+	}
+	response = append(response, "Content-Length: 0", "Connection: close", "\r\n")
+	_, err := writer.Write([]byte(strings.Join(response, "\r\n")))
+	return err
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string {
+	return "stream"
+}
+
+func (a streamAddr) String() string {
+	return string(a)
+}
+
+// streamConn 把 io.WriteCloser 和 io.ReadCloser 组合成一个 net.Conn，
+// 用于需要 net.Conn 但只有两条单向流的场景（例如 tls.Server）。
+// 如果底层的流支持 deadline，就会把 deadline 传递下去，否则忽略。
+type streamConn struct {
+	io.WriteCloser
+	reader io.ReadCloser
+}
+
+func newStreamConn(writer io.WriteCloser, reader io.ReadCloser) net.Conn {
+	if conn, ok := writer.(net.Conn); ok && io.ReadCloser(conn) == reader {
+		return conn
+	}
+	return &streamConn{
+		WriteCloser: writer,
+		reader:      reader,
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *streamConn) Close() error {
+	writeErr := c.WriteCloser.Close()
+	readErr := c.reader.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return readErr
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr("local")
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return streamAddr("remote")
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.reader.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.WriteCloser.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+var (
+	connectionIDPrefix  = newConnectionIDPrefix()
+	connectionIDCounter = &atomic.Uint64{}
+)
+
+func newConnectionIDPrefix() string {
+	prefix := make([]byte, 4)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		bigEndianUint64Pack(prefix, uint64(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(prefix)
+}
+
+// newConnectionID 生成一个在进程内唯一、在不同进程之间大概率不重复的连接 ID
+func newConnectionID() string {
+	return connectionIDPrefix + "-" + strconv.FormatUint(connectionIDCounter.Add(1), 10)
+}
+
+// prefixedReadCloser 先读取已经缓冲的数据，再读取原来的流
+type prefixedReadCloser struct {
+	io.Reader
+	rc io.ReadCloser
+}
+
+func (r *prefixedReadCloser) Close() error {
+	return r.rc.Close()
+}
+
+func (r *prefixedReadCloser) SetReadDeadline(t time.Time) error {
+	return setReadDeadline(r.rc, t)
+}
+
+// inputReadCloser 返回握手之后读取帧使用的流，keepBuffer 为 true 时继续使用 reader 作为读取的缓冲区，
+// 否则只保留 reader 已经缓冲的数据
+func inputReadCloser(reader *bufio.Reader, rc io.ReadCloser, keepBuffer bool) io.ReadCloser {
+	if keepBuffer {
+		return &prefixedReadCloser{Reader: reader, rc: rc}
+	}
+	return bufferedReadCloser(reader, rc)
+}
+
+// withReadBuffer 在 size 大于 0 的时候，使用 size 大小的缓冲区读取 rc
+func withReadBuffer(rc io.ReadCloser, size int) io.ReadCloser {
+	if size < 1 {
+		return rc
+	}
+	return &prefixedReadCloser{Reader: bufio.NewReaderSize(rc, size), rc: rc}
+}
+
+// reuseReadBuffer 使用 buffered 读取 rc，buffered 已经缓冲的数据（例如 Hijack 之前对方紧跟在握手请求之后发送的帧）不会丢失，
+// 也不需要在 buffered 上面再套一层缓冲区。size 大于 buffered 的缓冲区大小时会换成 size 大小的缓冲区。
+// buffered 为空，或者没有缓冲的数据并且不需要缓冲区的时候直接读取 rc。
+func reuseReadBuffer(buffered *bufio.Reader, rc io.ReadCloser, size int) io.ReadCloser {
+	if buffered == nil {
+		return withReadBuffer(rc, size)
+	}
+	if size > buffered.Size() {
+		return withReadBuffer(bufferedReadCloser(buffered, rc), size)
+	}
+	if size < 1 && buffered.Buffered() < 1 {
+		return rc
+	}
+	return &prefixedReadCloser{Reader: buffered, rc: rc}
+}
+
+// bufferedReadCloser 用于在 bufio.Reader 读取完 HTTP 头之后，保留它已经缓冲的数据，
+// 避免对方紧跟在握手之后发送的帧丢失。
+func bufferedReadCloser(reader *bufio.Reader, rc io.ReadCloser) io.ReadCloser {
+	if reader.Buffered() < 1 {
+		return rc
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	return &prefixedReadCloser{
+		Reader: &prefixReader{
+			prefix: bytes.NewReader(append([]byte(nil), buffered...)),
+			reader: rc,
+		},
+		rc: rc,
+	}
+}
+
+// prefixReader 和 io.MultiReader 一样先读取 prefix 再读取 reader，但是可以知道 prefix 还剩多少数据
+type prefixReader struct {
+	prefix *bytes.Reader
+	reader io.Reader
+}
+
+func (r *prefixReader) Read(p []byte) (int, error) {
+	if r.prefix.Len() > 0 {
+		return r.prefix.Read(p)
+	}
+	return r.reader.Read(p)
+}
+
+// bufferedInput 返回 stream 在底层连接之上是否还有已经缓冲、可以不经过连接直接读取的数据
+func bufferedInput(stream any) bool {
+	for {
+		switch s := stream.(type) {
+		case *prefixedReadCloser:
+			switch r := s.Reader.(type) {
+			case *bufio.Reader:
+				if r.Buffered() > 0 {
+					return true
+				}
+			case *prefixReader:
+				if r.prefix.Len() > 0 {
+					return true
+				}
+			}
+			stream = s.rc
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+const (
+	// minWindowBits 和 maxWindowBits 是 permessage-deflate 允许的 LZ77 窗口大小范围
+	minWindowBits = 8
+	maxWindowBits = 15
+)
+
+// flatePool 缓存 flate.Writer、flate.Reader 和滑动窗口的缓冲区。
+// 创建 flate.Writer 需要分配几百 KB 的内存，如果每个 Message 都重新创建，压缩的内存分配会占据主要的开销。
+// flate.Writer 的压缩级别在创建之后不能修改，所以按照压缩级别分开缓存；
+// flate.Reader 和滑动窗口缓冲区按照协商出来的窗口大小分开缓存。
+type flatePool struct {
+	lock    *sync.Mutex
+	writers map[int]*sync.Pool
+	readers map[int]*sync.Pool
+	windows map[int]*sync.Pool
+}
+
+var flatePools = &flatePool{
+	lock:    &sync.Mutex{},
+	writers: map[int]*sync.Pool{},
+	readers: map[int]*sync.Pool{},
+	windows: map[int]*sync.Pool{},
+}
+
+func normalizeWindowBits(windowBits int) int {
+	if windowBits < minWindowBits || windowBits > maxWindowBits {
+		return maxWindowBits
+	}
+	return windowBits
+}
+
+func (p *flatePool) pool(pools map[int]*sync.Pool, windowBits int) *sync.Pool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pool, ok := pools[windowBits]
+	if !ok {
+		pool = &sync.Pool{}
+		pools[windowBits] = pool
+	}
+	return pool
+}
+
+func normalizeLevel(level int) int {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// getWriter 获取一个输出到 w、使用 level 压缩级别的 flate.Writer，使用完之后需要调用 putWriter 放回
+func (p *flatePool) getWriter(w io.Writer, level int) *flate.Writer {
+	level = normalizeLevel(level)
+	if fw, ok := p.pool(p.writers, level).Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+	fw, _ := flate.NewWriter(w, level)
+	return fw
+}
+
+func (p *flatePool) putWriter(fw *flate.Writer, level int) {
+	fw.Reset(nil)
+	p.pool(p.writers, normalizeLevel(level)).Put(fw)
+}
+
+// getReader 获取一个从 r 读取、使用 dict 作为预设字典的 flate.Reader，使用完之后需要调用 putReader 放回
+func (p *flatePool) getReader(r io.Reader, windowBits int, dict []byte) io.ReadCloser {
+	windowBits = normalizeWindowBits(windowBits)
+	if fr, ok := p.pool(p.readers, windowBits).Get().(io.ReadCloser); ok {
+		_ = fr.(flate.Resetter).Reset(r, dict)
+		return fr
+	}
+	return flate.NewReaderDict(r, dict)
+}
+
+func (p *flatePool) putReader(fr io.ReadCloser, windowBits int) {
+	_ = fr.Close()
+	p.pool(p.readers, normalizeWindowBits(windowBits)).Put(fr)
+}
+
+// getWindow 获取一个容量是 1<<windowBits 的滑动窗口缓冲区，用于在开启上下文复用的时候保存最近解压的数据
+func (p *flatePool) getWindow(windowBits int) []byte {
+	windowBits = normalizeWindowBits(windowBits)
+	if window, ok := p.pool(p.windows, windowBits).Get().(*[]byte); ok {
+		return (*window)[:0]
+	}
+	return make([]byte, 0, 1<<windowBits)
+}
+
+func (p *flatePool) putWindow(window []byte, windowBits int) {
+	windowBits = normalizeWindowBits(windowBits)
+	if cap(window) != 1<<windowBits {
+		return
+	}
+	window = window[:0]
+	p.pool(p.windows, windowBits).Put(&window)
+}
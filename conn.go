@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewConn 把 ws 转换成一个字节流的 net.Conn，用于在 WebSocket 上运行基于 TCP 的协议。
+// 每次 Write 发送一个 BinaryFrame Message，Read 按照顺序读取收到的 Message 的内容，Message 的边界不会被保留。
+// 对方使用 CloseNormalClosure、CloseGoingAway 或者不带状态码的 ConnectionClose 关闭连接的时候 Read 返回 io.EOF，
+// Close 会关闭 ws，deadline 会设置到 ws 上。
+//
+// net.Conn 读取的时候会调用 ws.NextReader，所以不能再直接读取 ws，也不能开启 BackgroundRead。
+func NewConn(ws WebSocket) net.Conn {
+	return &wsConn{
+		ws:        ws,
+		readLock:  &sync.Mutex{},
+		writeLock: &sync.Mutex{},
+	}
+}
+
+type wsConn struct {
+	ws WebSocket
+
+	readLock *sync.Mutex
+	// reader 是正在读取的 Message，需要持有 readLock
+	reader io.Reader
+
+	// writeLock 保证同时调用 Write 的时候每次 Write 都发送完整的一个 Message
+	writeLock *sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(p) < 1 {
+		return 0, nil
+	}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	for {
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, connReadError(err)
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err := c.ws.WriteMessage(BinaryFrame, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// connReadError 把正常关闭的 *CloseError 转换成 io.EOF，使用 net.Conn 的代码通常只认识 io.EOF
+func connReadError(err error) error {
+	if IsCloseError(err, CloseNormalClosure, CloseGoingAway, CloseNoStatusReceived) {
+		return io.EOF
+	}
+	return err
+}
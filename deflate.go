@@ -0,0 +1,457 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// DeflateExtension 是 RFC 7692 定义的 permessage-deflate 扩展
+const DeflateExtension = "permessage-deflate"
+
+// deflateTail 是 permessage-deflate 在每个压缩过的 Message 末尾去掉的 4 个字节，参考 RFC 7692 7.2.1
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinalBlock 是一个空的最终块，解压的时候追加在 deflateTail 之后，让 flate.Reader 可以正常地返回 EOF
+var deflateFinalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+var (
+	ErrInvalidDeflateParams    = errors.New("invalid permessage-deflate parameters")
+	ErrInvalidCompressionLevel = errors.New("invalid compression level")
+)
+
+// deflateParams 是从本地的角度看，协商出来的 permessage-deflate 参数
+type deflateParams struct {
+	// writeNoContextTakeover 表示本地每个 Message 都要使用新的压缩上下文
+	writeNoContextTakeover bool
+	// readNoContextTakeover 表示对方每个 Message 都会使用新的压缩上下文
+	readNoContextTakeover bool
+	// writeWindowBits 是本地压缩允许使用的窗口大小
+	writeWindowBits int
+	// readWindowBits 是对方压缩使用的窗口大小
+	readWindowBits int
+}
+
+// deflateState 保存一个连接的压缩和解压上下文，连接关闭之后里面从 flatePools 取出的对象会被放回去
+type deflateState struct {
+	params deflateParams
+
+	// lock 保护压缩使用的字段，readLock 保护解压使用的字段，压缩过程中会读取收到的 Message（例如直接转发），所以两边不能共用一把锁。
+	// closed 表示已经放回了 flatePools，之后不能再使用它们，修改的时候需要同时持有两把锁，读取的时候持有任意一把就可以。
+	lock     *sync.Mutex
+	readLock *sync.Mutex
+	closed   bool
+
+	// writer 和 output 是开启上下文复用的时候，在多个 Message 之间共用的压缩器和它的输出，level 是 writer 的压缩级别
+	writer *flate.Writer
+	output *bytes.Buffer
+	level  int
+
+	// window 是开启上下文复用的时候，最近解压出来的数据，作为下一个 Message 的预设字典
+	window []byte
+	// source 是上一个读完的 Message 留下的 inflateSource，下一个压缩过的 Message 会复用它
+	source *inflateSource
+}
+
+func newDeflateState(params deflateParams) *deflateState {
+	return &deflateState{
+		params:   params,
+		lock:     &sync.Mutex{},
+		readLock: &sync.Mutex{},
+	}
+}
+
+// enableDeflate 在握手协商出 permessage-deflate 之后开启压缩，连接关闭的时候释放压缩上下文
+func (w *webSocket) enableDeflate(params deflateParams) {
+	w.deflate = newDeflateState(params)
+	w.allowedRsv |= 0b100
+	w.addCloseHook(w.deflate.release)
+}
+
+// release 把压缩器和滑动窗口放回 flatePools
+func (d *deflateState) release() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.readLock.Lock()
+	defer d.readLock.Unlock()
+	d.closed = true
+	d.resetWriter()
+	if d.window != nil {
+		flatePools.putWindow(d.window, d.params.readWindowBits)
+		d.window = nil
+	}
+	d.source = nil
+}
+
+// resetWriter 把开启上下文复用时的压缩器放回 flatePools，下一个 Message 会使用新的压缩上下文，调用的时候需要持有 d.lock
+func (d *deflateState) resetWriter() {
+	if d.writer != nil {
+		flatePools.putWriter(d.writer, d.level)
+		d.writer = nil
+	}
+}
+
+// appendWindow 把解压出来的数据追加到滑动窗口中，连接关闭之后不再保存
+func (d *deflateState) appendWindow(p []byte) {
+	d.readLock.Lock()
+	defer d.readLock.Unlock()
+	if !d.closed {
+		d.window = appendWindow(d.window, p)
+	}
+}
+
+// canCompress 判断本地能否发送压缩过的 Message。
+// compress/flate 总是使用 32KB 的窗口，对方要求更小的窗口的时候只能发送不压缩的 Message，这是 RFC 7692 允许的。
+func (d *deflateState) canCompress() bool {
+	return d.params.writeWindowBits == maxWindowBits
+}
+
+// parseWindowBits 解析 max_window_bits 参数，allowEmpty 表示参数可以没有值
+func parseWindowBits(value string, allowEmpty bool) (int, bool) {
+	if len(value) < 1 {
+		return maxWindowBits, allowEmpty
+	}
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits || strconv.Itoa(bits) != value {
+		return 0, false
+	}
+	return bits, true
+}
+
+// deflateOffer 是客户端发送的 permessage-deflate 请求
+func deflateOffer() string {
+	return DeflateExtension + "; client_max_window_bits"
+}
+
+// clientDeflate 解析服务器对 permessage-deflate 的响应，服务器没有同意的时候返回 nil
+func clientDeflate(header http.Header) (*deflateParams, error) {
+	for _, e := range ParseExtensions(header) {
+		if e.Name != DeflateExtension {
+			continue
+		}
+		if e.Duplicate {
+			return nil, ErrInvalidDeflateParams
+		}
+		params := &deflateParams{
+			writeWindowBits: maxWindowBits,
+			readWindowBits:  maxWindowBits,
+		}
+		for key, value := range e.Params {
+			var ok bool
+			switch key {
+			case "server_no_context_takeover":
+				params.readNoContextTakeover, ok = true, len(value) < 1
+			case "client_no_context_takeover":
+				params.writeNoContextTakeover, ok = true, len(value) < 1
+			case "server_max_window_bits":
+				params.readWindowBits, ok = parseWindowBits(value, false)
+			case "client_max_window_bits":
+				params.writeWindowBits, ok = parseWindowBits(value, false)
+			}
+			if !ok {
+				return nil, ErrInvalidDeflateParams
+			}
+		}
+		return params, nil
+	}
+	return nil, nil
+}
+
+// acceptDeflate 从客户端的请求中选择第一个可以接受的 permessage-deflate，返回响应头的值和协商出来的参数
+func acceptDeflate(header http.Header) (string, *deflateParams, bool) {
+offers:
+	for _, e := range ParseExtensions(header) {
+		if e.Name != DeflateExtension || e.Duplicate {
+			continue
+		}
+		params := &deflateParams{
+			writeWindowBits: maxWindowBits,
+			readWindowBits:  maxWindowBits,
+		}
+		response := DeflateExtension
+		for key, value := range e.Params {
+			var ok bool
+			switch key {
+			case "server_no_context_takeover":
+				params.writeNoContextTakeover, ok = true, len(value) < 1
+				response += "; server_no_context_takeover"
+			case "client_no_context_takeover":
+				params.readNoContextTakeover, ok = true, len(value) < 1
+				response += "; client_no_context_takeover"
+			case "server_max_window_bits":
+				params.writeWindowBits, ok = parseWindowBits(value, false)
+				response += "; server_max_window_bits=" + value
+			case "client_max_window_bits":
+				// 客户端支持这个参数，但是服务端不需要限制客户端的窗口
+				_, ok = parseWindowBits(value, true)
+			}
+			if !ok {
+				continue offers
+			}
+		}
+		return response, params, true
+	}
+	return "", nil, false
+}
+
+// SetCompressionLevel 设置压缩数据 Message 使用的 flate 压缩级别，默认是 flate.DefaultCompression
+func (w *webSocket) SetCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return ErrInvalidCompressionLevel
+	}
+	w.compressionLevel.Store(int32(level))
+	return nil
+}
+
+// SetCompressionThreshold 设置压缩的最小长度，小于 size 字节的数据 Message 不会被压缩
+func (w *webSocket) SetCompressionThreshold(size int) {
+	w.compressionThreshold.Store(int64(size))
+}
+
+// EnableWriteCompression 设置是否压缩发送的数据 Message，默认开启。
+// 只有协商了 permessage-deflate 的时候才会生效，Message.Compress 可以覆盖这个设置。
+func (w *webSocket) EnableWriteCompression(enable bool) {
+	w.writeCompressionOff.Store(!enable)
+}
+
+// shouldCompress 判断一个 Message 是否需要压缩，override 是 Message.Compress。
+// 需要判断阈值的时候会先读取最多阈值长度的数据，返回的 io.Reader 会重新包含这些数据。
+func (w *webSocket) shouldCompress(override *bool, reader io.Reader) (io.Reader, bool, error) {
+	if override != nil {
+		return reader, *override, nil
+	}
+	if w.writeCompressionOff.Load() {
+		return reader, false, nil
+	}
+	threshold := w.compressionThreshold.Load()
+	if threshold < 1 {
+		return reader, true, nil
+	}
+	head := make([]byte, threshold)
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return bytes.NewReader(head[:n]), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return io.MultiReader(bytes.NewReader(head), reader), true, nil
+}
+
+// compress 返回一个读取 reader 的数据并使用 level 压缩之后的 io.Reader，输出的末尾已经去掉了 deflateTail
+func (d *deflateState) compress(reader io.Reader, level int) io.Reader {
+	r := &deflateReader{
+		reader: reader,
+		buf:    make([]byte, 2048),
+	}
+	if d.params.writeNoContextTakeover {
+		r.output = &bytes.Buffer{}
+		r.writer = flatePools.getWriter(r.output, level)
+		r.release = func() {
+			flatePools.putWriter(r.writer, level)
+		}
+		return r
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// 修改压缩级别之后需要新的压缩器，新的压缩器不会引用之前的数据，对方的解压上下文仍然是有效的
+	if d.writer != nil && d.level != level {
+		d.resetWriter()
+	}
+	if d.writer == nil && !d.closed {
+		if d.output == nil {
+			d.output = &bytes.Buffer{}
+		}
+		d.writer = flatePools.getWriter(d.output, level)
+		d.level = level
+	}
+	d.output.Reset()
+	r.output = d.output
+	r.writer = d.writer
+	r.state = d
+	return r
+}
+
+// deflateReader 把 reader 的数据写入压缩器，再从压缩器的输出中读取。
+// 在 reader 结束之前，输出的最后 4 个字节会被保留，因为结束的时候它们可能就是需要去掉的 deflateTail。
+type deflateReader struct {
+	reader  io.Reader
+	writer  *flate.Writer
+	output  *bytes.Buffer
+	buf     []byte
+	done    bool
+	release func()
+
+	// state 不为空时 writer 是 state 中共用的压缩器，连接关闭的时候会被放回 flatePools，使用的时候需要持有 state.lock
+	state *deflateState
+}
+
+func (r *deflateReader) Read(p []byte) (int, error) {
+	if r.state != nil {
+		r.state.lock.Lock()
+		defer r.state.lock.Unlock()
+		if r.state.closed {
+			return 0, ErrClosedStatus
+		}
+	}
+	for !r.done && r.output.Len() <= len(deflateTail) {
+		n, err := r.reader.Read(r.buf)
+		if n > 0 {
+			_, writeErr := r.writer.Write(r.buf[:n])
+			if writeErr != nil {
+				return 0, writeErr
+			}
+		}
+		if err == io.EOF {
+			err = r.writer.Flush()
+			if err != nil {
+				return 0, err
+			}
+			if bytes.HasSuffix(r.output.Bytes(), deflateTail) {
+				r.output.Truncate(r.output.Len() - len(deflateTail))
+			}
+			r.done = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	available := r.output.Len()
+	if !r.done {
+		available -= len(deflateTail)
+	}
+	if available < 1 {
+		if r.release != nil {
+			r.release()
+			r.release = nil
+		}
+		return 0, io.EOF
+	}
+	if len(p) > available {
+		p = p[:available]
+	}
+	return r.output.Read(p)
+}
+
+// decompress 返回一个解压 reader 的 io.Reader，reader 是一个压缩过的 Message 去掉了 deflateTail 的内容
+func (w *webSocket) decompress(reader io.Reader) io.Reader {
+	d := w.deflate
+	bits := d.params.readWindowBits
+	d.readLock.Lock()
+	defer d.readLock.Unlock()
+	// 上一个 Message 还没有读完的时候它的 source 仍然在使用，这时使用一个新的 source
+	source := d.source
+	d.source = nil
+	if source == nil {
+		source = &inflateSource{}
+	}
+	source.reader, source.tail = reader, inflateTail
+	r := &inflateReader{ws: w, source: source, takeover: !d.params.readNoContextTakeover}
+	if !r.takeover {
+		r.reader = flatePools.getReader(source, bits, nil)
+		return r
+	}
+	if d.window == nil && !d.closed {
+		d.window = flatePools.getWindow(bits)
+	}
+	// flate.Reader 会复制预设字典，之后修改 d.window 不会影响这个 Message 的解压
+	r.reader = flatePools.getReader(source, bits, d.window)
+	return r
+}
+
+// inflateTail 是解压的时候追加在 Message 之后的 deflateTail 和 deflateFinalBlock
+var inflateTail = append(append([]byte{}, deflateTail...), deflateFinalBlock...)
+
+// inflateSource 是 flate.Reader 读取的数据，先读取 Message 的内容，再读取 inflateTail。
+// 每个连接在 deflateState 中保存一个，读完一个 Message 之后留给下一个 Message 使用，不需要每次重新创建。
+type inflateSource struct {
+	reader io.Reader
+	tail   []byte
+}
+
+func (s *inflateSource) Read(p []byte) (int, error) {
+	if s.reader != nil {
+		n, err := s.reader.Read(p)
+		if err == io.EOF {
+			s.reader = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	if len(s.tail) < 1 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.tail)
+	s.tail = s.tail[n:]
+	return n, nil
+}
+
+// inflateReader 读取解压之后的数据，开启上下文复用的时候会把数据追加到滑动窗口中
+type inflateReader struct {
+	ws       *webSocket
+	reader   io.ReadCloser
+	source   *inflateSource
+	total    int64
+	takeover bool
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		// 已经读到了结尾，flate.Reader 已经放回了 flatePools
+		return 0, io.EOF
+	}
+	n, err := r.reader.Read(p)
+	if r.takeover {
+		r.ws.deflate.appendWindow(p[:n])
+	}
+	r.total += int64(n)
+	// 压缩过的 Message 解压之后可能远远大于收到的长度，所以解压之后的长度也要检查
+	if r.ws.exceedsReadLimit(r.total) {
+		return n, r.ws.readLimitExceeded()
+	}
+	if err == io.EOF {
+		r.release()
+	}
+	if err != nil && err != io.EOF {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, err
+		}
+		_ = r.ws.fail(CloseInvalidFramePayloadData, err.Error())
+	}
+	return n, err
+}
+
+// release 在读到结尾之后把 flate.Reader 放回 flatePools，并把 source 留给下一个 Message
+func (r *inflateReader) release() {
+	d := r.ws.deflate
+	flatePools.putReader(r.reader, d.params.readWindowBits)
+	r.reader = nil
+	*r.source = inflateSource{}
+	d.readLock.Lock()
+	if !d.closed {
+		d.source = r.source
+	}
+	d.readLock.Unlock()
+	r.source = nil
+}
+
+// appendWindow 把 p 追加到滑动窗口中，超过容量的时候丢弃最早的数据
+func appendWindow(window []byte, p []byte) []byte {
+	size := cap(window)
+	if len(p) >= size {
+		return append(window[:0], p[len(p)-size:]...)
+	}
+	if len(window)+len(p) > size {
+		drop := len(window) + len(p) - size
+		copy(window, window[drop:])
+		window = window[:len(window)-drop]
+	}
+	return append(window, p...)
+}
@@ -0,0 +1,480 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var benchmarkText = []byte(strings.Repeat(`{"id":1024,"name":"websocket","tags":["a","b","c"],"ok":true}`, 64))
+
+func newDeflateWebSocket(writer io.Writer, reader io.Reader, role Role, noContextTakeover bool) *webSocket {
+	ws := NewWebSocketWithRole(discardCloser{writer}, io.NopCloser(reader), role).(*webSocket)
+	ws.enableDeflate(deflateParams{
+		writeNoContextTakeover: noContextTakeover,
+		readNoContextTakeover:  noContextTakeover,
+		writeWindowBits:        maxWindowBits,
+		readWindowBits:         maxWindowBits,
+	})
+	return ws
+}
+
+func benchmarkCompressedSend(b *testing.B, noContextTakeover bool) {
+	ws := newDeflateWebSocket(io.Discard, bytes.NewReader(nil), RoleServer, noContextTakeover)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ws.WriteMessage(TextFrame, benchmarkText); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressedSend(b *testing.B) {
+	b.Run("ContextTakeover", func(b *testing.B) {
+		benchmarkCompressedSend(b, false)
+	})
+	b.Run("NoContextTakeover", func(b *testing.B) {
+		benchmarkCompressedSend(b, true)
+	})
+}
+
+func benchmarkCompressedReceive(b *testing.B, noContextTakeover bool) {
+	frames := &bytes.Buffer{}
+	sender := newDeflateWebSocket(frames, bytes.NewReader(nil), RoleClient, noContextTakeover)
+	for i := 0; i < b.N; i++ {
+		if err := sender.WriteMessage(TextFrame, benchmarkText); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ws := newDeflateWebSocket(io.Discard, frames, RoleServer, noContextTakeover)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkText)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, reader, err := ws.NextReader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = io.Copy(io.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCompressedReceive 中解压相关的对象都是复用的，剩下的分配是每个 Message 的 Message、读取的闭包和 UTF-8 校验，
+// 不压缩的 TextFrame 也有同样的分配
+func BenchmarkCompressedReceive(b *testing.B) {
+	b.Run("ContextTakeover", func(b *testing.B) {
+		benchmarkCompressedReceive(b, false)
+	})
+	b.Run("NoContextTakeover", func(b *testing.B) {
+		benchmarkCompressedReceive(b, true)
+	})
+}
+
+func TestDeflateReleaseReturnsWriter(t *testing.T) {
+	frames := &bytes.Buffer{}
+	sender := newDeflateWebSocket(frames, bytes.NewReader(nil), RoleClient, false)
+	for _, level := range []int{flate.BestSpeed, flate.BestCompression} {
+		if err := sender.SetCompressionLevel(level); err != nil {
+			t.Fatal(err)
+		}
+		if err := sender.WriteMessage(TextFrame, benchmarkText); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.deflate.release()
+	if sender.deflate.writer != nil {
+		t.Fatal("writer is not returned to the pool")
+	}
+	if err := sender.WriteMessage(TextFrame, benchmarkText); err == nil {
+		t.Fatal("write after release succeeded")
+	}
+
+	receiver := newDeflateWebSocket(io.Discard, frames, RoleServer, false)
+	for i := 0; i < 2; i++ {
+		_, data, err := receiver.ReadAllMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, benchmarkText) {
+			t.Fatalf("message %d does not match", i)
+		}
+	}
+	receiver.deflate.release()
+	if receiver.deflate.window != nil {
+		t.Fatal("window is not returned to the pool")
+	}
+}
+
+// deflateSocket 返回协商了使用上下文复用的 permessage-deflate 的 WebSocket
+func deflateSocket(writer io.Writer, reader io.Reader, mask bool) *webSocket {
+	ws := NewWebSocket(discardCloser{writer}, io.NopCloser(reader), mask).(*webSocket)
+	ws.deflate = newDeflateState(deflateParams{writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits})
+	ws.allowedRsv |= 0b100
+	return ws
+}
+
+// sentRsv1 返回 data 中每个帧的 Rsv1 标志位
+func sentRsv1(t *testing.T, data []byte) []bool {
+	t.Helper()
+	reader := bytes.NewReader(data)
+	var rsv1 []bool
+	for reader.Len() > 0 {
+		frame := &Frame{}
+		if err := frame.Decode(context.Background(), reader); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, frame.Payload); err != nil {
+			t.Fatal(err)
+		}
+		rsv1 = append(rsv1, frame.Rsv1)
+	}
+	return rsv1
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	ws := deflateSocket(io.Discard, bytes.NewReader(nil), false)
+	for _, level := range []int{flate.HuffmanOnly, flate.DefaultCompression, flate.NoCompression, flate.BestCompression} {
+		if err := ws.SetCompressionLevel(level); err != nil {
+			t.Fatalf("SetCompressionLevel(%d) error = %v", level, err)
+		}
+	}
+	for _, level := range []int{flate.HuffmanOnly - 1, flate.BestCompression + 1} {
+		if err := ws.SetCompressionLevel(level); err != ErrInvalidCompressionLevel {
+			t.Fatalf("SetCompressionLevel(%d) error = %v, want %v", level, err, ErrInvalidCompressionLevel)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	short := strings.Repeat("a", 10)
+	long := strings.Repeat("a", 100)
+	always, never := true, false
+	tests := []struct {
+		name     string
+		data     string
+		disable  bool
+		compress *bool
+		want     bool
+	}{
+		{name: "short", data: short, want: false},
+		{name: "exactly threshold", data: strings.Repeat("a", 64), want: true},
+		{name: "long", data: long, want: true},
+		{name: "short always", data: short, compress: &always, want: true},
+		{name: "long never", data: long, compress: &never, want: false},
+		// EnableWriteCompression(false) 之后只有 Message.Compress 为 true 的 Message 会被压缩
+		{name: "disabled", data: long, disable: true, want: false},
+		{name: "disabled always", data: short, disable: true, compress: &always, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := deflateSocket(output, bytes.NewReader(nil), false)
+			ws.SetCompressionThreshold(64)
+			ws.EnableWriteCompression(!test.disable)
+			message := &Message{Reader: strings.NewReader(test.data), OpCode: TextFrame, Compress: test.compress}
+			if err := ws.SendMessage(message); err != nil {
+				t.Fatal(err)
+			}
+			frames := output.Bytes()
+			if rsv1 := sentRsv1(t, frames); len(rsv1) != 1 || rsv1[0] != test.want {
+				t.Fatalf("Rsv1 = %v, want %v", rsv1, test.want)
+			}
+			// 读取的时候可以还原压缩过和没有压缩的 Message
+			receiver := deflateSocket(io.Discard, bytes.NewReader(frames), false)
+			if data := readText(t, receiver); data != test.data {
+				t.Fatalf("ReadMessage() = %q, want %q", data, test.data)
+			}
+		})
+	}
+}
+
+func TestCompressionLevelChangeKeepsContext(t *testing.T) {
+	output := &bytes.Buffer{}
+	sender := deflateSocket(output, bytes.NewReader(nil), true)
+	text := strings.Repeat("websocket ", 50)
+	// 在上下文复用的时候修改压缩级别，对方仍然可以用之前的上下文解压
+	for _, level := range []int{flate.BestSpeed, flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly} {
+		if err := sender.SetCompressionLevel(level); err != nil {
+			t.Fatal(err)
+		}
+		if err := sender.Send(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiver := deflateSocket(io.Discard, bytes.NewReader(output.Bytes()), false)
+	for i := 0; i < 4; i++ {
+		if data := readText(t, receiver); data != text {
+			t.Fatalf("message %d = %q, want %q", i, data, text)
+		}
+	}
+}
+
+func TestDecompressReusesSource(t *testing.T) {
+	for _, noContextTakeover := range []bool{false, true} {
+		frames := &bytes.Buffer{}
+		sender := newDeflateWebSocket(frames, bytes.NewReader(nil), RoleClient, noContextTakeover)
+		messages := [][]byte{benchmarkText, []byte("hello"), benchmarkText, {}}
+		for _, message := range messages {
+			if err := sender.WriteMessage(TextFrame, message); err != nil {
+				t.Fatal(err)
+			}
+		}
+		receiver := newDeflateWebSocket(io.Discard, frames, RoleServer, noContextTakeover)
+		var source *inflateSource
+		for i, message := range messages {
+			_, data, err := receiver.ReadAllMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, message) {
+				t.Fatalf("message %d = %q, want %q", i, data, message)
+			}
+			if receiver.deflate.source == nil || (source != nil && receiver.deflate.source != source) {
+				t.Fatalf("message %d did not return the shared source", i)
+			}
+			source = receiver.deflate.source
+		}
+		receiver.deflate.release()
+		if receiver.deflate.source != nil {
+			t.Fatal("source is kept after release")
+		}
+	}
+}
+
+// offerHeader 返回 Sec-WebSocket-Extensions 是 values 的请求头
+func offerHeader(values ...string) http.Header {
+	header := http.Header{}
+	for _, value := range values {
+		header.Add("Sec-Websocket-Extensions", value)
+	}
+	return header
+}
+
+func TestAcceptDeflate(t *testing.T) {
+	defaults := deflateParams{writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits}
+	tests := []struct {
+		name     string
+		offers   []string
+		ok       bool
+		params   deflateParams
+		response ExtensionParams
+	}{
+		{name: "no offer", offers: []string{"x-other"}},
+		{name: "default", offers: []string{"permessage-deflate"}, ok: true, params: defaults, response: ExtensionParams{}},
+		{
+			name:     "client window bits without value",
+			offers:   []string{"permessage-deflate; client_max_window_bits"},
+			ok:       true,
+			params:   defaults,
+			response: ExtensionParams{},
+		},
+		{
+			name:     "client window bits with value",
+			offers:   []string{"permessage-deflate; client_max_window_bits=10"},
+			ok:       true,
+			params:   defaults,
+			response: ExtensionParams{},
+		},
+		{
+			name:     "no context takeover",
+			offers:   []string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+			ok:       true,
+			params:   deflateParams{writeNoContextTakeover: true, readNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+			response: ExtensionParams{"server_no_context_takeover": "", "client_no_context_takeover": ""},
+		},
+		{
+			name:     "server no context takeover only",
+			offers:   []string{"permessage-deflate; server_no_context_takeover"},
+			ok:       true,
+			params:   deflateParams{writeNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+			response: ExtensionParams{"server_no_context_takeover": ""},
+		},
+		{
+			name:     "server window bits",
+			offers:   []string{"permessage-deflate; server_max_window_bits=10"},
+			ok:       true,
+			params:   deflateParams{writeWindowBits: 10, readWindowBits: maxWindowBits},
+			response: ExtensionParams{"server_max_window_bits": "10"},
+		},
+		{name: "server window bits without value", offers: []string{"permessage-deflate; server_max_window_bits"}},
+		{name: "server window bits too large", offers: []string{"permessage-deflate; server_max_window_bits=16"}},
+		{name: "server window bits too small", offers: []string{"permessage-deflate; server_max_window_bits=7"}},
+		{name: "server window bits with leading zero", offers: []string{"permessage-deflate; server_max_window_bits=09"}},
+		{name: "client window bits invalid", offers: []string{"permessage-deflate; client_max_window_bits=16"}},
+		{name: "flag with value", offers: []string{"permessage-deflate; server_no_context_takeover=1"}},
+		{name: "unknown parameter", offers: []string{"permessage-deflate; x=1"}},
+		{name: "duplicate parameter", offers: []string{"permessage-deflate; server_no_context_takeover; server_no_context_takeover"}},
+		{
+			name:     "first acceptable offer",
+			offers:   []string{"permessage-deflate; server_max_window_bits=16, permessage-deflate; client_no_context_takeover", "permessage-deflate"},
+			ok:       true,
+			params:   deflateParams{readNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+			response: ExtensionParams{"client_no_context_takeover": ""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, params, ok := acceptDeflate(offerHeader(test.offers...))
+			if ok != test.ok {
+				t.Fatalf("acceptDeflate() ok = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if *params != test.params {
+				t.Fatalf("params = %+v, want %+v", *params, test.params)
+			}
+			// 参数的顺序不重要，解析之后比较
+			extensions := ParseExtensions(offerHeader(response))
+			if len(extensions) != 1 || extensions[0].Name != DeflateExtension || !reflect.DeepEqual(extensions[0].Params, test.response) {
+				t.Fatalf("response = %q, want %v", response, test.response)
+			}
+		})
+	}
+}
+
+func TestClientDeflate(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []string
+		params   *deflateParams
+		err      error
+	}{
+		{name: "not accepted", response: []string{"x-other"}},
+		{name: "default", response: []string{"permessage-deflate"}, params: &deflateParams{writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits}},
+		{
+			name:     "no context takeover",
+			response: []string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+			params:   &deflateParams{readNoContextTakeover: true, writeNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+		},
+		{
+			name:     "window bits",
+			response: []string{"permessage-deflate; server_max_window_bits=9; client_max_window_bits=10"},
+			params:   &deflateParams{readWindowBits: 9, writeWindowBits: 10},
+		},
+		{name: "client window bits without value", response: []string{"permessage-deflate; client_max_window_bits"}, err: ErrInvalidDeflateParams},
+		{name: "window bits out of range", response: []string{"permessage-deflate; server_max_window_bits=16"}, err: ErrInvalidDeflateParams},
+		{name: "unknown parameter", response: []string{"permessage-deflate; x=1"}, err: ErrInvalidDeflateParams},
+		{name: "duplicate parameter", response: []string{"permessage-deflate; client_no_context_takeover; client_no_context_takeover"}, err: ErrInvalidDeflateParams},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := clientDeflate(offerHeader(test.response...))
+			if err != test.err {
+				t.Fatalf("clientDeflate() error = %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(params, test.params) {
+				t.Fatalf("clientDeflate() = %+v, want %+v", params, test.params)
+			}
+		})
+	}
+}
+
+func TestDeflateInterop(t *testing.T) {
+	upgrader := &Upgrader{EnableCompression: true}
+	server := httptest.NewServer(upgrader.Handler(func(ws WebSocket) {
+		for {
+			message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = ws.SendMessage(message); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		name   string
+		offer  string
+		params deflateParams
+	}{
+		{
+			name:   "default",
+			params: deflateParams{writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+		},
+		{
+			name:   "no context takeover",
+			offer:  "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			params: deflateParams{writeNoContextTakeover: true, readNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+		},
+		{
+			name:   "server no context takeover",
+			offer:  "permessage-deflate; server_no_context_takeover",
+			params: deflateParams{readNoContextTakeover: true, writeWindowBits: maxWindowBits, readWindowBits: maxWindowBits},
+		},
+		{
+			// 服务端只能使用 32KB 的窗口，对方要求更小的窗口的时候服务端发送不压缩的 Message
+			name:   "small server window",
+			offer:  "permessage-deflate; server_max_window_bits=10",
+			params: deflateParams{writeWindowBits: maxWindowBits, readWindowBits: 10},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := &Dialer{EnableCompression: true}
+			if len(test.offer) > 0 {
+				dialer.Header = offerHeader(test.offer)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ws, err := dialer.Dial(ctx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			w := ws.(*webSocket)
+			if w.deflate == nil || w.deflate.params != test.params {
+				t.Fatalf("negotiated %+v, want %+v", w.deflate, test.params)
+			}
+			// 多个 Message 确认上下文复用的时候滑动窗口在两边是一致的
+			for i := 0; i < 4; i++ {
+				if err = ws.WriteMessage(TextFrame, benchmarkText); err != nil {
+					t.Fatal(err)
+				}
+				_, data, err := ws.ReadAllMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, benchmarkText) {
+					t.Fatalf("message %d was not echoed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDialRejectsUnrequestedDeflate(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		request, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		accept, _ := getSecAcceptKey(request.Header.Get("Sec-Websocket-Key"))
+		_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-Websocket-Accept: "+accept+"\r\nSec-Websocket-Extensions: permessage-deflate\r\n\r\n")
+	}()
+	request, _ := http.NewRequest(http.MethodGet, "ws://example.com/", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, _, err := (&Dialer{}).NewClientConn(ctx, client, request); err == nil || !strings.Contains(err.Error(), "unexpected extension permessage-deflate") {
+		t.Fatalf("NewClientConn() error = %v, want an unexpected extension error", err)
+	}
+}
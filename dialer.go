@@ -0,0 +1,590 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var tcpDialer = proxy.Dial
+var tlsDialer = tlsDial(tcpDialer, nil)
+
+// tlsDial 在 dial 建立的连接上完成 TLS 握手，config 为空时使用默认的配置。
+// config 没有设置 ServerName 的时候，使用连接地址中的主机名。
+func tlsDial(dial func(context.Context, string, string) (net.Conn, error), config *tls.Config) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		rawConn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig := &tls.Config{}
+		if config != nil {
+			clientConfig = config.Clone()
+		}
+		if len(clientConfig.ServerName) < 1 {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				host = address
+			}
+			clientConfig.ServerName = host
+		}
+		conn := tls.Client(rawConn, clientConfig)
+		err = conn.HandshakeContext(ctx)
+		if err != nil {
+			_ = rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// Dialer 用于配置客户端如何连接 WebSocket 服务器
+type Dialer struct {
+	// NetDialContext 用于建立底层的 TCP 连接，为空时使用默认的拨号方式（支持 HTTP_PROXY、HTTPS_PROXY、NO_PROXY 和 ALL_PROXY 环境变量）。
+	// 如果 URL 的 scheme 是 https 或者 wss，会在这个连接上完成 TLS 握手。
+	NetDialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Network 和 Address 不为空时代替 tcp 和 URL 中的主机和端口，用于连接 Unix socket（Network 是 unix）或者指定的地址，
+	// 握手请求的 Host 和路径仍然来自 URL，wss 的证书按照 URL 中的主机名校验，设置了 Address 的时候不会使用代理。
+	// 也可以直接使用 ws+unix:///path/to.sock:/ws 形式的 URL 连接 Unix socket。
+	Network string
+	Address string
+
+	// Resolver 是解析服务器（以及代理服务器）主机名使用的 DNS 解析器，为空时使用 net.DefaultResolver。
+	// AddressFamily 是连接解析出来的地址时优先或者只使用的地址族，默认优先使用 IPv6。
+	// FallbackDelay 是 Happy Eyeballs（RFC 8305）开始连接下一个地址之前等待上一个地址的时间，为 0 时使用 DefaultFallbackDelay，
+	// 小于 0 时只有上一个地址连接失败之后才会连接下一个地址。设置了 NetDialContext 的时候这三个选项都不会使用。
+	Resolver      *net.Resolver
+	AddressFamily AddressFamily
+	FallbackDelay time.Duration
+
+	// TLSConfig 是 wss 和 https 连接使用的 TLS 配置，可以设置私有的 RootCAs、mTLS 的客户端证书、MinVersion 等。
+	// 为空时使用默认的配置，没有设置 ServerName 的时候使用 URL 中的主机名。
+	TLSConfig *tls.Config
+
+	// Proxy 返回连接使用的代理服务器，返回 nil 表示直接连接，支持 http、https（通过 CONNECT 建立隧道）以及 socks5 和 socks5h 代理，
+	// URL 中的用户名和密码会用于代理的认证。为空并且没有设置 NetDialContext 的时候使用 ProxyFromEnvironment，
+	// 环境变量中没有对应的代理时再使用 ALL_PROXY 环境变量；设置了 NetDialContext 的时候直接使用 NetDialContext。
+	Proxy func(request *http.Request) (*url.URL, error)
+
+	// ProxyConnectHeader 是发送给 HTTP 代理的 CONNECT 请求中额外的请求头，例如自定义的 Proxy-Authorization
+	ProxyConnectHeader http.Header
+
+	// HandshakeTimeout 是完成握手的最长时间，大于 0 时会覆盖 Timeouts 中的 Handshake
+	HandshakeTimeout time.Duration
+
+	// Header 是加入到每个握手请求中的请求头，请求中已经存在的头不会被覆盖。
+	// 重定向到其他主机或者从 wss 降级到 ws 的时候，不会带上其中的 Authorization 和 Cookie。
+	Header http.Header
+
+	// Jar 不为空时，握手请求会带上 Jar 中对应 URL 的 Cookie（请求中已经有的同名 Cookie 不会被覆盖），
+	// 握手响应中的 Set-Cookie 会保存到 Jar 中，包括重定向和被拒绝的响应。ws 和 wss 会按照 http 和 https 处理。
+	Jar http.CookieJar
+
+	// ReadBufferSize 大于 0 时，读取连接使用这个大小的缓冲区，可以减少读取小帧时的系统调用。
+	// WriteBufferSize 大于 0 时，每个帧会先写入这个大小的缓冲区，再一次性写入连接。
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// FragmentSize 不为 0 时，握手成功之后会使用它调用 SetFragmentSize
+	FragmentSize int
+
+	// BackgroundRead 为 true 时，握手成功之后会开启后台读取模式，BackgroundQueueSize 是数据 Message 队列的长度。
+	// 这样即使应用长时间不调用 ReadMessage，对方的 Ping 和 ConnectionClose 也会被及时处理。
+	BackgroundRead      bool
+	BackgroundQueueSize int
+
+	// PinnedCertificates 是固定的服务器证书 DER 编码的 SHA-256，PinnedPublicKeys 是固定的证书 SubjectPublicKeyInfo 的 SHA-256。
+	// 设置了任意一个的时候，校验通过的证书链中至少要有一个证书匹配，否则 TLS 握手会失败并返回 ErrCertificatePinMismatch，恢复的会话也会重新校验。
+	// 这个校验是在正常的证书校验之后进行的，使用自签名证书的时候可以配合 TLSConfig 的 InsecureSkipVerify 只校验固定值，
+	// 这时只有服务器自己的证书会被用来匹配。
+	PinnedCertificates [][]byte
+	PinnedPublicKeys   [][]byte
+
+	// SkipAcceptCheck 为 true 时不校验响应头中的 Sec-WebSocket-Accept，
+	// 用于连接一些握手实现有问题的嵌入式或者老旧的服务器。
+	SkipAcceptCheck bool
+
+	// LenientHeaders 为 true 时，容忍响应头中缺失或者不规范的 Connection 和 Upgrade。
+	LenientHeaders bool
+
+	// Subprotocols 是按照优先级排列的，向服务器请求的子协议，服务器选择的子协议可以通过 WebSocket.Subprotocol 获取。
+	// 请求头中已经有 Sec-WebSocket-Protocol 的时候不会再添加。
+	Subprotocols []string
+
+	// EnableCompression 为 true 时会向服务器请求 permessage-deflate，服务器同意之后数据 Message 会被压缩
+	EnableCompression bool
+
+	// Extensions 是向服务器请求的自定义扩展，服务器同意的扩展会按照响应的顺序处理数据 Message
+	Extensions []Extension
+
+	// Checksum 为 true 时会向服务器请求 ChecksumExtension，服务器同意之后每个数据 Message 都会带上 CRC32 校验值
+	Checksum bool
+
+	// Timeouts 是握手和连接使用的超时配置，为空时使用 DefaultTimeouts
+	Timeouts *Timeouts
+
+	// Keepalive 不为空时，握手成功之后会使用它调用 SetKeepalive
+	Keepalive *Keepalive
+
+	// KeySource 是生成 Sec-WebSocket-Key 使用的随机数来源，为空时使用 crypto/rand。
+	// 可以设置成固定的数据，用于需要确定的握手请求的测试。
+	KeySource io.Reader
+
+	// MaxRedirects 大于 0 时，握手收到 301、302、303、307 或者 308 响应会按照 Location 重新握手，最多跟随 MaxRedirects 次，
+	// 超过之后返回 ErrTooManyRedirects。Location 中的 http 和 https 会被转换成 ws 和 wss。为 0 时不跟随重定向。
+	MaxRedirects int
+
+	// AuthChallenge 不为空时，服务器用带有 WWW-Authenticate 的 401 响应拒绝握手的时候会调用它，
+	// response 是服务器的响应，request 是调用者最初的握手请求的副本，AuthChallenge 在 request 中设置认证信息
+	// （例如 Basic、刷新之后的 Bearer token 或者按照 challenge 计算的 Digest）之后会使用 request 重新握手一次。
+	// 返回错误的时候不再重试，错误会被包装在 *ResponseError 中返回；重新握手仍然是 401 的时候返回 *ResponseError。
+	AuthChallenge func(ctx context.Context, response *http.Response, request *http.Request) error
+
+	// Retry 不为空时，建立连接失败的时候会按照它重试
+	Retry *RetryPolicy
+
+	// Registry 不为空时，建立的 WebSocket 对象会被加入到 Registry 中
+	Registry *Registry
+
+	// dialConn 不为空时直接用于建立完整的连接，不会再进行 TLS 握手
+	dialConn func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DefaultDialer 是 New 和 Connect 使用的 Dialer
+var DefaultDialer = &Dialer{}
+
+// New 使用 url 链接来创建一个 WebSocket 对象。
+// 可以通过设置环境变量 HTTP_PROXY、HTTPS_PROXY 或者 ALL_PROXY 来使用代理服务器。
+//
+// 例子1：wss://ws.postman-echo.com/raw/
+// 例子2：http://example.com/ws
+func New(url string) (WebSocket, error) {
+	return DefaultDialer.Dial(context.Background(), url)
+}
+
+// Connect 使用一个 HTTP 请求来创建 WebSocket 对象。
+// 可以通过设置环境变量 HTTP_PROXY、HTTPS_PROXY 或者 ALL_PROXY 来使用代理服务器。
+// 传入 HTTP 请求的方法，可以用于需要验证的 WebSocket 连接，自定义添加验证信息到请求头中。
+func Connect(ctx context.Context, request *http.Request) (WebSocket, error) {
+	return DefaultDialer.Connect(ctx, request)
+}
+
+// ConnectWithDialer 传入自定义 dialer，然后创建一个 WebSocket 。
+// 这个函数主要考虑是用于自定义代理方法来连接目标 WebSocket。
+// dialer 需要自己负责建立完整的连接，包括 wss 需要的 TLS 握手。
+func ConnectWithDialer(ctx context.Context, dialer func(context.Context, string, string) (net.Conn, error), request *http.Request) (WebSocket, error) {
+	d := &Dialer{dialConn: dialer}
+	return d.Connect(ctx, request)
+}
+
+// Dial 使用 url 链接来创建一个 WebSocket 对象
+func (d *Dialer) Dial(ctx context.Context, url string) (WebSocket, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.Connect(ctx, request)
+}
+
+// Connect 使用一个 HTTP 请求来创建 WebSocket 对象。
+// 设置了 MaxRedirects 的时候会跟随服务器的重定向，重定向之后的请求使用 request 最初的请求头（以及 AuthChallenge 设置的认证信息）。
+func (d *Dialer) Connect(ctx context.Context, request *http.Request) (WebSocket, error) {
+	timeouts := d.timeouts()
+	if timeouts.Handshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeouts.Handshake)
+		defer cancel()
+	}
+	// Header 只在最初的请求中加入一次，重定向到其他主机或者降级到 ws 的时候，其中的 Authorization 和 Cookie 会被移除
+	request = request.Clone(request.Context())
+	d.addHeader(request)
+	redirects, challenged := 0, false
+	for {
+		// 每次握手使用 request 的副本，重试认证的时候 request 仍然是调用者最初的请求
+		ws, err := d.connect(ctx, request.Clone(request.Context()), timeouts)
+		var challenge *challengeError
+		if errors.As(err, &challenge) {
+			if challenged {
+				return nil, challenge.responseError()
+			}
+			challenged = true
+			request, err = d.answerChallenge(ctx, request, challenge)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var redirect *redirectError
+		if !errors.As(err, &redirect) {
+			if err != nil {
+				return nil, err
+			}
+			return ws, nil
+		}
+		if redirects >= d.MaxRedirects {
+			return nil, &ResponseError{Response: redirect.response, Err: ErrTooManyRedirects}
+		}
+		redirects++
+		request, err = redirectRequest(request, redirect.location, request.Header)
+		if err != nil {
+			return nil, &ResponseError{Response: redirect.response, Err: err}
+		}
+	}
+}
+
+// NewClientConn 使用 DefaultDialer 在已经建立好的 conn 上完成客户端的握手，参考 Dialer.NewClientConn
+func NewClientConn(ctx context.Context, conn net.Conn, request *http.Request) (WebSocket, *http.Response, error) {
+	return DefaultDialer.NewClientConn(ctx, conn, request)
+}
+
+// NewClientConn 在调用者自己建立的 conn 上只完成 WebSocket 的握手，不会建立连接，也不会进行 TLS 握手，
+// 适合通过自定义的隧道、TOR 或者 QUIC 的 stream 等方式建立的连接，wss 需要的 TLS 由调用者在 conn 上完成。
+// request 的 URL 用于请求的路径和 Host，Dialer 的 Header、Jar、Subprotocols 和扩展等握手配置仍然有效，
+// 连接相关的配置（NetDialContext、Proxy、TLSConfig、Retry 等）不会使用。conn 只能使用一次，所以不会跟随重定向。
+// 返回值和 ConnectResponse 一样，握手失败的时候 conn 会被关闭。
+func (d *Dialer) NewClientConn(ctx context.Context, conn net.Conn, request *http.Request) (WebSocket, *http.Response, error) {
+	timeouts := d.timeouts()
+	if timeouts.Handshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeouts.Handshake)
+		defer cancel()
+	}
+	// 和 Connect 一样使用 request 的副本，握手加入的请求头不会留在调用者的 request 中
+	request = request.Clone(ctx)
+	d.addRequestHeaders(request)
+	ws, err := d.upgrade(ctx, conn, request, timeouts)
+	if err != nil {
+		// conn 只能使用一次，重定向和认证都不能重新握手
+		var redirect *redirectError
+		if errors.As(err, &redirect) {
+			err = &ResponseError{Response: redirect.response, Err: errors.New(redirect.response.Status)}
+		}
+		var challenge *challengeError
+		if errors.As(err, &challenge) {
+			err = challenge.responseError()
+		}
+		var responseErr *ResponseError
+		if errors.As(err, &responseErr) {
+			return nil, responseErr.Response, err
+		}
+		return nil, nil, err
+	}
+	return ws, ws.HandshakeResponse(), nil
+}
+
+// DialResponse 和 Dial 一样，同时返回服务器的握手响应，参考 ConnectResponse
+func (d *Dialer) DialResponse(ctx context.Context, url string) (WebSocket, *http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.ConnectResponse(ctx, request)
+}
+
+// ConnectResponse 和 Connect 一样，同时返回服务器的握手响应。握手成功的时候是 101 响应；
+// 服务器返回了不正确的响应（例如 401、429 或者缺少必要的响应头）的时候也会返回这个响应，这时错误是 *ResponseError；
+// 没有收到响应（例如连接失败）的时候响应是 nil。
+func (d *Dialer) ConnectResponse(ctx context.Context, request *http.Request) (WebSocket, *http.Response, error) {
+	ws, err := d.Connect(ctx, request)
+	if err != nil {
+		var responseErr *ResponseError
+		if errors.As(err, &responseErr) {
+			return nil, responseErr.Response, err
+		}
+		return nil, nil, err
+	}
+	return ws, ws.HandshakeResponse(), nil
+}
+
+// maxErrorBodySize 是握手失败的时候保留的响应内容的最大长度
+const maxErrorBodySize = 16 << 10
+
+// ResponseError 表示服务器的握手响应不是一个正确的 101 响应，Response 是收到的响应，Err 是失败的原因。
+// 连接已经被关闭，Response.Body 是已经读入内存的响应内容，最多保留 16 KiB，可以在返回之后读取。
+type ResponseError struct {
+	Response *http.Response
+	Err      error
+}
+
+func (e *ResponseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+func newResponseError(resp *http.Response, err error) *ResponseError {
+	return &ResponseError{Response: bufferResponse(resp), Err: err}
+}
+
+// bufferResponse 把 resp 最多 maxErrorBodySize 的内容读入内存，之后连接关闭了也可以读取
+func bufferResponse(resp *http.Response) *http.Response {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// connect 使用 request 完成一次握手，服务器重定向的时候返回 *redirectError
+func (d *Dialer) connect(ctx context.Context, request *http.Request, timeouts Timeouts) (*webSocket, error) {
+	network, address, override, err := d.target(request)
+	if err != nil {
+		return nil, err
+	}
+	d.addCookies(request)
+	dial, err := d.dial(request, override)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialRetry(ctx, dial, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.upgrade(ctx, conn, request, timeouts)
+}
+
+// addRequestHeaders 把 Dialer 的 Header 和 Jar 中的 Cookie 加入到握手请求中
+func (d *Dialer) addRequestHeaders(request *http.Request) {
+	d.addHeader(request)
+	d.addCookies(request)
+}
+
+// addHeader 把 Dialer 的 Header 加入 request，request 中已经存在的头不会被覆盖
+func (d *Dialer) addHeader(request *http.Request) {
+	for key, values := range d.Header {
+		if len(request.Header.Values(key)) < 1 {
+			request.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+}
+
+// addCookies 把 Jar 中属于 request 的 URL 的 Cookie 加入 request
+func (d *Dialer) addCookies(request *http.Request) {
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(cookieURL(request.URL)) {
+			// 调用者在请求中自己设置的同名 Cookie 优先
+			if _, err := request.Cookie(cookie.Name); err == nil {
+				continue
+			}
+			request.AddCookie(cookie)
+		}
+	}
+}
+
+// upgrade 在已经建立的连接上完成握手并按照 Dialer 的配置设置 WebSocket 对象，失败的时候会关闭连接
+func (d *Dialer) upgrade(ctx context.Context, conn net.Conn, request *http.Request, timeouts Timeouts) (*webSocket, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	ws, err := d.handshake(conn, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	ws.SetTimeouts(timeouts)
+	if d.Keepalive != nil {
+		ws.SetKeepalive(*d.Keepalive)
+	}
+	if d.FragmentSize != 0 {
+		ws.SetFragmentSize(d.FragmentSize)
+	}
+	if d.BackgroundRead {
+		ws.BackgroundRead(d.BackgroundQueueSize)
+	}
+	if d.Registry != nil {
+		d.Registry.Track(ws)
+	}
+	return ws, nil
+}
+
+func (d *Dialer) timeouts() Timeouts {
+	timeouts := DefaultTimeouts
+	if d.Timeouts != nil {
+		timeouts = *d.Timeouts
+	}
+	if d.HandshakeTimeout > 0 {
+		timeouts.Handshake = d.HandshakeTimeout
+	}
+	return timeouts
+}
+
+// cookieURL 把 ws 和 wss 转换成 http 和 https，因为 http.CookieJar 的实现一般只处理 HTTP 的 URL
+func cookieURL(u *url.URL) *url.URL {
+	jarURL := *u
+	switch u.Scheme {
+	case "ws":
+		jarURL.Scheme = "http"
+	case "wss":
+		jarURL.Scheme = "https"
+	}
+	return &jarURL
+}
+
+func isSecureScheme(scheme string) bool {
+	return scheme == "https" || scheme == "wss"
+}
+
+// dial 返回连接 request 的拨号函数，override 表示连接的地址被 ws+unix 或者 Address 替换了，这时不会使用代理
+func (d *Dialer) dial(request *http.Request, override bool) (func(context.Context, string, string) (net.Conn, error), error) {
+	if d.dialConn != nil {
+		return d.dialConn, nil
+	}
+	dial := d.NetDialContext
+	direct := dial == nil
+	if direct {
+		dial = d.dialDirect
+	}
+	proxyFunc := d.Proxy
+	if proxyFunc == nil && direct {
+		// 默认按照 HTTP_PROXY、HTTPS_PROXY 和 NO_PROXY 选择代理
+		proxyFunc = ProxyFromEnvironment
+	}
+	if proxyFunc != nil && !override {
+		proxyURL, err := proxyFunc(request)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			dial, err = proxyDial(proxyURL, dial, d.ProxyConnectHeader)
+			if err != nil {
+				return nil, err
+			}
+		} else if d.Proxy == nil {
+			// 没有对应的代理的时候仍然支持 ALL_PROXY
+			dial = contextDial(proxy.FromEnvironmentUsing(dialFunc(dial)))
+		}
+	}
+	if isSecureScheme(request.URL.Scheme) {
+		config := d.pinnedTLSConfig(d.TLSConfig)
+		if override && (config == nil || len(config.ServerName) < 1) {
+			// 连接的地址不是主机名，证书按照 URL 中的主机名校验
+			if config == nil {
+				config = &tls.Config{}
+			}
+			config = config.Clone()
+			config.ServerName = request.URL.Hostname()
+		}
+		return tlsDial(dial, config), nil
+	}
+	return dial, nil
+}
+
+// handshake 在已经建立的连接上完成客户端的 WebSocket 握手
+func (d *Dialer) handshake(conn net.Conn, request *http.Request) (*webSocket, error) {
+	key, err := getSecWebsocketKey(d.KeySource)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("sec-websocket-key", key)
+	request.Header.Set("sec-websocket-version", "13")
+	request.Header.Set("connection", "upgrade")
+	request.Header.Set("upgrade", "websocket")
+	if len(d.Subprotocols) > 0 && len(request.Header.Values("sec-websocket-protocol")) < 1 {
+		request.Header.Set("sec-websocket-protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if d.EnableCompression && !containsFold(extensionNames(request.Header), DeflateExtension) {
+		request.Header.Add("sec-websocket-extensions", deflateOffer())
+	}
+	offerExtensions(request.Header, d.Extensions)
+	if d.Checksum && !containsFold(extensionNames(request.Header), ChecksumExtension) {
+		request.Header.Add("sec-websocket-extensions", ChecksumExtension)
+	}
+
+	err = request.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	if d.ReadBufferSize > 0 {
+		reader = bufio.NewReaderSize(conn, d.ReadBufferSize)
+	}
+	resp, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*webSocket, error) {
+		return nil, newResponseError(resp, err)
+	}
+	if resp.StatusCode != 101 {
+		if d.Jar != nil {
+			d.Jar.SetCookies(cookieURL(request.URL), resp.Cookies())
+		}
+		if d.AuthChallenge != nil && resp.StatusCode == http.StatusUnauthorized && len(resp.Header.Values("www-authenticate")) > 0 {
+			return nil, &challengeError{response: bufferResponse(resp)}
+		}
+		if d.MaxRedirects > 0 && isRedirect(resp.StatusCode) {
+			location, err := resp.Location()
+			if err == nil {
+				return nil, &redirectError{response: bufferResponse(resp), location: location}
+			}
+		}
+		return fail(errors.New(resp.Status))
+	}
+	if !d.LenientHeaders {
+		if !headerContainsToken(resp.Header, "connection", "upgrade") {
+			return fail(errors.New("WebSocket connection to '" + request.URL.String() + "' failed"))
+		}
+		if !headerContainsToken(resp.Header, "upgrade", "websocket") {
+			return fail(errors.New("WebSocket connection to '" + request.URL.String() + "' failed"))
+		}
+	}
+	// 服务器只能选择客户端提供的子协议和扩展
+	protocols := headerList(resp.Header, "sec-websocket-protocol")
+	if len(protocols) > 1 || len(protocols) == 1 && !containsFold(headerList(request.Header, "sec-websocket-protocol"), protocols[0]) {
+		return fail(errors.New("WebSocket connection to '" + request.URL.String() + "' failed: unexpected subprotocol"))
+	}
+	offeredExtensions := extensionNames(request.Header)
+	for _, name := range extensionNames(resp.Header) {
+		if !containsFold(offeredExtensions, name) {
+			return fail(errors.New("WebSocket connection to '" + request.URL.String() + "' failed: unexpected extension " + name))
+		}
+	}
+	if !d.SkipAcceptCheck {
+		secAcceptKey, err := getSecAcceptKey(request.Header.Get("sec-websocket-key"))
+		if err != nil {
+			return fail(err)
+		}
+		if secAcceptKey != resp.Header.Get("sec-websocket-accept") {
+			return fail(errors.New("WebSocket connection to '" + request.URL.String() + "' failed"))
+		}
+	}
+	ws := NewWebSocketWithRole(conn, inputReadCloser(reader, conn, d.ReadBufferSize > 0), RoleClient).(*webSocket)
+	ws.setWriteBufferSize(d.WriteBufferSize)
+	if d.Jar != nil {
+		d.Jar.SetCookies(cookieURL(request.URL), resp.Cookies())
+	}
+	if len(protocols) == 1 {
+		ws.subprotocol = protocols[0]
+	}
+	ws.handshakeRequest = request
+	ws.handshakeResponse = resp
+	ws.checksum = containsFold(extensionNames(resp.Header), ChecksumExtension)
+	params, err := clientDeflate(resp.Header)
+	if err != nil {
+		return fail(err)
+	}
+	if params != nil {
+		ws.enableDeflate(*params)
+	}
+	ws.extensions, err = confirmExtensions(resp.Header, d.Extensions, ws.allowedRsv)
+	if err != nil {
+		return fail(err)
+	}
+	for _, ext := range ws.extensions {
+		ws.allowedRsv |= ext.Rsv()
+	}
+	return ws, nil
+}
@@ -0,0 +1,619 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawHandshakeServer 返回一个只接受一个连接的服务器地址，它读取握手请求之后原样写回 respond 返回的数据
+func rawHandshakeServer(t *testing.T, respond func(key string) string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, respond(request.Header.Get("Sec-WebSocket-Key")))
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	return listener.Addr().String()
+}
+
+func acceptKey(t *testing.T, key string) string {
+	t.Helper()
+	accept, err := getSecAcceptKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accept
+}
+
+func TestDialerLenientHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(accept string) string
+		dialer  Dialer
+		ok      bool
+	}{
+		{
+			name: "valid",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+			ok: true,
+		},
+		{
+			name: "missing upgrade headers",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+		},
+		{
+			name: "lenient headers",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: keep-alive\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+			dialer: Dialer{LenientHeaders: true},
+			ok:     true,
+		},
+		{
+			name: "wrong accept",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: wrong\r\n\r\n"
+			},
+		},
+		{
+			name: "skip accept check",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+			},
+			dialer: Dialer{SkipAcceptCheck: true},
+			ok:     true,
+		},
+		{
+			name: "connection token list",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: keep-alive, Upgrade\r\nUpgrade: WebSocket\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+			ok: true,
+		},
+		{
+			name: "connection token substring",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: not-upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+		},
+		{
+			// 服务器只能选择客户端提供的子协议和扩展
+			name: "unoffered subprotocol",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: chat\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+		},
+		{
+			name: "unoffered extension",
+			respond: func(accept string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Extensions: permessage-deflate\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"
+			},
+		},
+		{
+			name: "not switching",
+			respond: func(accept string) string {
+				return "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+			},
+			dialer: Dialer{LenientHeaders: true, SkipAcceptCheck: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			respond := test.respond
+			address := rawHandshakeServer(t, func(key string) string {
+				return respond(acceptKey(t, key))
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ws, err := test.dialer.Dial(ctx, "ws://"+address+"/ws")
+			if test.ok != (err == nil) {
+				t.Fatalf("Dial() error = %v, want success %v", err, test.ok)
+			}
+			if ws != nil {
+				_ = ws.Close()
+			}
+		})
+	}
+}
+
+func TestDialerKeepsFramesAfterHandshake(t *testing.T) {
+	address := rawHandshakeServer(t, func(key string) string {
+		// 紧跟在响应之后的帧会和响应一起被 bufio.Reader 读取
+		return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " +
+			acceptKey(t, key) + "\r\n\r\n" + "\x81\x02hi"
+	})
+	dialed := ""
+	dialer := &Dialer{NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := dialer.Dial(ctx, "ws://"+address+"/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if dialed != address {
+		t.Fatalf("NetDialContext dialed %q, want %q", dialed, address)
+	}
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(message); err != nil || string(data) != "hi" {
+		t.Fatalf("ReadMessage() = %q, %v, want hi", data, err)
+	}
+}
+
+func TestHandshakeInformation(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	servers := make(chan WebSocket, 1)
+	go func() {
+		upgrader := &Upgrader{Subprotocols: []string{"chat"}, EnableCompression: true}
+		ws, err := upgrader.UpgradeStream(a, a)
+		if err != nil {
+			close(servers)
+			return
+		}
+		servers <- ws
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{
+		Subprotocols:      []string{"chat"},
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return b, nil
+		},
+	}
+	client, err := dialer.Dial(ctx, "ws://example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-servers
+	if !ok {
+		t.Fatal("UpgradeStream() failed")
+	}
+
+	// 两端看到的是同一个握手请求和响应
+	for _, ws := range []WebSocket{client, server} {
+		request, response := ws.HandshakeRequest(), ws.HandshakeResponse()
+		if request == nil || response == nil {
+			t.Fatalf("HandshakeRequest() = %v, HandshakeResponse() = %v", request, response)
+		}
+		if key := request.Header.Get("Sec-WebSocket-Key"); key != client.HandshakeRequest().Header.Get("Sec-WebSocket-Key") {
+			t.Fatalf("Sec-WebSocket-Key = %q, want the key sent by the client", key)
+		}
+		if response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("HandshakeResponse().StatusCode = %d, want 101", response.StatusCode)
+		}
+		if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != acceptKey(t, request.Header.Get("Sec-WebSocket-Key")) {
+			t.Fatalf("Sec-WebSocket-Accept = %q", accept)
+		}
+		if protocol := response.Header.Get("Sec-WebSocket-Protocol"); protocol != "chat" {
+			t.Fatalf("Sec-WebSocket-Protocol = %q, want chat", protocol)
+		}
+		if extensions := ws.Extensions(); len(extensions) != 1 || extensions[0].Name != DeflateExtension {
+			t.Fatalf("Extensions() = %v, want %s", extensions, DeflateExtension)
+		}
+	}
+
+	// 没有握手的连接没有这些信息
+	ws := NewWebSocket(a, a, false)
+	if ws.HandshakeRequest() != nil || ws.HandshakeResponse() != nil || ws.Extensions() != nil {
+		t.Fatal("WebSocket created without a handshake has handshake information")
+	}
+}
+
+func TestDialerHeaderAndJar(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- request
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Accept: "+acceptKey(t, request.Header.Get("Sec-WebSocket-Key"))+"\r\n"+
+			"Set-Cookie: session=new\r\n\r\n")
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	jar.SetCookies(&url.URL{Scheme: "http", Host: address, Path: "/"}, []*http.Cookie{{Name: "token", Value: "old"}})
+	dialer := &Dialer{
+		Header: http.Header{"X-Dialer": {"dialer"}, "X-Request": {"dialer"}},
+		Jar:    jar,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequest(http.MethodGet, "ws://"+address+"/ws", nil)
+	request.Header.Set("X-Request", "request")
+	ws, err := dialer.Connect(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	received := <-requests
+	// Dialer.Header 不会覆盖请求中已经存在的头
+	if received.Header.Get("X-Dialer") != "dialer" || received.Header.Get("X-Request") != "request" {
+		t.Fatalf("request header = %v, want X-Dialer from the Dialer and X-Request from the request", received.Header)
+	}
+	if cookie, err := received.Cookie("token"); err != nil || cookie.Value != "old" {
+		t.Fatalf("request cookie token = %v, %v, want old", cookie, err)
+	}
+	// 101 响应中的 Set-Cookie 保存到 Jar 中，使用 http 的 URL 保存
+	cookies := jar.Cookies(&url.URL{Scheme: "http", Host: address, Path: "/ws"})
+	found := false
+	for _, cookie := range cookies {
+		found = found || cookie.Name == "session" && cookie.Value == "new"
+	}
+	if !found {
+		t.Fatalf("jar cookies = %v, want session=new", cookies)
+	}
+}
+
+func TestDialerHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// 接受连接但是不响应握手
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	// HandshakeTimeout 覆盖 Timeouts 中的 Handshake
+	dialer := &Dialer{HandshakeTimeout: 50 * time.Millisecond, Timeouts: &Timeouts{Handshake: time.Minute}}
+	start := time.Now()
+	if ws, err := dialer.Dial(context.Background(), "ws://"+listener.Addr().String()+"/ws"); err == nil {
+		t.Fatalf("Dial() = %v, want a timeout error", ws)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Dial() returned after %v", elapsed)
+	}
+}
+
+func TestDialerBufferSizes(t *testing.T) {
+	address := rawHandshakeServer(t, func(key string) string {
+		return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " +
+			acceptKey(t, key) + "\r\n\r\n" + "\x81\x02hi"
+	})
+	dialer := &Dialer{ReadBufferSize: 8192, WriteBufferSize: 4096}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := dialer.Dial(ctx, "ws://"+address+"/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if size := ws.(*webSocket).writeBuffer.Size(); size != 4096 {
+		t.Fatalf("write buffer size = %d, want 4096", size)
+	}
+	// 使用读取缓冲区的时候，紧跟在响应之后的帧也不会丢失
+	if data := readText(t, ws); data != "hi" {
+		t.Fatalf("ReadMessage() = %q, want hi", data)
+	}
+	if err = ws.Send(strings.Repeat("a", 10000)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialResponse(t *testing.T) {
+	body := `{"error":"invalid token"}`
+	tests := []struct {
+		name    string
+		respond func(key string) string
+		status  int
+		body    string
+		ok      bool
+	}{
+		{
+			name: "switching protocols",
+			respond: func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + acceptKey(t, key) + "\r\n\r\n"
+			},
+			status: http.StatusSwitchingProtocols,
+			ok:     true,
+		},
+		// 响应内容在连接关闭之后仍然可以读取
+		{
+			name: "unauthorized",
+			respond: func(key string) string {
+				return "HTTP/1.1 401 Unauthorized\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+			},
+			status: http.StatusUnauthorized,
+			body:   body,
+		},
+		{
+			name: "body limit",
+			respond: func(key string) string {
+				return "HTTP/1.1 429 Too Many Requests\r\nContent-Length: 20000\r\n\r\n" + strings.Repeat("a", 20000)
+			},
+			status: http.StatusTooManyRequests,
+			body:   strings.Repeat("a", maxErrorBodySize),
+		},
+		{
+			name: "wrong accept key",
+			respond: func(key string) string {
+				return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: wrong\r\n\r\n"
+			},
+			status: http.StatusSwitchingProtocols,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := rawHandshakeServer(t, test.respond)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ws, resp, err := (&Dialer{}).DialResponse(ctx, "ws://"+address+"/")
+			if resp == nil || resp.StatusCode != test.status {
+				t.Fatalf("DialResponse() response = %v, want status %d", resp, test.status)
+			}
+			if test.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ws.Close()
+				if ws.HandshakeResponse() != resp {
+					t.Fatal("DialResponse() returned a different response than HandshakeResponse()")
+				}
+				return
+			}
+			var responseErr *ResponseError
+			if ws != nil || !errors.As(err, &responseErr) || responseErr.Response != resp {
+				t.Fatalf("DialResponse() = %v, %v, want a *ResponseError", ws, err)
+			}
+			if data, err := io.ReadAll(resp.Body); err != nil || string(data) != test.body {
+				t.Fatalf("response body = %d bytes, %v, want %d bytes", len(data), err, len(test.body))
+			}
+		})
+	}
+}
+
+func TestDialResponseWithoutResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// 没有收到响应的时候响应是 nil
+	ws, resp, err := (&Dialer{}).DialResponse(ctx, "ws://"+address+"/")
+	if ws != nil || resp != nil || err == nil {
+		t.Fatalf("DialResponse() = %v, %v, %v, want an error without a response", ws, resp, err)
+	}
+}
+
+func TestDialResponseTooManyRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/next", http.StatusFound)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, resp, err := (&Dialer{MaxRedirects: 2}).DialResponse(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/")
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("DialResponse() error = %v, want %v", err, ErrTooManyRedirects)
+	}
+	if resp == nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("DialResponse() response = %v, want the last redirect", resp)
+	}
+}
+
+func TestCookieURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "ws://example.com/chat", want: "http://example.com/chat"},
+		{url: "wss://example.com/chat", want: "https://example.com/chat"},
+		{url: "https://example.com/chat", want: "https://example.com/chat"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cookieURL(u).String(); got != test.want {
+			t.Errorf("cookieURL(%s) = %s, want %s", test.url, got, test.want)
+		}
+		if u.String() != test.url {
+			t.Errorf("cookieURL modified %s", test.url)
+		}
+	}
+}
+
+func TestDialerJar(t *testing.T) {
+	cookies := make(chan []*http.Cookie, 1)
+	mux := http.NewServeMux()
+	// 被拒绝的握手和重定向响应中的 Set-Cookie 也会保存到 Jar 中
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Path: "/"})
+		http.Error(w, "login first", http.StatusForbidden)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "hop", Value: "2", Path: "/"})
+		http.Redirect(w, r, "/ws", http.StatusFound)
+	})
+	mux.Handle("/ws", (&Upgrader{}).Handler(func(ws WebSocket) {
+		cookies <- ws.HandshakeRequest().Cookies()
+	}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{Jar: jar, MaxRedirects: 1}
+	if _, err = dialer.Dial(ctx, base+"/login"); dialStatus(err) != http.StatusForbidden {
+		t.Fatalf("Dial(/login) error = %v, want a 403", err)
+	}
+	ws, err := dialer.Dial(ctx, base+"/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	got := map[string]string{}
+	for _, cookie := range <-cookies {
+		got[cookie.Name] = cookie.Value
+	}
+	if len(got) != 2 || got["session"] != "1" || got["hop"] != "2" {
+		t.Fatalf("handshake cookies = %v, want session=1 and hop=2", got)
+	}
+
+	// 请求中自己设置的同名 Cookie 优先，Jar 中的其他 Cookie 仍然会加入
+	request, err := http.NewRequest(http.MethodGet, base+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.AddCookie(&http.Cookie{Name: "session", Value: "explicit"})
+	ws, err = dialer.Connect(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	var sessions []string
+	got = map[string]string{}
+	for _, cookie := range <-cookies {
+		got[cookie.Name] = cookie.Value
+		if cookie.Name == "session" {
+			sessions = append(sessions, cookie.Value)
+		}
+	}
+	if len(sessions) != 1 || sessions[0] != "explicit" || got["hop"] != "2" {
+		t.Fatalf("handshake cookies = %v, want the explicit session and hop=2", got)
+	}
+}
+
+func TestDialerJarSavesHandshakeCookies(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		request, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		accept, _ := getSecAcceptKey(request.Header.Get("Sec-Websocket-Key"))
+		_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-Websocket-Accept: "+accept+"\r\nSet-Cookie: token=abc; Path=/; Secure\r\n\r\n")
+	}()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := http.NewRequest(http.MethodGet, "wss://example.com/ws", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, _, err = (&Dialer{Jar: jar}).NewClientConn(ctx, client, request); err != nil {
+		t.Fatal(err)
+	}
+	// wss 按照 https 保存，Secure 的 Cookie 只会发送给 wss
+	secure, _ := url.Parse("https://example.com/ws")
+	plain, _ := url.Parse("http://example.com/ws")
+	if cookies := jar.Cookies(secure); len(cookies) != 1 || cookies[0].Value != "abc" {
+		t.Fatalf("jar cookies for wss = %v, want token=abc", cookies)
+	}
+	if cookies := jar.Cookies(plain); len(cookies) != 0 {
+		t.Fatalf("jar cookies for ws = %v, want none", cookies)
+	}
+}
+
+func TestNewClientConnKeepsCallerRequest(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "ws://example.com/ws", nil)
+	request.Header.Set("X-Caller", "yes")
+	dialer := &Dialer{Header: http.Header{"X-Dialer": {"yes"}}, Subprotocols: []string{"chat"}}
+	// 同一个 request 使用两次，第二次握手的请求头和第一次一样
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		headers := make(chan http.Header, 1)
+		go func() {
+			defer server.Close()
+			request, err := http.ReadRequest(bufio.NewReader(server))
+			if err != nil {
+				return
+			}
+			headers <- request.Header
+			accept, _ := getSecAcceptKey(request.Header.Get("Sec-Websocket-Key"))
+			_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-Websocket-Accept: "+accept+"\r\nSec-Websocket-Protocol: chat\r\n\r\n")
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		ws, _, err := dialer.NewClientConn(ctx, client, request)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = ws.Close()
+		header := <-headers
+		for _, key := range []string{"Sec-Websocket-Key", "X-Dialer", "X-Caller", "Sec-Websocket-Protocol"} {
+			if len(header.Values(key)) != 1 {
+				t.Fatalf("handshake %d sent %s %v, want exactly one value", i, key, header.Values(key))
+			}
+		}
+	}
+	if len(request.Header) != 1 || request.Header.Get("X-Caller") != "yes" {
+		t.Fatalf("caller request header = %v, want only X-Caller", request.Header)
+	}
+}
@@ -0,0 +1,116 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// EventHandlers 是 Serve 使用的回调，为空的回调会被忽略。
+// 回调都在 Serve 的读取 goroutine 中按收到的顺序调用，回调返回之前不会读取下一个 Message。
+type EventHandlers struct {
+	// OnText 在收到 TextFrame 的时候被调用
+	OnText func(text string)
+
+	// OnBinary 在收到 BinaryFrame 的时候被调用
+	OnBinary func(data []byte)
+
+	// OnPing 在收到 Ping 的时候被调用，Pong 仍然会按照 PingPolicy 自动回复
+	OnPing func(payload []byte)
+
+	// OnClose 在连接关闭之后被调用一次，底层的流出错时 code 是 CloseAbnormalClosure
+	OnClose func(code uint16, reason string)
+
+	// OnError 在读取因为正常关闭以外的原因结束的时候被调用，ctx 结束不会调用 OnError
+	OnError func(err error)
+}
+
+// Serve 在一个后台 goroutine 中循环读取 Message，并把它们交给 handler 对应的回调，直到连接关闭或者 ctx 结束。
+// ctx 结束的时候会使用 CloseGoingAway 关闭连接，最多等待 Timeouts 的 Close 让读取结束，然后返回 ctx.Err()；
+// 等待超时的时候读取的 goroutine 可能在 Serve 返回之后才结束。
+// 连接被任意一方使用 CloseNormalClosure、CloseGoingAway 或者不带状态码的 ConnectionClose 关闭时返回 nil，
+// 其他情况返回读取的错误，这时连接也会被关闭。
+//
+// handler.OnPing 不为空时，Serve 会通过 SetPingHandler 设置自己的 Ping 回调。
+func (w *webSocket) Serve(ctx context.Context, handler EventHandlers) error {
+	if handler.OnPing != nil {
+		w.SetPingHandler(func(payload []byte) error {
+			handler.OnPing(payload)
+			if !w.autoPong() {
+				return nil
+			}
+			return w.replyPong(payload)
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.dispatch(handler)
+	}()
+
+	var err, readErr error
+	select {
+	case readErr = <-done:
+		err = readErr
+	case <-ctx.Done():
+		_ = w.CloseWithCode(CloseGoingAway, "")
+		w.waitDispatch(done)
+		err = ctx.Err()
+	}
+	if w.state() == OPEN {
+		_ = w.Close()
+	}
+
+	code, reason := CloseAbnormalClosure, ""
+	if info := w.CloseReason(); info != nil {
+		code, reason = info.Code, info.Reason
+	}
+	if handler.OnClose != nil {
+		handler.OnClose(code, reason)
+	}
+	if readErr != nil && handler.OnError != nil {
+		handler.OnError(readErr)
+	}
+	return err
+}
+
+// waitDispatch 等待 dispatch 返回，最多等待 Timeouts 的 Close。
+// 关闭连接之后读取仍然没有结束的时候（例如 CloseWriterOnly 或者 Close 不会打断 Read 的输入流），
+// 超时之后直接关闭流，不再等待读取的 goroutine。
+func (w *webSocket) waitDispatch(done <-chan error) {
+	timeout := w.getTimeouts().Close
+	if timeout <= 0 {
+		<-done
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		_ = w.closeStreams()
+	}
+}
+
+// dispatch 读取 Message 并调用对应的回调，返回 nil 表示连接是正常关闭的
+func (w *webSocket) dispatch(handler EventHandlers) error {
+	for {
+		opCode, data, err := w.ReadAllMessage()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && !IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway, CloseNoStatusReceived) {
+				return nil
+			}
+			return err
+		}
+		switch {
+		case opCode == TextFrame && handler.OnText != nil:
+			handler.OnText(string(data))
+		case opCode == BinaryFrame && handler.OnBinary != nil:
+			handler.OnBinary(data)
+		case opCode == Ping && handler.OnPing != nil:
+			// 关闭了自动回复的时候，Ping 可能在 Serve 设置回调之前就已经被放入了队列
+			handler.OnPing(data)
+		}
+	}
+}
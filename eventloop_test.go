@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServeEventHandlers(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   uint16
+		events []string
+		err    bool
+	}{
+		{name: "normal closure", code: CloseNormalClosure, events: []string{"text hi", "binary 0102", "ping p", "close 1000 done"}},
+		{name: "unexpected closure", code: 4000, events: []string{"text hi", "binary 0102", "ping p", "close 4000 done", "error"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var input []byte
+			input = append(input, maskedFrame(TextFrame, []byte("hi"))...)
+			input = append(input, maskedFrame(BinaryFrame, []byte{1, 2})...)
+			input = append(input, maskedFrame(Ping, []byte("p"))...)
+			input = append(input, maskedFrame(ConnectionClose, closePayload(test.code, "done"))...)
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+			var events []string
+			err := ws.Serve(context.Background(), EventHandlers{
+				OnText:   func(text string) { events = append(events, "text "+text) },
+				OnBinary: func(data []byte) { events = append(events, fmt.Sprintf("binary %x", data)) },
+				OnPing:   func(payload []byte) { events = append(events, "ping "+string(payload)) },
+				OnClose: func(code uint16, reason string) {
+					events = append(events, fmt.Sprintf("close %d %s", code, reason))
+				},
+				OnError: func(err error) { events = append(events, "error") },
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("Serve() error = %v, want error %v", err, test.err)
+			}
+			if !reflect.DeepEqual(events, test.events) {
+				t.Fatalf("events = %q, want %q", events, test.events)
+			}
+			// 设置了 OnPing 之后仍然自动回复 Pong
+			frames := decodeFrames(t, output.Bytes())
+			if len(frames) == 0 || frames[0].OpCode != Pong || string(frames[0].Payload) != "p" {
+				t.Fatalf("sent frames %+v, want a pong first", frames)
+			}
+		})
+	}
+}
+
+// blockingReader 的 Read 一直阻塞到 release 被关闭，Close 不会打断 Read
+type blockingReader struct {
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	select {
+	case r.reading <- struct{}{}:
+	default:
+	}
+	<-r.release
+	return 0, io.EOF
+}
+
+func (r *blockingReader) Close() error {
+	return nil
+}
+
+func TestServeContextCloseTimeout(t *testing.T) {
+	reader := &blockingReader{reading: make(chan struct{}, 1), release: make(chan struct{})}
+	t.Cleanup(func() {
+		close(reader.release)
+	})
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, reader, false)
+	ws.SetTimeouts(Timeouts{Close: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan uint16, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ws.Serve(ctx, EventHandlers{OnClose: func(code uint16, reason string) {
+			closed <- code
+		}})
+	}()
+	// 读取已经阻塞之后才结束 ctx
+	<-reader.reading
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Serve() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() did not return after the close timeout")
+	}
+	if code := <-closed; code != CloseGoingAway {
+		t.Fatalf("OnClose() code = %d, want %d", code, CloseGoingAway)
+	}
+	if code := sentCloseCode(t, output.Bytes()); code != CloseGoingAway {
+		t.Fatalf("sent close code %d, want %d", code, CloseGoingAway)
+	}
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ExtensionParams 是 Sec-WebSocket-Extensions 中一个扩展的参数，没有值的参数对应空字符串
+type ExtensionParams map[string]string
+
+// Extension 是一个可以在握手时协商的自定义扩展。
+// 客户端在 Dialer.Extensions 中设置，服务端在 Upgrader.Extensions 中设置或者使用 RegisterExtension 注册。
+type Extension interface {
+	// Name 返回扩展名，也就是 Sec-WebSocket-Extensions 中每一项的第一个 token
+	Name() string
+
+	// Offer 返回客户端请求这个扩展时发送的参数
+	Offer() ExtensionParams
+
+	// Accept 在服务端收到客户端请求的参数时调用，返回 true 表示同意，同时返回响应的参数和这个连接使用的扩展
+	Accept(offer ExtensionParams) (ExtensionParams, NegotiatedExtension, bool)
+
+	// Confirm 在客户端收到服务端响应的参数时调用，返回这个连接使用的扩展，返回错误会让握手失败
+	Confirm(response ExtensionParams) (NegotiatedExtension, error)
+}
+
+// NegotiatedExtension 是协商成功之后，一个连接中的扩展实例，可以在多个 Message 之间保存状态。
+// 发送的时候，数据按照协商的顺序依次经过每个扩展的 WrapWriter；接收的时候按照相反的顺序经过 WrapReader。
+// 控制帧不会经过扩展。
+type NegotiatedExtension interface {
+	// Rsv 返回这个扩展会使用的保留标志位，Rsv1 是 0b100，Rsv2 是 0b010，Rsv3 是 0b001
+	Rsv() byte
+
+	// WrapWriter 包装一个要发送的数据 Message 的输出，返回的 io.WriteCloser 会在数据写完之后被关闭，
+	// 返回的 rsv 会被设置在这个 Message 的第一个帧上。返回 nil 表示这个 Message 不需要处理。
+	WrapWriter(opCode OpCode, writer io.Writer) (wrapped io.WriteCloser, rsv byte)
+
+	// WrapReader 包装一个收到的数据 Message 的输入，rsv 是这个 Message 第一个帧的保留标志位。
+	// 返回的 io.Reader 返回 *CloseError 的时候，连接会使用里面的状态码关闭。
+	WrapReader(opCode OpCode, rsv byte, reader io.Reader) io.Reader
+}
+
+var ErrExtensionRegistered = errors.New("extension with the same name is already registered")
+
+var (
+	extensionsLock = &sync.Mutex{}
+	extensions     = map[string]Extension{}
+)
+
+// RegisterExtension 注册一个扩展，没有设置 Extensions 的 Upgrader 会同意客户端请求的已注册扩展。
+// 扩展名不区分大小写，不能和已经注册的扩展或者内置的扩展重复。
+func RegisterExtension(ext Extension) error {
+	name := strings.ToLower(ext.Name())
+	if name == DeflateExtension || name == ChecksumExtension {
+		return ErrExtensionRegistered
+	}
+	extensionsLock.Lock()
+	defer extensionsLock.Unlock()
+	if _, ok := extensions[name]; ok {
+		return ErrExtensionRegistered
+	}
+	extensions[name] = ext
+	return nil
+}
+
+// registeredExtensions 按照扩展名的顺序返回所有注册的扩展
+func registeredExtensions() []Extension {
+	extensionsLock.Lock()
+	defer extensionsLock.Unlock()
+	list := make([]Extension, 0, len(extensions))
+	for _, ext := range extensions {
+		list = append(list, ext)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name()) < strings.ToLower(list[j].Name())
+	})
+	return list
+}
+
+// offerExtensions 把客户端请求的扩展加入到请求头中，已经存在的扩展不会重复加入
+func offerExtensions(header http.Header, exts []Extension) {
+	for _, ext := range exts {
+		if containsFold(extensionNames(header), ext.Name()) {
+			continue
+		}
+		header.Add("sec-websocket-extensions", ExtensionOffer{Name: ext.Name(), Params: ext.Offer()}.String())
+	}
+}
+
+// confirmExtensions 按照服务端响应的顺序，确认服务端同意的扩展
+func confirmExtensions(header http.Header, exts []Extension, usedRsv byte) ([]NegotiatedExtension, error) {
+	var negotiated []NegotiatedExtension
+	for _, e := range ParseExtensions(header) {
+		for _, ext := range exts {
+			if !strings.EqualFold(e.Name, ext.Name()) {
+				continue
+			}
+			n, err := ext.Confirm(e.Params)
+			if err != nil {
+				return nil, err
+			}
+			if n.Rsv()&usedRsv != 0 {
+				return nil, errors.New("extension " + ext.Name() + " uses reserved bits of another extension")
+			}
+			usedRsv |= n.Rsv()
+			negotiated = append(negotiated, n)
+			break
+		}
+	}
+	return negotiated, nil
+}
+
+// acceptExtensions 按照客户端请求的顺序，选择服务端同意的扩展，返回响应头中的每一项和协商出来的扩展。
+// 同一个扩展只会同意第一个可以接受的请求，和已经使用的保留标志位冲突的扩展会被忽略。
+func acceptExtensions(header http.Header, exts []Extension, usedRsv byte) ([]string, []NegotiatedExtension) {
+	var responses []string
+	var negotiated []NegotiatedExtension
+	accepted := map[string]bool{}
+	for _, e := range ParseExtensions(header) {
+		if accepted[e.Name] || e.Duplicate {
+			continue
+		}
+		for _, ext := range exts {
+			if !strings.EqualFold(e.Name, ext.Name()) {
+				continue
+			}
+			params, n, ok := ext.Accept(e.Params)
+			if !ok || n.Rsv()&usedRsv != 0 {
+				break
+			}
+			usedRsv |= n.Rsv()
+			accepted[e.Name] = true
+			responses = append(responses, ExtensionOffer{Name: ext.Name(), Params: params}.String())
+			negotiated = append(negotiated, n)
+			break
+		}
+	}
+	return responses, negotiated
+}
+
+// wrapOutgoing 让要发送的数据 Message 依次经过协商的扩展，返回处理之后的数据和第一个帧的保留标志位
+func (w *webSocket) wrapOutgoing(opCode OpCode, reader io.Reader) (io.Reader, byte) {
+	var rsv byte
+	for _, ext := range w.extensions {
+		r := &extensionWriterReader{
+			reader: reader,
+			output: &bytes.Buffer{},
+			buf:    make([]byte, 2048),
+		}
+		writer, bits := ext.WrapWriter(opCode, r.output)
+		if writer == nil {
+			continue
+		}
+		r.writer = writer
+		reader = r
+		rsv |= bits
+	}
+	return reader, rsv
+}
+
+// wrapIncoming 让收到的数据 Message 按照相反的顺序经过协商的扩展
+func (w *webSocket) wrapIncoming(opCode OpCode, rsv byte, reader io.Reader) io.Reader {
+	for i := len(w.extensions) - 1; i >= 0; i-- {
+		reader = w.extensions[i].WrapReader(opCode, rsv, reader)
+	}
+	if len(w.extensions) < 1 {
+		return reader
+	}
+	return rwFunc(func(p []byte) (int, error) {
+		n, err := reader.Read(p)
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			_ = w.fail(closeErr.Code, closeErr.Reason)
+		}
+		return n, err
+	})
+}
+
+// extensionWriterReader 把 reader 的数据写入扩展的 io.WriteCloser，再从扩展的输出中读取
+type extensionWriterReader struct {
+	reader io.Reader
+	writer io.WriteCloser
+	output *bytes.Buffer
+	buf    []byte
+	done   bool
+}
+
+func (r *extensionWriterReader) Read(p []byte) (int, error) {
+	for !r.done && r.output.Len() < 1 {
+		n, err := r.reader.Read(r.buf)
+		if n > 0 {
+			_, writeErr := r.writer.Write(r.buf[:n])
+			if writeErr != nil {
+				return 0, writeErr
+			}
+		}
+		if err == io.EOF {
+			r.done = true
+			err = r.writer.Close()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.output.Len() < 1 {
+		return 0, io.EOF
+	}
+	return r.output.Read(p)
+}
@@ -0,0 +1,280 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// xorExtension 是测试用的扩展，使用 Rsv2 标记用 key 异或过的数据 Message
+type xorExtension struct {
+	name string
+	key  byte
+	rsv  byte
+}
+
+func (e xorExtension) Name() string {
+	return e.name
+}
+
+func (e xorExtension) Offer() ExtensionParams {
+	return ExtensionParams{"key": strconv.Itoa(int(e.key))}
+}
+
+func (e xorExtension) Accept(offer ExtensionParams) (ExtensionParams, NegotiatedExtension, bool) {
+	key, err := strconv.Atoi(offer["key"])
+	if err != nil || key < 1 || key > 255 {
+		return nil, nil, false
+	}
+	return offer, &xorNegotiated{key: byte(key), rsv: e.rsv}, true
+}
+
+func (e xorExtension) Confirm(response ExtensionParams) (NegotiatedExtension, error) {
+	key, err := strconv.Atoi(response["key"])
+	if err != nil || byte(key) != e.key {
+		return nil, errors.New("unexpected key " + response["key"])
+	}
+	return &xorNegotiated{key: e.key, rsv: e.rsv}, nil
+}
+
+type xorNegotiated struct {
+	key byte
+	rsv byte
+}
+
+func (n *xorNegotiated) Rsv() byte {
+	return n.rsv
+}
+
+func (n *xorNegotiated) WrapWriter(opCode OpCode, writer io.Writer) (io.WriteCloser, byte) {
+	return discardCloser{rwFunc(func(p []byte) (int, error) {
+		return writer.Write(xorBytes(p, n.key))
+	})}, n.rsv
+}
+
+func (n *xorNegotiated) WrapReader(opCode OpCode, rsv byte, reader io.Reader) io.Reader {
+	if rsv&n.rsv == 0 {
+		return reader
+	}
+	return rwFunc(func(p []byte) (int, error) {
+		count, err := reader.Read(p)
+		copy(p, xorBytes(p[:count], n.key))
+		return count, err
+	})
+}
+
+func xorBytes(p []byte, key byte) []byte {
+	out := make([]byte, len(p))
+	for i, b := range p {
+		out[i] = b ^ key
+	}
+	return out
+}
+
+// rejectingNegotiated 在读取数据 Message 的时候返回 *CloseError
+type rejectingNegotiated struct{}
+
+func (rejectingNegotiated) Rsv() byte {
+	return 0b010
+}
+
+func (rejectingNegotiated) WrapWriter(opCode OpCode, writer io.Writer) (io.WriteCloser, byte) {
+	return nil, 0
+}
+
+func (rejectingNegotiated) WrapReader(opCode OpCode, rsv byte, reader io.Reader) io.Reader {
+	return rwFunc(func(p []byte) (int, error) {
+		return 0, &CloseError{Code: CloseInvalidFramePayloadData, Reason: "bad payload"}
+	})
+}
+
+func TestRegisterExtension(t *testing.T) {
+	if err := RegisterExtension(xorExtension{name: "x-test-registered", key: 1, rsv: 0b010}); err != nil {
+		t.Fatalf("RegisterExtension() error = %v", err)
+	}
+	// 扩展名不区分大小写，也不能覆盖内置的扩展
+	for _, name := range []string{"X-Test-Registered", DeflateExtension, ChecksumExtension} {
+		if err := RegisterExtension(xorExtension{name: name}); err != ErrExtensionRegistered {
+			t.Fatalf("RegisterExtension(%q) error = %v, want %v", name, err, ErrExtensionRegistered)
+		}
+	}
+	found := false
+	for _, ext := range registeredExtensions() {
+		found = found || ext.Name() == "x-test-registered"
+	}
+	if !found {
+		t.Fatal("registeredExtensions() does not contain the registered extension")
+	}
+}
+
+func TestAcceptExtensions(t *testing.T) {
+	tests := []struct {
+		name      string
+		offers    []string
+		exts      []Extension
+		usedRsv   byte
+		responses []string
+	}{
+		{
+			name:      "accepted",
+			offers:    []string{"x-xor; key=7"},
+			exts:      []Extension{xorExtension{name: "x-xor", rsv: 0b010}},
+			responses: []string{"x-xor; key=7"},
+		},
+		// 同一个扩展只同意第一个可以接受的请求
+		{
+			name:      "first acceptable offer",
+			offers:    []string{"x-xor; key=bad, x-xor; key=5", "x-xor; key=6"},
+			exts:      []Extension{xorExtension{name: "x-xor", rsv: 0b010}},
+			responses: []string{"x-xor; key=5"},
+		},
+		{
+			name:   "unknown extension",
+			offers: []string{"x-other; key=7"},
+			exts:   []Extension{xorExtension{name: "x-xor", rsv: 0b010}},
+		},
+		// 和 permessage-deflate 使用的 Rsv1 冲突
+		{
+			name:    "rsv used by deflate",
+			offers:  []string{"x-xor; key=7"},
+			exts:    []Extension{xorExtension{name: "x-xor", rsv: 0b100}},
+			usedRsv: 0b100,
+		},
+		{
+			name:   "rsv used by another extension",
+			offers: []string{"x-a; key=1, x-b; key=2"},
+			exts: []Extension{
+				xorExtension{name: "x-a", rsv: 0b001},
+				xorExtension{name: "x-b", rsv: 0b001},
+			},
+			responses: []string{"x-a; key=1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{"Sec-Websocket-Extensions": test.offers}
+			responses, negotiated := acceptExtensions(header, test.exts, test.usedRsv)
+			if !reflect.DeepEqual(responses, test.responses) {
+				t.Fatalf("acceptExtensions() responses = %q, want %q", responses, test.responses)
+			}
+			if len(negotiated) != len(test.responses) {
+				t.Fatalf("acceptExtensions() negotiated %d extensions, want %d", len(negotiated), len(test.responses))
+			}
+		})
+	}
+}
+
+func TestConfirmExtensions(t *testing.T) {
+	exts := []Extension{xorExtension{name: "x-xor", key: 7, rsv: 0b010}}
+	header := http.Header{"Sec-Websocket-Extensions": {"x-xor; key=7"}}
+	negotiated, err := confirmExtensions(header, exts, 0)
+	if err != nil || len(negotiated) != 1 {
+		t.Fatalf("confirmExtensions() = %v, %v, want 1 extension", negotiated, err)
+	}
+	// Confirm 返回的错误让握手失败
+	header = http.Header{"Sec-Websocket-Extensions": {"x-xor; key=8"}}
+	if _, err = confirmExtensions(header, exts, 0); err == nil {
+		t.Fatal("confirmExtensions() with a wrong key succeeded")
+	}
+	header = http.Header{"Sec-Websocket-Extensions": {"x-xor; key=7"}}
+	if _, err = confirmExtensions(header, exts, 0b010); err == nil {
+		t.Fatal("confirmExtensions() with conflicting reserved bits succeeded")
+	}
+}
+
+func TestExtensionWrapsDataMessages(t *testing.T) {
+	output := &bytes.Buffer{}
+	payload := xorBytes([]byte("hello"), 7)
+	input := append([]byte{0x81 | 0x20, byte(len(payload))}, payload...)
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false).(*webSocket)
+	ws.extensions = []NegotiatedExtension{&xorNegotiated{key: 7, rsv: 0b010}}
+	ws.allowedRsv = 0b010
+
+	if data := readText(t, ws); data != "hello" {
+		t.Fatalf("ReadMessage() = %q, want hello", data)
+	}
+	if err := ws.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	frame := &Frame{}
+	if err := frame.Decode(context.Background(), bytes.NewReader(output.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(frame.Payload)
+	if !frame.Rsv2 || !bytes.Equal(data, payload) {
+		t.Fatalf("sent frame Rsv2 = %v, payload = % x, want true, % x", frame.Rsv2, data, payload)
+	}
+}
+
+func TestExtensionCloseError(t *testing.T) {
+	output := &bytes.Buffer{}
+	input := []byte{0x81 | 0x20, 2, 'h', 'i'}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false).(*webSocket)
+	ws.extensions = []NegotiatedExtension{rejectingNegotiated{}}
+	ws.allowedRsv = 0b010
+
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var closeErr *CloseError
+	if _, err = io.ReadAll(message); !errors.As(err, &closeErr) {
+		t.Fatalf("ReadAll() error = %v, want a CloseError", err)
+	}
+	// 扩展返回的状态码会被发送给对方
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 1 || frames[0].OpCode != ConnectionClose {
+		t.Fatalf("sent frames = %v, want a single close frame", frames)
+	}
+	if code := uint16(frames[0].Payload[0])<<8 | uint16(frames[0].Payload[1]); code != CloseInvalidFramePayloadData {
+		t.Fatalf("close code = %d, want %d", code, CloseInvalidFramePayloadData)
+	}
+}
+
+func TestExtensionHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		upgrader := &Upgrader{Extensions: []Extension{xorExtension{name: "x-xor", rsv: 0b010}}}
+		ws, err := upgrader.UpgradeStream(a, a)
+		if err != nil {
+			return
+		}
+		message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(message)
+		_ = ws.Send(string(data))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{
+		Extensions: []Extension{xorExtension{name: "x-xor", key: 9, rsv: 0b010}},
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return b, nil
+		},
+	}
+	ws, err := dialer.Dial(ctx, "ws://example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(ws.(*webSocket).extensions); n != 1 {
+		t.Fatalf("negotiated %d extensions, want 1", n)
+	}
+	if err = ws.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if data := readText(t, ws); data != "hello" {
+		t.Fatalf("ReadMessage() = %q, want hello", data)
+	}
+}
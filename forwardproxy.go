@@ -0,0 +1,211 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ForwardProxy 是一个 HTTP 正向代理，实现了 http.Handler 接口。
+// 它可以处理 CONNECT 隧道请求，以及 absolute-form（例如 GET http://example.com/ws）的 WebSocket 升级请求；
+// 对于后者，会分别与客户端和目标服务器建立 WebSocket 连接，然后逐个 Message 地进行转发。
+// 适合用于搭建出口网关。
+//
+// 使用例子：
+//
+//	proxy := &websocket.ForwardProxy{
+//		Authenticate: func(request *http.Request) bool {
+//			return request.Header.Get("proxy-authorization") == "Basic dXNlcjpwYXNz"
+//		},
+//		Logf: log.Printf,
+//	}
+//	http.ListenAndServe("0.0.0.0:8080", proxy)
+type ForwardProxy struct {
+	// Authenticate 用于校验客户端的请求，返回 false 会响应 407 Proxy Authentication Required。
+	// 为空时不做校验。
+	Authenticate func(request *http.Request) bool
+
+	// Logf 用于输出代理的日志，为空时不输出。
+	Logf func(format string, v ...any)
+
+	// Dialer 用于连接目标服务器，为空时使用默认的拨号方式（支持 ALL_PROXY 环境变量）。
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (p *ForwardProxy) logf(format string, v ...any) {
+	if p.Logf != nil {
+		p.Logf(format, v...)
+	}
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if p.Authenticate != nil && !p.Authenticate(request) {
+		p.logf("proxy: %s %s from %s: authentication failed", request.Method, request.Host, request.RemoteAddr)
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if request.Method == http.MethodConnect {
+		p.tunnel(w, request)
+		return
+	}
+	if !request.URL.IsAbs() {
+		http.Error(w, "request target must be in absolute-form", http.StatusBadRequest)
+		return
+	}
+	if !headerContainsToken(request.Header, "connection", "upgrade") ||
+		!headerContainsToken(request.Header, "upgrade", "websocket") {
+		http.Error(w, "only WebSocket upgrade requests are supported", http.StatusNotImplemented)
+		return
+	}
+	p.relay(w, request)
+}
+
+func (p *ForwardProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if p.Dialer != nil {
+		return p.Dialer(ctx, network, address)
+	}
+	return tcpDialer(ctx, network, address)
+}
+
+// tunnel 处理 CONNECT 请求，建立一条透明的 TCP 隧道
+func (p *ForwardProxy) tunnel(w http.ResponseWriter, request *http.Request) {
+	target, err := p.dial(request.Context(), "tcp", request.Host)
+	if err != nil {
+		p.logf("proxy: CONNECT %s from %s: %v", request.Host, request.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijack, ok := w.(http.Hijacker)
+	if !ok {
+		_ = target.Close()
+		http.Error(w, ErrHijackResponseWriterFailed.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijack.Hijack()
+	if err != nil {
+		_ = target.Close()
+		p.logf("proxy: CONNECT %s from %s: %v", request.Host, request.RemoteAddr, err)
+		return
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		_ = target.Close()
+		_ = conn.Close()
+		return
+	}
+	p.logf("proxy: CONNECT %s from %s: tunnel established", request.Host, request.RemoteAddr)
+	pipe(target, conn, buf.Reader)
+	p.logf("proxy: CONNECT %s from %s: tunnel closed", request.Host, request.RemoteAddr)
+}
+
+// pipe 在两条连接之间双向复制数据，直到任意一方结束
+func pipe(target net.Conn, client net.Conn, clientReader *bufio.Reader) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, clientReader)
+		_ = target.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, target)
+		_ = client.Close()
+	}()
+	wg.Wait()
+}
+
+// hopHeaders 是不会转发给目标服务器的请求头
+var hopHeaders = []string{
+	"connection",
+	"upgrade",
+	"proxy-connection",
+	"proxy-authorization",
+	"keep-alive",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"sec-websocket-key",
+	"sec-websocket-version",
+	"sec-websocket-extensions",
+}
+
+// relay 处理 absolute-form 的 WebSocket 升级请求，分别与两端建立 WebSocket 之后转发 Message
+func (p *ForwardProxy) relay(w http.ResponseWriter, request *http.Request) {
+	upstreamRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, request.URL.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for key, values := range request.Header {
+		upstreamRequest.Header[key] = values
+	}
+	for _, key := range hopHeaders {
+		upstreamRequest.Header.Del(key)
+	}
+
+	var upstream WebSocket
+	if p.Dialer != nil {
+		upstream, err = ConnectWithDialer(request.Context(), p.Dialer, upstreamRequest)
+	} else {
+		upstream, err = Connect(request.Context(), upstreamRequest)
+	}
+	if err != nil {
+		p.logf("proxy: %s %s from %s: %v", request.Method, request.URL, request.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	// 客户端的握手响应使用目标服务器选择的子协议，两端的子协议才会一致
+	subprotocol := upstream.Subprotocol()
+	upgrader := &Upgrader{SelectProtocol: func(request *http.Request, offered []string) string {
+		return subprotocol
+	}}
+	client, err := upgrader.Upgrade(w, request)
+	if err != nil {
+		_ = upstream.Close()
+		p.logf("proxy: %s %s from %s: %v", request.Method, request.URL, request.RemoteAddr, err)
+		return
+	}
+	p.logf("proxy: %s %s from %s: relay established (client %s, upstream %s)", request.Method, request.URL, request.RemoteAddr, client.ID(), upstream.ID())
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayMessages(upstream, client)
+	}()
+	go func() {
+		defer wg.Done()
+		relayMessages(client, upstream)
+	}()
+	wg.Wait()
+	p.logf("proxy: %s %s from %s: relay closed (client %s, upstream %s)", request.Method, request.URL, request.RemoteAddr, client.ID(), upstream.ID())
+}
+
+// relayMessages 把 src 收到的 Message 转发到 dst，任意一方出错时关闭两端。
+// src 被对方关闭的时候，使用对方发送的状态码和原因关闭 dst。
+func relayMessages(dst WebSocket, src WebSocket) {
+	defer func() {
+		_ = dst.Close()
+		_ = src.Close()
+	}()
+	for {
+		message, err := src.ReadMessage()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && (validCloseCode(closeErr.Code) || closeErr.Code == CloseNoStatusReceived) {
+				_ = dst.CloseWithCode(closeErr.Code, closeErr.Reason)
+			}
+			return
+		}
+		err = dst.SendMessage(message)
+		if err != nil {
+			return
+		}
+	}
+}
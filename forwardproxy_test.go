@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialForwardProxy 通过 ForwardProxy 以 absolute-form 的升级请求连接 upstream，返回代理的响应和客户端的 WebSocket
+func dialForwardProxy(t *testing.T, proxy *httptest.Server, upstream *httptest.Server, header string) (*http.Response, WebSocket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	target := "ws" + strings.TrimPrefix(upstream.URL, "http") + "/"
+	_, err = conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: " + strings.TrimPrefix(upstream.URL, "http://") +
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==" +
+		"\r\n" + header + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("proxy answered %d, want 101", response.StatusCode)
+	}
+	return response, NewWebSocketWithRole(conn, &prefixedReadCloser{Reader: reader, rc: conn}, RoleClient)
+}
+
+func TestForwardProxyRelaySubprotocol(t *testing.T) {
+	upstream := httptest.NewServer((&Upgrader{Subprotocols: []string{"b"}}).Handler(func(ws WebSocket) {
+		_ = ws.Send(ws.Subprotocol())
+	}))
+	t.Cleanup(upstream.Close)
+	proxy := httptest.NewServer(&ForwardProxy{})
+	t.Cleanup(proxy.Close)
+
+	response, ws := dialForwardProxy(t, proxy, upstream, "Sec-WebSocket-Protocol: a, b\r\n")
+	// 客户端收到的子协议和目标服务器选择的一样
+	if protocol := response.Header.Get("Sec-WebSocket-Protocol"); protocol != "b" {
+		t.Fatalf("proxy answered with subprotocol %q, want b", protocol)
+	}
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "b" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want the upstream subprotocol b", data, err)
+	}
+}
+
+func TestForwardProxyRelayClose(t *testing.T) {
+	upstream := httptest.NewServer((&Upgrader{}).Handler(func(ws WebSocket) {
+		_ = ws.CloseWithCode(4001, "bye")
+	}))
+	t.Cleanup(upstream.Close)
+	proxy := httptest.NewServer(&ForwardProxy{})
+	t.Cleanup(proxy.Close)
+
+	_, ws := dialForwardProxy(t, proxy, upstream, "")
+	// 目标服务器关闭连接的状态码和原因原样转发给客户端
+	_, err := ws.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4001 || closeErr.Reason != "bye" {
+		t.Fatalf("ReadMessage() error = %v, want close 4001 bye", err)
+	}
+}
+
+func TestForwardProxyTunnel(t *testing.T) {
+	address := echoServer(t)
+	proxy := httptest.NewServer(&ForwardProxy{
+		Authenticate: func(request *http.Request) bool {
+			// Basic dXNlcjpwYXNz 是 user:pass
+			return request.Header.Get("Proxy-Authorization") == "Basic dXNlcjpwYXNz"
+		},
+	})
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("user", "pass")
+	dialer := &Dialer{Proxy: http.ProxyURL(proxyURL)}
+	if err = echoThrough(t, dialer, address); err != nil {
+		t.Fatal(err)
+	}
+
+	// 认证失败的 CONNECT 请求得到 407
+	proxyURL.User = url.UserPassword("user", "wrong")
+	err = echoThrough(t, dialer, address)
+	var responseErr *ResponseError
+	if !errors.As(err, &responseErr) || responseErr.Response.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("Dial() error = %v, want a 407 response", err)
+	}
+}
@@ -4,34 +4,80 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"math/rand"
 )
 
 type Frame struct {
 	Payload *io.LimitedReader
 	Fin     bool
-	Mask    bool
+	// Rsv1、Rsv2、Rsv3 是保留给扩展使用的 3 个标志位，例如 permessage-deflate 使用 Rsv1 标记压缩过的 Message
+	Rsv1 bool
+	Rsv2 bool
+	Rsv3 bool
+	Mask bool
+	// MaskKey 是 Mask 为 true 时 Encode 使用的掩码 key，为空时使用 DefaultMaskKeySource 生成
+	MaskKey []byte
 	OpCode  OpCode
+
+	// maskKey 用于保存 MaskKey 的内容，避免每个帧单独分配掩码 key
+	maskKey [4]byte
+	// data 不为空时是 Payload 的全部内容，并且可以直接修改，发送的时候会和帧头一起写入，不需要经过 Payload
+	data []byte
+	// encoder 和 masking 是 Encode 返回的 io.Reader 和加上掩码的 Payload，放在 Frame 中避免每次 Encode 分配新的对象
+	encoder frameReader
+	masking maskingReader
 }
 
 func (f *Frame) String() string {
 	if f.Payload == nil {
-		f.Payload = emptyReader
+		f.Payload = &io.LimitedReader{}
+	}
+	return fmt.Sprintf("Frame(%s){Fin:%v Rsv:%03b Mask:%v PayloadLen:%d}", f.OpCode, f.Fin, f.rsv(), f.Mask, f.Payload.N)
+}
+
+// setRsv 按照 rsv 的格式设置 3 个保留标志位
+func (f *Frame) setRsv(rsv byte) {
+	f.Rsv1 = rsv&0b100 > 0
+	f.Rsv2 = rsv&0b010 > 0
+	f.Rsv3 = rsv&0b001 > 0
+}
+
+// rsv 返回 3 个保留标志位，Rsv1 是最高位
+func (f *Frame) rsv() byte {
+	var rsv byte
+	if f.Rsv1 {
+		rsv |= 0b100
+	}
+	if f.Rsv2 {
+		rsv |= 0b010
+	}
+	if f.Rsv3 {
+		rsv |= 0b001
 	}
-	return fmt.Sprintf("Frame(%s){Fin:%v Mask:%v PayloadLen:%d}", f.OpCode, f.Fin, f.Mask, f.Payload.N)
+	return rsv
 }
 
 // Decode 用于从 io.Reader 中反序列化到 Frame
 func (f *Frame) Decode(ctx context.Context, reader io.Reader) error {
-	buf := make([]byte, 8)
+	header := headerPool.Get().(*[maxFrameHeaderLength]byte)
+	defer headerPool.Put(header)
+	return f.decode(ctx, reader, header, &io.LimitedReader{}, &maskingReader{})
+}
+
+// decode 使用调用者提供的帧头缓冲区、io.LimitedReader 和 maskingReader 解码帧，它们会被 Frame 引用，
+// 在 Frame 的内容读完之前不能被复用
+func (f *Frame) decode(ctx context.Context, reader io.Reader, header *[maxFrameHeaderLength]byte, payload *io.LimitedReader, masking *maskingReader) error {
+	buf := header[:8]
 	_, err := mustRead(ctx, reader, buf[:2])
 	if err != nil {
 		return err
 	}
 	f.Fin = buf[0]&0b10000000 > 0
+	f.Rsv1 = buf[0]&0b01000000 > 0
+	f.Rsv2 = buf[0]&0b00100000 > 0
+	f.Rsv3 = buf[0]&0b00010000 > 0
 	f.OpCode = OpCode(buf[0] & 0b00001111)
 	f.Mask = buf[1]&0b10000000 > 0
-	f.Payload = &io.LimitedReader{}
+	f.Payload = payload
 	f.Payload.N = int64(buf[1] & 0b01111111)
 	extendPayloadLength := 0
 	if f.Payload.N == 126 {
@@ -48,33 +94,67 @@ func (f *Frame) Decode(ctx context.Context, reader io.Reader) error {
 	if extendPayloadLength > 0 {
 		f.Payload.N = int64(bigEndianUint64Unpack(buf[:extendPayloadLength]))
 	}
-	maskKey := buf[:4]
 	if f.Mask {
-		_, err = mustRead(ctx, reader, maskKey)
+		_, err = mustRead(ctx, reader, f.maskKey[:])
 		if err != nil {
 			return err
 		}
-		reader = maskReader(maskKey, reader)
+		f.MaskKey = f.maskKey[:]
+		*masking = maskingReader{
+			key:    f.maskKey,
+			reader: reader,
+		}
+		reader = masking
 	}
 	f.Payload.R = reader
 	return nil
 }
 
-// Encode 用于从 Frame 中把数据序列化
+// Encode 用于从 Frame 中把数据序列化。返回的 io.Reader 保存在 Frame 中，不会分配新的对象，
+// 所以在它读完之前不能再次调用同一个 Frame 的 Encode。
 func (f *Frame) Encode() io.Reader {
-	buf := make([]byte, 14)
+	header := headerPool.Get().(*[maxFrameHeaderLength]byte)
+	headerLen, maskKey := f.encodeHeader(header)
+	if f.Mask {
+		reader := f.Payload.R
+		if reader == io.Reader(&f.masking) {
+			// 同一个 Frame 再次 Encode 的时候，不能让 masking 读取它自己
+			reader = f.masking.reader
+		}
+		f.masking = maskingReader{reader: reader}
+		copy(f.masking.key[:], maskKey)
+		f.Payload.R = &f.masking
+	}
+	f.encoder = frameReader{
+		header:  header,
+		length:  headerLen,
+		payload: f.Payload,
+	}
+	return &f.encoder
+}
+
+// encodeHeader 把帧头写入 header，返回帧头的长度和使用的掩码 key，内容的长度是 Payload.N
+func (f *Frame) encodeHeader(header *[maxFrameHeaderLength]byte) (int, []byte) {
+	*header = [maxFrameHeaderLength]byte{}
+	buf := header[:]
 	headerLen := 2
 	if f.Fin {
 		buf[0] |= 0b10000000
 	}
+	buf[0] |= f.rsv() << 4
 	buf[0] |= byte(f.OpCode)
 
-	maskKey := []byte{byte(rand.Int()), byte(rand.Int()), byte(rand.Int()), byte(rand.Int())}
+	maskKey := f.MaskKey
+	if f.Mask && len(maskKey) != 4 {
+		f.maskKey = DefaultMaskKeySource()
+		maskKey = f.maskKey[:]
+	}
 	extendedPayloadLen := 0
 	if f.Payload == nil {
-		f.Payload = emptyReader
+		// Encode 会修改 Payload.R，所以每个 Frame 需要自己的空 Payload，不能共用 emptyReader
+		f.Payload = &io.LimitedReader{}
 	}
-	if f.Payload.N < 125 {
+	if f.Payload.N <= 125 {
 		buf[1] |= byte(f.Payload.N)
 	} else if f.Payload.N < 1<<16 {
 		buf[1] |= 126
@@ -90,8 +170,6 @@ func (f *Frame) Encode() io.Reader {
 	if f.Mask {
 		buf[1] |= 0b10000000
 		headerLen += copy(buf[2+extendedPayloadLen:], maskKey)
-		f.Payload.R = maskReader(maskKey, f.Payload.R)
 	}
-
-	return io.MultiReader(newBytesBuffer(buf[:headerLen]), f.Payload)
+	return headerLen, maskKey
 }
@@ -2,4 +2,13 @@ module github.com/RommHui/websocket
 
 go 1.20
 
-require golang.org/x/net v0.14.0 // indirect
+require (
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/net v0.14.0
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/text v0.12.0 // indirect
+)
@@ -0,0 +1,309 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPCWebSocketsSubprotocol 是 gRPC-Web over WebSocket 使用的子协议，和 improbable-eng/grpc-web 的 websocket 传输兼容
+const GRPCWebSocketsSubprotocol = "grpc-websockets"
+
+var ErrInvalidGRPCWebHeaders = errors.New("invalid gRPC-Web headers message")
+
+// grpcWebTrailerFlag 是 gRPC-Web 中表示 header 或者 trailer 帧的标志位
+const grpcWebTrailerFlag = 0x80
+
+// defaultGRPCUpgrader 是 GRPCProxy 没有设置 Upgrader 时使用的 Upgrader
+var defaultGRPCUpgrader = &Upgrader{Subprotocols: []string{GRPCWebSocketsSubprotocol}}
+
+// GRPCProxy 把 WebSocket 连接转发到一个 gRPC 服务端，实现了 http.Handler 接口，用于只允许 WebSocket 的环境。
+// 根据客户端请求的子协议有两种转发方式：
+//
+//   - 没有请求 GRPCWebSocketsSubprotocol 的时候，WebSocket 是一条字节流隧道，BinaryFrame Message 的内容原样写入和 Target 的 TCP 连接，
+//     客户端在上面运行完整的 HTTP/2，使用 GRPCDialer 可以让 grpc.Dial 通过这种方式连接。
+//   - 请求了 GRPCWebSocketsSubprotocol 的时候（例如浏览器中的 gRPC-Web 客户端），每个 WebSocket 是一次 gRPC 调用，
+//     握手请求的路径是 gRPC 方法，第一个 Message 是请求头，之后每个 Message 是一个字节 0x00 加上 gRPC 长度前缀帧，
+//     只有一个字节 0x01 的 Message 表示请求结束。调用会通过 HTTP/2（h2c）发送给 Target，
+//     响应头、gRPC 帧和 trailer 按照 gRPC-Web 的格式通过 BinaryFrame Message 返回，之后连接被关闭。
+//
+// 使用例子：
+//
+//	proxy := &websocket.GRPCProxy{Target: "127.0.0.1:50051", Logf: log.Printf}
+//	http.Handle("/", proxy)
+//	http.ListenAndServe("0.0.0.0:8080", nil)
+type GRPCProxy struct {
+	// Target 是 gRPC 服务端的地址（host:port）
+	Target string
+
+	// Dialer 用于连接 Target，为空时使用默认的拨号方式（支持 ALL_PROXY 环境变量）。
+	// 连接上直接使用 HTTP/2，需要 TLS 的时候可以返回一个通过 ALPN 协商了 h2 的 *tls.Conn。
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Upgrader 用于完成 WebSocket 握手，为空时使用一个支持 GRPCWebSocketsSubprotocol 的 Upgrader。
+	// 设置了 Upgrader 的时候，需要在 Subprotocols 中包含 GRPCWebSocketsSubprotocol 才能接收 gRPC-Web 客户端。
+	Upgrader *Upgrader
+
+	// Logf 用于输出代理的日志，为空时不输出。
+	Logf func(format string, v ...any)
+
+	transportOnce sync.Once
+	transport     *http2.Transport
+}
+
+// GRPCDialer 返回一个通过 url 上的 GRPCProxy 连接 gRPC 服务端的拨号函数，可以作为 grpc.WithContextDialer 的参数，
+// grpc.Dial 的地址会被忽略。dialer 为空时使用 DefaultDialer。
+//
+// 使用例子：
+//
+//	conn, err := grpc.Dial("passthrough:///gateway",
+//		grpc.WithContextDialer(websocket.GRPCDialer("wss://gateway.example.com/grpc", nil)),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+func GRPCDialer(url string, dialer *Dialer) func(ctx context.Context, address string) (net.Conn, error) {
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		ws, err := dialer.Dial(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		return NewConn(ws), nil
+	}
+}
+
+func (p *GRPCProxy) logf(format string, v ...any) {
+	if p.Logf != nil {
+		p.Logf(format, v...)
+	}
+}
+
+func (p *GRPCProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if p.Dialer != nil {
+		return p.Dialer(ctx, network, address)
+	}
+	return tcpDialer(ctx, network, address)
+}
+
+func (p *GRPCProxy) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	upgrader := p.Upgrader
+	if upgrader == nil {
+		upgrader = defaultGRPCUpgrader
+	}
+	ws, err := upgrader.Upgrade(w, request)
+	if err != nil {
+		p.logf("grpc: upgrade from %s: %v", request.RemoteAddr, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ws.Done()
+		cancel()
+	}()
+	if ws.Subprotocol() == GRPCWebSocketsSubprotocol {
+		p.serveWeb(ctx, ws, request)
+		return
+	}
+	p.tunnel(ctx, ws, request.RemoteAddr)
+}
+
+// tunnel 在 ws 和 Target 之间转发字节流
+func (p *GRPCProxy) tunnel(ctx context.Context, ws WebSocket, remoteAddr string) {
+	target, err := p.dial(ctx, "tcp", p.Target)
+	if err != nil {
+		p.logf("grpc: tunnel from %s: %v", remoteAddr, err)
+		_ = ws.CloseWithCode(CloseTryAgainLater, "")
+		return
+	}
+	conn := NewConn(ws)
+	p.logf("grpc: tunnel from %s to %s established", remoteAddr, p.Target)
+	pipe(target, conn, bufio.NewReader(conn))
+	p.logf("grpc: tunnel from %s to %s closed", remoteAddr, p.Target)
+}
+
+func (p *GRPCProxy) roundTrip(request *http.Request) (*http.Response, error) {
+	p.transportOnce.Do(func() {
+		p.transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, address string, _ *tls.Config) (net.Conn, error) {
+				return p.dial(ctx, network, address)
+			},
+		}
+	})
+	return p.transport.RoundTrip(request)
+}
+
+// serveWeb 把 ws 上的一次 gRPC-Web 调用转换成 Target 上的 gRPC 调用
+func (p *GRPCProxy) serveWeb(ctx context.Context, ws WebSocket, handshake *http.Request) {
+	defer ws.Close()
+	method := handshake.URL.Path
+	_, data, err := ws.ReadAllMessage()
+	if err != nil {
+		return
+	}
+	header, err := parseGRPCWebHeaders(data)
+	if err != nil {
+		p.logf("grpc: %s from %s: %v", method, handshake.RemoteAddr, err)
+		_ = ws.CloseWithCode(CloseProtocolError, err.Error())
+		return
+	}
+
+	body, bodyWriter := io.Pipe()
+	go readGRPCWebRequest(ws, bodyWriter)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+p.Target+method, body)
+	if err != nil {
+		_ = body.Close()
+		return
+	}
+	request.Header = header
+	for _, key := range hopHeaders {
+		request.Header.Del(key)
+	}
+	request.Header.Set("Content-Type", grpcContentType(header.Get("Content-Type")))
+	request.Header.Set("Te", "trailers")
+
+	response, err := p.roundTrip(request)
+	if err != nil {
+		_ = body.Close()
+		p.logf("grpc: %s from %s: %v", method, handshake.RemoteAddr, err)
+		trailer := http.Header{}
+		trailer.Set("grpc-status", "14")
+		trailer.Set("grpc-message", err.Error())
+		if writeGRPCWebHeaders(ws, http.Header{"Content-Type": {"application/grpc-web+proto"}}) == nil {
+			_ = writeGRPCWebTrailer(ws, trailer)
+		}
+		return
+	}
+	defer response.Body.Close()
+
+	responseHeader := response.Header.Clone()
+	responseHeader.Set("Content-Type", grpcWebContentType(responseHeader.Get("Content-Type")))
+	if err = writeGRPCWebHeaders(ws, responseHeader); err != nil {
+		return
+	}
+	buffer := make([]byte, fragmentSize)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			if sendErr := ws.WriteMessage(BinaryFrame, buffer[:n]); sendErr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.logf("grpc: %s from %s: %v", method, handshake.RemoteAddr, err)
+			return
+		}
+	}
+	trailer := response.Trailer
+	if len(trailer.Get("grpc-status")) < 1 {
+		// Trailers-Only 响应的 grpc-status 在响应头中，其他的响应头已经发送过了
+		trailer = http.Header{}
+		for key, values := range response.Header {
+			if strings.HasPrefix(strings.ToLower(key), "grpc-") {
+				trailer[key] = values
+			}
+		}
+	}
+	if err = writeGRPCWebTrailer(ws, trailer); err != nil {
+		return
+	}
+	_ = ws.CloseWithCode(CloseNormalClosure, "")
+}
+
+// readGRPCWebRequest 把 ws 收到的请求帧写入 writer，收到结束标志之后继续读取 ws，直到连接关闭
+func readGRPCWebRequest(ws WebSocket, writer *io.PipeWriter) {
+	finished := false
+	for {
+		_, data, err := ws.ReadAllMessage()
+		if err != nil {
+			_ = writer.CloseWithError(connReadError(err))
+			return
+		}
+		if finished || len(data) < 1 {
+			continue
+		}
+		if len(data) == 1 && data[0] == 1 {
+			finished = true
+			_ = writer.Close()
+			continue
+		}
+		if _, err = writer.Write(data[1:]); err != nil {
+			finished = true
+		}
+	}
+}
+
+// parseGRPCWebHeaders 解析 "key: value\r\n" 格式的请求头
+func parseGRPCWebHeaders(data []byte) (http.Header, error) {
+	data = bytes.TrimRight(data, "\r\n")
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n\r\n"))))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, ErrInvalidGRPCWebHeaders
+	}
+	return http.Header(header), nil
+}
+
+// writeGRPCWebHeaders 发送响应头，先发送一个带有 grpcWebTrailerFlag 的长度前缀，再发送 "key: value\r\n" 格式的内容
+func writeGRPCWebHeaders(ws WebSocket, header http.Header) error {
+	block := &bytes.Buffer{}
+	_ = header.Write(block)
+	prefix := make([]byte, 5)
+	prefix[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(prefix[1:], uint32(block.Len()))
+	err := ws.WriteMessage(BinaryFrame, prefix)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(BinaryFrame, block.Bytes())
+}
+
+// writeGRPCWebTrailer 发送 gRPC-Web 的 trailer 帧，key 按照 gRPC-Web 的要求使用小写
+func writeGRPCWebTrailer(ws WebSocket, trailer http.Header) error {
+	frame := []byte{grpcWebTrailerFlag, 0, 0, 0, 0}
+	for key, values := range trailer {
+		key = strings.ToLower(key)
+		for _, value := range values {
+			frame = append(frame, key...)
+			frame = append(frame, ": "...)
+			frame = append(frame, value...)
+			frame = append(frame, "\r\n"...)
+		}
+	}
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(frame)-5))
+	return ws.WriteMessage(BinaryFrame, frame)
+}
+
+// grpcContentType 把 gRPC-Web 的 Content-Type 转换成 gRPC 的 Content-Type
+func grpcContentType(contentType string) string {
+	if suffix, ok := strings.CutPrefix(contentType, "application/grpc-web"); ok {
+		return "application/grpc" + suffix
+	}
+	if len(contentType) < 1 {
+		return "application/grpc"
+	}
+	return contentType
+}
+
+// grpcWebContentType 把 gRPC 的 Content-Type 转换成 gRPC-Web 的 Content-Type
+func grpcWebContentType(contentType string) string {
+	if suffix, ok := strings.CutPrefix(contentType, "application/grpc"); ok && !strings.HasPrefix(suffix, "-web") {
+		return "application/grpc-web" + suffix
+	}
+	return contentType
+}
@@ -0,0 +1,325 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestParseGRPCWebHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want http.Header
+		err  error
+	}{
+		{
+			name: "empty",
+			data: "",
+			want: http.Header{},
+		},
+		{
+			name: "canonical keys",
+			data: "content-type: application/grpc-web+proto\r\nx-grpc-web: 1\r\n",
+			want: http.Header{"Content-Type": {"application/grpc-web+proto"}, "X-Grpc-Web": {"1"}},
+		},
+		{
+			name: "without trailing line break",
+			data: "authorization: Bearer token",
+			want: http.Header{"Authorization": {"Bearer token"}},
+		},
+		{
+			name: "repeated keys",
+			data: "x-a: 1\r\nX-A: 2\r\n\r\n",
+			want: http.Header{"X-A": {"1", "2"}},
+		},
+		{
+			name: "line without colon",
+			data: "content-type: application/grpc-web\r\ngarbage\r\n",
+			err:  ErrInvalidGRPCWebHeaders,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseGRPCWebHeaders([]byte(test.data))
+			if err != test.err {
+				t.Fatalf("parseGRPCWebHeaders() error = %v, want %v", err, test.err)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parseGRPCWebHeaders() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// recordMessages 调用 write 向一个 WebSocket 写入，然后返回写入的所有 Message 的内容
+func recordMessages(t *testing.T, write func(ws WebSocket) error) [][]byte {
+	t.Helper()
+	output := &bytes.Buffer{}
+	if err := write(NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)); err != nil {
+		t.Fatal(err)
+	}
+	reader := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(output), false)
+	var messages [][]byte
+	for {
+		_, data, err := reader.ReadAllMessage()
+		if err != nil {
+			return messages
+		}
+		messages = append(messages, data)
+	}
+}
+
+func TestWriteGRPCWebHeaders(t *testing.T) {
+	header := http.Header{"Content-Type": {"application/grpc-web+proto"}, "X-Request-Id": {"1"}}
+	messages := recordMessages(t, func(ws WebSocket) error {
+		return writeGRPCWebHeaders(ws, header)
+	})
+	want := "Content-Type: application/grpc-web+proto\r\nX-Request-Id: 1\r\n"
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want the prefix and the header block", len(messages))
+	}
+	prefix := messages[0]
+	if len(prefix) != 5 || prefix[0] != grpcWebTrailerFlag || binary.BigEndian.Uint32(prefix[1:]) != uint32(len(want)) {
+		t.Fatalf("prefix = % x, want flag %#x and length %d", prefix, grpcWebTrailerFlag, len(want))
+	}
+	if string(messages[1]) != want {
+		t.Fatalf("header block = %q, want %q", messages[1], want)
+	}
+}
+
+func TestWriteGRPCWebTrailer(t *testing.T) {
+	tests := []struct {
+		name    string
+		trailer http.Header
+		want    string
+	}{
+		{
+			name:    "empty",
+			trailer: http.Header{},
+			want:    "",
+		},
+		{
+			name:    "lowercase keys",
+			trailer: http.Header{"Grpc-Status": {"0"}},
+			want:    "grpc-status: 0\r\n",
+		},
+		{
+			name:    "repeated values",
+			trailer: http.Header{"X-Debug": {"a", "b"}},
+			want:    "x-debug: a\r\nx-debug: b\r\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := recordMessages(t, func(ws WebSocket) error {
+				return writeGRPCWebTrailer(ws, test.trailer)
+			})
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages, want 1", len(messages))
+			}
+			frame := messages[0]
+			if len(frame) < 5 || frame[0] != grpcWebTrailerFlag || binary.BigEndian.Uint32(frame[1:5]) != uint32(len(frame)-5) {
+				t.Fatalf("trailer frame = % x, want flag %#x and a matching length", frame, grpcWebTrailerFlag)
+			}
+			if string(frame[5:]) != test.want {
+				t.Fatalf("trailer = %q, want %q", frame[5:], test.want)
+			}
+		})
+	}
+}
+
+func TestGRPCContentType(t *testing.T) {
+	tests := []struct {
+		web  string
+		grpc string
+	}{
+		{web: "application/grpc-web", grpc: "application/grpc"},
+		{web: "application/grpc-web+proto", grpc: "application/grpc+proto"},
+		{web: "application/grpc-web+json", grpc: "application/grpc+json"},
+		{web: "", grpc: "application/grpc"},
+		{web: "application/grpc+proto", grpc: "application/grpc+proto"},
+	}
+	for _, test := range tests {
+		if got := grpcContentType(test.web); got != test.grpc {
+			t.Errorf("grpcContentType(%q) = %q, want %q", test.web, got, test.grpc)
+		}
+	}
+
+	reverse := []struct {
+		grpc string
+		web  string
+	}{
+		{grpc: "application/grpc", web: "application/grpc-web"},
+		{grpc: "application/grpc+proto", web: "application/grpc-web+proto"},
+		{grpc: "application/grpc-web+proto", web: "application/grpc-web+proto"},
+		{grpc: "text/plain", web: "text/plain"},
+	}
+	for _, test := range reverse {
+		if got := grpcWebContentType(test.grpc); got != test.web {
+			t.Errorf("grpcWebContentType(%q) = %q, want %q", test.grpc, got, test.web)
+		}
+	}
+}
+
+// grpcWebCall 通过 proxy 发起一次 gRPC-Web 调用，返回响应头、数据帧和 trailer
+func grpcWebCall(t *testing.T, backend http.HandlerFunc, request []byte) (http.Header, []byte, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendServer := &http.Server{Handler: h2c.NewHandler(backend, &http2.Server{})}
+	go func() {
+		_ = backendServer.Serve(listener)
+	}()
+	defer backendServer.Close()
+	server := httptest.NewServer(&GRPCProxy{Target: listener.Addr().String()})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{Subprotocols: []string{GRPCWebSocketsSubprotocol}}
+	ws, err := dialer.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/test.Echo/Say")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err = ws.WriteMessage(BinaryFrame, []byte("content-type: application/grpc-web+proto\r\nx-user: alice\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(request) > 0 {
+		if err = ws.WriteMessage(BinaryFrame, append([]byte{0x00}, request...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ws.WriteMessage(BinaryFrame, []byte{0x01}); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages [][]byte
+	for {
+		_, data, err := ws.ReadAllMessage()
+		if err != nil {
+			if !IsCloseError(err, CloseNormalClosure) {
+				t.Fatalf("ReadAllMessage() error = %v, want a normal closure", err)
+			}
+			break
+		}
+		messages = append(messages, data)
+	}
+	if len(messages) < 3 {
+		t.Fatalf("got %d messages, want the header prefix, header block and trailer", len(messages))
+	}
+	header, err := parseGRPCWebHeaders(messages[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	trailer := messages[len(messages)-1]
+	if trailer[0] != grpcWebTrailerFlag {
+		t.Fatalf("last message % x is not a trailer frame", trailer)
+	}
+	return header, bytes.Join(messages[2:len(messages)-1], nil), string(trailer[5:])
+}
+
+// grpcFrame 返回一个没有压缩的 gRPC 长度前缀帧
+func grpcFrame(data string) []byte {
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(data)))
+	return append(frame, data...)
+}
+
+func TestGRPCWebCall(t *testing.T) {
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test.Echo/Say" || r.Header.Get("Content-Type") != "application/grpc+proto" || r.Header.Get("X-User") != "alice" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	}
+	header, data, trailer := grpcWebCall(t, backend, grpcFrame("hello"))
+	if header.Get("Content-Type") != "application/grpc-web+proto" {
+		t.Fatalf("Content-Type = %q, want application/grpc-web+proto", header.Get("Content-Type"))
+	}
+	if !bytes.Equal(data, grpcFrame("hello")) {
+		t.Fatalf("data = % x, want the echoed frame", data)
+	}
+	if trailer != "grpc-status: 0\r\n" {
+		t.Fatalf("trailer = %q, want grpc-status 0", trailer)
+	}
+}
+
+func TestGRPCWebTrailersOnly(t *testing.T) {
+	backend := func(w http.ResponseWriter, r *http.Request) {
+		// Trailers-Only：只有响应头，grpc-status 放在响应头中
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "not found")
+		w.WriteHeader(http.StatusOK)
+	}
+	header, data, trailer := grpcWebCall(t, backend, nil)
+	if header.Get("Content-Type") != "application/grpc-web" {
+		t.Fatalf("Content-Type = %q, want application/grpc-web", header.Get("Content-Type"))
+	}
+	if len(data) > 0 {
+		t.Fatalf("data = % x, want no data frames", data)
+	}
+	lines := strings.Split(strings.TrimSuffix(trailer, "\r\n"), "\r\n")
+	want := map[string]bool{"grpc-status: 5": true, "grpc-message: not found": true}
+	if len(lines) != len(want) {
+		t.Fatalf("trailer = %q, want grpc-status and grpc-message only", trailer)
+	}
+	for _, line := range lines {
+		if !want[line] {
+			t.Fatalf("trailer = %q, want grpc-status and grpc-message only", trailer)
+		}
+	}
+}
+
+func TestGRPCWebBackendUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关闭之后连接会被拒绝
+	address := listener.Addr().String()
+	_ = listener.Close()
+	server := httptest.NewServer(&GRPCProxy{Target: address})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := (&Dialer{Subprotocols: []string{GRPCWebSocketsSubprotocol}}).Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/test.Echo/Say")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err = ws.WriteMessage(BinaryFrame, []byte("content-type: application/grpc-web\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	var last []byte
+	for {
+		_, data, err := ws.ReadAllMessage()
+		if err != nil {
+			break
+		}
+		last = data
+	}
+	if len(last) < 5 || last[0] != grpcWebTrailerFlag || !strings.Contains(string(last[5:]), "grpc-status: 14\r\n") {
+		t.Fatalf("last message = %q, want a trailer with grpc-status 14", last)
+	}
+}
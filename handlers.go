@@ -0,0 +1,38 @@
+package websocket
+
+// controlHandlers 是通过 SetPingHandler、SetPongHandler 和 SetCloseHandler 设置的控制帧回调
+type controlHandlers struct {
+	ping  func(payload []byte) error
+	pong  func(payload []byte) error
+	close func(code uint16, reason string) error
+}
+
+// SetPingHandler 设置收到 Ping 时的回调，设置之后不会再自动回复 Pong，需要回调自己使用 WriteControl 回复。
+// handler 为空时恢复按照 PingPolicy 自动回复。handler 返回的错误会从 ReadMessage 返回。
+func (w *webSocket) SetPingHandler(handler func(payload []byte) error) {
+	w.handlersLock.Lock()
+	defer w.handlersLock.Unlock()
+	w.handlers.ping = handler
+}
+
+// SetPongHandler 设置收到 Pong 时的回调，例如用于记录连接的活跃时间，Ping 仍然可以收到对应的 Pong。
+// handler 返回的错误会从 ReadMessage 返回。
+func (w *webSocket) SetPongHandler(handler func(payload []byte) error) {
+	w.handlersLock.Lock()
+	defer w.handlersLock.Unlock()
+	w.handlers.pong = handler
+}
+
+// SetCloseHandler 设置收到 ConnectionClose 时的回调，回调之后仍然会回复 ConnectionClose 并关闭连接。
+// handler 返回的错误会代替 *CloseError 从 ReadMessage 返回。
+func (w *webSocket) SetCloseHandler(handler func(code uint16, reason string) error) {
+	w.handlersLock.Lock()
+	defer w.handlersLock.Unlock()
+	w.handlers.close = handler
+}
+
+func (w *webSocket) getHandlers() controlHandlers {
+	w.handlersLock.Lock()
+	defer w.handlersLock.Unlock()
+	return w.handlers
+}
@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPingHandler(t *testing.T) {
+	input := []byte{0x89, 2, 'p', '1', 0x81, 2, 'o', 'k', 0x89, 2, 'p', '2', 0x81, 2, 'o', 'k'}
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+	var pings []string
+	ws.SetPingHandler(func(payload []byte) error {
+		pings = append(pings, string(payload))
+		return nil
+	})
+	if data := readText(t, ws); data != "ok" {
+		t.Fatalf("ReadMessage() = %q, want ok", data)
+	}
+	// 设置了回调之后不会自动回复 Pong
+	if !reflect.DeepEqual(pings, []string{"p1"}) || output.Len() > 0 {
+		t.Fatalf("pings = %q, sent % x, want [p1] and nothing sent", pings, output.Bytes())
+	}
+	// 清除回调之后恢复自动回复
+	ws.SetPingHandler(nil)
+	if data := readText(t, ws); data != "ok" {
+		t.Fatalf("ReadMessage() = %q, want ok", data)
+	}
+	want := []sentFrame{{OpCode: Pong, Fin: true, Payload: []byte("p2")}}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) || len(pings) != 1 {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+}
+
+func TestPongHandler(t *testing.T) {
+	input := []byte{0x8a, 4, 'b', 'e', 'a', 't', 0x81, 2, 'o', 'k', 0x8a, 0}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	var pongs []string
+	errPong := errors.New("pong rejected")
+	ws.SetPongHandler(func(payload []byte) error {
+		pongs = append(pongs, string(payload))
+		if len(payload) < 1 {
+			return errPong
+		}
+		return nil
+	})
+	if data := readText(t, ws); data != "ok" {
+		t.Fatalf("ReadMessage() = %q, want ok", data)
+	}
+	// 回调返回的错误从 ReadMessage 返回
+	if _, err := ws.ReadMessage(); err != errPong {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, errPong)
+	}
+	if !reflect.DeepEqual(pongs, []string{"beat", ""}) {
+		t.Fatalf("pongs = %q, want [beat ]", pongs)
+	}
+}
+
+func TestCloseHandler(t *testing.T) {
+	errClose := errors.New("close handled")
+	tests := []struct {
+		name  string
+		err   error
+		check func(err error) bool
+	}{
+		{name: "nil error", check: func(err error) bool {
+			var closeErr *CloseError
+			return errors.As(err, &closeErr) && closeErr.Code == CloseGoingAway && closeErr.Reason == "away"
+		}},
+		{name: "handler error", err: errClose, check: func(err error) bool {
+			return err == errClose
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := append([]byte{0x88, 6, 0x03, 0xe9}, "away"...)
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+			var code uint16
+			var reason string
+			ws.SetCloseHandler(func(c uint16, r string) error {
+				code, reason = c, r
+				return test.err
+			})
+			if _, err := ws.ReadMessage(); !test.check(err) {
+				t.Fatalf("ReadMessage() error = %v", err)
+			}
+			if code != CloseGoingAway || reason != "away" {
+				t.Fatalf("close handler got %d %q, want %d away", code, reason, CloseGoingAway)
+			}
+			// 回调之后仍然会回复 ConnectionClose
+			want := []sentFrame{{OpCode: ConnectionClose, Fin: true, Payload: []byte{0x03, 0xe9}}}
+			if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+				t.Fatalf("sent frames %+v, want %+v", frames, want)
+			}
+		})
+	}
+}
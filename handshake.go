@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxHandshakeLineLength 是握手请求中单行的最大长度
+	maxHandshakeLineLength = 8 << 10
+	// maxHandshakeHeaderLines 是握手请求中请求头的最大行数
+	maxHandshakeHeaderLines = 128
+	// DefaultMaxHeaderBytes 是 Upgrader 没有设置 MaxHeaderBytes 时，握手请求的请求行和请求头的最大总长度
+	DefaultMaxHeaderBytes = 16 << 10
+)
+
+var (
+	ErrHandshakeLineTooLong   = errors.New("handshake request line is too long")
+	ErrHandshakeTooManyLines  = errors.New("handshake request has too many header lines")
+	ErrHandshakeMalformedLine = errors.New("handshake request contains a malformed line")
+	ErrHandshakeHasBody       = errors.New("handshake request must not have a body")
+	ErrHandshakeTooLarge      = errors.New("handshake request header is too large")
+)
+
+// readHandshakeRequest 从原始的流中读取握手请求。
+// 与 http.ReadRequest 相比，这里会严格校验请求头，拒绝常见的请求走私手段：
+// 过长的行、缺少 CR 的换行、单独的 CR、折叠的请求头、重复的 Content-Length 以及任何请求体。
+// 请求行和请求头的总长度不能超过 maxBytes。
+// 返回的 bufio.Reader 中可能已经缓冲了紧跟在握手请求之后的帧。
+func readHandshakeRequest(reader io.Reader, maxBytes int) (*http.Request, *bufio.Reader, error) {
+	buf := bufio.NewReaderSize(reader, maxHandshakeLineLength)
+	raw := &bytes.Buffer{}
+	// http.ReadRequest 会把值相同的多个 Content-Length 合并成一个，所以需要自己计数
+	contentLengths := 0
+	for lines := 0; ; lines++ {
+		if lines > maxHandshakeHeaderLines {
+			return nil, nil, ErrHandshakeTooManyLines
+		}
+		line, err := buf.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, nil, ErrHandshakeLineTooLong
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !validHandshakeLine(line, lines == 0) {
+			return nil, nil, ErrHandshakeMalformedLine
+		}
+		if lines > 0 && len(line) > len("content-length:") && strings.EqualFold(string(line[:len("content-length:")]), "content-length:") {
+			contentLengths++
+		}
+		raw.Write(line)
+		if raw.Len() > maxBytes {
+			return nil, nil, ErrHandshakeTooLarge
+		}
+		if len(line) == 2 {
+			break
+		}
+	}
+
+	request, err := http.ReadRequest(bufio.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentLengths > 1 || len(request.TransferEncoding) > 0 || request.ContentLength != 0 {
+		return nil, nil, ErrHandshakeHasBody
+	}
+	return request, buf, nil
+}
+
+// validHandshakeLine 校验一行请求头，line 需要以 CRLF 结尾
+func validHandshakeLine(line []byte, first bool) bool {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return false
+	}
+	content := line[:len(line)-2]
+	if !first && len(content) > 0 && (content[0] == ' ' || content[0] == '\t') {
+		return false
+	}
+	for _, c := range content {
+		if c == '\r' || c == '\n' || c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// handshakeErrorStatus 返回读取握手请求失败时响应的 HTTP 状态码
+func handshakeErrorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusRequestTimeout
+	case errors.Is(err, ErrHandshakeTooLarge), errors.Is(err, ErrHandshakeLineTooLong), errors.Is(err, ErrHandshakeTooManyLines):
+		return http.StatusRequestHeaderFieldsTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,355 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handshakeRequest 是一个合法的原始握手请求，extra 会加在请求头的最后
+func handshakeRequest(extra string) string {
+	return "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" + extra + "\r\n"
+}
+
+// upgradeRaw 使用 upgrader 处理原始的握手请求 raw，返回升级的结果和写回的 HTTP 响应
+func upgradeRaw(t *testing.T, upgrader *Upgrader, raw string) (WebSocket, *http.Response, error) {
+	t.Helper()
+	output := &bytes.Buffer{}
+	ws, err := upgrader.UpgradeStream(discardCloser{output}, io.NopCloser(strings.NewReader(raw)))
+	response, readErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(output.Bytes())), nil)
+	if readErr != nil {
+		t.Fatalf("read the handshake response %q: %v", output.String(), readErr)
+	}
+	return ws, response, err
+}
+
+func TestServerPairRejectsSmuggling(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		err  error
+	}{
+		{name: "duplicate content-length", raw: handshakeRequest("Content-Length: 0\r\nContent-Length: 0\r\n"), err: ErrHandshakeHasBody},
+		{name: "body", raw: handshakeRequest("Content-Length: 5\r\n") + "hello", err: ErrHandshakeHasBody},
+		{name: "chunked", raw: handshakeRequest("Transfer-Encoding: chunked\r\n") + "0\r\n\r\n", err: ErrHandshakeHasBody},
+		{name: "bare cr", raw: handshakeRequest("X-Test: a\rb\r\n"), err: ErrHandshakeMalformedLine},
+		{name: "bare lf", raw: strings.Replace(handshakeRequest(""), "Host: example.com\r\n", "Host: example.com\n", 1), err: ErrHandshakeMalformedLine},
+		{name: "folded header", raw: handshakeRequest("X-Test: a\r\n b\r\n"), err: ErrHandshakeMalformedLine},
+		{name: "long line", raw: handshakeRequest("X-Test: " + strings.Repeat("a", maxHandshakeLineLength) + "\r\n"), err: ErrHandshakeLineTooLong},
+		{name: "too many lines", raw: handshakeRequest(strings.Repeat("X-Test: a\r\n", maxHandshakeHeaderLines+1)), err: ErrHandshakeTooManyLines},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, response, err := upgradeRaw(t, &Upgrader{MaxHeaderBytes: 1 << 20}, test.raw)
+			if ws != nil || err != test.err {
+				t.Fatalf("UpgradeStream() = %v, %v, want %v", ws, err, test.err)
+			}
+			if response.StatusCode < 400 {
+				t.Fatalf("response status %d, want an error", response.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServerPairKeepsFramesAfterHandshake(t *testing.T) {
+	// 紧跟在握手请求之后的帧不能因为读取请求时的缓冲而丢失
+	raw := handshakeRequest("") + string(maskedFrame(TextFrame, []byte("hello")))
+	ws, response, err := upgradeRaw(t, &Upgrader{}, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response status %d, want 101", response.StatusCode)
+	}
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want hello", data, err)
+	}
+}
+
+func TestSecWebsocketKey(t *testing.T) {
+	first, err := getSecWebsocketKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := getSecWebsocketKey(nil)
+	if first == second || !validSecWebsocketKey(first) || !validSecWebsocketKey(second) {
+		t.Fatalf("generated keys %q and %q, want two different 16-byte nonces", first, second)
+	}
+
+	// KeySource 可以让握手请求的 key 是确定的
+	source := bytes.Repeat([]byte{7}, secWebsocketKeyLength)
+	client, server := net.Pipe()
+	keys := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		request, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		keys <- request.Header.Get("Sec-Websocket-Key")
+		accept, _ := getSecAcceptKey(request.Header.Get("Sec-Websocket-Key"))
+		_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-Websocket-Accept: "+accept+"\r\n\r\n")
+	}()
+	request, _ := http.NewRequest(http.MethodGet, "ws://example.com/ws", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ws, _, err := (&Dialer{KeySource: bytes.NewReader(source)}).NewClientConn(ctx, client, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	if key := <-keys; key != base64.StdEncoding.EncodeToString(source) {
+		t.Fatalf("sent key %q, want the KeySource bytes", key)
+	}
+}
+
+func TestServerRejectsInvalidSecWebsocketKey(t *testing.T) {
+	valid := "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	for _, key := range []string{
+		"",
+		"Sec-WebSocket-Key: short\r\n",
+		"Sec-WebSocket-Key: " + base64.StdEncoding.EncodeToString(make([]byte, 15)) + "\r\n",
+		"Sec-WebSocket-Key: " + base64.StdEncoding.EncodeToString(make([]byte, 17)) + "\r\n",
+		"Sec-WebSocket-Key: !!!!!!!!!!!!!!!!!!!!!!!!\r\n",
+	} {
+		raw := strings.Replace(handshakeRequest(""), valid, key, 1)
+		ws, response, err := upgradeRaw(t, &Upgrader{}, raw)
+		if ws != nil || !errors.Is(err, ErrInvalidSecWebsocketKey) || response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("key %q: UpgradeStream() = %v, %v with status %d, want 400 %v", key, ws, err, response.StatusCode, ErrInvalidSecWebsocketKey)
+		}
+	}
+}
+
+func TestUpgraderCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		origin   string
+		check    func(request *http.Request) bool
+		rejected bool
+	}{
+		{name: "no origin"},
+		{name: "same origin", origin: "https://example.com"},
+		{name: "same origin different case", origin: "https://EXAMPLE.com"},
+		{name: "cross origin", origin: "https://evil.com", rejected: true},
+		{name: "invalid origin", origin: "://", rejected: true},
+		{
+			name:   "custom allows",
+			origin: "https://trusted.com",
+			check: func(request *http.Request) bool {
+				return request.Header.Get("Origin") == "https://trusted.com"
+			},
+		},
+		{name: "custom rejects", check: func(request *http.Request) bool { return false }, rejected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+			request.Header.Set("Sec-WebSocket-Version", "13")
+			request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if len(test.origin) > 0 {
+				request.Header.Set("Origin", test.origin)
+			}
+			// ResponseRecorder 不能 Hijack，通过校验的请求会在 Hijack 的时候失败，所以 403 一定是在 Hijack 之前响应的
+			recorder := httptest.NewRecorder()
+			_, err := (&Upgrader{CheckOrigin: test.check}).Upgrade(recorder, request)
+			if test.rejected != errors.Is(err, ErrBadOrigin) {
+				t.Fatalf("Upgrade() error = %v, want rejected %v", err, test.rejected)
+			}
+			if test.rejected && recorder.Code != http.StatusForbidden {
+				t.Fatalf("response status %d, want 403", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestUpgradeStreamHeaderLimit(t *testing.T) {
+	// 请求头的总长度超过 MaxHeaderBytes，每一行都没有超过单行的限制
+	raw := handshakeRequest(strings.Repeat("X-Test: "+strings.Repeat("a", 100)+"\r\n", 10))
+	ws, response, err := upgradeRaw(t, &Upgrader{MaxHeaderBytes: 512}, raw)
+	if ws != nil || err != ErrHandshakeTooLarge || response.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("UpgradeStream() = %v, %v with status %d, want 431 %v", ws, err, response.StatusCode, ErrHandshakeTooLarge)
+	}
+	// 没有超过限制的请求可以正常握手
+	if _, response, err = upgradeRaw(t, &Upgrader{MaxHeaderBytes: 4096}, raw); err != nil || response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("UpgradeStream() error = %v with status %d, want 101", err, response.StatusCode)
+	}
+}
+
+func TestUpgradeStreamHandshakeTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := (&Upgrader{HandshakeTimeout: 100 * time.Millisecond}).UpgradeStream(server, server)
+		done <- err
+	}()
+	// 客户端只发送了请求行，之后一直不发送请求头
+	if _, err := io.WriteString(client, "GET /ws HTTP/1.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusRequestTimeout {
+		t.Fatalf("response status %d, want 408", response.StatusCode)
+	}
+	var netErr net.Error
+	if err = <-done; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("UpgradeStream() error = %v, want a timeout", err)
+	}
+}
+
+func TestUpgraderValidatesRequest(t *testing.T) {
+	valid := handshakeRequest("")
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+		err    error
+	}{
+		{name: "post", raw: strings.Replace(valid, "GET", "POST", 1), status: http.StatusMethodNotAllowed, err: ErrHandshakeBadMethod},
+		{name: "http 1.0", raw: strings.Replace(valid, "HTTP/1.1", "HTTP/1.0", 1), status: http.StatusBadRequest, err: ErrHandshakeBadProtocol},
+		{name: "no host", raw: strings.Replace(valid, "Host: example.com\r\n", "", 1), status: http.StatusBadRequest, err: ErrHandshakeMissingHost},
+		{name: "no connection upgrade", raw: strings.Replace(valid, "Connection: Upgrade", "Connection: keep-alive", 1), status: http.StatusBadRequest, err: ErrHandshakeNotUpgrade},
+		{name: "no upgrade", raw: strings.Replace(valid, "Upgrade: websocket\r\n", "", 1), status: http.StatusBadRequest, err: ErrHandshakeNotWebSocket},
+		{name: "no key", raw: strings.Replace(valid, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", "", 1), status: http.StatusBadRequest, err: ErrInvalidSecWebsocketKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, response, err := upgradeRaw(t, &Upgrader{}, test.raw)
+			var handshakeErr *HandshakeError
+			if ws != nil || !errors.As(err, &handshakeErr) || !errors.Is(err, test.err) {
+				t.Fatalf("UpgradeStream() = %v, %v, want a *HandshakeError for %v", ws, err, test.err)
+			}
+			if response.StatusCode != test.status || handshakeErr.Status != test.status {
+				t.Fatalf("response status %d, HandshakeError status %d, want %d", response.StatusCode, handshakeErr.Status, test.status)
+			}
+			if test.status == http.StatusMethodNotAllowed && response.Header.Get("Allow") != http.MethodGet {
+				t.Fatalf("Allow = %q, want GET", response.Header.Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestUpgraderRejectsVersion(t *testing.T) {
+	valid := handshakeRequest("")
+	for _, version := range []string{"Sec-WebSocket-Version: 8\r\n", ""} {
+		raw := strings.Replace(valid, "Sec-WebSocket-Version: 13\r\n", version, 1)
+		ws, response, err := upgradeRaw(t, &Upgrader{}, raw)
+		if ws != nil || !errors.Is(err, ErrHandshakeBadVersion) {
+			t.Fatalf("version %q: UpgradeStream() = %v, %v, want %v", version, ws, err, ErrHandshakeBadVersion)
+		}
+		if response.StatusCode != http.StatusUpgradeRequired || response.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Fatalf("version %q: response %d with version %q, want 426 with 13", version, response.StatusCode, response.Header.Get("Sec-WebSocket-Version"))
+		}
+	}
+
+	// Upgrade 使用 http.ResponseWriter 的时候响应一样
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "8")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	recorder := httptest.NewRecorder()
+	if _, err := (&Upgrader{}).Upgrade(recorder, request); !errors.Is(err, ErrHandshakeBadVersion) {
+		t.Fatalf("Upgrade() error = %v, want %v", err, ErrHandshakeBadVersion)
+	}
+	if recorder.Code != http.StatusUpgradeRequired || recorder.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("response %d with version %q, want 426 with 13", recorder.Code, recorder.Header().Get("Sec-WebSocket-Version"))
+	}
+}
+
+func TestUpgraderSelectProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		offered  string
+		upgrader *Upgrader
+		want     string
+	}{
+		{name: "client order", offered: "v1, v2", upgrader: &Upgrader{Subprotocols: []string{"v2", "v1"}}, want: "v1"},
+		{name: "unsupported", offered: "v3", upgrader: &Upgrader{Subprotocols: []string{"v1"}}},
+		{name: "nothing offered", upgrader: &Upgrader{Subprotocols: []string{"v1"}}},
+		{
+			name:    "select",
+			offered: "v1, v2",
+			upgrader: &Upgrader{SelectProtocol: func(request *http.Request, offered []string) string {
+				return offered[len(offered)-1]
+			}},
+			want: "v2",
+		},
+		// SelectProtocol 返回客户端没有请求的子协议会被忽略
+		{
+			name:    "select not offered",
+			offered: "v1",
+			upgrader: &Upgrader{SelectProtocol: func(request *http.Request, offered []string) string {
+				return "v9"
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extra := ""
+			if len(test.offered) > 0 {
+				extra = "Sec-WebSocket-Protocol: " + test.offered + "\r\n"
+			}
+			ws, response, err := upgradeRaw(t, test.upgrader, handshakeRequest(extra))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ws.Subprotocol() != test.want || response.Header.Get("Sec-WebSocket-Protocol") != test.want {
+				t.Fatalf("Subprotocol() = %q, response %q, want %q", ws.Subprotocol(), response.Header.Get("Sec-WebSocket-Protocol"), test.want)
+			}
+		})
+	}
+}
+
+func TestDialerSubprotocols(t *testing.T) {
+	upgrader := &Upgrader{Subprotocols: []string{"v2", "v1"}}
+	_, url := handlerServer(t, upgrader.Handler(func(ws WebSocket) {
+		_ = ws.Send(ws.Subprotocol())
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := (&Dialer{Subprotocols: []string{"v1", "v2"}}).Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if ws.Subprotocol() != "v1" {
+		t.Fatalf("client Subprotocol() = %q, want v1", ws.Subprotocol())
+	}
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "v1" {
+		t.Fatalf("server Subprotocol() = %q, %v, want v1", data, err)
+	}
+
+	// 服务器选择了客户端没有请求的子协议，握手失败
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		request, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			return
+		}
+		accept, _ := getSecAcceptKey(request.Header.Get("Sec-Websocket-Key"))
+		_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-Websocket-Accept: "+accept+"\r\nSec-Websocket-Protocol: v9\r\n\r\n")
+	}()
+	request, _ := http.NewRequest(http.MethodGet, "ws://example.com/ws", nil)
+	if _, _, err = (&Dialer{Subprotocols: []string{"v1"}}).NewClientConn(ctx, client, request); err == nil || !strings.Contains(err.Error(), "unexpected subprotocol") {
+		t.Fatalf("NewClientConn() error = %v, want an unexpected subprotocol error", err)
+	}
+}
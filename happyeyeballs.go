@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// DefaultFallbackDelay 是 Dialer 没有设置 FallbackDelay 时使用的 Connection Attempt Delay，是 RFC 8305 推荐的值
+const DefaultFallbackDelay = 250 * time.Millisecond
+
+// AddressFamily 表示 Dialer 连接解析出来的地址时优先使用的地址族
+type AddressFamily uint8
+
+const (
+	// PreferIPv6 先连接 IPv6 地址，再交替连接 IPv4 和 IPv6 地址，这是 RFC 8305 推荐的默认行为
+	PreferIPv6 AddressFamily = iota
+	// PreferIPv4 先连接 IPv4 地址，再交替连接 IPv6 和 IPv4 地址
+	PreferIPv4
+	// OnlyIPv6 只连接 IPv6 地址
+	OnlyIPv6
+	// OnlyIPv4 只连接 IPv4 地址
+	OnlyIPv4
+)
+
+// lookupNetwork 返回解析 network 的地址时使用的 Resolver.LookupNetIP 的 network
+func (f AddressFamily) lookupNetwork(network string) string {
+	switch {
+	case network == "tcp4" || f == OnlyIPv4:
+		return "ip4"
+	case network == "tcp6" || f == OnlyIPv6:
+		return "ip6"
+	}
+	return "ip"
+}
+
+// sort 把地址按照 RFC 8305 第 4 节的规则排列：优先的地址族排在第一个，之后两个地址族交替排列，同一个地址族保持解析的顺序
+func (f AddressFamily) sort(addrs []netip.Addr) []netip.Addr {
+	var preferred, fallback []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() == (f == PreferIPv4) {
+			preferred = append(preferred, addr)
+		} else {
+			fallback = append(fallback, addr)
+		}
+	}
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for len(preferred) > 0 || len(fallback) > 0 {
+		if len(preferred) > 0 {
+			sorted = append(sorted, preferred[0])
+			preferred = preferred[1:]
+		}
+		if len(fallback) > 0 {
+			sorted = append(sorted, fallback[0])
+			fallback = fallback[1:]
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialDirect 是 Dialer 没有设置 NetDialContext 时建立连接的方式。
+// TCP 连接的主机名使用 Dialer.Resolver 解析，解析出来的地址按照 AddressFamily 排列之后使用 Happy Eyeballs（RFC 8305）连接：
+// 一个地址在 FallbackDelay 之内没有连接成功或者连接失败的时候开始连接下一个地址，最先成功的连接会被使用，其他的连接会被关闭。
+// 这样某个地址族的网络不通的时候，不需要等到 TCP 连接超时才尝试另一个地址族。
+func (d *Dialer) dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Resolver: d.Resolver}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	port, err := resolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := resolver.LookupNetIP(ctx, d.AddressFamily.lookupNetwork(network), host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = d.AddressFamily.sort(addrs)
+	if len(addrs) < 1 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	start := func() {
+		target := netip.AddrPortFrom(addrs[next], uint16(port)).String()
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, target)
+			select {
+			case results <- dialResult{conn: conn, err: err}:
+			case <-ctx.Done():
+				// 已经有其他的地址连接成功，或者调用者已经放弃
+				if conn != nil {
+					_ = conn.Close()
+				}
+			}
+		}()
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(addrs) && delay > 0 {
+			timer = time.NewTimer(delay)
+			fallback = timer.C
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-fallback:
+			start()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver 返回一个对所有主机名都回复 addrs 的 Resolver
+func fakeResolver(addrs ...string) *net.Resolver {
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			// 连接不是 net.PacketConn，Resolver 使用 TCP 的格式，每个消息前面是 2 个字节的长度
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(query)
+			if err != nil {
+				return
+			}
+			question, err := parser.Question()
+			if err != nil {
+				return
+			}
+			builder := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			_ = builder.StartQuestions()
+			_ = builder.Question(question)
+			_ = builder.StartAnswers()
+			for _, s := range addrs {
+				addr := netip.MustParseAddr(s)
+				resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+				if addr.Is4() && question.Type == dnsmessage.TypeA {
+					_ = builder.AResource(resource, dnsmessage.AResource{A: addr.As4()})
+				} else if addr.Is6() && question.Type == dnsmessage.TypeAAAA {
+					_ = builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: addr.As16()})
+				}
+			}
+			response, err := builder.Finish()
+			if err != nil {
+				return
+			}
+			binary.BigEndian.PutUint16(response, uint16(len(response)-2))
+			if _, err = conn.Write(response); err != nil {
+				return
+			}
+		}
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serve(server)
+			return client, nil
+		},
+	}
+}
+
+func TestAddressFamilySort(t *testing.T) {
+	var addrs []netip.Addr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "192.0.2.3", "2001:db8::2"} {
+		addrs = append(addrs, netip.MustParseAddr(s))
+	}
+	tests := []struct {
+		family AddressFamily
+		want   []string
+	}{
+		{family: PreferIPv6, want: []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}},
+		{family: PreferIPv4, want: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"}},
+	}
+	for _, test := range tests {
+		var sorted []string
+		for _, addr := range test.family.sort(addrs) {
+			sorted = append(sorted, addr.String())
+		}
+		if !reflect.DeepEqual(sorted, test.want) {
+			t.Fatalf("sort(%d) = %v, want %v", test.family, sorted, test.want)
+		}
+	}
+}
+
+func TestAddressFamilyLookupNetwork(t *testing.T) {
+	tests := []struct {
+		family  AddressFamily
+		network string
+		want    string
+	}{
+		{family: PreferIPv6, network: "tcp", want: "ip"},
+		{family: PreferIPv4, network: "tcp", want: "ip"},
+		{family: OnlyIPv4, network: "tcp", want: "ip4"},
+		{family: OnlyIPv6, network: "tcp", want: "ip6"},
+		// network 指定的地址族优先
+		{family: OnlyIPv6, network: "tcp4", want: "ip4"},
+		{family: PreferIPv6, network: "tcp6", want: "ip6"},
+	}
+	for _, test := range tests {
+		if got := test.family.lookupNetwork(test.network); got != test.want {
+			t.Fatalf("lookupNetwork(%d, %q) = %q, want %q", test.family, test.network, got, test.want)
+		}
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	tests := []struct {
+		name   string
+		dialer *Dialer
+		ok     bool
+	}{
+		{name: "single address", dialer: &Dialer{Resolver: fakeResolver("127.0.0.1")}, ok: true},
+		// 127.0.0.2 上没有监听，连接失败之后马上连接下一个地址
+		{name: "fallback", dialer: &Dialer{Resolver: fakeResolver("127.0.0.2", "127.0.0.1"), FallbackDelay: time.Minute}, ok: true},
+		{name: "sequential", dialer: &Dialer{Resolver: fakeResolver("127.0.0.2", "127.0.0.1"), FallbackDelay: -1}, ok: true},
+		{name: "all failed", dialer: &Dialer{Resolver: fakeResolver("127.0.0.2", "127.0.0.3")}},
+		{name: "no address of the family", dialer: &Dialer{Resolver: fakeResolver("127.0.0.1"), AddressFamily: OnlyIPv6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := test.dialer.dialDirect(ctx, "tcp", net.JoinHostPort("happy.test", port))
+			if test.ok != (err == nil) {
+				t.Fatalf("dialDirect() error = %v, want success %v", err, test.ok)
+			}
+			if conn == nil {
+				return
+			}
+			defer conn.Close()
+			if remote := conn.RemoteAddr().String(); remote != listener.Addr().String() {
+				t.Fatalf("connected to %s, want %s", remote, listener.Addr())
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package websocket
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// splitHeaderList 按照 RFC 7230 7 的 #rule 把请求头的值拆分成列表，双引号内的逗号不会被拆分，空元素会被忽略
+func splitHeaderList(value string) []string {
+	return splitQuoted(value, ',')
+}
+
+// splitQuoted 按照 separator 拆分 value，双引号内的 separator 不会被拆分，每个元素前后的空白会被去掉，空元素会被忽略
+func splitQuoted(value string, separator byte) []string {
+	var list []string
+	quoted := false
+	escaped := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && value[i] == '\\':
+			escaped = true
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && value[i] == separator:
+			if element := strings.TrimSpace(value[start:i]); len(element) > 0 {
+				list = append(list, element)
+			}
+			start = i + 1
+		}
+	}
+	if element := strings.TrimSpace(value[start:]); len(element) > 0 {
+		list = append(list, element)
+	}
+	return list
+}
+
+// headerList 合并所有同名的请求头，然后拆分成列表
+func headerList(header http.Header, name string) []string {
+	var list []string
+	for _, value := range header.Values(name) {
+		list = append(list, splitHeaderList(value)...)
+	}
+	return list
+}
+
+// headerContainsToken 判断请求头的列表中是否包含 token，不区分大小写
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, element := range headerList(header, name) {
+		if strings.EqualFold(element, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionNames 返回 Sec-WebSocket-Extensions 中每一项的扩展名
+func extensionNames(header http.Header) []string {
+	var names []string
+	for _, offer := range ParseExtensions(header) {
+		names = append(names, offer.Name)
+	}
+	return names
+}
+
+// ExtensionOffer 是 Sec-WebSocket-Extensions 中的一项，客户端的请求和服务端的响应都使用这个格式
+type ExtensionOffer struct {
+	// Name 是扩展名，解析的时候会转成小写
+	Name string
+
+	// Params 是扩展的参数，解析的时候参数名会转成小写，带双引号的值会去掉双引号和转义，没有值的参数对应空字符串
+	Params ExtensionParams
+
+	// Duplicate 表示这一项中有重复的参数，按照 RFC 7692 这样的一项是不合法的，Params 中保存的是最后一个值
+	Duplicate bool
+}
+
+// ParseExtensions 解析所有的 Sec-WebSocket-Extensions 头，按照出现的顺序返回每一项。
+// 同一个头中用逗号分隔的多项和多个同名的头都会被解析，双引号内的逗号和分号不会被拆分。
+func ParseExtensions(header http.Header) []ExtensionOffer {
+	var offers []ExtensionOffer
+	for _, value := range header.Values("sec-websocket-extensions") {
+		offers = append(offers, ParseExtensionList(value)...)
+	}
+	return offers
+}
+
+// ParseExtensionList 解析一个 Sec-WebSocket-Extensions 头的值，没有扩展名或者扩展名不是 token 的项会被忽略，
+// 参数名不是 token 的参数也会被忽略
+func ParseExtensionList(value string) []ExtensionOffer {
+	var offers []ExtensionOffer
+	for _, element := range splitHeaderList(value) {
+		parts := splitQuoted(element, ';')
+		if len(parts) < 1 || strings.HasPrefix(element, ";") || !isToken(parts[0]) {
+			continue
+		}
+		offer := ExtensionOffer{
+			Name:   strings.ToLower(parts[0]),
+			Params: ExtensionParams{},
+		}
+		for _, part := range parts[1:] {
+			key, value, _ := strings.Cut(part, "=")
+			key = strings.ToLower(strings.TrimSpace(key))
+			if !isToken(key) {
+				continue
+			}
+			if _, ok := offer.Params[key]; ok {
+				offer.Duplicate = true
+			}
+			offer.Params[key] = unquote(strings.TrimSpace(value))
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// String 把这一项编码成 Sec-WebSocket-Extensions 中的格式，参数按照名字排序，不是 token 的值会加上双引号
+func (o ExtensionOffer) String() string {
+	keys := make([]string, 0, len(o.Params))
+	for key := range o.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	element := o.Name
+	for _, key := range keys {
+		element += "; " + key
+		if value := o.Params[key]; len(value) > 0 {
+			element += "=" + quote(value)
+		}
+	}
+	return element
+}
+
+// FormatExtensions 把多项编码成一个 Sec-WebSocket-Extensions 头的值
+func FormatExtensions(offers ...ExtensionOffer) string {
+	elements := make([]string, len(offers))
+	for i, offer := range offers {
+		elements[i] = offer.String()
+	}
+	return strings.Join(elements, ", ")
+}
+
+// unquote 去掉 RFC 7230 3.2.6 的 quoted-string 的双引号和转义，不是 quoted-string 的值原样返回
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// quote 在值不是 token 的时候把它编码成 quoted-string
+func quote(value string) string {
+	if isToken(value) {
+		return value
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(value[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// isToken 判断 value 是否是 RFC 7230 3.2.6 的 token
+func isToken(value string) bool {
+	if len(value) < 1 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, element := range list {
+		if strings.EqualFold(element, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package websocket
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSplitHeaderList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: nil},
+		{value: "Upgrade", want: []string{"Upgrade"}},
+		{value: "keep-alive, Upgrade", want: []string{"keep-alive", "Upgrade"}},
+		// 空元素会被忽略
+		{value: " , a,,b ,", want: []string{"a", "b"}},
+		// 双引号内的逗号不会被拆分
+		{value: `a; p="x,y", b`, want: []string{`a; p="x,y"`, "b"}},
+		{value: `a; p="x\",y", b`, want: []string{`a; p="x\",y"`, "b"}},
+	}
+	for _, test := range tests {
+		if got := splitHeaderList(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("splitHeaderList(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestHeaderContainsToken(t *testing.T) {
+	header := http.Header{}
+	header.Add("Connection", "keep-alive")
+	header.Add("Connection", "UPGRADE")
+	header.Add("Upgrade", "websocket-next")
+	if !headerContainsToken(header, "connection", "upgrade") {
+		t.Fatal("a token in the second Connection line is not found")
+	}
+	// 只匹配完整的元素，不匹配子字符串
+	if headerContainsToken(header, "upgrade", "websocket") {
+		t.Fatal("websocket-next matched the websocket token")
+	}
+	header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits, X-Custom")
+	if names := extensionNames(header); !reflect.DeepEqual(names, []string{"permessage-deflate", "x-custom"}) {
+		t.Fatalf("extensionNames() = %q", names)
+	}
+}
+
+func TestParseExtensionList(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []ExtensionOffer
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  nil,
+		},
+		{
+			name:  "single",
+			value: "permessage-deflate",
+			want:  []ExtensionOffer{{Name: "permessage-deflate", Params: ExtensionParams{}}},
+		},
+		{
+			name:  "params",
+			value: "permessage-deflate; client_max_window_bits; server_max_window_bits=10",
+			want: []ExtensionOffer{{Name: "permessage-deflate", Params: ExtensionParams{
+				"client_max_window_bits": "",
+				"server_max_window_bits": "10",
+			}}},
+		},
+		{
+			name:  "case",
+			value: "PerMessage-Deflate; Server_No_Context_Takeover",
+			want:  []ExtensionOffer{{Name: "permessage-deflate", Params: ExtensionParams{"server_no_context_takeover": ""}}},
+		},
+		{
+			name:  "quoted value",
+			value: `permessage-deflate; server_max_window_bits="10"`,
+			want:  []ExtensionOffer{{Name: "permessage-deflate", Params: ExtensionParams{"server_max_window_bits": "10"}}},
+		},
+		{
+			name:  "quoted separators",
+			value: `x-foo; path="/a,b;c=d", x-bar`,
+			want: []ExtensionOffer{
+				{Name: "x-foo", Params: ExtensionParams{"path": "/a,b;c=d"}},
+				{Name: "x-bar", Params: ExtensionParams{}},
+			},
+		},
+		{
+			name:  "escaped quotes",
+			value: `x-foo; say="he said \"hi\", \\o/"; next=1`,
+			want:  []ExtensionOffer{{Name: "x-foo", Params: ExtensionParams{"say": `he said "hi", \o/`, "next": "1"}}},
+		},
+		{
+			name:  "empty elements",
+			value: "a,,b, ,c,",
+			want: []ExtensionOffer{
+				{Name: "a", Params: ExtensionParams{}},
+				{Name: "b", Params: ExtensionParams{}},
+				{Name: "c", Params: ExtensionParams{}},
+			},
+		},
+		{
+			name:  "stray whitespace and semicolons",
+			value: "  a ;; x = 1 ;  ; y ;, \tb\t;",
+			want: []ExtensionOffer{
+				{Name: "a", Params: ExtensionParams{"x": "1", "y": ""}},
+				{Name: "b", Params: ExtensionParams{}},
+			},
+		},
+		{
+			name:  "leading semicolon",
+			value: "; a, b",
+			want:  []ExtensionOffer{{Name: "b", Params: ExtensionParams{}}},
+		},
+		{
+			name:  "duplicate params",
+			value: "permessage-deflate; server_max_window_bits=10; SERVER_MAX_WINDOW_BITS=12",
+			want: []ExtensionOffer{{
+				Name:      "permessage-deflate",
+				Params:    ExtensionParams{"server_max_window_bits": "12"},
+				Duplicate: true,
+			}},
+		},
+		{
+			name:  "bad tokens",
+			value: `"quoted", a b, c/d, ok; bad key=1; =2; "k"=3; good=4`,
+			want:  []ExtensionOffer{{Name: "ok", Params: ExtensionParams{"good": "4"}}},
+		},
+		{
+			name:  "unterminated quote",
+			value: `a; x="1, b`,
+			want:  []ExtensionOffer{{Name: "a", Params: ExtensionParams{"x": `"1, b`}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseExtensionList(test.value)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("ParseExtensionList(%q) = %#v, want %#v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExtensionsMultipleHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Add("Sec-WebSocket-Extensions", "permessage-deflate; client_max_window_bits, x-foo")
+	header.Add("sec-websocket-extensions", "")
+	header.Add("Sec-Websocket-Extensions", `x-bar; v="1,2"`)
+	got := ParseExtensions(header)
+	want := []ExtensionOffer{
+		{Name: "permessage-deflate", Params: ExtensionParams{"client_max_window_bits": ""}},
+		{Name: "x-foo", Params: ExtensionParams{}},
+		{Name: "x-bar", Params: ExtensionParams{"v": "1,2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseExtensions() = %#v, want %#v", got, want)
+	}
+}
+
+func TestFormatExtensions(t *testing.T) {
+	tests := []struct {
+		offers []ExtensionOffer
+		want   string
+	}{
+		{
+			offers: nil,
+			want:   "",
+		},
+		{
+			offers: []ExtensionOffer{{Name: "permessage-deflate", Params: ExtensionParams{
+				"server_no_context_takeover": "",
+				"client_max_window_bits":     "10",
+			}}},
+			want: "permessage-deflate; client_max_window_bits=10; server_no_context_takeover",
+		},
+		{
+			offers: []ExtensionOffer{
+				{Name: "x-foo", Params: ExtensionParams{"path": "/a,b", "say": `"hi" \o/`}},
+				{Name: "x-bar"},
+			},
+			want: `x-foo; path="/a,b"; say="\"hi\" \\o/", x-bar`,
+		},
+	}
+	for _, test := range tests {
+		if got := FormatExtensions(test.offers...); got != test.want {
+			t.Errorf("FormatExtensions(%v) = %q, want %q", test.offers, got, test.want)
+		}
+	}
+}
+
+func TestExtensionsRoundTrip(t *testing.T) {
+	values := []string{
+		"permessage-deflate",
+		"permessage-deflate; client_max_window_bits; server_max_window_bits=10",
+		`x-foo; path="/a,b;c=d"; say="he said \"hi\""`,
+		`x-a; k="v w", x-b, x-c; n=1`,
+		"x-unicode; v=\"caf\u00e9\"",
+	}
+	for _, value := range values {
+		offers := ParseExtensionList(value)
+		formatted := FormatExtensions(offers...)
+		if formatted != value {
+			t.Errorf("FormatExtensions(ParseExtensionList(%q)) = %q", value, formatted)
+		}
+		if again := ParseExtensionList(formatted); !reflect.DeepEqual(again, offers) {
+			t.Errorf("ParseExtensionList(%q) = %#v, want %#v", formatted, again, offers)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+)
+
+// Handler 把一个处理 WebSocket 的函数转换成 http.Handler，使用 DefaultUpgrader 握手，
+// 握手失败的请求已经收到了错误响应，不会调用函数。函数返回之后 WebSocket 会被关闭，函数 panic 的时候会先使用
+// CloseInternalServerErr 关闭连接，再继续 panic。需要其他的 Upgrader 时使用 Upgrader.Handler。
+//
+// 使用例子：
+//
+//	http.Handle("/ws", websocket.Handler(func(ws websocket.WebSocket) {
+//		_ = ws.Send("Hi")
+//	}))
+type Handler func(ws WebSocket)
+
+func (f Handler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	DefaultUpgrader.Handler(f).ServeHTTP(w, request)
+}
+
+// HandlerContext 和 Handler 一样，使用 DefaultUpgrader 握手，函数的 ctx 会在请求结束或者 WebSocket 关闭的时候结束。
+// 对方关闭连接需要被读取到才会让 WebSocket 关闭，所以函数需要在读取 Message，或者开启 BackgroundRead。
+func HandlerContext(f func(ctx context.Context, ws WebSocket)) http.Handler {
+	return DefaultUpgrader.HandlerContext(f)
+}
+
+// Handler 返回一个使用 u 握手，然后调用 f 的 http.Handler，参考 Handler
+func (u *Upgrader) Handler(f func(ws WebSocket)) http.Handler {
+	return u.HandlerContext(func(ctx context.Context, ws WebSocket) {
+		f(ws)
+	})
+}
+
+// HandlerContext 返回一个使用 u 握手，然后调用 f 的 http.Handler，f 的 ctx 会在请求结束或者 WebSocket 关闭的时候结束
+func (u *Upgrader) HandlerContext(f func(ctx context.Context, ws WebSocket)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		ws, err := u.Upgrade(w, request)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithCancel(request.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-ws.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				_ = ws.CloseWithCode(CloseInternalServerErr, "")
+				panic(r)
+			}
+			_ = ws.Close()
+		}()
+		f(ctx, ws)
+	})
+}
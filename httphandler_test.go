@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// handlerServer 返回运行 handler 的服务器和它的 ws URL
+func handlerServer(t *testing.T, handler http.Handler) (*httptest.Server, string) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(handler)
+	// 测试中的 panic 会被 http.Server 记录，不需要输出
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestHandler(t *testing.T) {
+	called := &atomic.Int32{}
+	server, url := handlerServer(t, Handler(func(ws WebSocket) {
+		called.Add(1)
+		_ = ws.Send("hello")
+	}))
+
+	// 不是 WebSocket 握手的请求收到错误响应，不会调用函数
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 400 || called.Load() != 0 {
+		t.Fatalf("plain request got %d and called the function %d times, want an error response", resp.StatusCode, called.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want hello", data, err)
+	}
+	// 函数返回之后连接被关闭，Close 发送不带状态码的 ConnectionClose
+	if _, _, err = ws.ReadAllMessage(); !IsCloseError(err, CloseNoStatusReceived) {
+		t.Fatalf("ReadAllMessage() error = %v, want %d", err, CloseNoStatusReceived)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	_, url := handlerServer(t, Handler(func(ws WebSocket) {
+		panic("boom")
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, _, err = ws.ReadAllMessage(); !IsCloseError(err, CloseInternalServerErr) {
+		t.Fatalf("ReadAllMessage() error = %v, want %d", err, CloseInternalServerErr)
+	}
+}
+
+func TestHandlerContext(t *testing.T) {
+	done := make(chan error, 1)
+	_, url := handlerServer(t, HandlerContext(func(ctx context.Context, ws WebSocket) {
+		ws.BackgroundRead(1)
+		<-ctx.Done()
+		done <- ctx.Err()
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 对方关闭连接之后 ctx 结束
+	_ = ws.Close()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Fatalf("ctx.Err() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ctx was not done after the peer closed the connection")
+	}
+}
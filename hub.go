@@ -0,0 +1,323 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHubQueueSize 是 HubConfig 没有设置 QueueSize 时每个连接的发送队列长度
+const DefaultHubQueueSize = 64
+
+// DefaultStallTimeout 是 HubConfig 没有设置 StallTimeout 时判断连接卡住的时间
+const DefaultStallTimeout = 10 * time.Second
+
+var (
+	ErrHubClosed     = errors.New("hub is closed")
+	ErrSlowConsumer  = errors.New("connection is evicted because it stopped reading broadcasts")
+	ErrNotRegistered = errors.New("connection is not registered to the hub")
+)
+
+// HubConfig 是 Hub 的配置
+type HubConfig struct {
+	// QueueSize 是每个连接的发送队列长度，小于 1 时使用 DefaultHubQueueSize。
+	// 队列满了的连接收不到新的广播，这次广播会被计入 BroadcastResult.Dropped。
+	QueueSize int
+
+	// StallTimeout 是判断连接卡住的时间，连接的队列满了并且正在发送的 Message 超过这个时间还没有发送完的时候，
+	// 下一次广播会把它从 Hub 中移除，并直接关闭连接，关闭原因是 ClosePolicyViolation。小于等于 0 时使用 DefaultStallTimeout。
+	StallTimeout time.Duration
+
+	// OnEvict 不为空时，会在连接因为卡住或者发送出错被移除的时候被调用，err 是 ErrSlowConsumer 或者发送的错误
+	OnEvict func(ws WebSocket, err error)
+}
+
+// Hub 记录一组连接，把同一个 Message 广播给所有的连接，适合聊天室和通知这类服务端。
+// 每个连接有自己的发送队列和发送的 goroutine，慢的连接不会影响其他连接，也不会让 Broadcast 阻塞；
+// Message 会被编码成 PreparedMessage，同一种连接只需要编码和压缩一次。
+// 关闭的连接会自动从 Hub 中移除。
+//
+// 使用例子：
+//
+//	hub := websocket.NewHub(websocket.HubConfig{StallTimeout: 5 * time.Second})
+//	...
+//	ws, err := upgrader.Upgrade(w, r)
+//	err = hub.Register(ws)
+//	...
+//	result, err := hub.Broadcast(websocket.TextFrame, []byte("hello"))
+type Hub struct {
+	config HubConfig
+
+	lock    *sync.Mutex
+	members map[string]*hubMember
+	// rooms 是每个房间的连接，patterns 是包含通配符的房间，都需要持有 lock
+	rooms    map[string]map[string]*hubMember
+	patterns map[string]struct{}
+	closed   bool
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+	evicted atomic.Uint64
+}
+
+// hubMember 是 Hub 中的一个连接
+type hubMember struct {
+	ws    WebSocket
+	queue chan *PreparedMessage
+	done  chan struct{}
+	// progress 是最后一次开始或者发送完一个 Message 的时间（UnixNano），用于判断连接是否卡住
+	progress atomic.Int64
+	// writing 表示发送 goroutine 正在发送，这时连接因为发送出错被关闭，由发送 goroutine 移除连接并调用 OnEvict
+	writing atomic.Bool
+	once    *sync.Once
+	// rooms 是连接加入的房间，需要持有 Hub 的 lock
+	rooms map[string]struct{}
+}
+
+// BroadcastResult 是一次广播的结果
+type BroadcastResult struct {
+	// Queued 是 Message 被放入发送队列的连接数量
+	Queued int
+	// Dropped 是因为队列满了没有收到这次广播的连接数量
+	Dropped int
+	// Evicted 是因为卡住被移除的连接数量
+	Evicted int
+}
+
+// HubStats 是 Hub 从创建以来的统计
+type HubStats struct {
+	// Connections 是 Hub 中现在的连接数量
+	Connections int
+	// Sent 是成功发送的 Message 数量，每个连接分别计算
+	Sent uint64
+	// Dropped 是因为队列满了被丢弃的 Message 数量，每个连接分别计算
+	Dropped uint64
+	// Evicted 是因为卡住或者发送出错被移除的连接数量
+	Evicted uint64
+}
+
+func NewHub(config HubConfig) *Hub {
+	if config.QueueSize < 1 {
+		config.QueueSize = DefaultHubQueueSize
+	}
+	if config.StallTimeout <= 0 {
+		config.StallTimeout = DefaultStallTimeout
+	}
+	return &Hub{
+		config:   config,
+		lock:     &sync.Mutex{},
+		members:  map[string]*hubMember{},
+		rooms:    map[string]map[string]*hubMember{},
+		patterns: map[string]struct{}{},
+	}
+}
+
+// Register 把 ws 加入 Hub，并启动它的发送 goroutine，已经在 Hub 中的连接不会重复加入
+func (h *Hub) Register(ws WebSocket) error {
+	if ws.Status() > OPEN {
+		return ErrClosedStatus
+	}
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return ErrHubClosed
+	}
+	if _, ok := h.members[ws.ID()]; ok {
+		h.lock.Unlock()
+		return nil
+	}
+	m := &hubMember{
+		ws:    ws,
+		queue: make(chan *PreparedMessage, h.config.QueueSize),
+		done:  make(chan struct{}),
+		once:  &sync.Once{},
+		rooms: map[string]struct{}{},
+	}
+	m.progress.Store(time.Now().UnixNano())
+	h.members[ws.ID()] = m
+	h.lock.Unlock()
+
+	go h.drain(m)
+	if w, ok := ws.(*webSocket); ok {
+		w.addCloseHook(func() {
+			if !m.writing.Load() {
+				h.leave(m)
+			}
+		})
+	}
+	return nil
+}
+
+// Unregister 把 ws 从 Hub 和它加入的所有房间中移除，队列中还没有发送的 Message 会被丢弃，不会关闭 ws
+func (h *Hub) Unregister(ws WebSocket) error {
+	h.lock.Lock()
+	m, ok := h.members[ws.ID()]
+	h.lock.Unlock()
+	if !ok {
+		return ErrNotRegistered
+	}
+	h.leave(m)
+	return nil
+}
+
+// Len 返回 Hub 中的连接数量
+func (h *Hub) Len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.members)
+}
+
+// Stats 返回 Hub 的统计
+func (h *Hub) Stats() HubStats {
+	return HubStats{
+		Connections: h.Len(),
+		Sent:        h.sent.Load(),
+		Dropped:     h.dropped.Load(),
+		Evicted:     h.evicted.Load(),
+	}
+}
+
+// Broadcast 把内容是 data 的 Message 放入所有连接的发送队列，不等待发送完成，data 在之后不能被修改
+func (h *Hub) Broadcast(opCode OpCode, data []byte) (BroadcastResult, error) {
+	pm, err := NewPreparedMessage(opCode, data)
+	if err != nil {
+		return BroadcastResult{}, err
+	}
+	return h.BroadcastPrepared(pm)
+}
+
+// BroadcastPrepared 把 pm 放入所有连接的发送队列，不等待发送完成
+func (h *Hub) BroadcastPrepared(pm *PreparedMessage) (BroadcastResult, error) {
+	members, err := h.snapshot()
+	if err != nil {
+		return BroadcastResult{}, err
+	}
+	return h.deliver(members, pm), nil
+}
+
+// Close 移除 Hub 中的所有连接并停止它们的发送 goroutine，连接不会被关闭
+func (h *Hub) Close() error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return nil
+	}
+	h.closed = true
+	members := h.members
+	h.members = map[string]*hubMember{}
+	h.rooms = map[string]map[string]*hubMember{}
+	h.patterns = map[string]struct{}{}
+	h.lock.Unlock()
+	for _, m := range members {
+		m.stop()
+	}
+	return nil
+}
+
+func (h *Hub) snapshot() ([]*hubMember, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, ErrHubClosed
+	}
+	members := make([]*hubMember, 0, len(h.members))
+	for _, m := range h.members {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// deliver 把 pm 放入 members 的发送队列，队列满了并且卡住的连接会被移除
+func (h *Hub) deliver(members []*hubMember, pm *PreparedMessage) BroadcastResult {
+	var result BroadcastResult
+	now := time.Now().UnixNano()
+	for _, m := range members {
+		select {
+		case m.queue <- pm:
+			result.Queued++
+			continue
+		case <-m.done:
+			continue
+		default:
+		}
+		if time.Duration(now-m.progress.Load()) < h.config.StallTimeout {
+			result.Dropped++
+			h.dropped.Add(1)
+			continue
+		}
+		result.Evicted++
+		h.evict(m, ErrSlowConsumer)
+	}
+	return result
+}
+
+// evict 移除 m 并直接关闭连接，卡住的连接可能已经写不出 ConnectionClose 了
+func (h *Hub) evict(m *hubMember, err error) {
+	if !h.leave(m) {
+		return
+	}
+	h.evicted.Add(1)
+	if w, ok := m.ws.(*webSocket); ok {
+		if err == ErrSlowConsumer {
+			w.setCloseInfo(&CloseInfo{
+				Initiator: CloseByLocal,
+				Code:      ClosePolicyViolation,
+				Reason:    err.Error(),
+				Err:       err,
+			})
+		}
+		_ = w.closeStreams()
+	} else {
+		_ = m.ws.Close()
+	}
+	if h.config.OnEvict != nil {
+		h.config.OnEvict(m.ws, err)
+	}
+}
+
+// leave 把 m 从 Hub 中移除并停止它的发送 goroutine，返回 m 是否还在 Hub 中
+func (h *Hub) leave(m *hubMember) bool {
+	h.lock.Lock()
+	current, ok := h.members[m.ws.ID()]
+	if ok && current == m {
+		delete(h.members, m.ws.ID())
+		for room := range m.rooms {
+			h.removeFromRoom(m, room)
+		}
+	}
+	h.lock.Unlock()
+	m.stop()
+	return ok && current == m
+}
+
+func (m *hubMember) stop() {
+	m.once.Do(func() {
+		close(m.done)
+	})
+}
+
+func (h *Hub) drain(m *hubMember) {
+	for {
+		select {
+		case pm := <-m.queue:
+			m.progress.Store(time.Now().UnixNano())
+			m.writing.Store(true)
+			err := m.ws.WritePreparedMessage(pm)
+			m.writing.Store(false)
+			if err == ErrClosedStatus {
+				// 连接在别的地方被关闭，不算作移除
+				h.leave(m)
+				return
+			}
+			if err != nil {
+				h.evict(m, err)
+				return
+			}
+			m.progress.Store(time.Now().UnixNano())
+			h.sent.Add(1)
+		case <-m.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipeWebSocket 返回使用 net.Pipe 的服务端 WebSocket 和对方的连接，对方不读取的时候写入会阻塞
+func newPipeWebSocket(t *testing.T) (WebSocket, net.Conn) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return NewWebSocketWithRole(a, a, RoleServer), b
+}
+
+// errorWriter 的 Write 总是返回 err
+type errorWriter struct {
+	err error
+}
+
+func (w errorWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func (w errorWriter) Close() error {
+	return nil
+}
+
+// waitFor 等待 condition 返回 true
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubEvictsStalledConsumer(t *testing.T) {
+	evicted := make(chan error, 1)
+	var evictedWS WebSocket
+	hub := NewHub(HubConfig{
+		QueueSize:    2,
+		StallTimeout: 100 * time.Millisecond,
+		OnEvict: func(ws WebSocket, err error) {
+			evictedWS = ws
+			evicted <- err
+		},
+	})
+	defer hub.Close()
+
+	stalled, _ := newPipeWebSocket(t)
+	healthy, peer := newPipeWebSocket(t)
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+	if err := hub.Register(stalled); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Register(healthy); err != nil {
+		t.Fatal(err)
+	}
+	hub.lock.Lock()
+	member := hub.members[stalled.ID()]
+	hub.lock.Unlock()
+
+	broadcast := func() BroadcastResult {
+		t.Helper()
+		result, err := hub.Broadcast(TextFrame, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// 第一个 Message 被发送 goroutine 取走，阻塞在写入中
+	if result := broadcast(); result.Queued != 2 {
+		t.Fatalf("first broadcast = %+v, want 2 queued", result)
+	}
+	waitFor(t, "the first message to be dequeued", func() bool {
+		return len(member.queue) == 0
+	})
+	// 之后的 Message 填满队列
+	for i := 0; i < 2; i++ {
+		if result := broadcast(); result.Queued != 2 {
+			t.Fatalf("broadcast %d = %+v, want 2 queued", i+2, result)
+		}
+	}
+	// 队列满了，但是还没有超过 StallTimeout，只丢弃这次广播
+	if result := broadcast(); result.Queued != 1 || result.Dropped != 1 || result.Evicted != 0 {
+		t.Fatalf("broadcast with a full queue = %+v, want 1 queued and 1 dropped", result)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if result := broadcast(); result.Queued != 1 || result.Dropped != 0 || result.Evicted != 1 {
+		t.Fatalf("broadcast after the stall timeout = %+v, want 1 queued and 1 evicted", result)
+	}
+
+	select {
+	case err := <-evicted:
+		if err != ErrSlowConsumer || evictedWS != stalled {
+			t.Fatalf("OnEvict(%v, %v), want the stalled connection and %v", evictedWS, err, ErrSlowConsumer)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnEvict was not called")
+	}
+	if info := stalled.CloseReason(); info == nil || info.Code != ClosePolicyViolation {
+		t.Fatalf("CloseReason() = %+v, want code %d", info, ClosePolicyViolation)
+	}
+	if stalled.Status() != CLOSED {
+		t.Fatalf("Status() = %d, want %d", stalled.Status(), CLOSED)
+	}
+	waitFor(t, "the healthy connection to receive every broadcast", func() bool {
+		return hub.Stats().Sent >= 5
+	})
+	stats := hub.Stats()
+	if stats.Connections != 1 || stats.Dropped != 1 || stats.Evicted != 1 {
+		t.Fatalf("Stats() = %+v, want 1 connection, 1 dropped and 1 evicted", stats)
+	}
+}
+
+func TestHubEvictsOnSendError(t *testing.T) {
+	sendErr := errors.New("broken pipe")
+	evicted := make(chan error, 1)
+	hub := NewHub(HubConfig{OnEvict: func(ws WebSocket, err error) {
+		evicted <- err
+	}})
+	defer hub.Close()
+	reader, _ := io.Pipe()
+	ws := NewWebSocketWithRole(errorWriter{sendErr}, reader, RoleServer)
+	if err := hub.Register(ws); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hub.Broadcast(TextFrame, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-evicted:
+		if !errors.Is(err, sendErr) {
+			t.Fatalf("OnEvict error = %v, want %v", err, sendErr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnEvict was not called after a send error")
+	}
+	if stats := hub.Stats(); stats.Connections != 0 || stats.Evicted != 1 || stats.Sent != 0 {
+		t.Fatalf("Stats() = %+v, want no connections and 1 evicted", stats)
+	}
+}
+
+func TestHubUnregisterAndClose(t *testing.T) {
+	var lock sync.Mutex
+	evictions := 0
+	hub := NewHub(HubConfig{OnEvict: func(ws WebSocket, err error) {
+		lock.Lock()
+		evictions++
+		lock.Unlock()
+	}})
+	first, _ := newPipeWebSocket(t)
+	second, _ := newPipeWebSocket(t)
+	for _, ws := range []WebSocket{first, second, first} {
+		if err := hub.Register(ws); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hub.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", hub.Len())
+	}
+	if err := hub.Unregister(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Unregister(first); err != ErrNotRegistered {
+		t.Fatalf("Unregister() twice error = %v, want %v", err, ErrNotRegistered)
+	}
+	// 关闭的连接自动从 Hub 中移除
+	_ = second.(*webSocket).closeStreams()
+	waitFor(t, "the closed connection to leave the hub", func() bool {
+		return hub.Len() == 0
+	})
+	if first.Status() != OPEN {
+		t.Fatal("Unregister closed the connection")
+	}
+
+	_ = hub.Close()
+	if err := hub.Register(first); err != ErrHubClosed {
+		t.Fatalf("Register() after Close error = %v, want %v", err, ErrHubClosed)
+	}
+	if _, err := hub.Broadcast(TextFrame, nil); err != ErrHubClosed {
+		t.Fatalf("Broadcast() after Close error = %v, want %v", err, ErrHubClosed)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if evictions != 0 {
+		t.Fatalf("OnEvict was called %d times without an eviction", evictions)
+	}
+}
@@ -0,0 +1,332 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/RommHui/websocket"
+)
+
+// Conn 是一个 WebSocket 连接上的 JSON-RPC 2.0 会话，所有的方法都可以在多个 goroutine 中同时调用
+type Conn struct {
+	ws     websocket.WebSocket
+	server *Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    *sync.Mutex
+	nextID  uint64
+	pending map[string]chan *message
+
+	done      chan struct{}
+	err       error
+	closeOnce *sync.Once
+}
+
+// BatchElem 是 CallBatch 中的一个请求
+type BatchElem struct {
+	Method string
+	Params any
+	// Result 不为空时，响应的 result 会被解码到 Result 中
+	Result any
+	// Notify 为 true 时这个请求是通知，不会有响应
+	Notify bool
+	// Error 是这个请求的错误，在 CallBatch 返回之后设置，对方返回错误响应的时候是 *Error
+	Error error
+}
+
+type connKey struct{}
+
+// ConnFromContext 返回 Handler 的 ctx 中收到请求的 Conn，不是 Handler 的 ctx 时返回 nil
+func ConnFromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
+
+// NewConn 在 ws 上创建一个 Conn，并开始在后台读取 ws 的 Message。
+// server 用于处理对方的请求和通知，为空时对方的请求会收到 CodeMethodNotFound。
+// 创建之后 ws 只能由 Conn 读取，但是仍然可以并发地调用 Ping 之类的方法。
+func NewConn(ws websocket.WebSocket, server *Server) *Conn {
+	c := &Conn{
+		ws:        ws,
+		server:    server,
+		lock:      &sync.Mutex{},
+		nextID:    1,
+		pending:   map[string]chan *message{},
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(context.Background(), connKey{}, c))
+	go c.readLoop()
+	return c
+}
+
+// Call 调用对方的 method，并等待响应，result 不为空时响应的 result 会被解码到 result 中。
+// 对方返回错误响应的时候返回 *Error；ctx 结束的时候返回 ctx.Err()，之后收到的响应会被丢弃。
+func (c *Conn) Call(ctx context.Context, method string, params any, result any) error {
+	batch := []*BatchElem{{Method: method, Params: params, Result: result}}
+	err := c.CallBatch(ctx, batch)
+	if err != nil {
+		return err
+	}
+	return batch[0].Error
+}
+
+// Notify 发送一个通知，对方不会回复，所以不知道对方是否处理成功
+func (c *Conn) Notify(ctx context.Context, method string, params any) error {
+	return c.CallBatch(ctx, []*BatchElem{{Method: method, Params: params, Notify: true}})
+}
+
+// CallBatch 把 batch 作为一个批量请求发送，并等待所有的响应，每个请求的结果设置在它的 Result 和 Error 中。
+// 只有一个请求的时候不会使用 JSON 数组。返回的错误是发送失败、连接关闭或者 ctx 结束，这时 batch 中没有收到响应的 Error 也会被设置。
+func (c *Conn) CallBatch(ctx context.Context, batch []*BatchElem) error {
+	if len(batch) < 1 {
+		return ErrEmptyBatch
+	}
+	requests := make([]*request, len(batch))
+	waits := make(map[string]*BatchElem, len(batch))
+	responses := make(chan *message, len(batch))
+	for i, elem := range batch {
+		req := &request{JSONRPC: Version, Method: elem.Method}
+		if elem.Params != nil {
+			params, err := json.Marshal(elem.Params)
+			if err != nil {
+				return err
+			}
+			req.Params = params
+		}
+		if !elem.Notify {
+			req.ID = c.register(responses)
+			waits[string(req.ID)] = elem
+		}
+		requests[i] = req
+	}
+	defer func() {
+		for id := range waits {
+			c.unregister(id)
+		}
+	}()
+
+	var data []byte
+	var err error
+	if len(requests) == 1 {
+		data, err = json.Marshal(requests[0])
+	} else {
+		data, err = json.Marshal(requests)
+	}
+	if err == nil {
+		err = c.send(ctx, data)
+	}
+	for len(waits) > 0 && err == nil {
+		select {
+		case m := <-responses:
+			elem := waits[string(m.ID)]
+			delete(waits, string(m.ID))
+			elem.Error = decodeResult(m, elem.Result)
+		case <-c.done:
+			err = c.Err()
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	for _, elem := range waits {
+		elem.Error = err
+	}
+	return err
+}
+
+// Close 关闭 Conn 和 WebSocket 连接，等待中的 Call 返回 ErrConnClosed
+func (c *Conn) Close() error {
+	c.shutdown(ErrConnClosed)
+	return c.ws.Close()
+}
+
+// Done 返回一个在 Conn 关闭之后会被关闭的 channel
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 返回 Conn 关闭的原因，没有关闭的时候返回 nil
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// WebSocket 返回 Conn 使用的 WebSocket 连接
+func (c *Conn) WebSocket() websocket.WebSocket {
+	return c.ws
+}
+
+func (c *Conn) register(responses chan *message) json.RawMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id := strconv.AppendUint(nil, c.nextID, 10)
+	c.nextID++
+	c.pending[string(id)] = responses
+	return id
+}
+
+func (c *Conn) unregister(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Conn) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		c.pending = map[string]chan *message{}
+		c.lock.Unlock()
+		c.cancel()
+		close(c.done)
+	})
+}
+
+// send 发送一个 Message，发送的时间由 ctx 限制。
+// 等待其他 Message 的时候 ctx 结束不影响连接，已经开始写入之后 ctx 结束，WebSocket 会被关闭，Conn 也随之关闭
+func (c *Conn) send(ctx context.Context, data []byte) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	err := c.ws.WriteMessageContext(ctx, websocket.TextFrame, data)
+	if err != nil && (ctx.Err() == nil || c.ws.Status() != websocket.OPEN) {
+		c.shutdown(err)
+	}
+	return err
+}
+
+func (c *Conn) readLoop() {
+	for {
+		_, data, err := c.ws.ReadAllMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				err = ErrConnClosed
+			}
+			c.shutdown(err)
+			return
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '[' {
+			c.handleBatch(data)
+			continue
+		}
+		m := &message{}
+		if err = json.Unmarshal(data, m); err != nil {
+			code := CodeParseError
+			if json.Valid(data) {
+				code = CodeInvalidRequest
+			}
+			c.reply(&response{JSONRPC: Version, ID: nullID, Error: &Error{Code: code, Message: err.Error()}})
+			continue
+		}
+		if !m.isRequest() {
+			c.dispatch(m)
+			continue
+		}
+		go func() {
+			if resp := c.server.handle(c.ctx, m); resp != nil {
+				c.reply(resp)
+			}
+		}()
+	}
+}
+
+// handleBatch 处理一个 JSON 数组，数组中的响应交给等待的 Call，请求会被同时处理，它们的响应作为一个数组发送
+func (c *Conn) handleBatch(data []byte) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		c.reply(&response{JSONRPC: Version, ID: nullID, Error: &Error{Code: CodeParseError, Message: err.Error()}})
+		return
+	}
+	if len(elems) < 1 {
+		c.reply(&response{JSONRPC: Version, ID: nullID, Error: &Error{Code: CodeInvalidRequest, Message: "empty batch"}})
+		return
+	}
+	var requests []*message
+	var invalid []*response
+	for _, elem := range elems {
+		m := &message{}
+		if err := json.Unmarshal(elem, m); err != nil {
+			invalid = append(invalid, &response{JSONRPC: Version, ID: nullID, Error: &Error{Code: CodeInvalidRequest, Message: err.Error()}})
+			continue
+		}
+		if m.isRequest() {
+			requests = append(requests, m)
+		} else {
+			c.dispatch(m)
+		}
+	}
+	if len(requests) < 1 && len(invalid) < 1 {
+		return
+	}
+	go func() {
+		responses := make([]*response, len(requests))
+		wg := &sync.WaitGroup{}
+		wg.Add(len(requests))
+		for i, m := range requests {
+			go func(i int, m *message) {
+				defer wg.Done()
+				responses[i] = c.server.handle(c.ctx, m)
+			}(i, m)
+		}
+		wg.Wait()
+		batch := invalid
+		for _, resp := range responses {
+			if resp != nil {
+				batch = append(batch, resp)
+			}
+		}
+		if len(batch) < 1 {
+			// 全部是通知的时候不回复
+			return
+		}
+		data, err := json.Marshal(batch)
+		if err == nil {
+			_ = c.send(context.Background(), data)
+		}
+	}()
+}
+
+// dispatch 把响应交给等待它的 Call，没有在等待的响应会被丢弃
+func (c *Conn) dispatch(m *message) {
+	m.ID = bytes.TrimSpace(m.ID)
+	c.lock.Lock()
+	responses, ok := c.pending[string(m.ID)]
+	delete(c.pending, string(m.ID))
+	c.lock.Unlock()
+	if ok {
+		// responses 的容量是批量请求中的请求数量，每个 id 只会放入一次，所以不会阻塞
+		responses <- m
+	}
+}
+
+func (c *Conn) reply(resp *response) {
+	data, err := json.Marshal(resp)
+	if err == nil {
+		_ = c.send(context.Background(), data)
+	}
+}
+
+// decodeResult 返回响应中的错误，或者把 result 解码到 result 中
+func decodeResult(m *message, result any) error {
+	if m.Error != nil {
+		return m.Error
+	}
+	if m.Result == nil {
+		return ErrInvalidResponse
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(m.Result, result)
+}
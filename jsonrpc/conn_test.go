@@ -0,0 +1,289 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RommHui/websocket"
+)
+
+// newPeer 返回使用 server 的 Conn，和通过 net.Pipe 连接到它的 WebSocket，测试直接在 WebSocket 上收发 JSON
+func newPeer(t *testing.T, server *Server) (*Conn, websocket.WebSocket) {
+	a, b := net.Pipe()
+	conn := NewConn(websocket.NewWebSocketWithRole(a, a, websocket.RoleServer), server)
+	peer := websocket.NewWebSocketWithRole(b, b, websocket.RoleClient)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return conn, peer
+}
+
+// newConnPair 返回通过 net.Pipe 连接的两个 Conn，server 用于处理第二个 Conn 收到的请求
+func newConnPair(t *testing.T, server *Server) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	client := NewConn(websocket.NewWebSocketWithRole(a, a, websocket.RoleClient), nil)
+	conn := NewConn(websocket.NewWebSocketWithRole(b, b, websocket.RoleServer), server)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return client, conn
+}
+
+// exchange 通过 peer 发送 data，然后读取一个响应并解码到 v 中
+func exchange(t *testing.T, peer websocket.WebSocket, data string, v any) {
+	t.Helper()
+	if err := peer.WriteMessage(websocket.TextFrame, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	_, reply, err := peer.ReadAllMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(reply, v); err != nil {
+		t.Fatalf("invalid reply %s: %v", reply, err)
+	}
+}
+
+func TestCallOutOfOrderResponses(t *testing.T) {
+	conn, peer := newPeer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	type result struct {
+		params string
+		value  string
+		err    error
+	}
+	results := make(chan result, 2)
+	for _, params := range []string{"first", "second"} {
+		go func(params string) {
+			var value string
+			err := conn.Call(ctx, "echo", params, &value)
+			results <- result{params: params, value: value, err: err}
+		}(params)
+	}
+
+	// 读取两个请求，然后按照相反的顺序回复
+	requests := make([]*message, 2)
+	for i := range requests {
+		_, data, err := peer.ReadAllMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests[i] = &message{}
+		if err = json.Unmarshal(data, requests[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := len(requests) - 1; i >= 0; i-- {
+		data, _ := json.Marshal(&response{JSONRPC: Version, ID: requests[i].ID, Result: requests[i].Params})
+		if err := peer.WriteMessage(websocket.TextFrame, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range requests {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("Call(%q) error = %v", r.params, r.err)
+		}
+		if r.value != r.params {
+			t.Fatalf("Call(%q) = %q, responses were not matched by id", r.params, r.value)
+		}
+	}
+}
+
+func TestBatchMixedEntries(t *testing.T) {
+	server := NewServer()
+	server.Register("add", Method(func(ctx context.Context, params [2]int) (int, error) {
+		return params[0] + params[1], nil
+	}))
+	notified := make(chan string, 1)
+	server.Register("notify", Method(func(ctx context.Context, params string) (any, error) {
+		notified <- params
+		return nil, nil
+	}))
+	_, peer := newPeer(t, server)
+
+	var replies []response
+	exchange(t, peer, `[
+		{"jsonrpc": "2.0", "id": 1, "method": "add", "params": [1, 2]},
+		{"jsonrpc": "2.0", "method": "notify", "params": "hi"},
+		1,
+		{"jsonrpc": "2.0", "id": 2, "method": "missing"}
+	]`, &replies)
+	select {
+	case params := <-notified:
+		if params != "hi" {
+			t.Fatalf("notify params = %q, want %q", params, "hi")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification was not handled")
+	}
+
+	// 通知没有响应，无效的元素和请求的响应都在同一个数组中
+	if len(replies) != 3 {
+		t.Fatalf("got %d responses, want 3: %+v", len(replies), replies)
+	}
+	byID := map[string]response{}
+	for _, reply := range replies {
+		byID[string(reply.ID)] = reply
+	}
+	if reply := byID["null"]; reply.Error == nil || reply.Error.Code != CodeInvalidRequest {
+		t.Fatalf("invalid entry response = %+v, want code %d", reply, CodeInvalidRequest)
+	}
+	if reply := byID["1"]; reply.Error != nil || string(reply.Result) != "3" {
+		t.Fatalf("add response = %+v, want result 3", reply)
+	}
+	if reply := byID["2"]; reply.Error == nil || reply.Error.Code != CodeMethodNotFound {
+		t.Fatalf("missing method response = %+v, want code %d", reply, CodeMethodNotFound)
+	}
+}
+
+func TestBatchOnlyNotifications(t *testing.T) {
+	server := NewServer()
+	notified := make(chan struct{}, 2)
+	server.Register("notify", func(ctx context.Context, params json.RawMessage) (any, error) {
+		notified <- struct{}{}
+		return nil, nil
+	})
+	_, peer := newPeer(t, server)
+	err := peer.WriteMessage(websocket.TextFrame, []byte(`[{"jsonrpc": "2.0", "method": "notify"}, {"jsonrpc": "2.0", "method": "notify"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notified:
+		case <-time.After(2 * time.Second):
+			t.Fatal("notification was not handled")
+		}
+	}
+	// 全部是通知的批量请求没有响应，之后收到的是下一个请求的响应
+	var reply response
+	exchange(t, peer, `{"jsonrpc": "2.0", "id": 7, "method": "missing"}`, &reply)
+	if string(reply.ID) != "7" {
+		t.Fatalf("got response %+v, want the response to id 7", reply)
+	}
+}
+
+func TestParseErrorAndInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		code int
+	}{
+		{name: "malformed object", data: `{"jsonrpc": "2.0", "method"`, code: CodeParseError},
+		{name: "malformed batch", data: `[{"jsonrpc": "2.0"`, code: CodeParseError},
+		{name: "not an object", data: `"hello"`, code: CodeInvalidRequest},
+		{name: "wrong field type", data: `{"jsonrpc": "2.0", "id": 1, "method": 1}`, code: CodeInvalidRequest},
+		{name: "empty batch", data: `[]`, code: CodeInvalidRequest},
+		{name: "wrong version", data: `{"jsonrpc": "1.0", "id": 1, "method": "add"}`, code: CodeInvalidRequest},
+		{name: "unknown method", data: `{"jsonrpc": "2.0", "id": 1, "method": "missing"}`, code: CodeMethodNotFound},
+	}
+	server := NewServer()
+	server.Register("add", Method(func(ctx context.Context, params [2]int) (int, error) {
+		return params[0] + params[1], nil
+	}))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, peer := newPeer(t, server)
+			var reply response
+			exchange(t, peer, test.data, &reply)
+			if reply.Error == nil || reply.Error.Code != test.code {
+				t.Fatalf("response = %+v, want code %d", reply, test.code)
+			}
+		})
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	server := NewServer()
+	server.Register("add", Method(func(ctx context.Context, params [2]int) (int, error) {
+		return params[0] + params[1], nil
+	}))
+	client, _ := newConnPair(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := client.Call(ctx, "add", "one and two", nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeInvalidParams {
+		t.Fatalf("Call() error = %v, want code %d", err, CodeInvalidParams)
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	server := NewServer()
+	server.Register("panic", func(ctx context.Context, params json.RawMessage) (any, error) {
+		panic("boom")
+	})
+	server.Register("ping", Method(func(ctx context.Context, params any) (string, error) {
+		return "pong", nil
+	}))
+	client, _ := newConnPair(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := client.Call(ctx, "panic", nil, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeInternalError || e.Message != "panic: boom" {
+		t.Fatalf("Call() error = %v, want code %d", err, CodeInternalError)
+	}
+	// panic 之后连接仍然可以使用
+	var result string
+	if err = client.Call(ctx, "ping", nil, &result); err != nil || result != "pong" {
+		t.Fatalf("Call() after a panic = %q, %v", result, err)
+	}
+}
+
+func TestCallContextCancelWaitingForResponse(t *testing.T) {
+	conn, peer := newPeer(t, nil)
+	go func() {
+		// 读取请求但是不回复
+		for {
+			if _, _, err := peer.ReadAllMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := conn.Call(ctx, "slow", nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Call() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 请求已经发送完，ctx 结束不影响连接
+	if err := conn.Err(); err != nil {
+		t.Fatalf("Err() = %v after a cancelled Call", err)
+	}
+	conn.lock.Lock()
+	pending := len(conn.pending)
+	conn.lock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d calls are still pending after the ctx ended", pending)
+	}
+}
+
+func TestCallContextCancelStalledWrite(t *testing.T) {
+	// peer 不读取任何数据，请求的写入会一直阻塞
+	conn, _ := newPeer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := conn.Call(ctx, "slow", nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Call() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Call() returned after %v", elapsed)
+	}
+	// 请求只发送了一部分，连接被关闭
+	select {
+	case <-conn.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Conn is still open after a partial write")
+	}
+}
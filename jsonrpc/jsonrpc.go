@@ -0,0 +1,104 @@
+// Package jsonrpc 在 WebSocket 连接上实现 JSON-RPC 2.0（https://www.jsonrpc.org/specification）。
+//
+// 每个请求、通知和响应是一个 TextFrame 的 Message，批量请求和批量响应是一个包含 JSON 数组的 Message。
+// 连接的两边是对等的：每一边都可以用 Call 和 Notify 调用对方，也可以用 Server 中注册的方法处理对方的请求。
+// 同一个连接上可以同时进行多个调用，响应通过 id 和请求对应，不需要按照请求的顺序返回；收到的请求会在各自的 goroutine 中处理。
+//
+// 使用例子：
+//
+//	// 服务端
+//	server := jsonrpc.NewServer()
+//	server.Register("add", jsonrpc.Method(func(ctx context.Context, params [2]int) (int, error) {
+//		return params[0] + params[1], nil
+//	}))
+//	http.Handle("/rpc", websocket.Handler(func(ws websocket.WebSocket) {
+//		conn := jsonrpc.NewConn(ws, server)
+//		<-conn.Done()
+//	}))
+//
+//	// 客户端
+//	conn := jsonrpc.NewConn(ws, nil)
+//	var sum int
+//	err := conn.Call(ctx, "add", []int{1, 2}, &sum)
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Version 是 jsonrpc 字段的值
+const Version = "2.0"
+
+// JSON-RPC 2.0 定义的错误码，-32000 到 -32099 留给服务端自定义
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+var (
+	ErrConnClosed      = errors.New("jsonrpc connection is closed")
+	ErrInvalidResponse = errors.New("invalid jsonrpc response")
+	ErrEmptyBatch      = errors.New("jsonrpc batch is empty")
+)
+
+// Error 是响应中的 error 对象。方法返回 *Error 的时候会原样发送给对方，返回其他错误的时候使用 CodeInternalError；
+// Call 收到错误响应的时候返回 *Error。
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "jsonrpc error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// NewError 返回一个 *Error，data 不为空时会被编码成 JSON 放在 Data 中
+func NewError(code int, message string, data any) *Error {
+	e := &Error{Code: code, Message: message}
+	if data != nil {
+		e.Data, _ = json.Marshal(data)
+	}
+	return e
+}
+
+// message 是收到的请求、通知或者响应，有 method 的是请求或者通知，没有 id 的请求是通知
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (m *message) isRequest() bool {
+	return len(m.Method) > 0
+}
+
+func (m *message) isNotification() bool {
+	return m.isRequest() && len(m.ID) < 1
+}
+
+// request 是发送的请求或者通知
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// response 是发送的响应，成功的时候 Result 至少是 null，id 在无法解析请求的时候是 null
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+var nullID = json.RawMessage("null")
@@ -0,0 +1,101 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Handler 处理一个请求或者通知，params 是请求中原样的 params，没有 params 的时候为空。
+// 返回的 result 会被编码成响应的 result，通知的返回值会被丢弃。
+// ctx 会在连接关闭的时候结束，ConnFromContext 可以从 ctx 中得到收到请求的 Conn，用于回调对方。
+type Handler func(ctx context.Context, params json.RawMessage) (result any, err error)
+
+// Method 把一个参数和返回值都有类型的函数转换成 Handler，params 会被解码成 P，解码失败的时候响应 CodeInvalidParams
+func Method[P, R any](f func(ctx context.Context, params P) (R, error)) Handler {
+	return func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		return f(ctx, params)
+	}
+}
+
+// Server 记录方法名和对应的 Handler，同一个 Server 可以被多个 Conn 共享
+type Server struct {
+	lock    *sync.RWMutex
+	methods map[string]Handler
+}
+
+func NewServer() *Server {
+	return &Server{
+		lock:    &sync.RWMutex{},
+		methods: map[string]Handler{},
+	}
+}
+
+// Register 注册 method 的 Handler，已经注册过的 method 会被替换，handler 为空时删除 method
+func (s *Server) Register(method string, handler Handler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if handler == nil {
+		delete(s.methods, method)
+		return
+	}
+	s.methods[method] = handler
+}
+
+func (s *Server) handler(method string) Handler {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.methods[method]
+}
+
+// handle 调用 m 对应的 Handler，返回需要发送的响应，通知返回 nil
+func (s *Server) handle(ctx context.Context, m *message) *response {
+	result, err := s.call(ctx, m)
+	if m.isNotification() {
+		return nil
+	}
+	resp := &response{JSONRPC: Version, ID: m.ID}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		resp.Result = nil
+		resp.Error = toError(err)
+	}
+	return resp
+}
+
+func (s *Server) call(ctx context.Context, m *message) (result any, err error) {
+	if m.JSONRPC != Version {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "jsonrpc must be " + Version}
+	}
+	handler := s.handler(m.Method)
+	if handler == nil {
+		return nil, &Error{Code: CodeMethodNotFound, Message: "method not found: " + m.Method}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Code: CodeInternalError, Message: fmt.Sprint("panic: ", r)}
+		}
+	}()
+	return handler(ctx, m.Params)
+}
+
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeInternalError, Message: err.Error()}
+}
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+)
+
+// Keepalive 是连接保活的配置，由一个后台 goroutine 定时发送 Ping 并检查对方是否还在响应
+type Keepalive struct {
+	// PingInterval 是自动发送 Ping 的间隔，为 0 时不发送
+	PingInterval time.Duration
+
+	// PongTimeout 是发送 Ping 之后等待对方响应的最长时间，这段时间内没有收到 Pong 或者其他任何帧，连接会被关闭。
+	// 为 0 时不检查。
+	PongTimeout time.Duration
+
+	// IdleTimeout 是没有收发任何数据 Message 的最长时间，超过之后连接会被关闭，控制帧不算作活动。为 0 时不检查。
+	IdleTimeout time.Duration
+
+	// ReadIdleTimeout 是没有收到对方任何帧的最长时间，超过之后连接会被关闭，控制帧也算作活动。为 0 时不检查。
+	// 和 IdleTimeout 不同，自己发送的 Message 不会推迟它，适合对方会定时发送应用层心跳的协议（例如 STOMP 的 heart-beat）。
+	ReadIdleTimeout time.Duration
+
+	// CloseCode 是超时之后关闭连接使用的状态码，为 0 时使用 CloseGoingAway
+	CloseCode uint16
+}
+
+var (
+	ErrIdleTimeout     = errors.New("no data message sent or received within the idle timeout")
+	ErrReadIdleTimeout = errors.New("no frame received from the peer within the read idle timeout")
+)
+
+// SetKeepalive 设置连接的保活配置，会覆盖 Timeouts 中的 PingInterval 和 PongWait。
+// 设置了 PingInterval、IdleTimeout 或者 ReadIdleTimeout 的时候会启动一个后台 goroutine，连接关闭之后自动退出。
+// 收到的帧只有在调用 ReadMessage 或者开启 BackgroundRead 之后才会被处理，长时间不读取的应用需要开启 BackgroundRead。
+func (w *webSocket) SetKeepalive(keepalive Keepalive) {
+	w.keepalive.Store(&keepalive)
+	w.startKeepalive(keepalive)
+}
+
+// getKeepalive 返回 SetKeepalive 设置的配置，没有设置的时候使用 Timeouts 中的 PingInterval 和 PongWait
+func (w *webSocket) getKeepalive() Keepalive {
+	if keepalive := w.keepalive.Load(); keepalive != nil {
+		return *keepalive
+	}
+	timeouts := w.getTimeouts()
+	return Keepalive{
+		PingInterval: timeouts.PingInterval,
+		PongTimeout:  timeouts.PongWait,
+	}
+}
+
+// startKeepalive 在需要的时候启动保活的 goroutine，已经启动的时候唤醒它重新读取配置
+func (w *webSocket) startKeepalive(keepalive Keepalive) {
+	if !keepalive.enabled() {
+		return
+	}
+	w.keepaliveOnce.Do(func() {
+		go w.runKeepalive()
+	})
+	select {
+	case w.keepaliveWake <- struct{}{}:
+	default:
+	}
+}
+
+// runKeepalive 定时发送 Ping，并在对方没有响应或者连接空闲太久的时候关闭连接
+func (w *webSocket) runKeepalive() {
+	done := w.Done()
+	var lastPing, waitingSince time.Time
+	for {
+		keepalive := w.getKeepalive()
+		if !keepalive.enabled() {
+			// 保活被关闭了，等待重新设置
+			select {
+			case <-done:
+				return
+			case <-w.keepaliveWake:
+				continue
+			}
+		}
+		code := keepalive.CloseCode
+		if code == 0 {
+			code = CloseGoingAway
+		}
+		now := time.Now()
+		if lastPing.IsZero() {
+			lastPing = now
+		}
+		// 发送 Ping 之后收到了任何帧都说明对方还在响应
+		if !waitingSince.IsZero() && w.lastRead.Load() >= waitingSince.UnixNano() {
+			waitingSince = time.Time{}
+		}
+
+		var next time.Time
+		if keepalive.IdleTimeout > 0 {
+			idleAt := time.Unix(0, w.lastData.Load()).Add(keepalive.IdleTimeout)
+			if !now.Before(idleAt) {
+				_ = w.fail(code, ErrIdleTimeout.Error())
+				return
+			}
+			next = idleAt
+		}
+		if keepalive.ReadIdleTimeout > 0 {
+			idleAt := time.Unix(0, w.lastRead.Load()).Add(keepalive.ReadIdleTimeout)
+			if !now.Before(idleAt) {
+				_ = w.fail(code, ErrReadIdleTimeout.Error())
+				return
+			}
+			next = earlierTime(next, idleAt)
+		}
+		if keepalive.PongTimeout > 0 && !waitingSince.IsZero() {
+			timeoutAt := waitingSince.Add(keepalive.PongTimeout)
+			if !now.Before(timeoutAt) {
+				_ = w.fail(code, ErrPongTimeout.Error())
+				return
+			}
+			next = earlierTime(next, timeoutAt)
+		}
+		if keepalive.PingInterval > 0 {
+			pingAt := lastPing.Add(keepalive.PingInterval)
+			if !now.Before(pingAt) {
+				// Ping 作为控制帧发送，不需要等待正在发送的大 Message
+				if w.sendControl(Ping, nil) != nil {
+					return
+				}
+				lastPing = now
+				if waitingSince.IsZero() {
+					waitingSince = now
+				}
+				pingAt = now.Add(keepalive.PingInterval)
+			}
+			next = earlierTime(next, pingAt)
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-w.keepaliveWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// enabled 判断是否需要保活的 goroutine
+func (k Keepalive) enabled() bool {
+	return k.PingInterval > 0 || k.IdleTimeout > 0 || k.ReadIdleTimeout > 0
+}
+
+// earlierTime 返回 a 和 b 中更早的一个，零值表示没有设置
+func earlierTime(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepalivePongTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	ws.SetKeepalive(Keepalive{PingInterval: 20 * time.Millisecond, PongTimeout: 50 * time.Millisecond, CloseCode: 4000})
+	// 只读取帧不回复 Pong，在收到关闭帧之前只会收到 Ping
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pings := 0
+	for {
+		frame := &Frame{}
+		if err := frame.Decode(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := io.ReadAll(frame.Payload)
+		if frame.OpCode == ConnectionClose {
+			if code := uint16(payload[0])<<8 | uint16(payload[1]); code != 4000 {
+				t.Fatalf("close code = %d, want 4000", code)
+			}
+			// 不回复关闭帧，直接断开连接
+			_ = b.Close()
+			break
+		}
+		if frame.OpCode != Ping {
+			t.Fatalf("keepalive sent %s, want a Ping", frame)
+		}
+		pings++
+	}
+	if pings == 0 {
+		t.Fatal("keepalive closed the connection without sending a Ping")
+	}
+	select {
+	case <-ws.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done() was not closed")
+	}
+	if info := ws.CloseReason(); info == nil || info.Initiator != CloseByLocal || info.Reason != ErrPongTimeout.Error() {
+		t.Fatalf("CloseReason() = %+v, want a pong timeout", info)
+	}
+}
+
+func TestKeepaliveAnsweredPings(t *testing.T) {
+	client, server := backgroundPair(t, 4)
+	// 对方自动回复 Pong，连接不会因为超时被关闭
+	server.SetKeepalive(Keepalive{PingInterval: 10 * time.Millisecond, PongTimeout: 30 * time.Millisecond})
+	select {
+	case <-server.Done():
+		t.Fatalf("connection closed: %+v", server.CloseReason())
+	case <-time.After(200 * time.Millisecond):
+	}
+	_ = client.Close()
+}
+
+func TestKeepaliveIdleTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		upgrader := &Upgrader{Keepalive: &Keepalive{IdleTimeout: 100 * time.Millisecond, CloseCode: 4001}}
+		ws, err := upgrader.UpgradeStream(a, a)
+		if err != nil {
+			return
+		}
+		for {
+			message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, message)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialer := &Dialer{NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return b, nil
+	}}
+	ws, err := dialer.Dial(ctx, "ws://example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 发送数据 Message 会重新开始计算空闲时间，Ping 不会
+	if err = ws.Send("a"); err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Now()
+	if err = ws.SendMessage(&Message{OpCode: Ping}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ws.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() succeeded, want the idle connection to be closed")
+	}
+	if elapsed := time.Since(sent); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, want at least the idle timeout", elapsed)
+	}
+	if info := ws.CloseReason(); info == nil || info.Initiator != CloseByPeer || info.Code != 4001 {
+		t.Fatalf("CloseReason() = %+v, want code 4001 from the peer", info)
+	}
+}
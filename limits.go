@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrTooManyConnections       = errors.New("too many connections")
+	ErrTooManyConnectionsFromIP = errors.New("too many connections from the same IP")
+	ErrAcceptRateExceeded       = errors.New("connections are accepted too fast")
+)
+
+// ConnectionLimits 是 ConnectionLimiter 的配置，为 0 的限制不会生效
+type ConnectionLimits struct {
+	// MaxConnections 是同时存在的最大连接数量，包括正在握手的连接
+	MaxConnections int
+
+	// MaxConnectionsPerIP 是同一个 IP 同时存在的最大连接数量。IP 来自连接的对端地址（Upgrade 是 request.RemoteAddr），
+	// 服务端在反向代理之后的时候所有的连接都来自代理的 IP。
+	MaxConnectionsPerIP int
+
+	// AcceptRate 是每秒最多接收的新连接数量，AcceptBurst 是可以突发接收的数量，为 0 时等于 AcceptRate
+	AcceptRate  int
+	AcceptBurst int
+
+	// RetryAfter 是超过限制时 503 响应中 Retry-After 头的秒数，为 0 时不发送这个头
+	RetryAfter int
+}
+
+// ConnectionLimiter 限制服务端的连接数量和接收新连接的速度，用于在连接洪泛的时候保护服务端。
+// 超过限制的连接会收到 503 响应。设置到 Upgrader 或者 Server 中使用，同一个 ConnectionLimiter 可以被多个 Upgrader 和 Server 共享。
+//
+// 使用例子：
+//
+//	limiter := websocket.NewConnectionLimiter(websocket.ConnectionLimits{
+//		MaxConnections:      10000,
+//		MaxConnectionsPerIP: 20,
+//		AcceptRate:          200,
+//		RetryAfter:          5,
+//	})
+//	upgrader := &websocket.Upgrader{Limiter: limiter}
+type ConnectionLimiter struct {
+	limits ConnectionLimits
+	bucket *tokenBucket
+
+	lock  *sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	l := &ConnectionLimiter{
+		limits: limits,
+		lock:   &sync.Mutex{},
+		perIP:  map[string]int{},
+	}
+	if limits.AcceptRate > 0 {
+		l.bucket = newTokenBucket(int64(limits.AcceptRate), int64(limits.AcceptBurst))
+	}
+	return l
+}
+
+// Acquire 在接收一个来自 remoteAddr 的连接之前调用，超过限制的时候返回 ErrTooManyConnections、
+// ErrTooManyConnectionsFromIP 或者 ErrAcceptRateExceeded。成功的时候返回 release，连接关闭或者握手失败之后需要调用它，
+// 多次调用 release 只有第一次有效。Upgrader 和 Server 会自己调用 Acquire 和 release。
+func (l *ConnectionLimiter) Acquire(remoteAddr string) (release func(), err error) {
+	ip := remoteIP(remoteAddr)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		return nil, ErrTooManyConnections
+	}
+	if l.limits.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.limits.MaxConnectionsPerIP {
+		return nil, ErrTooManyConnectionsFromIP
+	}
+	// 连接数量的检查不会消耗什么，所以先检查它们，全部通过之后才消耗接收速度的令牌、增加连接数量，
+	// 这样被其中一个限制拒绝的连接不会用掉其他限制的名额
+	if l.bucket != nil && !l.bucket.allow(1) {
+		return nil, ErrAcceptRateExceeded
+	}
+	l.total++
+	l.perIP[ip]++
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			l.release(ip)
+		})
+	}, nil
+}
+
+func (l *ConnectionLimiter) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Len 返回现在的连接数量
+func (l *ConnectionLimiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.total
+}
+
+// rejectHeader 返回超过限制时 503 响应的响应头
+func (l *ConnectionLimiter) rejectHeader() http.Header {
+	header := http.Header{}
+	if l.limits.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(l.limits.RetryAfter))
+	}
+	return header
+}
+
+// acquireFor 为 request 调用 Acquire，超过限制的时候返回需要发送给客户端的 *HandshakeError
+func (l *ConnectionLimiter) acquireFor(request *http.Request) (func(), *HandshakeError) {
+	release, err := l.Acquire(request.RemoteAddr)
+	if err != nil {
+		return nil, &HandshakeError{Status: http.StatusServiceUnavailable, Header: l.rejectHeader(), Err: err}
+	}
+	return release, nil
+}
+
+// releaseOnClose 在 ws 关闭之后调用 release
+func releaseOnClose(ws WebSocket, release func()) {
+	if w, ok := ws.(*webSocket); ok {
+		w.addCloseHook(release)
+		return
+	}
+	go func() {
+		<-ws.Done()
+		release()
+	}()
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiterAcquire(t *testing.T) {
+	limiter := NewConnectionLimiter(ConnectionLimits{MaxConnections: 2, MaxConnectionsPerIP: 1})
+	releaseA, err := limiter.Acquire("10.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = limiter.Acquire("10.0.0.1:1001"); err != ErrTooManyConnectionsFromIP {
+		t.Fatalf("Acquire() from the same IP error = %v, want %v", err, ErrTooManyConnectionsFromIP)
+	}
+	if _, err = limiter.Acquire("10.0.0.2:1000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = limiter.Acquire("10.0.0.3:1000"); err != ErrTooManyConnections {
+		t.Fatalf("Acquire() over MaxConnections error = %v, want %v", err, ErrTooManyConnections)
+	}
+	// 多次调用 release 只有第一次有效
+	releaseA()
+	releaseA()
+	if limiter.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", limiter.Len())
+	}
+	if _, err = limiter.Acquire("10.0.0.1:1002"); err != nil {
+		t.Fatalf("Acquire() after release error = %v", err)
+	}
+}
+
+func TestConnectionLimiterAcceptRate(t *testing.T) {
+	limiter := NewConnectionLimiter(ConnectionLimits{MaxConnectionsPerIP: 1, AcceptRate: 1, AcceptBurst: 2})
+	if _, err := limiter.Acquire("10.0.0.1:1000"); err != nil {
+		t.Fatal(err)
+	}
+	// 被连接数量拒绝的连接不会消耗接收速度的令牌
+	if _, err := limiter.Acquire("10.0.0.1:1001"); err != ErrTooManyConnectionsFromIP {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrTooManyConnectionsFromIP)
+	}
+	if _, err := limiter.Acquire("10.0.0.2:1000"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.Acquire("10.0.0.3:1000"); err != ErrAcceptRateExceeded {
+		t.Fatalf("Acquire() over AcceptBurst error = %v, want %v", err, ErrAcceptRateExceeded)
+	}
+	if limiter.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", limiter.Len())
+	}
+}
+
+func TestUpgraderLimiter(t *testing.T) {
+	limiter := NewConnectionLimiter(ConnectionLimits{MaxConnections: 1, RetryAfter: 5})
+	upgrader := &Upgrader{Limiter: limiter}
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	// 握手失败之后名额被释放
+	if _, err := upgrader.Upgrade(httptest.NewRecorder(), request); err != ErrHijackResponseWriterFailed {
+		t.Fatalf("Upgrade() error = %v, want %v", err, ErrHijackResponseWriterFailed)
+	}
+	if limiter.Len() != 0 {
+		t.Fatalf("Len() after a failed handshake = %d, want 0", limiter.Len())
+	}
+
+	release, err := limiter.Acquire("10.0.0.1:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	_, err = upgrader.Upgrade(recorder, request)
+	var e *HandshakeError
+	if !errors.As(err, &e) || !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("Upgrade() error = %v, want a *HandshakeError with %v", err, ErrTooManyConnections)
+	}
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Fatalf("response %d with Retry-After %q, want 503 with 5", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	release()
+
+	// 连接关闭之后名额被释放
+	_, url := handlerServer(t, upgrader.Handler(func(ws WebSocket) {
+		_, _, _ = ws.ReadAllMessage()
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", limiter.Len())
+	}
+	_ = ws.Close()
+	waitFor(t, "the limiter to release the closed connection", func() bool {
+		return limiter.Len() == 0
+	})
+}
+
+func TestServerLimiter(t *testing.T) {
+	limiter := NewConnectionLimiter(ConnectionLimits{MaxConnections: 1, RetryAfter: 3})
+	if _, err := limiter.Acquire("10.0.0.1:1000"); err != nil {
+		t.Fatal(err)
+	}
+	listener := &connListener{conns: make(chan net.Conn)}
+	defer close(listener.conns)
+	go func() {
+		_ = (&Server{Limiter: limiter}).Serve(listener)
+	}()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	listener.conns <- conn
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := http.ReadResponse(bufio.NewReader(peer), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") != "3" {
+		t.Fatalf("response %d with Retry-After %q, want 503 with 3", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+	if limiter.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", limiter.Len())
+	}
+}
@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DefaultListenerBacklog 是 ListenerConfig 没有设置 Backlog 时等待 Accept 的连接数量
+const DefaultListenerBacklog = 128
+
+// ListenerConfig 是 Listener 的配置
+type ListenerConfig struct {
+	// Upgrader 用于完成握手，为空时使用 DefaultUpgrader
+	Upgrader *Upgrader
+
+	// Backlog 是握手成功之后等待 Accept 的连接数量，小于 1 时使用 DefaultListenerBacklog。
+	// 队列满了的时候新连接的 ServeHTTP 会等待，直到连接被 Accept、请求结束或者 Listener 被关闭。
+	Backlog int
+
+	// Addr 是 Listener.Addr 返回的地址，为空时返回一个 Network 是 "websocket" 的地址
+	Addr net.Addr
+}
+
+// Listener 是一个 net.Listener，Accept 返回的是通过 WebSocket 握手接入的连接，连接使用 NewConn 转换成 net.Conn。
+// Listener 同时是一个 http.Handler，把它注册到 HTTP 服务中接收握手，已有的 TCP 服务（gRPC、Redis 协议或者自定义协议）
+// 可以不修改 accept 循环就放到 WebSocket 后面。
+//
+// 使用例子：
+//
+//	listener := websocket.NewListener(websocket.ListenerConfig{})
+//	http.Handle("/tunnel", listener)
+//	go http.ListenAndServe("0.0.0.0:8080", nil)
+//	grpcServer.Serve(listener)
+type Listener struct {
+	config ListenerConfig
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func NewListener(config ListenerConfig) *Listener {
+	if config.Upgrader == nil {
+		config.Upgrader = DefaultUpgrader
+	}
+	if config.Backlog < 1 {
+		config.Backlog = DefaultListenerBacklog
+	}
+	if config.Addr == nil {
+		config.Addr = listenerAddr("websocket")
+	}
+	return &Listener{
+		config: config,
+		conns:  make(chan net.Conn, config.Backlog),
+		done:   make(chan struct{}),
+		once:   &sync.Once{},
+	}
+}
+
+// ServeHTTP 完成握手，然后把连接交给 Accept。Listener 关闭之后的请求会收到 503 响应。
+func (l *Listener) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	ws, err := l.config.Upgrader.Upgrade(w, request)
+	if err != nil {
+		return
+	}
+	conn := NewConn(ws)
+	select {
+	case l.conns <- conn:
+		// Close 可能在放入之前已经清空了队列
+		select {
+		case <-l.done:
+			l.drain()
+		default:
+		}
+	case <-l.done:
+		_ = ws.CloseWithCode(CloseGoingAway, "")
+	case <-request.Context().Done():
+		_ = ws.CloseWithCode(CloseGoingAway, "")
+	}
+}
+
+// Accept 等待并返回下一个连接，Listener 关闭之后返回 net.ErrClosed
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭 Listener，已经 Accept 的连接不会被关闭，还在等待 Accept 的连接会使用 CloseGoingAway 关闭
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.drain()
+	})
+	return nil
+}
+
+// drain 关闭还在等待 Accept 的连接
+func (l *Listener) drain() {
+	for {
+		select {
+		case conn := <-l.conns:
+			_ = conn.(*wsConn).ws.CloseWithCode(CloseGoingAway, "")
+		default:
+			return
+		}
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.config.Addr
+}
+
+type listenerAddr string
+
+func (a listenerAddr) Network() string {
+	return string(a)
+}
+
+func (a listenerAddr) String() string {
+	return string(a)
+}
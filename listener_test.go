@@ -0,0 +1,143 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewConnRead(t *testing.T) {
+	closePayload := func(code uint16) []byte {
+		return binary.BigEndian.AppendUint16(nil, code)
+	}
+	tests := []struct {
+		name  string
+		close []byte
+		eof   bool
+	}{
+		{name: "normal closure", close: closePayload(CloseNormalClosure), eof: true},
+		{name: "going away", close: closePayload(CloseGoingAway), eof: true},
+		{name: "no status", eof: true},
+		{name: "internal error", close: closePayload(CloseInternalServerErr)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := bytes.Join([][]byte{
+				rawFrame(true, BinaryFrame, 3, []byte("hel")),
+				// 空的 Message 不会让 Read 返回 0
+				rawFrame(true, BinaryFrame, 0, nil),
+				rawFrame(false, TextFrame, 1, []byte("l")),
+				rawFrame(true, ContinuationFrame, 1, []byte("o")),
+				rawFrame(true, ConnectionClose, byte(len(test.close)), test.close),
+			}, nil)
+			conn := NewConn(NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false))
+			// Message 的边界不会被保留
+			data, err := io.ReadAll(conn)
+			if string(data) != "hello" {
+				t.Fatalf("ReadAll() = %q, want hello", data)
+			}
+			if test.eof != (err == nil) {
+				t.Fatalf("ReadAll() error = %v, want io.EOF %v", err, test.eof)
+			}
+			if !test.eof && !IsCloseError(err, CloseInternalServerErr) {
+				t.Fatalf("ReadAll() error = %v, want the close error", err)
+			}
+		})
+	}
+}
+
+func TestNewConnWrite(t *testing.T) {
+	output := &bytes.Buffer{}
+	conn := NewConn(NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false))
+	for _, data := range []string{"hello", "world"} {
+		if n, err := conn.Write([]byte(data)); n != len(data) || err != nil {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+	// 每次 Write 发送一个 BinaryFrame Message
+	want := []sentFrame{
+		{OpCode: BinaryFrame, Fin: true, Payload: []byte("hello")},
+		{OpCode: BinaryFrame, Fin: true, Payload: []byte("world")},
+	}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("late")); err == nil {
+		t.Fatal("Write() after Close succeeded")
+	}
+}
+
+func TestListener(t *testing.T) {
+	listener := NewListener(ListenerConfig{})
+	_, url := handlerServer(t, listener)
+	if listener.Addr().Network() != "websocket" {
+		t.Fatalf("Addr().Network() = %q, want websocket", listener.Addr().Network())
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err = ws.WriteMessage(BinaryFrame, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "ping" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want the echo", data, err)
+	}
+
+	_ = listener.Close()
+	if _, err = listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept() after Close error = %v, want %v", err, net.ErrClosed)
+	}
+	// 已经 Accept 的连接不会被关闭
+	if err = ws.WriteMessage(BinaryFrame, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "again" {
+		t.Fatalf("ReadAllMessage() after Close = %q, %v, want the echo", data, err)
+	}
+	if _, err = DefaultDialer.Dial(ctx, url); dialStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("Dial() after Close error = %v, want %d", err, http.StatusServiceUnavailable)
+	}
+}
+
+func TestListenerCloseDrainsBacklog(t *testing.T) {
+	listener := NewListener(ListenerConfig{Backlog: 1})
+	_, url := handlerServer(t, listener)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// 没有 Accept，握手成功的连接在队列中等待
+	ws, err := DefaultDialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = listener.Close()
+	if _, _, err = ws.ReadAllMessage(); !IsCloseError(err, CloseGoingAway) {
+		t.Fatalf("ReadAllMessage() error = %v, want %d", err, CloseGoingAway)
+	}
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// MaskKeySource 用于生成客户端发送帧时使用的掩码 key
+type MaskKeySource func() [4]byte
+
+// maskKeyBatch 是每次从 crypto/rand 读取的掩码 key 数量，批量读取可以减少系统调用
+const maskKeyBatch = 256
+
+// randomMaskKeys 从 crypto/rand 批量读取随机数，按 4 个字节一组作为掩码 key
+type randomMaskKeys struct {
+	lock   *sync.Mutex
+	buf    []byte
+	offset int
+}
+
+var defaultMaskKeys = &randomMaskKeys{
+	lock: &sync.Mutex{},
+	buf:  make([]byte, 4*maskKeyBatch),
+}
+
+func (r *randomMaskKeys) next() [4]byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.offset == 0 {
+		_, err := io.ReadFull(rand.Reader, r.buf)
+		if err != nil {
+			panic("websocket: read mask key from crypto/rand failed: " + err.Error())
+		}
+	}
+	var key [4]byte
+	copy(key[:], r.buf[r.offset:])
+	r.offset = (r.offset + 4) % len(r.buf)
+	return key
+}
+
+// DefaultMaskKeySource 使用 crypto/rand 生成掩码 key
+var DefaultMaskKeySource MaskKeySource = defaultMaskKeys.next
+
+// SetMaskKeySource 设置发送帧时使用的掩码 key 来源，为空时使用 DefaultMaskKeySource。
+// 可以用于在测试中使用固定的掩码 key，得到确定的输出。
+func (w *webSocket) SetMaskKeySource(source MaskKeySource) {
+	if source == nil {
+		w.maskKeySource.Store(nil)
+		return
+	}
+	w.maskKeySource.Store(&source)
+}
+
+func (w *webSocket) maskKey() [4]byte {
+	if source := w.maskKeySource.Load(); source != nil {
+		return (*source)()
+	}
+	return DefaultMaskKeySource()
+}
+
+// maskBytes 使用掩码 key 对 b 做异或，pos 是 b 的第一个字节在帧内容中的位置对 4 取余的结果，返回下一个字节的位置。
+// 长的数据每次处理 8 个字节：把 key 按照 pos 旋转之后重复成一个 uint64，因为 8 是 4 的倍数，处理之后 pos 不变。
+func maskBytes(key []byte, pos int, b []byte) int {
+	if len(b) >= 16 {
+		var word [8]byte
+		for i := range word {
+			word[i] = key[(pos+i)&0b11]
+		}
+		key64 := binary.LittleEndian.Uint64(word[:])
+		for len(b) >= 32 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^key64)
+			binary.LittleEndian.PutUint64(b[8:], binary.LittleEndian.Uint64(b[8:])^key64)
+			binary.LittleEndian.PutUint64(b[16:], binary.LittleEndian.Uint64(b[16:])^key64)
+			binary.LittleEndian.PutUint64(b[24:], binary.LittleEndian.Uint64(b[24:])^key64)
+			b = b[32:]
+		}
+		for len(b) >= 8 {
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^key64)
+			b = b[8:]
+		}
+	}
+	for i := range b {
+		b[i] ^= key[pos&0b11]
+		pos++
+	}
+	return pos & 0b11
+}
@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestSetMaskKeySource(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), true)
+	ws.SetMaskKeySource(func() [4]byte {
+		return [4]byte{1, 2, 3, 4}
+	})
+	if err := ws.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	// 固定的掩码 key 得到确定的输出
+	want := []byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1}
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Fatalf("sent % x, want % x", output.Bytes(), want)
+	}
+
+	// 为空时恢复使用 DefaultMaskKeySource，每个帧使用新的掩码 key
+	ws.SetMaskKeySource(nil)
+	output.Reset()
+	for i := 0; i < 2; i++ {
+		if err := ws.Send("hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys [][]byte
+	reader := bytes.NewReader(output.Bytes())
+	for reader.Len() > 0 {
+		frame := &Frame{}
+		if err := frame.Decode(context.Background(), reader); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := io.ReadAll(frame.Payload); err != nil || string(data) != "hello" {
+			t.Fatalf("payload = %q, %v, want hello", data, err)
+		}
+		keys = append(keys, frame.MaskKey)
+	}
+	if len(keys) != 2 || bytes.Equal(keys[0], []byte{1, 2, 3, 4}) || bytes.Equal(keys[0], keys[1]) {
+		t.Fatalf("mask keys %v, want two different random keys", keys)
+	}
+}
+
+func TestFrameEncodeMaskKey(t *testing.T) {
+	frame := &Frame{
+		Fin:     true,
+		Mask:    true,
+		MaskKey: []byte{0xff, 0, 0xff, 0},
+		OpCode:  BinaryFrame,
+		Payload: &io.LimitedReader{R: bytes.NewReader([]byte{1, 2}), N: 2},
+	}
+	encoded, err := io.ReadAll(frame.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x82, 0x82, 0xff, 0, 0xff, 0, 0xfe, 2}; !bytes.Equal(encoded, want) {
+		t.Fatalf("Encode() = % x, want % x", encoded, want)
+	}
+	decoded := &Frame{}
+	if err = decoded.Decode(context.Background(), bytes.NewReader(encoded)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.MaskKey, frame.MaskKey) {
+		t.Fatalf("Decode() MaskKey = % x, want % x", decoded.MaskKey, frame.MaskKey)
+	}
+}
+
+func TestRandomMaskKeysRefill(t *testing.T) {
+	keys := map[[4]byte]bool{}
+	// 超过一批之后会重新从 crypto/rand 读取，而不是重复使用上一批
+	for i := 0; i < 2*maskKeyBatch; i++ {
+		keys[DefaultMaskKeySource()] = true
+	}
+	if len(keys) < 2*maskKeyBatch-2 {
+		t.Fatalf("%d distinct keys in %d, want them to be random", len(keys), 2*maskKeyBatch)
+	}
+}
+
+// maskBytewise 是之前 maskingReader 中逐个字节处理的实现，作为 maskBytes 的参照
+func maskBytewise(key []byte, pos int, b []byte) int {
+	for k := range b {
+		b[k] ^= key[pos]
+		pos = (pos + 1) & 0b11
+	}
+	return pos
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	random := rand.New(rand.NewSource(1))
+	source := make([]byte, 4096+8)
+	random.Read(source)
+	lengths := []int{0, 1, 3, 7, 8, 9, 15, 16, 17, 31, 32, 33, 63, 64, 65, 100, 1000, 4096}
+	for offset := 0; offset < 8; offset++ {
+		for _, length := range lengths {
+			for pos := 0; pos < 4; pos++ {
+				want := append([]byte(nil), source[offset:offset+length]...)
+				wantPos := maskBytewise(key, pos, want)
+				// 从缓冲区中没有对齐的位置开始，确认 maskBytes 不依赖内存对齐
+				buf := append([]byte(nil), source...)
+				got := buf[offset : offset+length]
+				gotPos := maskBytes(key, pos, got)
+				if !bytes.Equal(got, want) || gotPos != wantPos {
+					t.Fatalf("offset %d length %d pos %d: maskBytes differs from maskBytewise", offset, length, pos)
+				}
+				if !bytes.Equal(buf[:offset], source[:offset]) || !bytes.Equal(buf[offset+length:], source[offset+length:]) {
+					t.Fatalf("offset %d length %d pos %d: maskBytes modified bytes outside of b", offset, length, pos)
+				}
+			}
+		}
+	}
+}
+
+func TestMaskBytesChunks(t *testing.T) {
+	key := []byte{0xde, 0xad, 0xbe, 0xef}
+	random := rand.New(rand.NewSource(2))
+	data := make([]byte, 10000)
+	random.Read(data)
+	want := append([]byte(nil), data...)
+	maskBytewise(key, 0, want)
+	// 分成长度不规则的多段处理，和 maskingReader 多次 Read 一样，pos 需要在段之间传递
+	got := append([]byte(nil), data...)
+	pos := 0
+	for b := got; len(b) > 0; {
+		n := random.Intn(70)
+		if n > len(b) {
+			n = len(b)
+		}
+		pos = maskBytes(key, pos, b[:n])
+		b = b[n:]
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("chunked maskBytes differs from maskBytewise")
+	}
+}
+
+var maskBenchmarkSizes = []int{7, 64, 1024, 16 * 1024, 64 * 1024}
+
+func benchmarkMask(b *testing.B, mask func(key []byte, pos int, b []byte) int) {
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	for _, size := range maskBenchmarkSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			// 从第 1 个字节开始，测试没有对齐的情况
+			data := make([]byte, size+1)[1:]
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mask(key, 1, data)
+			}
+		})
+	}
+}
+
+func BenchmarkMaskBytewise(b *testing.B) {
+	benchmarkMask(b, maskBytewise)
+}
+
+func BenchmarkMaskWord(b *testing.B) {
+	benchmarkMask(b, maskBytes)
+}
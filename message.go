@@ -4,39 +4,212 @@ import (
 	"context"
 	"errors"
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
 type Message struct {
 	io.Reader
 	OpCode OpCode
+
+	// Compress 用于覆盖连接的压缩设置，true 表示忽略阈值总是压缩，false 表示不压缩，
+	// 例如图片或者加密过的数据这类已经无法压缩的内容。为空时按照 EnableWriteCompression 和 SetCompressionThreshold 决定。
+	Compress *bool
+
+	// Size 大于 0 时是 Reader 内容的长度，用于决定发送时的分片。
+	// 为 0 时如果 Reader 有 Len 方法（例如 bytes.Buffer、bytes.Reader、strings.Reader）会使用 Len 返回的长度，
+	// Reader 是普通文件的时候使用文件剩下的长度。
+	// 作为一个帧发送的时候内容会直接从 Reader 写入连接，超过 Size 的内容不会被发送，不够 Size 的时候连接会被关闭。
+	Size int64
+}
+
+// DefaultFragmentSize 是 SendMessage 默认的分片长度
+const DefaultFragmentSize = fragmentSize
+
+// NoFragmentation 作为 SetFragmentSize 的参数时，长度已知的 Message 会作为一个帧发送，长度未知的仍然按照 DefaultFragmentSize 分片
+const NoFragmentation = -1
+
+// SetFragmentSize 设置 SendMessage 每个分片的最大长度，为 0 时使用 DefaultFragmentSize。
+// 分片越大帧越少，但是发送时暂存数据的缓冲区也越大，不是默认长度的缓冲区由每个连接自己持有。
+func (w *webSocket) SetFragmentSize(size int) {
+	if size < NoFragmentation {
+		size = 0
+	}
+	w.fragmentSize.Store(int64(size))
+}
+
+// messageLength 返回 Message 内容的长度，不知道的时候返回 -1
+func messageLength(message *Message) int64 {
+	if message.Size > 0 {
+		return message.Size
+	}
+	if r, ok := message.Reader.(interface{ Len() int }); ok {
+		return int64(r.Len())
+	}
+	if file, ok := message.Reader.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil || offset > info.Size() {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+// streamsSingleFrame 判断长度是 length 的 Message 是否直接从 Reader 流式发送成一个帧。
+// 比暂存的缓冲区小的 Message 仍然先读入缓冲区，这样帧头和内容可以合并成一次写入。
+func (w *webSocket) streamsSingleFrame(length int64) bool {
+	if length <= fragmentSize {
+		return false
+	}
+	size := w.fragmentSize.Load()
+	return size == NoFragmentation || size >= length
+}
+
+// streamFrame 把 reader 中长度是 length 的内容作为一个帧发送，不经过 sendMessage 暂存分片的缓冲区。
+// 内容不够 length 的时候帧已经无法完整发送，连接会被关闭。
+func (w *webSocket) streamFrame(frame *Frame, reader io.Reader, length int64) error {
+	frame.Fin = true
+	frame.Payload = &io.LimitedReader{
+		R: reader,
+		N: length,
+	}
+	return w.writeFrame(frame.OpCode, time.Time{}, func(output io.Writer) error {
+		if frame.Mask {
+			frame.maskKey = w.maskKey()
+			frame.MaskKey = frame.maskKey[:]
+		}
+		if w.writeBuffer != nil {
+			w.writeBuffer.Reset(output)
+			err := writeFrameStream(w.writeBuffer, frame)
+			if err != nil {
+				return err
+			}
+			return w.writeBuffer.Flush()
+		}
+		return writeFrameStream(output, frame)
+	})
+}
+
+// fragmentBuffer 返回 sendMessage 暂存分片的缓冲区，length 是已知的内容长度，-1 表示不知道。
+// 已知长度的时候缓冲区多留 1 个字节，这样读到内容结束的时候可以直接发送最后一个分片，不需要再发送一个空的分片。
+// 默认长度的缓冲区来自 fragmentPool，pooled 不为空时需要在发送结束之后放回 fragmentPool。
+func (w *webSocket) fragmentBuffer(length int64) (buf []byte, pooled *[fragmentSize]byte) {
+	configured := w.fragmentSize.Load()
+	size := configured
+	if size == NoFragmentation && length >= 0 {
+		size = length + 1
+	} else if size < 1 {
+		size = fragmentSize
+	}
+	if length >= 0 && length+1 < size {
+		size = length + 1
+	}
+	if size <= fragmentSize {
+		fragment := fragmentPool.Get().(*[fragmentSize]byte)
+		return fragment[:size], fragment
+	}
+	if configured < 1 {
+		// NoFragmentation 的缓冲区只用于这一个 Message，不保留在连接上
+		return make([]byte, size), nil
+	}
+	// 只能在持有 sendLock 的时候使用 w.fragment
+	if int64(len(w.fragment)) != configured {
+		w.fragment = make([]byte, configured)
+	}
+	return w.fragment[:size], nil
 }
 
 func (w *webSocket) sendMessage(message *Message) error {
+	var err error
+	if _, ok := w.reservedAllowed(message.OpCode); message.OpCode.IsReserved() && !ok {
+		return ErrReservedOpCode
+	}
 	ctx := context.Background()
-	frame := &Frame{
+	frame := &w.encoder.frame
+	*frame = Frame{
 		Payload: nil,
 		Fin:     false,
 		Mask:    w.mask,
 		OpCode:  message.OpCode,
 	}
-	buf := make([]byte, 2048)
-	offset := 0
 	if message.Reader == nil {
 		message.Reader = emptyReader
 	}
+	reader := message.Reader
+	// 压缩和扩展会改变内容的长度，这时 Message 的长度不能用来决定分片
+	length := messageLength(message)
+	if w.checksum || len(w.extensions) > 0 {
+		length = -1
+	}
+	if !message.OpCode.IsControl() {
+		var rsv byte
+		reader, rsv = w.wrapOutgoing(message.OpCode, reader)
+		if w.checksum {
+			reader = newChecksumReader(reader)
+		}
+		if w.deflate != nil && w.deflate.canCompress() {
+			var compress bool
+			reader, compress, err = w.shouldCompress(message.Compress, reader)
+			if err != nil {
+				return err
+			}
+			if compress {
+				reader = w.deflate.compress(reader, int(w.compressionLevel.Load()))
+				rsv |= 0b100
+				length = -1
+			}
+		}
+		frame.setRsv(rsv)
+	}
+	if !message.OpCode.IsControl() && w.streamsSingleFrame(length) {
+		return w.streamFrame(frame, reader, length)
+	}
+	buf, pooled := w.fragmentBuffer(length)
+	if pooled != nil {
+		defer fragmentPool.Put(pooled)
+	}
+	if message.OpCode.IsControl() && len(buf) > maxControlPayloadLength+1 {
+		// 控制帧不能分片，多读 1 个字节用于判断内容是否超过 125 字节
+		buf = buf[:maxControlPayloadLength+1]
+	}
+	offset := 0
+	lastPing := time.Now()
+	// sent 是已经发送的内容长度，carry 是判断内容是否结束时多读出来的 1 个字节
+	var sent int64
+	carry := w.encoder.carry[:]
+	carried := false
+	payload := &w.encoder.payload
+	data := &w.encoder.data
 	for {
-		n, err := message.Read(buf[offset:])
+		n, err := reader.Read(buf[offset:])
 		if err != nil && err != io.EOF {
 			return err
 		}
 		offset += n
-		if err == nil && n < len(buf) {
+		if err == nil && offset < len(buf) {
 			continue
 		}
-		frame.Payload = &io.LimitedReader{
-			R: newBytesBuffer(buf[:offset]),
-			N: int64(offset),
+		if message.OpCode.IsControl() && offset > maxControlPayloadLength {
+			return ErrControlPayloadTooLong
+		}
+		if err == nil && length >= 0 && sent+int64(offset) >= length {
+			// 已知的长度已经读完，多读 1 个字节确认内容是否结束，避免最后再发送一个空的分片
+			carried, err = readCarry(reader, carry)
+			if err != nil && err != io.EOF {
+				return err
+			}
 		}
+		*data = bytesBuffer{data: buf[:offset]}
+		payload.R, payload.N = data, int64(offset)
+		frame.Payload = payload
+		// buf 是 sendMessage 自己的缓冲区，可以直接加上掩码之后和帧头一起写入
+		frame.data = buf[:offset]
 		frame.Fin = err != nil
 		err = w.sendFrame(ctx, frame)
 		if err != nil {
@@ -45,75 +218,357 @@ func (w *webSocket) sendMessage(message *Message) error {
 		if frame.Fin {
 			return nil
 		}
+		if interval := time.Duration(w.transferKeepalive.Load()); interval > 0 && time.Since(lastPing) >= interval {
+			err = w.sendControl(Ping, nil)
+			if err != nil {
+				return err
+			}
+			lastPing = time.Now()
+		}
+		sent += int64(offset)
 		offset = 0
+		if carried {
+			offset = copy(buf, carry)
+			carried = false
+		}
 		frame.OpCode = ContinuationFrame
+		frame.setRsv(0)
+	}
+}
+
+// readCarry 从 reader 读取 1 个字节到 carry，返回是否读到了数据
+func readCarry(reader io.Reader, carry []byte) (bool, error) {
+	for {
+		n, err := reader.Read(carry)
+		if n > 0 {
+			return true, err
+		}
+		if err != nil {
+			return false, err
+		}
 	}
 }
 
+// SetTransferKeepalive 设置发送大 Message 的时候，在分片之间插入 Ping 帧的间隔，为 0 时不插入。
+// 这样可以避免对方在传输过程中因为没有收到控制帧而认为连接已经空闲。
+func (w *webSocket) SetTransferKeepalive(interval time.Duration) {
+	w.transferKeepalive.Store(int64(interval))
+}
+
 func (w *webSocket) SendMessage(message *Message) error {
 	w.sendLock.Lock()
 	defer w.sendLock.Unlock()
 	return w.sendMessage(message)
 }
 
-var ErrPreviousMessageNotReadToCompletion = errors.New("previous message not read to completion")
+// WriteMessage 发送一个内容是 data 的 Message
+func (w *webSocket) WriteMessage(opCode OpCode, data []byte) error {
+	return w.SendMessage(&Message{
+		Reader: newBytesBuffer(data),
+		OpCode: opCode,
+	})
+}
+
+func (w *webSocket) WriteMessageContext(ctx context.Context, opCode OpCode, data []byte) error {
+	if ctx.Done() == nil {
+		return w.WriteMessage(opCode, data)
+	}
+	if err := w.lockSend(ctx); err != nil {
+		return err
+	}
+	defer w.sendLock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.sendContext = ctx
+	defer func() {
+		w.sendContext = nil
+	}()
+
+	// finished 和 lock 保证 ctx 在 Message 发送完之后结束的时候，不会打断下一个 Message 的写入
+	lock := &sync.Mutex{}
+	finished := false
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			lock.Lock()
+			if !finished && w.writingData.Load() {
+				w.breakWrite()
+			}
+			lock.Unlock()
+		case <-stop:
+		}
+	}()
+	err := w.sendMessage(&Message{
+		Reader: newBytesBuffer(data),
+		OpCode: opCode,
+	})
+	lock.Lock()
+	finished = true
+	lock.Unlock()
+	close(stop)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// lockSend 获取 sendLock，ctx 在获取到之前结束的时候返回 ctx.Err()，之后获取到的 sendLock 会被立刻释放
+func (w *webSocket) lockSend(ctx context.Context) error {
+	if w.sendLock.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		w.sendLock.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			w.sendLock.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// ReadAllMessage 读取下一个 Message 的全部内容
+func (w *webSocket) ReadAllMessage() (OpCode, []byte, error) {
+	message, err := w.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	return message.OpCode, data, nil
+}
+
+var (
+	ErrPreviousMessageNotReadToCompletion = errors.New("previous message not read to completion")
+	ErrReadLimitExceeded                  = errors.New("message exceeds the read limit")
+)
+
+// SetReadLimit 设置收到的单个 Message 的最大长度，包括所有的分片，为 0 时不限制。
+// 超过限制之后会使用 CloseMessageTooBig 关闭连接，读取时返回 ErrReadLimitExceeded。
+func (w *webSocket) SetReadLimit(limit int64) {
+	w.readLimit.Store(limit)
+}
+
+func (w *webSocket) exceedsReadLimit(total int64) bool {
+	limit := w.readLimit.Load()
+	return limit > 0 && total > limit
+}
+
+func (w *webSocket) readLimitExceeded() error {
+	_ = w.fail(CloseMessageTooBig, ErrReadLimitExceeded.Error())
+	return ErrReadLimitExceeded
+}
 
 func (w *webSocket) readMessage() (*Message, error) {
 	w.readLock.Lock()
 	ctx := context.Background()
 	frame, err := w.readFrame(ctx)
 	if err != nil {
+		w.readLock.Unlock()
 		return nil, err
 	}
-	return &Message{
+	if frame.OpCode == ContinuationFrame {
+		w.readLock.Unlock()
+		_ = w.fail(CloseProtocolError, ErrUnexpectedContinuation.Error())
+		return nil, ErrUnexpectedContinuation
+	}
+	rsv := frame.rsv()
+	compressed := frame.Rsv1 && w.deflate != nil
+	// total 是这个 Message 已经收到的帧声明的长度之和，用于在读取内容之前检查 SetReadLimit 的限制
+	total := frame.Payload.N
+	if w.exceedsReadLimit(total) {
+		w.readLock.Unlock()
+		return nil, w.readLimitExceeded()
+	}
+	// finalErr 记录这个 Message 读取结束的原因，读取结束之后 readLock 已经释放，不能再去读底层的流
+	var finalErr error
+	finish := func(err error) (int, error) {
+		finalErr = err
+		w.readLock.Unlock()
+		return 0, err
+	}
+	message := &Message{
 		Reader: rwFunc(func(b []byte) (int, error) {
+			if finalErr != nil {
+				return 0, finalErr
+			}
 			for {
 				if frame != nil {
 					n, readErr := frame.Payload.Read(b)
-					if readErr == io.EOF && frame.Fin != true {
-						readErr = nil
+					if readErr == io.EOF && frame.Payload.N > 0 {
+						readErr = io.ErrUnexpectedEOF
+					}
+					if readErr != nil && readErr != io.EOF {
+						readErr = w.abort(readErr)
+					}
+					if readErr == io.EOF && !frame.Fin {
 						frame = nil
+						if n == 0 {
+							continue
+						}
+						return n, nil
 					}
 					if readErr != nil {
-						w.readLock.Unlock()
+						_, readErr = finish(readErr)
 					}
 					return n, readErr
 				}
-				frame, err = w.readFrame(ctx)
-				if err != nil {
-					return 0, err
+				next, readErr := w.readFrame(ctx)
+				if readErr != nil {
+					return finish(readErr)
+				}
+				// 分片的 Message 还没有结束的时候收到新的数据帧，对方违反了协议
+				if !next.OpCode.IsControl() && next.OpCode != ContinuationFrame {
+					_ = w.fail(CloseProtocolError, ErrPreviousMessageNotReadToCompletion.Error())
+					return finish(ErrPreviousMessageNotReadToCompletion)
 				}
-				if frame.OpCode != ContinuationFrame {
-					return 0, ErrPreviousMessageNotReadToCompletion
+				if next.OpCode == ContinuationFrame {
+					total += next.Payload.N
+					if w.exceedsReadLimit(total) {
+						return finish(w.readLimitExceeded())
+					}
+				}
+				// 控制帧可以插在分片之间，处理完之后继续读取这个 Message 的下一个分片
+				if next.OpCode.IsControl() {
+					readErr = w.interleavedControl(next)
+					if readErr != nil {
+						return finish(readErr)
+					}
+					continue
 				}
+				frame = next
 			}
 		}),
 		OpCode: frame.OpCode,
-	}, nil
+	}
+	if compressed {
+		message.Reader = w.decompress(message.Reader)
+	}
+	if w.checksum && !message.OpCode.IsControl() {
+		message.Reader = w.verifyChecksum(message.Reader)
+	}
+	if !message.OpCode.IsControl() {
+		message.Reader = w.wrapIncoming(message.OpCode, rsv, message.Reader)
+	}
+	if message.OpCode == TextFrame && !w.skipUTF8.Load() {
+		message.Reader = w.validateUTF8(message.Reader)
+	}
+	return message, nil
 }
 
 func (w *webSocket) ReadMessage() (*Message, error) {
+	interceptors := w.interceptors.Load()
+	if interceptors == nil {
+		return w.nextMessage()
+	}
+	for {
+		message, err := w.nextMessage()
+		if err != nil {
+			return nil, err
+		}
+		message, err = w.intercept(*interceptors, message)
+		if err != nil || message != nil {
+			return message, err
+		}
+	}
+}
+
+// nextMessage 返回下一个需要交给应用的 Message，不经过 MessageInterceptor
+func (w *webSocket) nextMessage() (*Message, error) {
+	if message := w.popPending(); message != nil {
+		return message, nil
+	}
+	if w.background != nil {
+		return w.background.readMessage()
+	}
 	for {
 		message, err := w.readMessage()
 		if err != nil {
 			return nil, err
 		}
-		if message.OpCode == Ping {
-			err = w.responsePong(message)
-			if err != nil {
-				return nil, err
-			}
-		} else if message.OpCode == ConnectionClose {
-			err = w.Close()
-			if err != nil {
-				return nil, err
-			}
-			_, err = io.Copy(blackHole, message)
-			if err != nil {
-				return nil, err
-			}
-		} else {
+		if !w.handled(message) {
 			return message, nil
 		}
+		err = w.handleControl(message)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handled 用于判断 Message 是否由 WebSocket 对象自己处理，否则需要交给应用
+func (w *webSocket) handled(message *Message) bool {
+	if message.OpCode == Ping {
+		return w.getHandlers().ping != nil || w.autoPong()
+	}
+	if message.OpCode.IsReserved() {
+		handler, _ := w.reservedAllowed(message.OpCode)
+		return handler != nil
+	}
+	return message.OpCode.IsControl()
+}
+
+// handleControl 处理收到的控制帧：回复 Ping，把 Pong 交给对应的 Ping，处理 ConnectionClose
+func (w *webSocket) handleControl(message *Message) error {
+	switch message.OpCode {
+	case Ping:
+		return w.responsePong(message)
+	case Pong:
+		return w.receivePong(message)
+	case ConnectionClose:
+		return w.responseClose(message)
+	default:
+		if handler, _ := w.reservedAllowed(message.OpCode); handler != nil {
+			return w.handleReserved(handler, message)
+		}
+		_, err := io.Copy(blackHole, message)
+		return err
+	}
+}
+
+// interleavedControl 处理在分片的 Message 中间收到的控制帧。
+// 不由 WebSocket 对象自己处理的控制帧（例如关闭了自动回复时的 Ping）会读入内存，在下一次 ReadMessage 的时候返回。
+func (w *webSocket) interleavedControl(frame *Frame) error {
+	message := &Message{
+		Reader: frame.Payload,
+		OpCode: frame.OpCode,
+	}
+	if w.handled(message) {
+		return w.handleControl(message)
+	}
+	message, err := bufferMessage(message)
+	if err != nil {
+		return err
+	}
+	w.pushPending(message)
+	return nil
+}
+
+func (w *webSocket) pushPending(message *Message) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	w.pending = append(w.pending, message)
+}
+
+func (w *webSocket) popPending() *Message {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	if len(w.pending) < 1 {
+		return nil
 	}
+	message := w.pending[0]
+	w.pending[0] = nil
+	w.pending = w.pending[1:]
+	return message
 }
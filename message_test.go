@@ -0,0 +1,388 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteMessage(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.WriteMessage(BinaryFrame, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WriteMessage(TextFrame, nil); err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 2 {
+		t.Fatalf("sent %d frames, want 2", len(frames))
+	}
+	if frames[0].OpCode != BinaryFrame || !frames[0].Fin || !bytes.Equal(frames[0].Payload, []byte{1, 2, 3}) {
+		t.Fatalf("first frame = %+v, want a binary frame with 01 02 03", frames[0])
+	}
+	if frames[1].OpCode != TextFrame || !frames[1].Fin || len(frames[1].Payload) > 0 {
+		t.Fatalf("second frame = %+v, want an empty text frame", frames[1])
+	}
+}
+
+func TestReadAllMessage(t *testing.T) {
+	// 一个分成两片的 BinaryFrame，后面跟着一个 TextFrame
+	input := []byte{0x02, 2, 'a', 'b', 0x80, 1, 'c', 0x81, 2, 'h', 'i'}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	tests := []struct {
+		opCode OpCode
+		data   string
+	}{
+		{opCode: BinaryFrame, data: "abc"},
+		{opCode: TextFrame, data: "hi"},
+	}
+	for _, test := range tests {
+		opCode, data, err := ws.ReadAllMessage()
+		if err != nil || opCode != test.opCode || string(data) != test.data {
+			t.Fatalf("ReadAllMessage() = %d, %q, %v, want %d, %q", opCode, data, err, test.opCode, test.data)
+		}
+	}
+	if _, data, err := ws.ReadAllMessage(); err == nil {
+		t.Fatalf("ReadAllMessage() at the end of the stream = %q, want an error", data)
+	}
+
+	// Message 的内容不完整的时候返回错误
+	ws = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader([]byte{0x81, 5, 'h', 'i'})), false)
+	if _, data, err := ws.ReadAllMessage(); err == nil {
+		t.Fatalf("ReadAllMessage() of a truncated frame = %q, want an error", data)
+	}
+}
+
+func TestWriteMessageContextInterruptsStalledWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// 对方不读取数据，写入会一直阻塞到 ctx 结束
+	err := ws.WriteMessageContext(ctx, BinaryFrame, bytes.Repeat([]byte{'a'}, 1<<20))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("WriteMessageContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("WriteMessageContext() returned after %v", elapsed)
+	}
+	// Message 只发送了一部分，连接需要被关闭
+	if ws.Status() != CLOSED {
+		t.Fatalf("Status() = %d, want %d", ws.Status(), CLOSED)
+	}
+}
+
+func TestWriteMessageContextWaitingForLock(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	ws := NewWebSocket(writer, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+	// 模拟另一个正在发送的 Message
+	ws.sendLock.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ws.WriteMessageContext(ctx, TextFrame, []byte("hello")); err != context.DeadlineExceeded {
+		t.Fatalf("WriteMessageContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if ws.Status() != OPEN {
+		t.Fatalf("Status() = %d, want %d", ws.Status(), OPEN)
+	}
+	ws.sendLock.Unlock()
+
+	// 没有开始写入的 Message 不影响之后的发送
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+	if err := ws.WriteMessageContext(context.Background(), TextFrame, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessageContext() error = %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ws.WriteMessageContext(ctx, TextFrame, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessageContext() error = %v", err)
+	}
+}
+
+func TestConcurrentWritersDoNotInterleave(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	sender := NewWebSocket(a, a, true)
+	receiver := NewWebSocket(b, b, false)
+	// 发送端读取接收端自动回复的 Pong
+	go func() {
+		for {
+			if _, err := sender.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const writers = 8
+	const size = 10000
+	wg := &sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 3 {
+			case 0:
+				err = sender.WriteMessage(BinaryFrame, data)
+			case 1:
+				err = sender.SendMessage(&Message{Reader: bytes.NewReader(data), OpCode: BinaryFrame})
+			default:
+				var writer io.WriteCloser
+				writer, err = sender.NextWriter(BinaryFrame)
+				for offset := 0; err == nil && offset < size; offset += 1000 {
+					_, err = writer.Write(data[offset : offset+1000])
+				}
+				if err == nil {
+					err = writer.Close()
+				}
+			}
+			if err != nil {
+				t.Errorf("writer %d: %v", i, err)
+			}
+		}(i)
+	}
+	// 发送的同时修改设置和插入控制帧
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			sender.SetTransferKeepalive(time.Duration(i%2) * time.Nanosecond)
+			_ = sender.WriteControl(Ping, []byte("beat"), time.Time{})
+		}
+	}()
+
+	seen := map[byte]bool{}
+	for i := 0; i < writers; i++ {
+		_, data, err := receiver.ReadAllMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 每个 Message 只包含同一个 writer 的数据
+		if len(data) != size || !bytes.Equal(data, bytes.Repeat(data[:1], size)) {
+			t.Fatalf("message %d has %d bytes mixed from several writers", i, len(data))
+		}
+		seen[data[0]] = true
+	}
+	wg.Wait()
+	if len(seen) != writers {
+		t.Fatalf("received messages from %d writers, want %d", len(seen), writers)
+	}
+}
+
+// unsizedReader 隐藏 Reader 的 Len 方法，让 Message 的长度未知
+type unsizedReader struct {
+	io.Reader
+}
+
+func TestSetFragmentSize(t *testing.T) {
+	data := strings.Repeat("a", 5000)
+	tests := []struct {
+		name    string
+		size    int
+		message func() *Message
+		want    []int
+	}{
+		{name: "default", message: func() *Message {
+			return &Message{Reader: strings.NewReader(data), OpCode: TextFrame}
+		}, want: []int{2048, 2048, 904}},
+		{name: "small fragments", size: 1000, message: func() *Message {
+			return &Message{Reader: strings.NewReader(data), OpCode: TextFrame}
+		}, want: []int{1000, 1000, 1000, 1000, 1000}},
+		{name: "no fragmentation", size: NoFragmentation, message: func() *Message {
+			return &Message{Reader: strings.NewReader(data), OpCode: TextFrame}
+		}, want: []int{5000}},
+		// Size 提供了 Reader 无法提供的长度
+		{name: "size hint", size: NoFragmentation, message: func() *Message {
+			return &Message{Reader: unsizedReader{strings.NewReader(data)}, OpCode: TextFrame, Size: 5000}
+		}, want: []int{5000}},
+		// 长度未知的时候按照 DefaultFragmentSize 分片，读到结束之后才发送最后一个分片
+		{name: "unknown length", size: NoFragmentation, message: func() *Message {
+			return &Message{Reader: unsizedReader{strings.NewReader(data)}, OpCode: TextFrame}
+		}, want: []int{2048, 2048, 904}},
+		{name: "large fragments", size: 4096, message: func() *Message {
+			return &Message{Reader: strings.NewReader(data), OpCode: TextFrame}
+		}, want: []int{4096, 904}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+			ws.SetFragmentSize(test.size)
+			// 发送两次，确认连接持有的缓冲区可以复用
+			for i := 0; i < 2; i++ {
+				output.Reset()
+				if err := ws.SendMessage(test.message()); err != nil {
+					t.Fatal(err)
+				}
+				var sizes []int
+				var sent []byte
+				for _, frame := range decodeFrames(t, output.Bytes()) {
+					sizes = append(sizes, len(frame.Payload))
+					sent = append(sent, frame.Payload...)
+				}
+				if !reflect.DeepEqual(sizes, test.want) || string(sent) != data {
+					t.Fatalf("fragments = %v, want %v", sizes, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendMessageSingleFrame(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	tests := []struct {
+		name         string
+		fragmentSize int
+		mask         bool
+		// 长度从 Size 得到还是从 Reader 的 Len 得到
+		size   bool
+		frames int
+	}{
+		{name: "default", frames: 5},
+		{name: "no fragmentation", fragmentSize: NoFragmentation, frames: 1},
+		{name: "no fragmentation masked", fragmentSize: NoFragmentation, mask: true, frames: 1},
+		{name: "no fragmentation size", fragmentSize: NoFragmentation, size: true, frames: 1},
+		{name: "large fragment", fragmentSize: len(content), mask: true, size: true, frames: 1},
+		{name: "small fragment", fragmentSize: len(content) - 1, size: true, frames: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), test.mask)
+			ws.SetFragmentSize(test.fragmentSize)
+			message := &Message{OpCode: BinaryFrame, Reader: bytes.NewReader(content)}
+			if test.size {
+				// 去掉 Len 方法，只能通过 Size 知道长度
+				message.Reader = struct{ io.Reader }{bytes.NewReader(content)}
+				message.Size = int64(len(content))
+			}
+			if err := ws.SendMessage(message); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			frames := decodeFrames(t, output.Bytes())
+			if len(frames) != test.frames {
+				t.Fatalf("sent %d frames, want %d", len(frames), test.frames)
+			}
+			var payload []byte
+			for i, frame := range frames {
+				if frame.Mask != test.mask || frame.Fin != (i == len(frames)-1) {
+					t.Fatalf("frame %d Mask = %v Fin = %v", i, frame.Mask, frame.Fin)
+				}
+				payload = append(payload, frame.Payload...)
+			}
+			if !bytes.Equal(payload, content) {
+				t.Fatalf("sent %d bytes, want the %d bytes of the message", len(payload), len(content))
+			}
+		})
+	}
+}
+
+func TestSendMessageSize(t *testing.T) {
+	content := bytes.Repeat([]byte{'a'}, 4*fragmentSize)
+
+	// 超过 Size 的内容不会被发送
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	ws.SetFragmentSize(NoFragmentation)
+	err := ws.SendMessage(&Message{OpCode: BinaryFrame, Reader: bytes.NewReader(content), Size: 3 * fragmentSize})
+	if err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if frames := decodeFrames(t, output.Bytes()); len(frames) != 1 || len(frames[0].Payload) != 3*fragmentSize {
+		t.Fatalf("sent frames %d, want one frame of %d bytes", len(frames), 3*fragmentSize)
+	}
+
+	// 内容不够 Size 的时候帧已经无法完整发送，连接会被关闭
+	ws = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	ws.SetFragmentSize(NoFragmentation)
+	err = ws.SendMessage(&Message{OpCode: BinaryFrame, Reader: bytes.NewReader(content), Size: 5 * fragmentSize})
+	if err == nil {
+		t.Fatal("SendMessage() with a short reader succeeded")
+	}
+	if ws.Status() != CLOSED {
+		t.Fatalf("Status() = %d, want %d", ws.Status(), CLOSED)
+	}
+	if err := ws.Send("hello"); err != ErrClosedStatus {
+		t.Fatalf("Send() after the short message error = %v, want %v", err, ErrClosedStatus)
+	}
+}
+
+type slowReader struct {
+	chunks [][]byte
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestTransferKeepaliveInterleavesPings(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocketWithRole(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), RoleClient)
+	ws.SetFragmentSize(4)
+	ws.SetTransferKeepalive(time.Millisecond)
+	data := []byte("aaaabbbbcccc")
+	err := ws.SendMessage(&Message{
+		OpCode: BinaryFrame,
+		Reader: &slowReader{chunks: [][]byte{data[:4], data[4:8], data[8:]}, delay: 5 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := &frameDecoder{}
+	reader := bytes.NewReader(output.Bytes())
+	var received []byte
+	var opCodes []OpCode
+	fin := false
+	for reader.Len() > 0 {
+		frame, err := decoder.decode(context.Background(), reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := io.ReadAll(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !frame.Mask {
+			t.Fatalf("%s is not masked", frame)
+		}
+		opCodes = append(opCodes, frame.OpCode)
+		if frame.OpCode == Ping {
+			if fin || len(payload) != 0 {
+				t.Fatalf("unexpected ping %s with payload %q after fin %v", frame, payload, fin)
+			}
+			continue
+		}
+		received = append(received, payload...)
+		fin = frame.Fin
+	}
+	if !fin || !bytes.Equal(received, data) {
+		t.Fatalf("received %q fin %v, want %q", received, fin, data)
+	}
+	// 每个分片之间都经过了超过 interval 的时间，所以第一个分片之后紧跟着 Ping
+	if len(opCodes) < 3 || opCodes[0] != BinaryFrame || opCodes[1] != Ping {
+		t.Fatalf("sent frames %v, want pings between fragments", opCodes)
+	}
+}
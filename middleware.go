@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// UpgradeHandler 处理一个握手请求，返回握手成功的 WebSocket 对象，Upgrader.Upgrade 就是一个 UpgradeHandler
+type UpgradeHandler func(w http.ResponseWriter, request *http.Request) (WebSocket, error)
+
+// UpgradeMiddleware 包装一个 UpgradeHandler。它可以在调用 next 之前检查或者修改握手请求，
+// 拒绝的时候自己通过 w 写入错误响应并返回错误，不调用 next；也可以在 next 返回之后设置 WebSocket 对象，例如调用 Set 保存用户身份。
+//
+// 使用例子：
+//
+//	logging := func(next websocket.UpgradeHandler) websocket.UpgradeHandler {
+//		return func(w http.ResponseWriter, request *http.Request) (websocket.WebSocket, error) {
+//			ws, err := next(w, request)
+//			log.Println(request.RemoteAddr, err)
+//			return ws, err
+//		}
+//	}
+//	upgrader := &websocket.Upgrader{Middleware: []websocket.UpgradeMiddleware{logging}}
+type UpgradeMiddleware func(next UpgradeHandler) UpgradeHandler
+
+// chainUpgrade 用 middleware 包装 handler，middleware[0] 在最外层
+func chainUpgrade(handler UpgradeHandler, middleware []UpgradeMiddleware) UpgradeHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// MessageInterceptor 在 ReadMessage 把 Message 交给应用之前被调用，可以用于认证、日志、长度限制和内容转换：
+//   - 返回 message 本身或者一个新的 Message，新的 Message 会交给下一个 MessageInterceptor 和应用。
+//     新的 Message 需要保证原来的 Message 会被完整读取，例如先读取原来的全部内容，或者包装原来的 Reader；
+//   - 返回 nil 和 nil 会丢弃这个 Message，没有读取的内容会被丢弃，ReadMessage 继续读取下一个 Message；
+//   - 返回错误会拒绝这个 Message 并关闭连接，ReadMessage 返回这个错误。错误是 *CloseError 并且状态码可以发送的时候
+//     使用它的状态码和原因关闭，否则使用 ClosePolicyViolation。
+type MessageInterceptor func(ws WebSocket, message *Message) (*Message, error)
+
+func (w *webSocket) Intercept(interceptors ...MessageInterceptor) {
+	for {
+		current := w.interceptors.Load()
+		var all []MessageInterceptor
+		if current != nil {
+			all = append(all, *current...)
+		}
+		all = append(all, interceptors...)
+		if w.interceptors.CompareAndSwap(current, &all) {
+			return
+		}
+	}
+}
+
+// intercept 按照顺序调用 interceptors，返回 nil 和 nil 表示 Message 被丢弃了
+func (w *webSocket) intercept(interceptors []MessageInterceptor, message *Message) (*Message, error) {
+	original := message
+	for _, interceptor := range interceptors {
+		next, err := interceptor(w, message)
+		if err != nil {
+			code, reason := ClosePolicyViolation, err.Error()
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && validCloseCode(closeErr.Code) {
+				// 1005、1006、1015 这类不能发送的状态码仍然使用 ClosePolicyViolation
+				code, reason = closeErr.Code, closeErr.Reason
+			}
+			_ = w.fail(code, reason)
+			return nil, err
+		}
+		if next == nil {
+			_, _ = io.Copy(io.Discard, original)
+			return nil, nil
+		}
+		message = next
+	}
+	return message, nil
+}
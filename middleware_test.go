@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradeMiddlewareOrder(t *testing.T) {
+	var calls []string
+	middleware := func(name string) UpgradeMiddleware {
+		return func(next UpgradeHandler) UpgradeHandler {
+			return func(w http.ResponseWriter, request *http.Request) (WebSocket, error) {
+				calls = append(calls, name+" before")
+				ws, err := next(w, request)
+				calls = append(calls, name+" after")
+				return ws, err
+			}
+		}
+	}
+	handler := chainUpgrade(func(w http.ResponseWriter, request *http.Request) (WebSocket, error) {
+		calls = append(calls, "upgrade")
+		return nil, nil
+	}, []UpgradeMiddleware{middleware("first"), middleware("second")})
+	_, _ = handler(nil, nil)
+	want := []string{"first before", "second before", "upgrade", "second after", "first after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+}
+
+// tagKey 是测试中 Middleware 使用 Set 保存的 key
+type tagKey struct{}
+
+func TestUpgradeMiddlewareReject(t *testing.T) {
+	reject := func(next UpgradeHandler) UpgradeHandler {
+		return func(w http.ResponseWriter, request *http.Request) (WebSocket, error) {
+			if request.URL.Query().Get("token") != "secret" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return nil, ErrForbidden
+			}
+			return next(w, request)
+		}
+	}
+	tag := func(next UpgradeHandler) UpgradeHandler {
+		return func(w http.ResponseWriter, request *http.Request) (WebSocket, error) {
+			ws, err := next(w, request)
+			if err == nil {
+				ws.Set(tagKey{}, "middleware")
+			}
+			return ws, err
+		}
+	}
+	upgrader := &Upgrader{Middleware: []UpgradeMiddleware{reject, tag}}
+	_, url := handlerServer(t, upgrader.Handler(func(ws WebSocket) {
+		value, _ := ws.Value(tagKey{}).(string)
+		_ = ws.Send(value)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 被 Middleware 拒绝的请求收到它写入的响应，不会握手
+	if _, err := DefaultDialer.Dial(ctx, url); dialStatus(err) != http.StatusForbidden {
+		t.Fatalf("Dial() without the token error = %v, want %d", err, http.StatusForbidden)
+	}
+	ws, err := DefaultDialer.Dial(ctx, url+"?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "middleware" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want the value set by the middleware", data, err)
+	}
+}
+
+func TestMessageInterceptorDropAndReplace(t *testing.T) {
+	input := bytes.Join([][]byte{
+		rawFrame(true, TextFrame, 4, []byte("drop")),
+		rawFrame(true, TextFrame, 5, []byte("hello")),
+	}, nil)
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	var seen []string
+	ws.Intercept(
+		func(ws WebSocket, message *Message) (*Message, error) {
+			data, err := io.ReadAll(message)
+			if err != nil {
+				return nil, err
+			}
+			seen = append(seen, string(data))
+			if string(data) == "drop" {
+				return nil, nil
+			}
+			// 原来的内容已经读完，返回新的 Message
+			return &Message{OpCode: message.OpCode, Reader: strings.NewReader(strings.ToUpper(string(data)))}, nil
+		},
+		func(ws WebSocket, message *Message) (*Message, error) {
+			// 后面的 MessageInterceptor 收到前面替换之后的 Message
+			seen = append(seen, "second")
+			return message, nil
+		},
+	)
+	opCode, data, err := ws.ReadAllMessage()
+	if err != nil || opCode != TextFrame || string(data) != "HELLO" {
+		t.Fatalf("ReadAllMessage() = %s %q %v, want TEXT HELLO", opCode, data, err)
+	}
+	// 被丢弃的 Message 不会经过第二个 MessageInterceptor
+	if want := []string{"drop", "hello", "second"}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("interceptors saw %v, want %v", seen, want)
+	}
+}
+
+func TestMessageInterceptorReject(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code uint16
+	}{
+		{name: "plain error", err: errors.New("not allowed"), code: ClosePolicyViolation},
+		{name: "close error", err: &CloseError{Code: CloseMessageTooBig, Reason: "too big"}, code: CloseMessageTooBig},
+		// 不能发送的状态码使用 ClosePolicyViolation
+		{name: "no status", err: &CloseError{Code: CloseNoStatusReceived}, code: ClosePolicyViolation},
+		{name: "abnormal", err: &CloseError{Code: CloseAbnormalClosure}, code: ClosePolicyViolation},
+		{name: "tls", err: &CloseError{Code: CloseTLSHandshake}, code: ClosePolicyViolation},
+		{name: "out of range", err: &CloseError{Code: 5000}, code: ClosePolicyViolation},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			input := rawFrame(true, TextFrame, 5, []byte("hello"))
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+			ws.Intercept(func(ws WebSocket, message *Message) (*Message, error) {
+				return nil, test.err
+			})
+			if _, _, err := ws.ReadAllMessage(); err != test.err {
+				t.Fatalf("ReadAllMessage() error = %v, want %v", err, test.err)
+			}
+			sent := output.Bytes()
+			if len(sent) < 4 || sent[0] != 0x88 || binary.BigEndian.Uint16(sent[2:4]) != test.code {
+				t.Fatalf("sent close frame % x, want status code %d", sent, test.code)
+			}
+		})
+	}
+}
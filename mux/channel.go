@@ -0,0 +1,187 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Channel 是 Session 中的一个逻辑通道，实现了 io.ReadWriteCloser，可以在多个 goroutine 中同时读和写。
+// 两个方向是独立关闭的：对方关闭之后，Read 会在读完已经收到的数据之后返回 io.EOF，Write 返回 ErrChannelClosed。
+type Channel struct {
+	session *Session
+	id      uint32
+
+	lock *sync.Mutex
+	// changed 会在通道的状态变化的时候被关闭并替换，用于唤醒等待读写的 goroutine
+	changed chan struct{}
+
+	buf *bytes.Buffer
+	// consumed 是已经被读取，但是还没有通过窗口更新帧归还给对方的长度
+	consumed int
+	// credit 是对方还可以接收的长度
+	credit int
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newChannel(s *Session, id uint32) *Channel {
+	return &Channel{
+		session: s,
+		id:      id,
+		lock:    &sync.Mutex{},
+		changed: make(chan struct{}),
+		buf:     &bytes.Buffer{},
+		credit:  s.config.Window,
+	}
+}
+
+// ID 返回通道的 ID
+func (c *Channel) ID() uint32 {
+	return c.id
+}
+
+// broadcast 唤醒所有等待的 goroutine，调用的时候需要持有 lock
+func (c *Channel) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Channel) Read(p []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if c.buf.Len() > 0 {
+			n, _ := c.buf.Read(p)
+			c.consumed += n
+			var update int
+			// 读取了一半窗口之后再归还额度，避免每次读取都发送窗口更新帧
+			if c.consumed >= c.session.config.Window/2 && !c.remoteClosed {
+				update = c.consumed
+				c.consumed = 0
+			}
+			c.lock.Unlock()
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, uint32(update))
+				_ = c.session.send(context.Background(), c.id, frameWindow, payload)
+			}
+			return n, nil
+		}
+		switch {
+		case c.err != nil:
+			c.lock.Unlock()
+			return 0, c.err
+		case c.localClosed:
+			c.lock.Unlock()
+			return 0, ErrChannelClosed
+		case c.remoteClosed:
+			c.lock.Unlock()
+			return 0, io.EOF
+		}
+		changed := c.changed
+		c.lock.Unlock()
+		<-changed
+	}
+}
+
+// Write 把 p 分成多个数据帧发送，对方的接收窗口用完的时候会等待对方读取
+func (c *Channel) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.lock.Lock()
+		switch {
+		case c.err != nil:
+			c.lock.Unlock()
+			return written, c.err
+		case c.localClosed || c.remoteClosed:
+			c.lock.Unlock()
+			return written, ErrChannelClosed
+		}
+		if c.credit < 1 {
+			changed := c.changed
+			c.lock.Unlock()
+			<-changed
+			continue
+		}
+		n := len(p) - written
+		if n > c.credit {
+			n = c.credit
+		}
+		if n > c.session.config.MaxFrameSize {
+			n = c.session.config.MaxFrameSize
+		}
+		c.credit -= n
+		c.lock.Unlock()
+		err := c.session.send(context.Background(), c.id, frameData, p[written:written+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close 关闭本地的通道，对方会在读完数据之后收到 io.EOF，这个通道之后收到的数据会被丢弃
+func (c *Channel) Close() error {
+	c.lock.Lock()
+	if c.localClosed || c.err != nil {
+		c.lock.Unlock()
+		return nil
+	}
+	c.localClosed = true
+	remoteClosed := c.remoteClosed
+	c.buf.Reset()
+	c.broadcast()
+	c.lock.Unlock()
+	if remoteClosed {
+		c.session.remove(c.id)
+	}
+	return c.session.send(context.Background(), c.id, frameClose, nil)
+}
+
+// receive 处理对方发送的数据帧
+func (c *Channel) receive(payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.localClosed {
+		return nil
+	}
+	if c.buf.Len()+c.consumed+len(payload) > c.session.config.Window {
+		return ErrWindowExceeded
+	}
+	c.buf.Write(payload)
+	c.broadcast()
+	return nil
+}
+
+// remoteClose 处理对方发送的关闭帧
+func (c *Channel) remoteClose() {
+	c.lock.Lock()
+	c.remoteClosed = true
+	localClosed := c.localClosed
+	c.broadcast()
+	c.lock.Unlock()
+	if localClosed {
+		c.session.remove(c.id)
+	}
+}
+
+// addCredit 处理对方发送的窗口更新帧
+func (c *Channel) addCredit(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.credit += n
+	c.broadcast()
+}
+
+// fail 在 Session 关闭的时候唤醒所有等待的 goroutine
+func (c *Channel) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	c.broadcast()
+}
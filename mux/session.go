@@ -0,0 +1,327 @@
+// Package mux 在一个 WebSocket 连接上承载多个互相独立的逻辑通道。
+//
+// 每个通道的数据都放在 BinaryFrame 的 Message 中传输，Message 的开头是通道 ID 和帧类型：
+//
+//	+----------------+--------+-----------------+
+//	| 通道 ID (4字节) | 类型(1) | 内容             |
+//	+----------------+--------+-----------------+
+//
+// 客户端打开的通道 ID 是奇数，服务端打开的通道 ID 是偶数，所以两边可以同时打开通道而不会冲突。
+// 每个通道有独立的接收窗口，发送方最多只能发送对方窗口大小的数据，对方读取之后再通过窗口更新帧归还额度，
+// 这样一个读取很慢的通道不会阻塞同一个连接上的其他通道。
+//
+// 使用例子：
+//
+//	// 客户端
+//	session := mux.NewSession(ws, true, nil)
+//	channel, err := session.OpenChannel(ctx)
+//	_, err = channel.Write([]byte("Hi"))
+//
+//	// 服务端
+//	session := mux.NewSession(ws, false, nil)
+//	for {
+//		channel, err := session.AcceptChannel(ctx)
+//		if err != nil {
+//			break
+//		}
+//		go io.Copy(channel, channel)
+//	}
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/RommHui/websocket"
+)
+
+const (
+	DefaultWindow        = 256 * 1024
+	DefaultMaxFrameSize  = 16 * 1024
+	DefaultAcceptBacklog = 64
+	DefaultWriteTimeout  = 30 * time.Second
+)
+
+// 帧类型
+const (
+	frameOpen byte = iota + 1
+	frameData
+	frameClose
+	frameWindow
+)
+
+// headerLength 是每个帧开头的通道 ID 和帧类型的长度
+const headerLength = 5
+
+var (
+	ErrSessionClosed  = errors.New("mux session is closed")
+	ErrChannelClosed  = errors.New("mux channel is closed")
+	ErrProtocol       = errors.New("mux protocol violation")
+	ErrWindowExceeded = errors.New("mux channel received more data than its window")
+)
+
+// Config 是 Session 的配置，为空时使用默认值
+type Config struct {
+	// Window 是每个通道的接收窗口大小，为 0 时使用 DefaultWindow
+	Window int
+
+	// MaxFrameSize 是每个数据帧中内容的最大长度，为 0 时使用 DefaultMaxFrameSize
+	MaxFrameSize int
+
+	// AcceptBacklog 是等待 AcceptChannel 的通道数量，超过之后对方新打开的通道会被直接关闭，为 0 时使用 DefaultAcceptBacklog
+	AcceptBacklog int
+
+	// WriteTimeout 是发送一个帧的最长时间，包括等待其他帧发送完的时间，为 0 时使用 DefaultWriteTimeout，小于 0 时不限制。
+	// 超时的时候如果帧已经开始写入，WebSocket 连接和 Session 都会被关闭，这样对方不读取数据的时候，所有写入的 goroutine 都不会一直阻塞
+	WriteTimeout time.Duration
+}
+
+func (c *Config) normalize() Config {
+	config := Config{}
+	if c != nil {
+		config = *c
+	}
+	if config.Window < 1 {
+		config.Window = DefaultWindow
+	}
+	if config.MaxFrameSize < 1 {
+		config.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if config.AcceptBacklog < 1 {
+		config.AcceptBacklog = DefaultAcceptBacklog
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	return config
+}
+
+// Session 是一个 WebSocket 连接上的所有逻辑通道
+type Session struct {
+	ws     websocket.WebSocket
+	config Config
+
+	lock     *sync.Mutex
+	channels map[uint32]*Channel
+	nextID   uint32
+	accept   chan *Channel
+
+	done      chan struct{}
+	err       error
+	closeOnce *sync.Once
+}
+
+// NewSession 在 ws 上创建一个 Session，并开始在后台读取 ws 的 Message。
+// client 为 true 时打开的通道 ID 是奇数，否则是偶数，连接两边的 client 必须不同。
+// 创建之后 ws 只能由 Session 读取，但是仍然可以并发地调用 Ping 之类的方法。
+func NewSession(ws websocket.WebSocket, client bool, config *Config) *Session {
+	s := &Session{
+		ws:        ws,
+		config:    config.normalize(),
+		lock:      &sync.Mutex{},
+		channels:  map[uint32]*Channel{},
+		nextID:    2,
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.accept = make(chan *Channel, s.config.AcceptBacklog)
+	go s.readLoop()
+	return s
+}
+
+// OpenChannel 打开一个新的通道，对方会从 AcceptChannel 得到这个通道，ctx 限制发送打开帧的时间
+func (s *Session) OpenChannel(ctx context.Context) (*Channel, error) {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	c := newChannel(s, id)
+	s.channels[id] = c
+	s.lock.Unlock()
+
+	err := s.send(ctx, id, frameOpen, nil)
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptChannel 等待对方打开一个新的通道
+func (s *Session) AcceptChannel(ctx context.Context) (*Channel, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close 关闭所有通道和 WebSocket 连接
+func (s *Session) Close() error {
+	s.shutdown(ErrSessionClosed)
+	return s.ws.Close()
+}
+
+// Done 返回一个在 Session 关闭之后会被关闭的 channel
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err 返回 Session 关闭的原因，没有关闭的时候返回 nil
+func (s *Session) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// NumChannels 返回当前打开的通道数量
+func (s *Session) NumChannels() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.channels)
+}
+
+func (s *Session) shutdown(err error) {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		channels := s.channels
+		s.channels = map[uint32]*Channel{}
+		s.lock.Unlock()
+		close(s.done)
+		for _, c := range channels {
+			c.fail(err)
+		}
+	})
+}
+
+func (s *Session) remove(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.channels, id)
+}
+
+func (s *Session) channel(id uint32) *Channel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.channels[id]
+}
+
+// send 发送一个帧，发送的时间由 ctx 和 Config.WriteTimeout 限制。
+// 等待其他帧的时候超时不影响 Session，已经开始写入之后超时，WebSocket 连接会被关闭，Session 也随之关闭
+func (s *Session) send(ctx context.Context, id uint32, kind byte, payload []byte) error {
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if s.config.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.WriteTimeout)
+		defer cancel()
+	}
+	data := make([]byte, headerLength+len(payload))
+	binary.BigEndian.PutUint32(data, id)
+	data[4] = kind
+	copy(data[headerLength:], payload)
+	err := s.ws.WriteMessageContext(ctx, websocket.BinaryFrame, data)
+	if err != nil && (ctx.Err() == nil || s.ws.Status() != websocket.OPEN) {
+		s.shutdown(err)
+	}
+	return err
+}
+
+func (s *Session) readLoop() {
+	for {
+		message, err := s.ws.ReadMessage()
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		data, err := io.ReadAll(message)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		if message.OpCode != websocket.BinaryFrame || len(data) < headerLength {
+			s.fail(ErrProtocol)
+			return
+		}
+		err = s.handle(binary.BigEndian.Uint32(data), data[4], data[headerLength:])
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// fail 在对方违反协议的时候关闭连接
+func (s *Session) fail(err error) {
+	s.shutdown(err)
+	_ = s.ws.CloseWithCode(websocket.CloseProtocolError, err.Error())
+}
+
+func (s *Session) handle(id uint32, kind byte, payload []byte) error {
+	switch kind {
+	case frameOpen:
+		return s.handleOpen(id)
+	case frameData:
+		if c := s.channel(id); c != nil {
+			return c.receive(payload)
+		}
+	case frameClose:
+		if c := s.channel(id); c != nil {
+			c.remoteClose()
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return ErrProtocol
+		}
+		if c := s.channel(id); c != nil {
+			c.addCredit(int(binary.BigEndian.Uint32(payload)))
+		}
+	default:
+		return ErrProtocol
+	}
+	// 已经关闭的通道可能还会收到对方在收到关闭帧之前发送的帧，直接忽略
+	return nil
+}
+
+func (s *Session) handleOpen(id uint32) error {
+	s.lock.Lock()
+	// 对方只能使用和本地不同奇偶性的通道 ID
+	if id == 0 || id%2 == s.nextID%2 {
+		s.lock.Unlock()
+		return ErrProtocol
+	}
+	if _, ok := s.channels[id]; ok {
+		s.lock.Unlock()
+		return ErrProtocol
+	}
+	c := newChannel(s, id)
+	s.channels[id] = c
+	s.lock.Unlock()
+	select {
+	case s.accept <- c:
+	default:
+		// 等待 AcceptChannel 的通道太多，拒绝这个通道
+		s.remove(id)
+		return s.send(context.Background(), id, frameClose, nil)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RommHui/websocket"
+)
+
+func TestStalledPeerDoesNotBlockWriters(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	session := NewSession(websocket.NewWebSocketWithRole(a, a, websocket.RoleClient), true, &Config{WriteTimeout: 200 * time.Millisecond})
+	defer session.Close()
+
+	// 对方先读取打开帧，之后不再读取任何数据
+	pause := &sync.Mutex{}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			pause.Lock()
+			pause.Unlock()
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	first, err := session.OpenChannel(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := session.OpenChannel(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pause.Lock()
+	defer pause.Unlock()
+
+	written := make(chan error, 2)
+	go func() {
+		_, err := first.Write(bytes.Repeat([]byte{'a'}, 1<<20))
+		written <- err
+	}()
+	go func() {
+		_, err := second.Write([]byte("hello"))
+		written <- err
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-written:
+			if err == nil {
+				t.Fatal("Write() to a stalled peer succeeded")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Write() is blocked by a stalled peer")
+		}
+	}
+	select {
+	case <-session.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session is still open after a write timed out")
+	}
+}
+
+// newSessionPair 返回通过 net.Pipe 连接的客户端和服务端 Session
+func newSessionPair(t *testing.T, config *Config) (*Session, *Session) {
+	a, b := net.Pipe()
+	client := NewSession(websocket.NewWebSocketWithRole(a, a, websocket.RoleClient), true, config)
+	server := NewSession(websocket.NewWebSocketWithRole(b, b, websocket.RoleServer), false, config)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return client, server
+}
+
+// newRawPeer 返回一个直接发送 mux 帧的客户端 WebSocket 和连接到它的服务端 Session
+func newRawPeer(t *testing.T, config *Config) (websocket.WebSocket, *Session) {
+	a, b := net.Pipe()
+	peer := websocket.NewWebSocketWithRole(a, a, websocket.RoleClient)
+	server := NewSession(websocket.NewWebSocketWithRole(b, b, websocket.RoleServer), false, config)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return peer, server
+}
+
+func rawMuxFrame(id uint32, kind byte, payload []byte) []byte {
+	data := binary.BigEndian.AppendUint32(nil, id)
+	data = append(data, kind)
+	return append(data, payload...)
+}
+
+func TestOpenAccept(t *testing.T) {
+	client, server := newSessionPair(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	opened, err := client.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.ID() != accepted.ID() || opened.ID()%2 != 1 {
+		t.Fatalf("opened channel %d, accepted channel %d", opened.ID(), accepted.ID())
+	}
+	// 服务端打开的通道 ID 是偶数
+	reverse, err := server.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverse.ID()%2 != 0 {
+		t.Fatalf("server opened channel %d, want an even ID", reverse.ID())
+	}
+	if _, err = client.AcceptChannel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, _ = io.Copy(accepted, accepted)
+	}()
+	if _, err = opened.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(opened, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read() = %q, %v, want %q", buf, err, "hello")
+	}
+	if n := client.NumChannels(); n != 2 {
+		t.Fatalf("NumChannels() = %d, want 2", n)
+	}
+}
+
+func TestWindowExhaustionAndCredit(t *testing.T) {
+	const window = 1024
+	client, server := newSessionPair(t, &Config{Window: window, MaxFrameSize: 256})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	opened, err := client.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte{'a'}, 3*window)
+	written := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(data)
+		written <- err
+	}()
+	// 对方没有读取的时候，最多只能发送一个窗口的数据
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		accepted.lock.Lock()
+		buffered := accepted.buf.Len()
+		accepted.lock.Unlock()
+		if buffered == window {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d bytes, want %d", buffered, window)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("Write() returned %v before the window was returned", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	opened.lock.Lock()
+	credit := opened.credit
+	opened.lock.Unlock()
+	if credit != 0 {
+		t.Fatalf("credit = %d, want 0", credit)
+	}
+
+	// 读取之后通过窗口更新帧归还额度，剩下的数据才能发送
+	received := make([]byte, len(data))
+	if _, err = io.ReadFull(accepted, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("received data differs from the written data")
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write() is still blocked after the window was returned")
+	}
+}
+
+func TestHalfCloseEOF(t *testing.T) {
+	client, server := newSessionPair(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	opened, err := client.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = opened.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = opened.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 对方关闭之后先读完已经收到的数据，然后得到 io.EOF
+	data, err := io.ReadAll(accepted)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadAll() = %q, %v, want %q", data, err, "hello")
+	}
+	if _, err = accepted.Write([]byte("late")); err != ErrChannelClosed {
+		t.Fatalf("Write() after the peer closed error = %v, want %v", err, ErrChannelClosed)
+	}
+	if _, err = opened.Read(make([]byte, 1)); err != ErrChannelClosed {
+		t.Fatalf("Read() after Close error = %v, want %v", err, ErrChannelClosed)
+	}
+	// 两边都关闭之后通道被移除
+	if err = accepted.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for client.NumChannels() != 0 || server.NumChannels() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("NumChannels() = %d, %d after both sides closed", client.NumChannels(), server.NumChannels())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAcceptBacklogOverflow(t *testing.T) {
+	client, server := newSessionPair(t, &Config{AcceptBacklog: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	queued, err := client.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := client.OpenChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 超过 AcceptBacklog 的通道被对方直接关闭
+	if _, err = rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() on a rejected channel error = %v, want %v", err, io.EOF)
+	}
+	accepted, err := server.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.ID() != queued.ID() {
+		t.Fatalf("accepted channel %d, want %d", accepted.ID(), queued.ID())
+	}
+	if server.Err() != nil {
+		t.Fatalf("Err() = %v after overflowing the backlog", server.Err())
+	}
+}
+
+func TestProtocolViolationCloses(t *testing.T) {
+	tests := []struct {
+		name string
+		// send 发送违反协议的内容
+		send func(peer websocket.WebSocket) error
+		err  error
+	}{
+		{
+			name: "text message",
+			send: func(peer websocket.WebSocket) error {
+				return peer.WriteMessage(websocket.TextFrame, rawMuxFrame(1, frameOpen, nil))
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "short header",
+			send: func(peer websocket.WebSocket) error {
+				return peer.WriteMessage(websocket.BinaryFrame, []byte{0, 0, 1})
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "unknown frame type",
+			send: func(peer websocket.WebSocket) error {
+				return peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, 0xff, nil))
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "wrong ID parity",
+			send: func(peer websocket.WebSocket) error {
+				return peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(2, frameOpen, nil))
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "duplicate open",
+			send: func(peer websocket.WebSocket) error {
+				if err := peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, frameOpen, nil)); err != nil {
+					return err
+				}
+				return peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, frameOpen, nil))
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "bad window update",
+			send: func(peer websocket.WebSocket) error {
+				return peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, frameWindow, []byte{1}))
+			},
+			err: ErrProtocol,
+		},
+		{
+			name: "window exceeded",
+			send: func(peer websocket.WebSocket) error {
+				if err := peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, frameOpen, nil)); err != nil {
+					return err
+				}
+				return peer.WriteMessage(websocket.BinaryFrame, rawMuxFrame(1, frameData, make([]byte, 65)))
+			},
+			err: ErrWindowExceeded,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer, server := newRawPeer(t, &Config{Window: 64})
+			if err := test.send(peer); err != nil {
+				t.Fatal(err)
+			}
+			// 服务端用 1002 关闭连接
+			for {
+				_, _, err := peer.ReadAllMessage()
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+					t.Fatalf("ReadAllMessage() error = %v, want close code %d", err, websocket.CloseProtocolError)
+				}
+				break
+			}
+			select {
+			case <-server.Done():
+			case <-time.After(2 * time.Second):
+				t.Fatal("session is still open after a protocol violation")
+			}
+			if err := server.Err(); err != test.err {
+				t.Fatalf("Err() = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
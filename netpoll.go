@@ -0,0 +1,306 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"syscall"
+)
+
+var (
+	ErrPollerUnsupported = errors.New("netpoll is not supported on this platform")
+	ErrPollerClosed      = errors.New("poller is closed")
+	ErrNotPollable       = errors.New("connection has no file descriptor to poll")
+	ErrNotPolled         = errors.New("connection is not added to the poller")
+	ErrBackgroundRead    = errors.New("connection is read by a background goroutine")
+)
+
+// Poller 使用 epoll（Linux）或者 kqueue（BSD、macOS）监听大量连接是否可读，
+// 连接在没有数据的时候不需要一个阻塞在 ReadMessage 上的 goroutine，适合保持几十万个大部分时间都空闲的连接。
+//
+// 连接可读的时候 Poller 会在自己的 goroutine 中调用 Add 传入的回调，回调不应该阻塞，通常把连接交给一个 worker 池，
+// 由 worker 调用 ReadMessage 读取并处理 Message（Message 需要被完整读取）。
+// 每次回调之后连接都会暂停监听，处理完之后需要调用 Resume 重新开始监听，这样同一个连接不会同时被两个 worker 读取。
+//
+// 使用 Poller 的连接不能再开启 BackgroundRead 或者使用 Incoming、Serve 这类会在后台读取的方法。
+// TLS 连接解密之后缓冲在 tls.Conn 中的数据不能被 Poller 发现，Poller 更适合在 TLS 已经被前面的代理终止的场景使用。
+//
+// 使用例子：
+//
+//	poller, err := websocket.NewPoller()
+//	...
+//	err = poller.Add(ws, func(ws websocket.WebSocket) {
+//		pool.Submit(func() {
+//			message, err := ws.ReadAllMessage()
+//			...
+//			_ = poller.Resume(ws)
+//		})
+//	})
+type Poller struct {
+	poller netpoller
+
+	lock    *sync.Mutex
+	entries map[int]*pollEntry
+	closed  bool
+	done    chan struct{}
+}
+
+// netpoller 是不同平台的 epoll 或者 kqueue 实现，所有的监听都是一次性的，触发之后需要重新 arm
+type netpoller interface {
+	// arm 开始监听 fd 是否可读，first 表示 fd 还没有被加入过
+	arm(fd int, first bool) error
+	// remove 停止监听 fd
+	remove(fd int) error
+	// wait 等待可读的 fd 并把它们放入 fds，被 wake 唤醒的时候返回 0 个 fd
+	wait(fds []int) (int, error)
+	// wake 唤醒正在等待的 wait
+	wake() error
+	close() error
+}
+
+type pollEntry struct {
+	ws         *webSocket
+	fd         int
+	onReadable func(ws WebSocket)
+	// registered 表示 fd 已经被加入了 netpoller
+	registered bool
+}
+
+// NewPoller 创建一个 Poller 并启动它的 goroutine，不支持的平台返回 ErrPollerUnsupported
+func NewPoller() (*Poller, error) {
+	poller, err := newNetpoller()
+	if err != nil {
+		return nil, err
+	}
+	p := &Poller{
+		poller:  poller,
+		lock:    &sync.Mutex{},
+		entries: map[int]*pollEntry{},
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Add 开始监听 ws，ws 可读的时候调用 onReadable。ws 已经缓冲了可以读取的数据（例如紧跟在握手之后的帧）时，onReadable 会被立刻调用。
+// ws 需要是 Dialer、Upgrader 这类基于 TCP 或者 Unix 连接创建的 WebSocket 对象，否则返回 ErrNotPollable。
+// ws 关闭之后会自动从 Poller 中移除。
+func (p *Poller) Add(ws WebSocket, onReadable func(ws WebSocket)) error {
+	w, ok := ws.(*webSocket)
+	if !ok {
+		return ErrNotPollable
+	}
+	if w.background != nil {
+		return ErrBackgroundRead
+	}
+	fd, err := pollFD(w.reader)
+	if err != nil {
+		return err
+	}
+	entry := &pollEntry{
+		ws:         w,
+		fd:         fd,
+		onReadable: onReadable,
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrPollerClosed
+	}
+	if old, ok := p.entries[fd]; ok && old.ws != w && old.registered {
+		// 旧的连接已经关闭，fd 被新的连接复用了
+		_ = p.poller.remove(fd)
+	}
+	p.entries[fd] = entry
+	readable := w.hasBufferedInput()
+	if !readable {
+		err = p.poller.arm(fd, true)
+		if err != nil {
+			delete(p.entries, fd)
+			p.lock.Unlock()
+			return err
+		}
+		entry.registered = true
+	}
+	p.lock.Unlock()
+
+	w.addCloseHook(func() {
+		p.forget(entry)
+	})
+	if readable {
+		onReadable(ws)
+	}
+	return nil
+}
+
+// Resume 在处理完一次可读的回调之后重新开始监听 ws。ws 还有已经缓冲的数据时，回调会被立刻调用。
+func (p *Poller) Resume(ws WebSocket) error {
+	w, ok := ws.(*webSocket)
+	if !ok {
+		return ErrNotPollable
+	}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrPollerClosed
+	}
+	entry := p.lookup(w)
+	if entry == nil {
+		p.lock.Unlock()
+		return ErrNotPolled
+	}
+	if w.state() == CLOSED {
+		p.lock.Unlock()
+		return ErrClosedStatus
+	}
+	if w.hasBufferedInput() {
+		p.lock.Unlock()
+		entry.onReadable(ws)
+		return nil
+	}
+	err := p.poller.arm(entry.fd, !entry.registered)
+	if err == nil {
+		entry.registered = true
+	}
+	p.lock.Unlock()
+	return err
+}
+
+// Remove 停止监听 ws，不会关闭 ws
+func (p *Poller) Remove(ws WebSocket) error {
+	w, ok := ws.(*webSocket)
+	if !ok {
+		return ErrNotPollable
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := p.lookup(w)
+	if entry == nil {
+		return ErrNotPolled
+	}
+	delete(p.entries, entry.fd)
+	if entry.registered && !p.closed {
+		return p.poller.remove(entry.fd)
+	}
+	return nil
+}
+
+// Len 返回 Poller 正在监听的连接数量
+func (p *Poller) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.entries)
+}
+
+// Close 停止 Poller 的 goroutine，正在监听的连接不会被关闭
+func (p *Poller) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.entries = map[int]*pollEntry{}
+	p.lock.Unlock()
+
+	err := p.poller.wake()
+	<-p.done
+	closeErr := p.poller.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// lookup 返回 w 对应的 pollEntry，需要持有 p.lock
+func (p *Poller) lookup(w *webSocket) *pollEntry {
+	fd, err := pollFD(w.reader)
+	if err != nil {
+		// 连接已经关闭，只能遍历查找
+		for _, entry := range p.entries {
+			if entry.ws == w {
+				return entry
+			}
+		}
+		return nil
+	}
+	if entry, ok := p.entries[fd]; ok && entry.ws == w {
+		return entry
+	}
+	return nil
+}
+
+// forget 在连接关闭之后移除 entry，关闭的 fd 已经被系统从 epoll 或者 kqueue 中移除了
+func (p *Poller) forget(entry *pollEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.entries[entry.fd] == entry {
+		delete(p.entries, entry.fd)
+	}
+}
+
+func (p *Poller) run() {
+	defer close(p.done)
+	fds := make([]int, 128)
+	for {
+		n, err := p.poller.wait(fds)
+		p.lock.Lock()
+		closed := p.closed
+		var ready []*pollEntry
+		for _, fd := range fds[:n] {
+			if entry, ok := p.entries[fd]; ok {
+				ready = append(ready, entry)
+			}
+		}
+		p.lock.Unlock()
+		if closed {
+			return
+		}
+		for _, entry := range ready {
+			entry.onReadable(entry.ws)
+		}
+		if err != nil && !errors.Is(err, syscall.EINTR) {
+			return
+		}
+	}
+}
+
+// hasBufferedInput 返回是否有不需要从连接读取就可以返回的数据
+func (w *webSocket) hasBufferedInput() bool {
+	w.pendingLock.Lock()
+	pending := len(w.pending)
+	w.pendingLock.Unlock()
+	return pending > 0 || bufferedInput(w.reader)
+}
+
+// pollFD 返回 stream 底层连接的文件描述符
+func pollFD(stream any) (int, error) {
+	for {
+		switch s := stream.(type) {
+		case *prefixedReadCloser:
+			stream = s.rc
+			continue
+		case *tls.Conn:
+			stream = s.NetConn()
+			continue
+		}
+		break
+	}
+	conn, ok := stream.(syscall.Conn)
+	if !ok {
+		return -1, ErrNotPollable
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
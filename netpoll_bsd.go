@@ -0,0 +1,88 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package websocket
+
+import "syscall"
+
+// kqueue 是 BSD 和 macOS 上的 netpoller，wakeFds 是用于唤醒 Kevent 的管道
+type kqueue struct {
+	fd      int
+	wakeFds [2]int
+	events  []syscall.Kevent_t
+}
+
+func newNetpoller() (netpoller, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	p := &kqueue{fd: fd}
+	err = syscall.Pipe(p.wakeFds[:])
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	for _, wakeFd := range p.wakeFds {
+		syscall.CloseOnExec(wakeFd)
+		_ = syscall.SetNonblock(wakeFd, true)
+	}
+	err = p.change(p.wakeFds[0], syscall.EV_ADD)
+	if err != nil {
+		_ = p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *kqueue) change(fd int, flags int) error {
+	changes := make([]syscall.Kevent_t, 1)
+	syscall.SetKevent(&changes[0], fd, syscall.EVFILT_READ, flags)
+	_, err := syscall.Kevent(p.fd, changes, nil, nil)
+	return err
+}
+
+func (p *kqueue) arm(fd int, first bool) error {
+	return p.change(fd, syscall.EV_ADD|syscall.EV_ONESHOT)
+}
+
+func (p *kqueue) remove(fd int) error {
+	err := p.change(fd, syscall.EV_DELETE)
+	if err == syscall.EBADF || err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (p *kqueue) wait(fds []int) (int, error) {
+	if len(p.events) < len(fds) {
+		p.events = make([]syscall.Kevent_t, len(fds))
+	}
+	n, err := syscall.Kevent(p.fd, nil, p.events[:len(fds)], nil)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, event := range p.events[:n] {
+		if int(event.Ident) == p.wakeFds[0] {
+			continue
+		}
+		fds[count] = int(event.Ident)
+		count++
+	}
+	return count, nil
+}
+
+func (p *kqueue) wake() error {
+	_, err := syscall.Write(p.wakeFds[1], []byte{0})
+	if err == syscall.EAGAIN {
+		return nil
+	}
+	return err
+}
+
+func (p *kqueue) close() error {
+	_ = syscall.Close(p.wakeFds[0])
+	_ = syscall.Close(p.wakeFds[1])
+	return syscall.Close(p.fd)
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package websocket
+
+import "syscall"
+
+// epoll 是 Linux 上的 netpoller，wakeFds 是用于唤醒 EpollWait 的管道
+type epoll struct {
+	fd      int
+	wakeFds [2]int
+	events  []syscall.EpollEvent
+}
+
+func newNetpoller() (netpoller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &epoll{fd: fd}
+	err = syscall.Pipe2(p.wakeFds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, p.wakeFds[0], &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(p.wakeFds[0]),
+	})
+	if err != nil {
+		_ = p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *epoll) arm(fd int, first bool) error {
+	op := syscall.EPOLL_CTL_MOD
+	if first {
+		op = syscall.EPOLL_CTL_ADD
+	}
+	return syscall.EpollCtl(p.fd, op, fd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(fd),
+	})
+}
+
+func (p *epoll) remove(fd int) error {
+	err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+	if err == syscall.EBADF || err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (p *epoll) wait(fds []int) (int, error) {
+	if len(p.events) < len(fds) {
+		p.events = make([]syscall.EpollEvent, len(fds))
+	}
+	n, err := syscall.EpollWait(p.fd, p.events[:len(fds)], -1)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, event := range p.events[:n] {
+		if int(event.Fd) == p.wakeFds[0] {
+			continue
+		}
+		fds[count] = int(event.Fd)
+		count++
+	}
+	return count, nil
+}
+
+func (p *epoll) wake() error {
+	_, err := syscall.Write(p.wakeFds[1], []byte{0})
+	if err == syscall.EAGAIN {
+		return nil
+	}
+	return err
+}
+
+func (p *epoll) close() error {
+	_ = syscall.Close(p.wakeFds[0])
+	_ = syscall.Close(p.wakeFds[1])
+	return syscall.Close(p.fd)
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package websocket
+
+func newNetpoller() (netpoller, error) {
+	return nil, ErrPollerUnsupported
+}
@@ -0,0 +1,211 @@
+package websocket
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPoller 创建一个测试结束时关闭的 Poller，不支持的平台跳过测试
+func newPoller(t *testing.T) *Poller {
+	t.Helper()
+	poller, err := NewPoller()
+	if err == ErrPollerUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = poller.Close()
+	})
+	return poller
+}
+
+// newTCPConns 返回一对通过 TCP 连接的 net.Conn，第一个是服务端
+func newTCPConns(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		_ = client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return server, client
+}
+
+// expectReadable 等待 readable 收到 ws，wait 为 false 时确认一段时间内没有收到
+func expectReadable(t *testing.T, readable <-chan WebSocket, ws WebSocket, wait bool) {
+	t.Helper()
+	if !wait {
+		select {
+		case <-readable:
+			t.Fatal("onReadable was called")
+		case <-time.After(100 * time.Millisecond):
+		}
+		return
+	}
+	select {
+	case got := <-readable:
+		if got != ws {
+			t.Fatal("onReadable was called with another connection")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("onReadable was not called")
+	}
+}
+
+func TestPoller(t *testing.T) {
+	poller := newPoller(t)
+	serverConn, clientConn := newTCPConns(t)
+	ws := NewWebSocketWithRole(serverConn, serverConn, RoleServer)
+	peer := NewWebSocketWithRole(clientConn, clientConn, RoleClient)
+	readable := make(chan WebSocket, 4)
+	if err := poller.Add(ws, func(ws WebSocket) {
+		readable <- ws
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if poller.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", poller.Len())
+	}
+	expectReadable(t, readable, ws, false)
+
+	// 每次回调之后暂停监听，Resume 之前不会再次回调
+	if err := peer.Send("a"); err != nil {
+		t.Fatal(err)
+	}
+	expectReadable(t, readable, ws, true)
+	if err := peer.Send("b"); err != nil {
+		t.Fatal(err)
+	}
+	expectReadable(t, readable, ws, false)
+	for _, want := range []string{"a", "b"} {
+		if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != want {
+			t.Fatalf("ReadAllMessage() = %q, %v, want %s", data, err, want)
+		}
+		// 第一次 Resume 的时候 b 可能已经在连接中等待读取
+		if err := poller.Resume(ws); err != nil {
+			t.Fatal(err)
+		}
+		if want == "a" {
+			expectReadable(t, readable, ws, true)
+		}
+	}
+	if err := peer.Send("c"); err != nil {
+		t.Fatal(err)
+	}
+	expectReadable(t, readable, ws, true)
+	if _, _, err := ws.ReadAllMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove 之后不再监听，也不会关闭连接
+	if err := poller.Resume(ws); err != nil {
+		t.Fatal(err)
+	}
+	if err := poller.Remove(ws); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Send("d"); err != nil {
+		t.Fatal(err)
+	}
+	expectReadable(t, readable, ws, false)
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "d" {
+		t.Fatalf("ReadAllMessage() after Remove = %q, %v, want d", data, err)
+	}
+	if err := poller.Remove(ws); err != ErrNotPolled {
+		t.Fatalf("Remove() again error = %v, want %v", err, ErrNotPolled)
+	}
+	if err := poller.Resume(ws); err != ErrNotPolled {
+		t.Fatalf("Resume() after Remove error = %v, want %v", err, ErrNotPolled)
+	}
+}
+
+func TestPollerForgetsClosedConnections(t *testing.T) {
+	poller := newPoller(t)
+	serverConn, _ := newTCPConns(t)
+	ws := NewWebSocketWithRole(serverConn, serverConn, RoleServer)
+	if err := poller.Add(ws, func(ws WebSocket) {}); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	waitFor(t, "the closed connection to be removed", func() bool {
+		return poller.Len() == 0
+	})
+	if err := poller.Resume(ws); err != ErrNotPolled {
+		t.Fatalf("Resume() after Close error = %v, want %v", err, ErrNotPolled)
+	}
+}
+
+func TestPollerBufferedInput(t *testing.T) {
+	poller := newPoller(t)
+	serverConn, clientConn := newTCPConns(t)
+	peer := NewWebSocketWithRole(clientConn, clientConn, RoleClient)
+	if err := peer.Send("early"); err != nil {
+		t.Fatal(err)
+	}
+	// 和握手之后一样，帧已经被读进了缓冲区，连接上没有可读的数据
+	reader := bufio.NewReader(serverConn)
+	if _, err := reader.Peek(1); err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebSocketWithRole(serverConn, &prefixedReadCloser{Reader: reader, rc: serverConn}, RoleServer)
+	readable := make(chan WebSocket, 1)
+	if err := poller.Add(ws, func(ws WebSocket) {
+		readable <- ws
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectReadable(t, readable, ws, true)
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "early" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want early", data, err)
+	}
+}
+
+func TestPollerErrors(t *testing.T) {
+	poller := newPoller(t)
+	pipe, _ := newPipeWebSocket(t)
+	if err := poller.Add(pipe, func(ws WebSocket) {}); err != ErrNotPollable {
+		t.Fatalf("Add() with net.Pipe error = %v, want %v", err, ErrNotPollable)
+	}
+
+	serverConn, _ := newTCPConns(t)
+	ws := NewWebSocketWithRole(serverConn, serverConn, RoleServer)
+	if err := poller.Resume(ws); err != ErrNotPolled {
+		t.Fatalf("Resume() before Add error = %v, want %v", err, ErrNotPolled)
+	}
+	if err := poller.Remove(ws); err != ErrNotPolled {
+		t.Fatalf("Remove() before Add error = %v, want %v", err, ErrNotPolled)
+	}
+
+	background, _ := newTCPConns(t)
+	backgroundWS := NewWebSocketWithRole(background, background, RoleServer)
+	backgroundWS.BackgroundRead(1)
+	if err := poller.Add(backgroundWS, func(ws WebSocket) {}); err != ErrBackgroundRead {
+		t.Fatalf("Add() with BackgroundRead error = %v, want %v", err, ErrBackgroundRead)
+	}
+
+	if err := poller.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := poller.Add(ws, func(ws WebSocket) {}); err != ErrPollerClosed {
+		t.Fatalf("Add() after Close error = %v, want %v", err, ErrPollerClosed)
+	}
+	if err := poller.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pingTracker 记录还没有收到对应 Pong 的 Ping 的内容。
+// 只有内容和某个 Ping 一致的 Pong 才会被当作这个 Ping 的回复，其他的 Pong 会被忽略。
+type pingTracker struct {
+	lock    *sync.Mutex
+	counter uint64
+	waiting map[string]chan struct{}
+}
+
+func newPingTracker() *pingTracker {
+	return &pingTracker{
+		lock:    &sync.Mutex{},
+		waiting: map[string]chan struct{}{},
+	}
+}
+
+// add 生成一个新的 Ping 内容，返回的 channel 会在收到对应的 Pong 之后关闭
+func (t *pingTracker) add() ([]byte, <-chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.counter++
+	payload := strconv.AppendUint(nil, t.counter, 10)
+	pong := make(chan struct{})
+	t.waiting[string(payload)] = pong
+	return payload, pong
+}
+
+// remove 取消等待 payload 对应的 Pong
+func (t *pingTracker) remove(payload []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.waiting, string(payload))
+}
+
+// resolve 用于处理收到的 Pong，返回是否有对应的 Ping
+func (t *pingTracker) resolve(payload []byte) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	pong, ok := t.waiting[string(payload)]
+	if ok {
+		delete(t.waiting, string(payload))
+		close(pong)
+	}
+	return ok
+}
+
+// PingContext 发送一个内容唯一的 Ping，等待内容相同的 Pong，返回从发送到收到 Pong 的往返时间。
+// 等待期间收到的数据 Message 不会丢失，之后的 ReadMessage 会按照收到的顺序返回它们。
+// Ping 是作为控制帧发送的，不需要等待正在发送的 Message，ctx 的 deadline 也是发送 Ping 的截止时间。
+// 没有开启 BackgroundRead 的时候，PingContext 需要自己读取连接，ctx 只会在每次收到帧之后检查。
+func (w *webSocket) PingContext(ctx context.Context) (time.Duration, error) {
+	payload, pong := w.pings.add()
+	defer w.pings.remove(payload)
+	deadline, _ := ctx.Deadline()
+	start := time.Now()
+	err := w.sendControlDeadline(Ping, payload, deadline)
+	if err != nil {
+		return 0, err
+	}
+	if w.background != nil {
+		err = w.background.waitPong(ctx, pong)
+		if err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+	for {
+		select {
+		case <-pong:
+			return time.Since(start), nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+		message, err := w.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if w.handled(message) {
+			err = w.handleControl(message)
+		} else if message, err = bufferMessage(message); err == nil {
+			w.pushPending(message)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// PingPolicy 用于配置收到 Ping 之后自动回复 Pong 的行为
+type PingPolicy struct {
+	// Disable 为 true 时不会自动回复 Pong，收到的 Ping 会通过 ReadMessage 交给应用处理
+	Disable bool
+
+	// Transform 用于修改回复的 Pong 的内容，为空时原样返回 Ping 的内容
+	Transform func(payload []byte) []byte
+
+	// MinInterval 是两次自动回复之间的最小间隔，间隔内收到的 Ping 不会回复，用于应对 Ping 洪泛。
+	// RFC 6455 允许只回复最近的一个 Ping。
+	MinInterval time.Duration
+}
+
+func (w *webSocket) SetPingPolicy(policy PingPolicy) {
+	w.pingPolicyLock.Lock()
+	defer w.pingPolicyLock.Unlock()
+	w.pingPolicy = policy
+}
+
+func (w *webSocket) autoPong() bool {
+	w.pingPolicyLock.Lock()
+	defer w.pingPolicyLock.Unlock()
+	return !w.pingPolicy.Disable
+}
+
+func (w *webSocket) responsePong(ping *Message) error {
+	payload, err := io.ReadAll(io.LimitReader(ping, maxControlPayloadLength+1))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(blackHole, ping)
+	if err != nil {
+		return err
+	}
+	if handler := w.getHandlers().ping; handler != nil {
+		return handler(payload)
+	}
+	return w.replyPong(payload)
+}
+
+// replyPong 按照 PingPolicy 回复 payload 对应的 Pong
+func (w *webSocket) replyPong(payload []byte) error {
+	w.pingPolicyLock.Lock()
+	policy := w.pingPolicy
+	now := time.Now()
+	limited := policy.MinInterval > 0 && now.Sub(w.lastAutoPong) < policy.MinInterval
+	if !limited {
+		w.lastAutoPong = now
+	}
+	w.pingPolicyLock.Unlock()
+	if limited {
+		return nil
+	}
+
+	if policy.Transform != nil {
+		payload = policy.Transform(payload)
+	}
+	if len(payload) > maxControlPayloadLength {
+		payload = payload[:maxControlPayloadLength]
+	}
+	return w.sendControl(Pong, payload)
+}
+
+// receivePong 处理收到的 Pong，没有对应 Ping 的 Pong 会被忽略
+func (w *webSocket) receivePong(pong *Message) error {
+	payload, err := io.ReadAll(io.LimitReader(pong, maxControlPayloadLength+1))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(blackHole, pong)
+	if err != nil {
+		return err
+	}
+	w.pings.resolve(payload)
+	if handler := w.getHandlers().pong; handler != nil {
+		return handler(payload)
+	}
+	return nil
+}
+
+var ErrControlPayloadTooLong = errors.New("control frame payload is longer than 125 bytes")
+
+func (w *webSocket) SendPong(payload []byte) error {
+	if len(payload) > maxControlPayloadLength {
+		return ErrControlPayloadTooLong
+	}
+	// 和 runKeepalive 一样直接发送控制帧，不需要在 sendLock 上等待正在发送的大 Message
+	return w.sendControl(Pong, payload)
+}
+
+func (w *webSocket) PongKeepalive(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	once := &sync.Once{}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if w.SendPong(nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
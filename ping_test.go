@@ -0,0 +1,314 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSendPong(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.SendPong([]byte("beat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.SendPong(bytes.Repeat([]byte{'a'}, maxControlPayloadLength+1)); err != ErrControlPayloadTooLong {
+		t.Fatalf("SendPong() error = %v, want %v", err, ErrControlPayloadTooLong)
+	}
+	// 太长的 Pong 不会被发送
+	want := []sentFrame{{OpCode: Pong, Fin: true, Payload: []byte("beat")}}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+}
+
+func TestPongKeepalive(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	stop := ws.PongKeepalive(10 * time.Millisecond)
+	// readPong 读取下一个帧，在 timeout 之内没有帧的时候返回错误
+	readPong := func(timeout time.Duration) error {
+		_ = b.SetReadDeadline(time.Now().Add(timeout))
+		frame := &Frame{}
+		if err := frame.Decode(context.Background(), b); err != nil {
+			return err
+		}
+		if frame.OpCode != Pong || frame.Payload.N != 0 {
+			t.Fatalf("keepalive sent %s, want an empty Pong", frame)
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := readPong(time.Second); err != nil {
+			t.Fatalf("read keepalive pong %d: %v", i, err)
+		}
+	}
+	stop()
+	stop()
+	// stop 的时候可能已经有一个 Pong 正在发送
+	extra := 0
+	for {
+		err := readPong(100 * time.Millisecond)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extra++; extra > 1 {
+			t.Fatal("PongKeepalive kept sending after stop")
+		}
+	}
+}
+
+func TestWriteControl(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	for _, opCode := range []OpCode{TextFrame, BinaryFrame, ContinuationFrame, ReservedControlFrame1} {
+		if err := ws.WriteControl(opCode, nil, time.Time{}); err != ErrNotControlOpCode {
+			t.Fatalf("WriteControl(%d) error = %v, want %v", opCode, err, ErrNotControlOpCode)
+		}
+	}
+	if err := ws.WriteControl(Ping, bytes.Repeat([]byte{'a'}, maxControlPayloadLength+1), time.Time{}); err != ErrControlPayloadTooLong {
+		t.Fatalf("WriteControl() error = %v, want %v", err, ErrControlPayloadTooLong)
+	}
+	// 允许使用的保留控制帧 OpCode 也可以发送
+	if err := ws.AllowReservedOpCode(ReservedControlFrame1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 控制帧可以插在正在发送的 Message 的分片之间
+	writer, err := ws.NextWriter(TextFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteControl(Ping, []byte("beat"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WriteControl(ReservedControlFrame1, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []sentFrame{
+		{OpCode: TextFrame, Payload: []byte("a")},
+		{OpCode: Ping, Fin: true, Payload: []byte("beat")},
+		{OpCode: ReservedControlFrame1, Fin: true, Payload: []byte{}},
+		{OpCode: ContinuationFrame, Fin: true, Payload: []byte{}},
+	}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+}
+
+func TestWriteControlClose(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.WriteControl(ConnectionClose, []byte{0x03}, time.Time{}); err != ErrInvalidClosePayload {
+		t.Fatalf("WriteControl() error = %v, want %v", err, ErrInvalidClosePayload)
+	}
+	payload := append([]byte{0x03, 0xe8}, "bye"...)
+	if err := ws.WriteControl(ConnectionClose, payload, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// 发送 ConnectionClose 之后 WebSocket 已经关闭
+	want := []sentFrame{{OpCode: ConnectionClose, Fin: true, Payload: payload}}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+	info := ws.CloseReason()
+	if info == nil || info.Initiator != CloseByLocal || info.Code != CloseNormalClosure || info.Reason != "bye" {
+		t.Fatalf("CloseReason() = %+v, want a local close with 1000 bye", info)
+	}
+	if err := ws.WriteControl(Ping, nil, time.Time{}); err == nil {
+		t.Fatal("WriteControl() after close succeeded")
+	}
+}
+
+func TestWriteControlDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	// 对方不读取的时候，写入在 deadline 之后失败
+	start := time.Now()
+	err := ws.WriteControl(Ping, nil, time.Now().Add(50*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("WriteControl() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("WriteControl() returned after %v", elapsed)
+	}
+}
+
+func TestPingContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := NewWebSocket(a, a, true)
+	server := NewWebSocket(b, b, false)
+	server.BackgroundRead(1)
+	go func() {
+		_ = server.Send("data")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := client.PingContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("PingContext() = %v, want a positive round-trip time", rtt)
+	}
+	// 等待 Pong 的时候收到的 Message 不会丢失
+	if data := readText(t, client); data != "data" {
+		t.Fatalf("ReadMessage() = %q, want data", data)
+	}
+}
+
+func TestPingContextCanceled(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		// 对方读取 Ping 但是不回复
+		_, _ = io.Copy(io.Discard, b)
+	}()
+	ws := NewWebSocket(a, a, true)
+	ws.BackgroundRead(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ws.PingContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("PingContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// 已经结束的 ctx 不会等待
+	if _, err := ws.PingContext(ctx); err == nil {
+		t.Fatal("PingContext() with a finished ctx succeeded")
+	}
+}
+
+func TestPingMatchesPongPayload(t *testing.T) {
+	output := &bytes.Buffer{}
+	// 第一个 Ping 的内容是 "1"，在它之前收到的 Pong 和数据 Message 都不是它的回复
+	input := bytes.Join([][]byte{
+		rawFrame(true, Pong, 1, []byte("x")),
+		rawFrame(true, TextFrame, 2, []byte("hi")),
+		rawFrame(true, Pong, 1, []byte("1")),
+	}, nil)
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+	var pongs []string
+	ws.SetPongHandler(func(payload []byte) error {
+		pongs = append(pongs, string(payload))
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := ws.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pongs) != 2 || pongs[1] != "1" {
+		t.Fatalf("pong handler saw %q, want both pongs", pongs)
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 1 || frames[0].OpCode != Ping || string(frames[0].Payload) != "1" {
+		t.Fatalf("sent frames %+v, want one ping with payload 1", frames)
+	}
+	// 等待 Pong 的时候收到的数据 Message 不会丢失
+	if opCode, data, err := ws.ReadAllMessage(); err != nil || opCode != TextFrame || string(data) != "hi" {
+		t.Fatalf("ReadAllMessage() = %s %q %v, want TEXT hi", opCode, data, err)
+	}
+}
+
+func TestPingIgnoresUnsolicitedPong(t *testing.T) {
+	// 只有不对应的 Pong，之后连接结束，Ping 不能被当作收到了回复
+	input := rawFrame(true, Pong, 3, []byte("999"))
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	if _, err := ws.PingContext(context.Background()); err == nil {
+		t.Fatal("PingContext() succeeded with an unsolicited pong")
+	}
+
+	tracker := newPingTracker()
+	payload, pong := tracker.add()
+	if tracker.resolve([]byte("other")) {
+		t.Fatal("resolve() matched a different payload")
+	}
+	if !tracker.resolve(payload) {
+		t.Fatal("resolve() did not match the ping payload")
+	}
+	select {
+	case <-pong:
+	default:
+		t.Fatal("the pong channel was not closed")
+	}
+	// 同一个 Pong 只能回复一次
+	if tracker.resolve(payload) {
+		t.Fatal("resolve() matched an answered ping twice")
+	}
+}
+
+func TestPingPolicy(t *testing.T) {
+	pings := bytes.Join([][]byte{
+		rawFrame(true, Ping, 1, []byte("a")),
+		rawFrame(true, Ping, 1, []byte("b")),
+		rawFrame(true, TextFrame, 4, []byte("done")),
+	}, nil)
+	tests := []struct {
+		name   string
+		policy PingPolicy
+		// pongs 是回复的 Pong 的内容，messages 是 ReadMessage 返回给应用的 Message 的内容
+		pongs    []string
+		messages []string
+	}{
+		{name: "default", pongs: []string{"a", "b"}, messages: []string{"done"}},
+		{name: "disable", policy: PingPolicy{Disable: true}, messages: []string{"a", "b", "done"}},
+		{
+			name: "transform",
+			policy: PingPolicy{Transform: func(payload []byte) []byte {
+				return append([]byte("re:"), payload...)
+			}},
+			pongs:    []string{"re:a", "re:b"},
+			messages: []string{"done"},
+		},
+		// 间隔内收到的第二个 Ping 不回复
+		{name: "min interval", policy: PingPolicy{MinInterval: time.Hour}, pongs: []string{"a"}, messages: []string{"done"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(pings)), false)
+			ws.SetPingPolicy(test.policy)
+			var messages []string
+			for len(messages) < len(test.messages) {
+				_, data, err := ws.ReadAllMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				messages = append(messages, string(data))
+			}
+			if !reflect.DeepEqual(messages, test.messages) {
+				t.Fatalf("ReadMessage returned %q, want %q", messages, test.messages)
+			}
+			var pongs []string
+			for _, frame := range decodeFrames(t, output.Bytes()) {
+				if frame.OpCode != Pong {
+					t.Fatalf("sent %s, want only pongs", frame.OpCode)
+				}
+				pongs = append(pongs, string(frame.Payload))
+			}
+			if !reflect.DeepEqual(pongs, test.pongs) {
+				t.Fatalf("sent pongs %q, want %q", pongs, test.pongs)
+			}
+		})
+	}
+}
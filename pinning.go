@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+var ErrCertificatePinMismatch = errors.New("server certificate does not match any pinned hash")
+
+// pinnedTLSConfig 在 config 的基础上增加证书固定的校验，没有设置任何固定值的时候原样返回 config
+func (d *Dialer) pinnedTLSConfig(config *tls.Config) *tls.Config {
+	if len(d.PinnedCertificates) < 1 && len(d.PinnedPublicKeys) < 1 {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.VerifyConnection = verifyPins(d.PinnedCertificates, d.PinnedPublicKeys, config.VerifyConnection)
+	return config
+}
+
+// verifyPins 返回一个 VerifyConnection 函数，pinCandidates 返回的证书中，
+// 只要有一个证书的 SHA-256 在 certificates 中，或者它的 SubjectPublicKeyInfo 的 SHA-256 在 publicKeys 中，校验就会通过。
+// 校验通过之后会继续调用 next。
+// 恢复会话的握手不会调用 VerifyPeerCertificate，但是会调用 VerifyConnection，所以这里使用 VerifyConnection。
+func verifyPins(certificates [][]byte, publicKeys [][]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if !matchPins(pinCandidates(state), certificates, publicKeys) {
+			return ErrCertificatePinMismatch
+		}
+		if next != nil {
+			return next(state)
+		}
+		return nil
+	}
+}
+
+// pinCandidates 返回可以用来匹配固定值的证书。
+// 服务器可以在证书链之后附带任意的证书，所以只使用校验通过的证书链中的证书；
+// InsecureSkipVerify 时没有校验过的证书链，只使用服务器自己的证书。
+func pinCandidates(state tls.ConnectionState) []*x509.Certificate {
+	if len(state.VerifiedChains) > 0 {
+		var certs []*x509.Certificate
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		return certs
+	}
+	if len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[:1]
+	}
+	return nil
+}
+
+func matchPins(certs []*x509.Certificate, certificates [][]byte, publicKeys [][]byte) bool {
+	for _, cert := range certs {
+		if len(certificates) > 0 {
+			sum := sha256.Sum256(cert.Raw)
+			if containsHash(certificates, sum[:]) {
+				return true
+			}
+		}
+		if len(publicKeys) > 0 {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if containsHash(publicKeys, sum[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsHash(hashes [][]byte, hash []byte) bool {
+	for _, h := range hashes {
+		if bytes.Equal(h, hash) {
+			return true
+		}
+	}
+	return false
+}
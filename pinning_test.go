@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCertificate 返回一个 127.0.0.1 的自签名证书
+func selfSignedCertificate(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// pinnedServer 启动一个发送 chain 作为证书链的 WebSocket 服务器，返回它的 wss URL
+func pinnedServer(t *testing.T, key *ecdsa.PrivateKey, chain ...*x509.Certificate) string {
+	t.Helper()
+	server := httptest.NewUnstartedServer((&Upgrader{}).Handler(func(ws WebSocket) {}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	certificate := tls.Certificate{PrivateKey: key}
+	for _, cert := range chain {
+		certificate.Certificate = append(certificate.Certificate, cert.Raw)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return "wss" + strings.TrimPrefix(server.URL, "https")
+}
+
+func certificateHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+func publicKeyHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+func TestDialerPins(t *testing.T) {
+	leaf, leafKey := selfSignedCertificate(t, "leaf")
+	pinned, _ := selfSignedCertificate(t, "pinned")
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	// 服务器在自己的证书之后附带了固定的证书，但是这个证书不在校验通过的证书链上，也不是服务器自己的证书
+	url := pinnedServer(t, leafKey, leaf, pinned)
+	verify := &tls.Config{RootCAs: pool}
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	tests := []struct {
+		name   string
+		dialer *Dialer
+		ok     bool
+	}{
+		{name: "leaf", dialer: &Dialer{TLSConfig: verify, PinnedCertificates: [][]byte{certificateHash(leaf)}}, ok: true},
+		{name: "leaf insecure", dialer: &Dialer{TLSConfig: insecure, PinnedCertificates: [][]byte{certificateHash(leaf)}}, ok: true},
+		{name: "public key", dialer: &Dialer{TLSConfig: verify, PinnedPublicKeys: [][]byte{publicKeyHash(leaf)}}, ok: true},
+		{name: "public key insecure", dialer: &Dialer{TLSConfig: insecure, PinnedPublicKeys: [][]byte{publicKeyHash(leaf)}}, ok: true},
+		{name: "appended certificate", dialer: &Dialer{TLSConfig: verify, PinnedCertificates: [][]byte{certificateHash(pinned)}}},
+		{name: "appended certificate insecure", dialer: &Dialer{TLSConfig: insecure, PinnedCertificates: [][]byte{certificateHash(pinned)}}},
+		{name: "appended public key insecure", dialer: &Dialer{TLSConfig: insecure, PinnedPublicKeys: [][]byte{publicKeyHash(pinned)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ws, err := test.dialer.Dial(ctx, url)
+			if test.ok {
+				if err != nil {
+					t.Fatalf("Dial() error = %v", err)
+				}
+				_ = ws.Close()
+				return
+			}
+			if !errors.Is(err, ErrCertificatePinMismatch) {
+				t.Fatalf("Dial() error = %v, want %v", err, ErrCertificatePinMismatch)
+			}
+		})
+	}
+}
+
+func TestDialerPinsResumedSession(t *testing.T) {
+	leaf, leafKey := selfSignedCertificate(t, "leaf")
+	other, _ := selfSignedCertificate(t, "other")
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	url := pinnedServer(t, leafKey, leaf)
+	resumed := make(chan bool, 1)
+	config := &tls.Config{
+		RootCAs:            pool,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		VerifyConnection: func(state tls.ConnectionState) error {
+			resumed <- state.DidResume
+			return nil
+		},
+	}
+	dial := func(pin []byte) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ws, err := (&Dialer{TLSConfig: config, PinnedCertificates: [][]byte{pin}}).Dial(ctx, url)
+		if err == nil {
+			// 读取到对方关闭连接，保证客户端处理了服务器发送的会话票据
+			_, _ = ws.ReadMessage()
+			_ = ws.Close()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := dial(certificateHash(leaf)); err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if did := <-resumed; did != (i > 0) {
+			t.Fatalf("handshake %d resumed = %v, want %v", i, did, i > 0)
+		}
+	}
+	// 恢复的会话不会重新校验证书，但是仍然要校验固定值
+	if err := dial(certificateHash(other)); !errors.Is(err, ErrCertificatePinMismatch) {
+		t.Fatalf("Dial() error = %v, want %v", err, ErrCertificatePinMismatch)
+	}
+}
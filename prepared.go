@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// PreparedMessage 是一个预先编码好的 Message，用于把同一个 Message 发送给很多连接，例如广播。
+// 每种连接需要的帧（是否压缩、压缩级别）只会编码和压缩一次，之后发送给同一种连接的时候直接写入编码好的帧。
+//
+// 客户端发送的帧需要使用每个帧不同的掩码 key，所以客户端连接只能复用压缩的结果，每次发送仍然需要加上掩码；
+// 协商了 ChecksumExtension 或者自定义扩展的连接需要对每个 Message 单独处理，会和 WriteMessage 一样发送。
+// PreparedMessage 可以在多个 goroutine 中同时使用。
+type PreparedMessage struct {
+	opCode OpCode
+	data   []byte
+
+	lock   *sync.Mutex
+	frames map[preparedKey]*preparedFrame
+}
+
+// preparedKey 是一种连接需要的帧的编码方式
+type preparedKey struct {
+	compress bool
+	level    int
+}
+
+// preparedFrame 是按照一种 preparedKey 编码好的帧，payload 是压缩之后的内容，encoded 是不带掩码的完整的帧
+type preparedFrame struct {
+	payload []byte
+	encoded []byte
+}
+
+// NewPreparedMessage 创建一个内容是 data 的 PreparedMessage，data 在之后不能被修改。
+// 控制帧的内容不能超过 125 字节。
+func NewPreparedMessage(opCode OpCode, data []byte) (*PreparedMessage, error) {
+	if opCode == ContinuationFrame {
+		return nil, ErrUnexpectedContinuation
+	}
+	if opCode.IsControl() && len(data) > maxControlPayloadLength {
+		return nil, ErrControlPayloadTooLong
+	}
+	return &PreparedMessage{
+		opCode: opCode,
+		data:   data,
+		lock:   &sync.Mutex{},
+		frames: map[preparedKey]*preparedFrame{},
+	}, nil
+}
+
+// frame 返回按照 key 编码好的帧，第一次使用的时候编码
+func (pm *PreparedMessage) frame(key preparedKey) (*preparedFrame, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if f, ok := pm.frames[key]; ok {
+		return f, nil
+	}
+	payload := pm.data
+	frame := &Frame{
+		Fin:    true,
+		OpCode: pm.opCode,
+	}
+	if key.compress {
+		// 使用新的压缩上下文，这样压缩的结果不依赖任何连接之前发送的 Message
+		d := newDeflateState(deflateParams{
+			writeNoContextTakeover: true,
+			writeWindowBits:        maxWindowBits,
+		})
+		var err error
+		payload, err = io.ReadAll(d.compress(bytes.NewReader(pm.data), key.level))
+		if err != nil {
+			return nil, err
+		}
+		frame.Rsv1 = true
+	}
+	frame.Payload = &io.LimitedReader{
+		R: bytes.NewReader(payload),
+		N: int64(len(payload)),
+	}
+	encoded, err := io.ReadAll(frame.Encode())
+	if err != nil {
+		return nil, err
+	}
+	f := &preparedFrame{
+		payload: payload,
+		encoded: encoded,
+	}
+	pm.frames[key] = f
+	return f, nil
+}
+
+// WritePreparedMessage 发送一个 PreparedMessage，和 SendMessage 一样会等待正在发送的 Message 结束
+func (w *webSocket) WritePreparedMessage(pm *PreparedMessage) error {
+	if _, ok := w.reservedAllowed(pm.opCode); pm.opCode.IsReserved() && !ok {
+		return ErrReservedOpCode
+	}
+	if w.checksum || len(w.extensions) > 0 {
+		return w.WriteMessage(pm.opCode, pm.data)
+	}
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+
+	var key preparedKey
+	if !pm.opCode.IsControl() && w.deflate != nil && w.deflate.canCompress() && !w.writeCompressionOff.Load() {
+		key.compress = int64(len(pm.data)) >= w.compressionThreshold.Load()
+	}
+	if key.compress {
+		key.level = normalizeLevel(int(w.compressionLevel.Load()))
+	}
+	f, err := pm.frame(key)
+	if err != nil {
+		return err
+	}
+	if key.compress && !w.deflate.params.writeNoContextTakeover {
+		// 对方的解压上下文里多了这个 Message，本地的压缩器需要重新开始，之后的 Message 才不会引用错误的数据
+		w.deflate.lock.Lock()
+		w.deflate.resetWriter()
+		w.deflate.lock.Unlock()
+	}
+	if w.mask {
+		frame := &Frame{
+			Fin:    true,
+			Rsv1:   key.compress,
+			Mask:   true,
+			OpCode: pm.opCode,
+			Payload: &io.LimitedReader{
+				R: bytes.NewReader(f.payload),
+				N: int64(len(f.payload)),
+			},
+			data: append([]byte(nil), f.payload...),
+		}
+		return w.sendFrame(context.Background(), frame)
+	}
+	return w.writeFrame(pm.opCode, time.Time{}, func(output io.Writer) error {
+		_, err := output.Write(f.encoded)
+		return err
+	})
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewPreparedMessage(t *testing.T) {
+	if _, err := NewPreparedMessage(ContinuationFrame, []byte("a")); err != ErrUnexpectedContinuation {
+		t.Fatalf("NewPreparedMessage(ContinuationFrame) error = %v, want %v", err, ErrUnexpectedContinuation)
+	}
+	long := bytes.Repeat([]byte{'a'}, maxControlPayloadLength+1)
+	if _, err := NewPreparedMessage(Ping, long); err != ErrControlPayloadTooLong {
+		t.Fatalf("NewPreparedMessage(Ping) error = %v, want %v", err, ErrControlPayloadTooLong)
+	}
+	if _, err := NewPreparedMessage(BinaryFrame, long); err != nil {
+		t.Fatalf("NewPreparedMessage(BinaryFrame) error = %v", err)
+	}
+}
+
+func TestWritePreparedMessage(t *testing.T) {
+	pm, err := NewPreparedMessage(TextFrame, []byte("broadcast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mask := range []bool{false, false, true} {
+		output := &bytes.Buffer{}
+		ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), mask)
+		if err = ws.WritePreparedMessage(pm); err != nil {
+			t.Fatal(err)
+		}
+		frames := decodeFrames(t, output.Bytes())
+		want := []sentFrame{{OpCode: TextFrame, Fin: true, Mask: mask, Payload: []byte("broadcast")}}
+		if !reflect.DeepEqual(frames, want) {
+			t.Fatalf("sent frames %+v, want %+v", frames, want)
+		}
+	}
+	// 所有连接都不压缩，只编码了一次
+	if len(pm.frames) != 1 {
+		t.Fatalf("encoded %d frames, want 1", len(pm.frames))
+	}
+}
+
+func TestWritePreparedMessageCompressed(t *testing.T) {
+	text := strings.Repeat("websocket ", 20)
+	pm, err := NewPreparedMessage(TextFrame, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	ws := deflateSocket(output, bytes.NewReader(nil), false)
+	if err = ws.Send(text); err != nil {
+		t.Fatal(err)
+	}
+	if err = ws.WritePreparedMessage(pm); err != nil {
+		t.Fatal(err)
+	}
+	// 压缩器在 PreparedMessage 之后重新开始，之后的 Message 仍然可以被对方解压
+	if err = ws.Send(text); err != nil {
+		t.Fatal(err)
+	}
+	if rsv1 := sentRsv1(t, output.Bytes()); len(rsv1) != 3 || !rsv1[0] || !rsv1[1] || !rsv1[2] {
+		t.Fatalf("Rsv1 = %v, want all compressed", rsv1)
+	}
+	receiver := deflateSocket(io.Discard, bytes.NewReader(output.Bytes()), false)
+	for i := 0; i < 3; i++ {
+		if data := readText(t, receiver); data != text {
+			t.Fatalf("message %d = %q, want %q", i, data, text)
+		}
+	}
+	// 不压缩的连接使用另一种编码
+	if err = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).WritePreparedMessage(pm); err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.frames) != 2 {
+		t.Fatalf("encoded %d frames, want 2", len(pm.frames))
+	}
+}
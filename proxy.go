@@ -0,0 +1,143 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+var ErrUnsupportedProxy = errors.New("unsupported proxy scheme")
+
+// dialFunc 是建立连接的函数，和 net.Dialer.DialContext 的签名一样
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+var (
+	envProxyOnce sync.Once
+	envProxyFunc func(*url.URL) (*url.URL, error)
+)
+
+// ProxyFromEnvironment 按照 HTTP_PROXY、HTTPS_PROXY 和 NO_PROXY 环境变量（以及它们的小写形式）返回 request 使用的代理服务器，
+// ws 按照 http 处理，wss 按照 https 处理。环境变量只在第一次调用的时候读取，发往 localhost 的请求不会使用代理。
+// 可以设置成 Dialer.Proxy 使用。
+func ProxyFromEnvironment(request *http.Request) (*url.URL, error) {
+	envProxyOnce.Do(func() {
+		envProxyFunc = httpproxy.FromEnvironment().ProxyFunc()
+	})
+	return envProxyFunc(cookieURL(request.URL))
+}
+
+// proxyDial 返回通过 proxyURL 连接目标地址的拨号函数，forward 用于连接代理服务器。
+// header 是 HTTP 代理的 CONNECT 请求中额外的请求头。
+func proxyDial(proxyURL *url.URL, forward dialFunc, header http.Header) (dialFunc, error) {
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return httpConnectDial(proxyURL, forward, header), nil
+	case "socks5", "socks5h":
+	default:
+		return nil, ErrUnsupportedProxy
+	}
+	dialer, err := proxy.FromURL(proxyURL, forward)
+	if err != nil {
+		return nil, err
+	}
+	return contextDial(dialer), nil
+}
+
+// contextDial 把 proxy.Dialer 转换成 dialFunc，不支持 context 的 Dialer 会忽略 ctx
+func contextDial(dialer proxy.Dialer) dialFunc {
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.Dial(network, address)
+	}
+}
+
+// httpConnectDial 返回通过 HTTP 代理的 CONNECT 方法建立隧道的拨号函数，https 代理会先和代理服务器完成 TLS 握手。
+// proxyURL 中的用户名和密码会作为 Proxy-Authorization 发送。代理拒绝的时候返回 *ResponseError。
+func httpConnectDial(proxyURL *url.URL, forward dialFunc, header http.Header) dialFunc {
+	proxyAddress := proxyURL.Host
+	if len(proxyURL.Port()) < 1 {
+		if proxyURL.Scheme == "https" {
+			proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	dial := forward
+	if proxyURL.Scheme == "https" {
+		dial = tlsDial(forward, nil)
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		request := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: header.Clone(),
+		}
+		if request.Header == nil {
+			request.Header = http.Header{}
+		}
+		if user := proxyURL.User; user != nil && len(request.Header.Get("Proxy-Authorization")) < 1 {
+			password, _ := user.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+			request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		err = request.Write(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, request)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			responseErr := newResponseError(resp, errors.New("proxy CONNECT failed: "+resp.Status))
+			_ = conn.Close()
+			return nil, responseErr
+		}
+		_ = conn.SetDeadline(time.Time{})
+		if reader.Buffered() > 0 {
+			// 代理在 200 响应之后已经发送了目标服务器的数据
+			return &prefixedConn{Conn: conn, reader: reader}, nil
+		}
+		return conn, nil
+	}
+}
+
+// prefixedConn 先读取 reader 中已经缓冲的数据，再读取 Conn
+type prefixedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
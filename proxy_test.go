@@ -0,0 +1,309 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer 返回一个把收到的 Message 原样发回的 WebSocket 服务器的地址
+func echoServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer((&Upgrader{}).Handler(func(ws WebSocket) {
+		for {
+			message, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = ws.SendMessage(message); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// connectProxy 是一个记录 CONNECT 请求的 HTTP 代理，Proxy-Authorization 和 authorization 不同的时候响应 407
+type connectProxy struct {
+	listener      net.Listener
+	authorization string
+	requests      chan *http.Request
+}
+
+func newConnectProxy(t *testing.T, authorization string) *connectProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{listener: listener, authorization: authorization, requests: make(chan *http.Request, 4)}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	p.requests <- request
+	if request.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	if request.Header.Get("Proxy-Authorization") != p.authorization {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		_, _ = io.Copy(target, conn)
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+// echoThrough 通过 dialer 连接 address 上的 echoServer，发送一个 Message 并确认收到了相同的内容
+func echoThrough(t *testing.T, dialer *Dialer, address string) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := dialer.Dial(ctx, "ws://"+address+"/")
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	if err = ws.Send("hello"); err != nil {
+		return err
+	}
+	_, data, err := ws.ReadAllMessage()
+	if err != nil {
+		return err
+	}
+	if string(data) != "hello" {
+		t.Fatalf("echoed %q, want hello", data)
+	}
+	return nil
+}
+
+func TestDialThroughHTTPProxy(t *testing.T) {
+	address := echoServer(t)
+	// Basic dXNlcjpwYXNz 是 user:pass
+	p := newConnectProxy(t, "Basic dXNlcjpwYXNz")
+	proxyURL := &url.URL{Scheme: "http", Host: p.listener.Addr().String(), User: url.UserPassword("user", "pass")}
+	dialer := &Dialer{
+		Proxy:              http.ProxyURL(proxyURL),
+		ProxyConnectHeader: http.Header{"User-Agent": {"proxy-test"}},
+	}
+	if err := echoThrough(t, dialer, address); err != nil {
+		t.Fatal(err)
+	}
+	request := <-p.requests
+	if request.Host != address || request.Header.Get("User-Agent") != "proxy-test" {
+		t.Fatalf("CONNECT %s with User-Agent %q, want %s and the ProxyConnectHeader", request.Host, request.Header.Get("User-Agent"), address)
+	}
+
+	// 用户名和密码不对的时候返回代理的响应
+	proxyURL.User = url.UserPassword("user", "wrong")
+	err := echoThrough(t, dialer, address)
+	var responseErr *ResponseError
+	if !errors.As(err, &responseErr) || responseErr.Response.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("Dial() error = %v, want a 407 response", err)
+	}
+	<-p.requests
+
+	// 设置了 Address 的时候不使用代理
+	dialer.Address = address
+	if err = echoThrough(t, dialer, "example.invalid"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request = <-p.requests:
+		t.Fatalf("proxy received %s %s with Address set", request.Method, request.Host)
+	default:
+	}
+}
+
+func TestDialThroughSOCKS5Proxy(t *testing.T) {
+	address := echoServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// SOCKS5Gateway 的 serve 处理的是普通的 SOCKS5 会话，可以直接作为 SOCKS5 代理
+	gateway := &SOCKS5Gateway{Authenticate: func(username, password string) bool {
+		return username == "user" && password == "pass"
+	}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go gateway.serve(context.Background(), conn, conn.RemoteAddr().String())
+		}
+	}()
+	proxyURL := &url.URL{Scheme: "socks5", Host: listener.Addr().String(), User: url.UserPassword("user", "pass")}
+	if err = echoThrough(t, &Dialer{Proxy: http.ProxyURL(proxyURL)}, address); err != nil {
+		t.Fatal(err)
+	}
+	proxyURL.User = url.UserPassword("user", "wrong")
+	if err = echoThrough(t, &Dialer{Proxy: http.ProxyURL(proxyURL)}, address); err == nil {
+		t.Fatal("Dial() with a wrong SOCKS5 password succeeded")
+	}
+}
+
+func TestDialUnsupportedProxy(t *testing.T) {
+	proxyURL := &url.URL{Scheme: "ftp", Host: "127.0.0.1:21"}
+	if err := echoThrough(t, &Dialer{Proxy: http.ProxyURL(proxyURL)}, "example.invalid"); !errors.Is(err, ErrUnsupportedProxy) {
+		t.Fatalf("Dial() error = %v, want %v", err, ErrUnsupportedProxy)
+	}
+}
+
+func TestHTTPConnectKeepsBufferedData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(server)); err != nil {
+			return
+		}
+		// 200 响应和目标服务器的数据在同一次写入中到达
+		_, _ = io.WriteString(server, "HTTP/1.1 200 OK\r\n\r\nhello")
+	}()
+	forward := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return client, nil
+	}
+	dial := httpConnectDial(&url.URL{Scheme: "http", Host: "proxy.example.com"}, forward, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadAll() = %q, %v, want hello", data, err)
+	}
+}
+
+func socks5Proxy(t *testing.T) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	targets := make(chan string, 4)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{5, 0})
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 1:
+			ip := make([]byte, 4)
+			if _, err := io.ReadFull(conn, ip); err != nil {
+				return
+			}
+			host = net.IP(ip).String()
+		case 3:
+			size := make([]byte, 1)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				return
+			}
+			name := make([]byte, size[0])
+			if _, err := io.ReadFull(conn, name); err != nil {
+				return
+			}
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(conn, port); err != nil {
+			return
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+		targets <- address
+		target, err := net.Dial("tcp", address)
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go func() {
+			_, _ = io.Copy(target, conn)
+		}()
+		_, _ = io.Copy(conn, target)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func TestDialProxyFunc(t *testing.T) {
+	address := echoServer(t)
+	// Proxy 返回 nil 的时候直接连接
+	direct := &Dialer{Proxy: func(request *http.Request) (*url.URL, error) {
+		return nil, nil
+	}}
+	if err := echoThrough(t, direct, address); err != nil {
+		t.Fatal(err)
+	}
+	errProxy := errors.New("no proxy")
+	failing := &Dialer{Proxy: func(request *http.Request) (*url.URL, error) {
+		return nil, errProxy
+	}}
+	if err := echoThrough(t, failing, address); !errors.Is(err, errProxy) {
+		t.Fatalf("Dial() error = %v, want %v", err, errProxy)
+	}
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultWriteQueueSize 是没有调用 SetWriteQueue 就使用 SendAsync 时的队列长度
+const DefaultWriteQueueSize = 64
+
+// QueuePolicy 表示异步发送队列满了之后如何处理新的 Message
+type QueuePolicy uint8
+
+const (
+	// QueueBlock 让 SendAsync 等待队列中有空位，这是默认的行为
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest 丢弃队列中最早的 Message，然后放入新的 Message
+	QueueDropOldest
+	// QueueDropNewest 丢弃新的 Message，SendAsync 返回 ErrWriteQueueFull
+	QueueDropNewest
+	// QueueCloseConnection 直接关闭连接，关闭原因是 ClosePolicyViolation，SendAsync 返回 ErrWriteQueueFull。
+	// 适合广播的服务端断开跟不上的慢客户端。
+	QueueCloseConnection
+)
+
+var ErrWriteQueueFull = errors.New("write queue is full")
+
+// WriteQueue 是异步发送队列的配置
+type WriteQueue struct {
+	// Size 是队列的长度，小于 1 时使用 DefaultWriteQueueSize
+	Size int
+
+	// Policy 是队列满了之后的处理方式
+	Policy QueuePolicy
+
+	// OnDrop 不为空时，会在 Message 因为队列满了被丢弃的时候被调用
+	OnDrop func(message *Message)
+}
+
+// writeQueue 是 SendAsync 使用的队列，由一个后台 goroutine 按顺序发送
+type writeQueue struct {
+	config   WriteQueue
+	messages chan *Message
+	// lock 让丢弃和放入成为一个整体，避免多个 SendAsync 同时丢弃
+	lock *sync.Mutex
+}
+
+// SetWriteQueue 设置 SendAsync 使用的队列，需要在第一次调用 SendAsync 之前调用，之后调用不会有效果
+func (w *webSocket) SetWriteQueue(queue WriteQueue) {
+	w.queueLock.Lock()
+	defer w.queueLock.Unlock()
+	if w.queue != nil {
+		return
+	}
+	w.queue = w.newWriteQueue(queue)
+}
+
+func (w *webSocket) newWriteQueue(config WriteQueue) *writeQueue {
+	if config.Size < 1 {
+		config.Size = DefaultWriteQueueSize
+	}
+	q := &writeQueue{
+		config:   config,
+		messages: make(chan *Message, config.Size),
+		lock:     &sync.Mutex{},
+	}
+	go w.drainWriteQueue(q)
+	return q
+}
+
+func (w *webSocket) getWriteQueue() *writeQueue {
+	w.queueLock.Lock()
+	defer w.queueLock.Unlock()
+	if w.queue == nil {
+		w.queue = w.newWriteQueue(WriteQueue{})
+	}
+	return w.queue
+}
+
+// SendAsync 把 Message 放入发送队列，由后台 goroutine 按照放入的顺序发送，不等待发送完成。
+// 发送之前 Message.Reader 需要保持可读，发送出错的时候连接会被关闭，错误可以通过 CloseReason 获取。
+// 队列满了之后的行为由 SetWriteQueue 设置的 QueuePolicy 决定。
+func (w *webSocket) SendAsync(message *Message) error {
+	if w.state() > OPEN {
+		return ErrClosedStatus
+	}
+	q := w.getWriteQueue()
+	done := w.Done()
+	if q.config.Policy == QueueBlock {
+		select {
+		case q.messages <- message:
+			return nil
+		case <-done:
+			return ErrClosedStatus
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		select {
+		case q.messages <- message:
+			return nil
+		default:
+		}
+		switch q.config.Policy {
+		case QueueDropOldest:
+			select {
+			case dropped := <-q.messages:
+				q.drop(dropped)
+			default:
+			}
+		case QueueDropNewest:
+			q.drop(message)
+			return ErrWriteQueueFull
+		default:
+			// 对方已经跟不上发送的速度，ConnectionClose 也可能写不出去，所以直接关闭流
+			w.setCloseInfo(&CloseInfo{
+				Initiator: CloseByLocal,
+				Code:      ClosePolicyViolation,
+				Reason:    ErrWriteQueueFull.Error(),
+				Err:       ErrWriteQueueFull,
+			})
+			_ = w.closeStreams()
+			return ErrWriteQueueFull
+		}
+	}
+}
+
+func (q *writeQueue) drop(message *Message) {
+	if q.config.OnDrop != nil {
+		q.config.OnDrop(message)
+	}
+}
+
+func (w *webSocket) drainWriteQueue(q *writeQueue) {
+	done := w.Done()
+	for {
+		select {
+		case message := <-q.messages:
+			err := w.SendMessage(message)
+			if err != nil {
+				_ = w.abort(err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stalledQueue 返回一个使用 config 的发送队列已经满了的 WebSocket：第一个 Message 正在阻塞地写入，
+// 队列中还有 config.Size 个 Message。返回的 io.PipeReader 读取发送的数据，开始读取之后写入才能继续。
+func stalledQueue(t *testing.T, config WriteQueue) (*webSocket, *io.PipeReader) {
+	t.Helper()
+	reader, writer := io.Pipe()
+	t.Cleanup(func() {
+		_ = reader.Close()
+	})
+	ws := NewWebSocket(writer, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+	ws.SetWriteQueue(config)
+	if err := ws.SendAsync(textMessage("1")); err != nil {
+		t.Fatal(err)
+	}
+	// 等待后台 goroutine 取走第一个 Message
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ws.queue.messages) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first message was not taken from the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i < config.Size+2; i++ {
+		if err := ws.SendAsync(textMessage(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ws, reader
+}
+
+func textMessage(text string) *Message {
+	return &Message{Reader: bytes.NewReader([]byte(text)), OpCode: TextFrame}
+}
+
+// receivedTexts 从 reader 中读取 count 个 Message 的内容
+func receivedTexts(t *testing.T, reader io.ReadCloser, count int) []string {
+	t.Helper()
+	receiver := NewWebSocket(discardCloser{io.Discard}, reader, false)
+	var texts []string
+	for i := 0; i < count; i++ {
+		_, data, err := receiver.ReadAllMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, string(data))
+	}
+	return texts
+}
+
+// droppedTexts 是记录被丢弃的 Message 内容的 OnDrop
+type droppedTexts struct {
+	lock  sync.Mutex
+	texts []string
+}
+
+func (d *droppedTexts) onDrop(message *Message) {
+	data, _ := io.ReadAll(message)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.texts = append(d.texts, string(data))
+}
+
+func TestWriteQueueDropNewest(t *testing.T) {
+	dropped := &droppedTexts{}
+	ws, reader := stalledQueue(t, WriteQueue{Size: 2, Policy: QueueDropNewest, OnDrop: dropped.onDrop})
+	if err := ws.SendAsync(textMessage("4")); err != ErrWriteQueueFull {
+		t.Fatalf("SendAsync() error = %v, want %v", err, ErrWriteQueueFull)
+	}
+	if !reflect.DeepEqual(dropped.texts, []string{"4"}) {
+		t.Fatalf("dropped %q, want [4]", dropped.texts)
+	}
+	if texts := receivedTexts(t, reader, 3); !reflect.DeepEqual(texts, []string{"1", "2", "3"}) {
+		t.Fatalf("received %q, want [1 2 3]", texts)
+	}
+}
+
+func TestWriteQueueDropOldest(t *testing.T) {
+	dropped := &droppedTexts{}
+	ws, reader := stalledQueue(t, WriteQueue{Size: 2, Policy: QueueDropOldest, OnDrop: dropped.onDrop})
+	if err := ws.SendAsync(textMessage("4")); err != nil {
+		t.Fatal(err)
+	}
+	// 正在写入的 Message 不会被丢弃，丢弃的是队列中最早的 Message
+	if !reflect.DeepEqual(dropped.texts, []string{"2"}) {
+		t.Fatalf("dropped %q, want [2]", dropped.texts)
+	}
+	if texts := receivedTexts(t, reader, 3); !reflect.DeepEqual(texts, []string{"1", "3", "4"}) {
+		t.Fatalf("received %q, want [1 3 4]", texts)
+	}
+}
+
+func TestWriteQueueCloseConnection(t *testing.T) {
+	ws, _ := stalledQueue(t, WriteQueue{Size: 1, Policy: QueueCloseConnection})
+	if err := ws.SendAsync(textMessage("3")); err != ErrWriteQueueFull {
+		t.Fatalf("SendAsync() error = %v, want %v", err, ErrWriteQueueFull)
+	}
+	if ws.Status() != CLOSED {
+		t.Fatalf("Status() = %d, want %d", ws.Status(), CLOSED)
+	}
+	if info := ws.CloseReason(); info == nil || info.Code != ClosePolicyViolation || info.Err != ErrWriteQueueFull {
+		t.Fatalf("CloseReason() = %+v, want %d with %v", info, ClosePolicyViolation, ErrWriteQueueFull)
+	}
+	if err := ws.SendAsync(textMessage("4")); err != ErrClosedStatus {
+		t.Fatalf("SendAsync() after close error = %v, want %v", err, ErrClosedStatus)
+	}
+}
+
+func TestWriteQueueBlock(t *testing.T) {
+	ws, reader := stalledQueue(t, WriteQueue{Size: 1})
+	sent := make(chan error, 1)
+	go func() {
+		sent <- ws.SendAsync(textMessage("3"))
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("SendAsync() = %v on a full queue, want it to wait", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// 开始读取之后队列有了空位
+	if texts := receivedTexts(t, reader, 3); !reflect.DeepEqual(texts, []string{"1", "2", "3"}) {
+		t.Fatalf("received %q, want [1 2 3]", texts)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteQueueDefaults(t *testing.T) {
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+	if err := ws.SendAsync(textMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+	if size := cap(ws.queue.messages); size != DefaultWriteQueueSize {
+		t.Fatalf("queue size = %d, want %d", size, DefaultWriteQueueSize)
+	}
+	// 使用之后再设置没有效果
+	ws.SetWriteQueue(WriteQueue{Size: 1})
+	if size := cap(ws.queue.messages); size != DefaultWriteQueueSize {
+		t.Fatalf("queue size = %d after SetWriteQueue, want %d", size, DefaultWriteQueueSize)
+	}
+}
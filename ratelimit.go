@@ -0,0 +1,259 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket 是一个令牌桶，令牌以 rate 个每秒的速度产生，最多积累 burst 个
+type tokenBucket struct {
+	lock   *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, burst int64) *tokenBucket {
+	if burst < 1 {
+		burst = rate
+	}
+	return &tokenBucket{
+		lock:   &sync.Mutex{},
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve 预先消耗 n 个令牌，返回需要等待多久才能使用它们。
+// 一次最多预支 burst 个令牌，更多的令牌需要分多次预支，这样等待的时间不会超过 burst 需要的时间，也不会溢出。
+func (b *tokenBucket) reserve(n int64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	b.tokens -= math.Min(float64(n), b.burst)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow 在令牌足够的时候消耗 n 个令牌并返回 true，否则不消耗并返回 false。
+// 令牌桶是满的时候总是允许，这样超过 burst 的请求也不会永远被拒绝。
+func (b *tokenBucket) allow(n int64) bool {
+	return allowAll(tokenRequest{bucket: b, n: n})
+}
+
+// tokenRequest 是 allowAll 中需要从 bucket 消耗的 n 个令牌，bucket 为空表示不限制
+type tokenRequest struct {
+	bucket *tokenBucket
+	n      int64
+}
+
+// allowAll 先检查所有的令牌桶，全部足够的时候才从每个桶中消耗令牌并返回 true。
+// 这样一个桶拒绝的时候不会用掉其他桶的令牌，多个限制之间不会互相影响。
+// 检查和消耗的时候持有所有桶的锁，同一组桶需要按照相同的顺序传入。
+func allowAll(requests ...tokenRequest) bool {
+	now := time.Now()
+	for _, r := range requests {
+		if r.bucket != nil {
+			r.bucket.lock.Lock()
+			defer r.bucket.lock.Unlock()
+		}
+	}
+	for _, r := range requests {
+		if b := r.bucket; b != nil {
+			b.refill(now)
+			if b.tokens < float64(r.n) && b.tokens < b.burst {
+				return false
+			}
+		}
+	}
+	for _, r := range requests {
+		if r.bucket != nil {
+			r.bucket.tokens -= float64(r.n)
+		}
+	}
+	return true
+}
+
+// wait 消耗 n 个令牌，令牌不够的时候会等待。ctx 结束或者 done 被关闭的时候停止等待并返回错误。
+func (b *tokenBucket) wait(ctx context.Context, done <-chan struct{}, n int64) error {
+	delay := b.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return ErrClosedStatus
+	}
+}
+
+// chunk 返回单次读写的最大字节数，避免一次预支太多的令牌
+func (b *tokenBucket) chunk(n int) int {
+	if burst := int(b.burst); n > burst && burst > 0 {
+		return burst
+	}
+	return n
+}
+
+// Bandwidth 用于限制单个方向的带宽
+type Bandwidth struct {
+	// BytesPerSecond 是每秒允许传输的字节数，为 0 时不限制
+	BytesPerSecond int64
+	// Burst 是允许突发传输的字节数，为 0 时等于 BytesPerSecond
+	Burst int64
+}
+
+func (b Bandwidth) bucket() *tokenBucket {
+	if b.BytesPerSecond < 1 {
+		return nil
+	}
+	return newTokenBucket(b.BytesPerSecond, b.Burst)
+}
+
+func (w *webSocket) SetBandwidth(upload Bandwidth, download Bandwidth) {
+	w.uploadLimit.Store(upload.bucket())
+	w.downloadLimit.Store(download.bucket())
+}
+
+// InboundLimit 用于限制对方发送帧的频率和流量，适合面向公网的服务端防止滥用
+type InboundLimit struct {
+	// FramesPerSecond 是每秒允许收到的帧数量，为 0 时不限制
+	FramesPerSecond int64
+	// FrameBurst 是允许突发收到的帧数量，为 0 时等于 FramesPerSecond
+	FrameBurst int64
+	// BytesPerSecond 是每秒允许收到的帧内容字节数，为 0 时不限制
+	BytesPerSecond int64
+	// ByteBurst 是允许突发收到的帧内容字节数，为 0 时等于 BytesPerSecond
+	ByteBurst int64
+	// CloseOnExceed 为 true 时，超过限制会使用 ClosePolicyViolation 关闭连接，
+	// 否则会延迟读取下一个帧，字节数的限制在读取帧内容的时候按照实际读取的字节数等待
+	CloseOnExceed bool
+}
+
+type inboundLimiter struct {
+	frames        *tokenBucket
+	bytes         *tokenBucket
+	closeOnExceed bool
+}
+
+var ErrInboundLimitExceeded = errors.New("peer exceeded the inbound rate limit")
+
+// SetInboundLimit 设置收到的帧的频率和流量限制，所有字段为 0 时取消限制
+func (w *webSocket) SetInboundLimit(limit InboundLimit) {
+	limiter := &inboundLimiter{closeOnExceed: limit.CloseOnExceed}
+	if limit.FramesPerSecond > 0 {
+		limiter.frames = newTokenBucket(limit.FramesPerSecond, limit.FrameBurst)
+	}
+	if limit.BytesPerSecond > 0 {
+		limiter.bytes = newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+	}
+	if limiter.frames == nil && limiter.bytes == nil {
+		limiter = nil
+	}
+	w.inboundLimit.Store(limiter)
+}
+
+// limitInbound 在收到帧之后按照 InboundLimit 消耗令牌，超过限制的时候延迟或者关闭连接
+func (w *webSocket) limitInbound(ctx context.Context, frame *Frame) error {
+	limiter := w.inboundLimit.Load()
+	if limiter == nil {
+		return nil
+	}
+	if limiter.closeOnExceed {
+		if !allowAll(tokenRequest{bucket: limiter.frames, n: 1}, tokenRequest{bucket: limiter.bytes, n: frame.Payload.N}) {
+			_ = w.fail(ClosePolicyViolation, ErrInboundLimitExceeded.Error())
+			return ErrInboundLimitExceeded
+		}
+		return nil
+	}
+	if limiter.frames != nil {
+		if err := limiter.frames.wait(ctx, w.Done(), 1); err != nil {
+			if w.state() > OPEN {
+				return w.closedError()
+			}
+			return w.abort(err)
+		}
+	}
+	if limiter.bytes != nil && frame.Payload.N > 0 {
+		// 帧头中的长度是对方声明的，内容可能很久之后才到达或者根本不会到达，所以按照实际读取的字节数消耗令牌
+		frame.Payload.R = &throttledReader{reader: frame.Payload.R, bucket: limiter.bytes, ctx: ctx, done: w.Done()}
+	}
+	return nil
+}
+
+// throttledReader 按照令牌桶的速度读取数据
+type throttledReader struct {
+	reader io.Reader
+	bucket *tokenBucket
+	ctx    context.Context
+	done   <-chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p[:r.bucket.chunk(len(p))])
+	if waitErr := r.bucket.wait(r.ctx, r.done, int64(n)); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// throttledWriter 按照令牌桶的速度写入数据
+type throttledWriter struct {
+	writer io.Writer
+	bucket *tokenBucket
+	done   <-chan struct{}
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		size := w.bucket.chunk(len(p) - written)
+		if err := w.bucket.wait(context.Background(), w.done, int64(size)); err != nil {
+			return written, err
+		}
+		n, err := w.writer.Write(p[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// input 返回读取帧使用的流，设置了下载带宽的时候会限制读取速度，ctx 结束或者连接关闭的时候停止等待
+func (w *webSocket) input(ctx context.Context) io.Reader {
+	if bucket := w.downloadLimit.Load(); bucket != nil {
+		return &throttledReader{reader: w.reader, bucket: bucket, ctx: ctx, done: w.Done()}
+	}
+	return w.reader
+}
+
+// output 返回发送帧使用的流，设置了上传带宽的时候会限制写入速度，连接关闭的时候停止等待
+func (w *webSocket) output() io.Writer {
+	if bucket := w.uploadLimit.Load(); bucket != nil {
+		return &throttledWriter{writer: w.writer, bucket: bucket, done: w.Done()}
+	}
+	return w.writer
+}
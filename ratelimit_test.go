@@ -0,0 +1,188 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := newTokenBucket(100, 10)
+	if delay := bucket.reserve(10); delay != 0 {
+		t.Fatalf("reserve() within the burst = %v, want 0", delay)
+	}
+	// 令牌不够的时候返回需要等待的时间，5 个令牌需要 50ms
+	if delay := bucket.reserve(5); delay <= 40*time.Millisecond || delay > 50*time.Millisecond {
+		t.Fatalf("reserve() = %v, want about 50ms", delay)
+	}
+	// 一次最多预支 burst 个令牌，等待的时间不会溢出
+	if delay := newTokenBucket(100, 10).reserve(1 << 62); delay != 0 {
+		t.Fatalf("reserve(1 << 62) on a full bucket = %v, want 0", delay)
+	}
+	if n := bucket.chunk(1000); n != 10 {
+		t.Fatalf("chunk(1000) = %d, want the burst 10", n)
+	}
+	// Burst 为 0 时等于 rate
+	if bucket = newTokenBucket(100, 0); bucket.burst != 100 {
+		t.Fatalf("burst = %v, want 100", bucket.burst)
+	}
+}
+
+// sizeRecorder 记录每次 Write 的最大长度
+type sizeRecorder struct {
+	bytes.Buffer
+	max int
+}
+
+func (r *sizeRecorder) Write(p []byte) (int, error) {
+	if len(p) > r.max {
+		r.max = len(p)
+	}
+	return r.Buffer.Write(p)
+}
+
+func TestSetBandwidthUpload(t *testing.T) {
+	output := &sizeRecorder{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	ws.SetBandwidth(Bandwidth{BytesPerSecond: 1000, Burst: 100}, Bandwidth{})
+	start := time.Now()
+	if err := ws.Send(string(bytes.Repeat([]byte{'a'}, 300))); err != nil {
+		t.Fatal(err)
+	}
+	// 超过 Burst 的 200 多个字节需要等待 200ms 以上
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("sending 300 bytes at 1000 B/s took %v", elapsed)
+	}
+	if output.max > 100 {
+		t.Fatalf("wrote %d bytes at once, want at most the burst", output.max)
+	}
+
+	// 为 0 的 Bandwidth 取消限制
+	ws.SetBandwidth(Bandwidth{}, Bandwidth{})
+	start = time.Now()
+	if err := ws.Send(string(bytes.Repeat([]byte{'a'}, 3000))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("sending without a limit took %v", elapsed)
+	}
+}
+
+func TestSetBandwidthDownload(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, 300)
+	input := append([]byte{0x82, 126, 0x01, 0x2c}, payload...)
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetBandwidth(Bandwidth{}, Bandwidth{BytesPerSecond: 1000, Burst: 100})
+	start := time.Now()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(message)
+	if err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("ReadAll() = %d bytes, %v", len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("reading 300 bytes at 1000 B/s took %v", elapsed)
+	}
+}
+
+func TestAllowAllConsumesOnlyWhenAllowed(t *testing.T) {
+	frameBucket := newTokenBucket(1, 10)
+	byteBucket := newTokenBucket(1, 100)
+	byteBucket.tokens = 50
+	if allowAll(tokenRequest{bucket: frameBucket, n: 1}, tokenRequest{bucket: byteBucket, n: 60}) {
+		t.Fatal("allowAll() = true with too few byte tokens")
+	}
+	if frameBucket.tokens < 10 {
+		t.Fatalf("frame tokens = %v after a rejection on bytes, want 10", frameBucket.tokens)
+	}
+	if !allowAll(tokenRequest{bucket: frameBucket, n: 1}, tokenRequest{bucket: byteBucket, n: 40}, tokenRequest{n: 1 << 20}) {
+		t.Fatal("allowAll() = false with enough tokens")
+	}
+	if frameBucket.tokens < 9 || frameBucket.tokens >= 9.5 || byteBucket.tokens < 10 || byteBucket.tokens >= 10.5 {
+		t.Fatalf("tokens = %v and %v, want 9 and 10", frameBucket.tokens, byteBucket.tokens)
+	}
+}
+
+func TestInboundLimitRejectOnBytesKeepsFrameBudget(t *testing.T) {
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).(*webSocket)
+	ws.SetInboundLimit(InboundLimit{
+		FramesPerSecond: 1,
+		FrameBurst:      5,
+		BytesPerSecond:  1,
+		ByteBurst:       100,
+		CloseOnExceed:   true,
+	})
+	limiter := ws.inboundLimit.Load()
+	limiter.bytes.tokens = 10
+	frame := &Frame{Payload: &io.LimitedReader{N: 50}}
+	if err := ws.limitInbound(context.Background(), frame); err != ErrInboundLimitExceeded {
+		t.Fatalf("limitInbound() error = %v, want %v", err, ErrInboundLimitExceeded)
+	}
+	if limiter.frames.tokens < 5 {
+		t.Fatalf("frame tokens = %v after a rejection on bytes, want 5", limiter.frames.tokens)
+	}
+}
+
+func TestInboundLimitDelayOversizedFrame(t *testing.T) {
+	// 帧头声明了 2^62 个字节，实际只发送了 3 个字节
+	input := []byte{0x82, 127, 0x40, 0, 0, 0, 0, 0, 0, 0, 'a', 'b', 'c'}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetInboundLimit(InboundLimit{BytesPerSecond: 100, ByteBurst: 10})
+	start := time.Now()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 令牌按照实际读取的字节消耗，不会在内容到达之前按照声明的长度等待
+	data, err := io.ReadAll(message)
+	if string(data) != "abc" || err == nil {
+		t.Fatalf("ReadAll() = %q, %v, want abc and an error", data, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("reading an oversized frame took %v", elapsed)
+	}
+}
+
+func TestInboundLimitDelayByBytesRead(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, 300)
+	input := append([]byte{0x82, 126, 0x01, 0x2c}, payload...)
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetInboundLimit(InboundLimit{BytesPerSecond: 1000, ByteBurst: 100})
+	start := time.Now()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(message); err != nil || !bytes.Equal(data, payload) {
+		t.Fatalf("ReadAll() = %d bytes, %v", len(data), err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("reading 300 bytes at 1000 B/s took %v", elapsed)
+	}
+}
+
+func TestInboundLimitCloseDuringDelay(t *testing.T) {
+	input := []byte{0x82, 1, 'a', 0x82, 1, 'b'}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	// 第二个帧需要等待 10 秒
+	ws.SetInboundLimit(InboundLimit{FramesPerSecond: 1, FrameBurst: 1})
+	ws.(*webSocket).inboundLimit.Load().frames.rate = 0.1
+	if data := readText(t, ws); data != "a" {
+		t.Fatalf("ReadMessage() = %q, want a", data)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = ws.Close()
+	}()
+	start := time.Now()
+	if _, err := ws.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage() succeeded after Close")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close interrupted the delay after %v", elapsed)
+	}
+}
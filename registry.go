@@ -0,0 +1,201 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Registry 用于记录一组 WebSocket 对象，方便给指定的连接发送 Message、踢掉连接，以及在程序退出的时候统一关闭。
+// 连接默认使用 WebSocket.ID 作为 key，也可以使用 TrackKey 指定自己的 key，例如用户 ID。
+// 关闭之后的 WebSocket 对象会自动从 Registry 中移除。
+//
+// 使用例子：
+//
+//	registry := websocket.NewRegistry()
+//	dialer := &websocket.Dialer{Registry: registry}
+//	...
+//	err = registry.Send(id, &websocket.Message{OpCode: websocket.TextFrame, Reader: strings.NewReader("hi")})
+//	err = registry.Kick(id, websocket.ClosePolicyViolation, "banned")
+//	...
+//	registry.CloseAll(websocket.CloseGoingAway, "server shutdown", time.Now().Add(5*time.Second))
+type Registry struct {
+	lock        *sync.Mutex
+	connections map[string]WebSocket
+	// keys 是 WebSocket.ID 对应的 key
+	keys map[string]string
+	// hooked 是已经添加了关闭回调的 WebSocket.ID，每个连接只添加一次，回调执行之后移除
+	hooked map[string]bool
+}
+
+var ErrConnectionNotFound = errors.New("connection is not found in the registry")
+
+// DefaultRegistry 是包级别的 Registry，需要使用的时候把它设置到 Dialer 或者 Server 中
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		lock:        &sync.Mutex{},
+		connections: map[string]WebSocket{},
+		keys:        map[string]string{},
+		hooked:      map[string]bool{},
+	}
+}
+
+// Track 使用 ws.ID() 作为 key 把 ws 加入 Registry
+func (r *Registry) Track(ws WebSocket) {
+	r.TrackKey(ws.ID(), ws)
+}
+
+// TrackKey 使用 key 把 ws 加入 Registry，key 已经对应了另一个连接的时候，之前的连接会被替换（不会被关闭）。
+// 同一个 ws 只有一个 key，再次加入的时候会使用新的 key。
+func (r *Registry) TrackKey(key string, ws WebSocket) {
+	r.lock.Lock()
+	if old, ok := r.connections[key]; ok && old != ws {
+		delete(r.keys, old.ID())
+	}
+	if oldKey, ok := r.keys[ws.ID()]; ok && oldKey != key {
+		delete(r.connections, oldKey)
+	}
+	r.connections[key] = ws
+	r.keys[ws.ID()] = key
+	w, ok := ws.(*webSocket)
+	hook := ok && !r.hooked[w.ID()]
+	if hook {
+		r.hooked[w.ID()] = true
+	}
+	r.lock.Unlock()
+	// 重复加入同一个连接的时候不再添加回调，否则每次更换 key 都会多一个回调
+	if hook {
+		w.addCloseHook(func() {
+			r.Untrack(w)
+			r.lock.Lock()
+			delete(r.hooked, w.ID())
+			r.lock.Unlock()
+		})
+	}
+}
+
+// Untrack 把 ws 从 Registry 中移除
+func (r *Registry) Untrack(ws WebSocket) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key, ok := r.keys[ws.ID()]
+	if !ok {
+		return
+	}
+	delete(r.keys, ws.ID())
+	if r.connections[key] == ws {
+		delete(r.connections, key)
+	}
+}
+
+// Len 返回 Registry 中的 WebSocket 数量
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.connections)
+}
+
+// Get 返回 key 对应的 WebSocket，没有的时候返回 nil 和 false
+func (r *Registry) Get(key string) (WebSocket, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ws, ok := r.connections[key]
+	return ws, ok
+}
+
+// Key 返回 ws 在 Registry 中的 key
+func (r *Registry) Key(ws WebSocket) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key, ok := r.keys[ws.ID()]
+	return key, ok
+}
+
+// Send 给 key 对应的连接发送 message，没有这个连接的时候返回 ErrConnectionNotFound
+func (r *Registry) Send(key string, message *Message) error {
+	ws, ok := r.Get(key)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	return ws.SendMessage(message)
+}
+
+// Range 对 Registry 中的每个连接调用 f，f 返回 false 的时候停止。
+// f 是在 Registry 的快照上调用的，可以在 f 中加入或者移除连接。
+func (r *Registry) Range(f func(key string, ws WebSocket) bool) {
+	r.lock.Lock()
+	keys := make([]string, 0, len(r.connections))
+	connections := make([]WebSocket, 0, len(r.connections))
+	for key, ws := range r.connections {
+		keys = append(keys, key)
+		connections = append(connections, ws)
+	}
+	r.lock.Unlock()
+	for i, ws := range connections {
+		if !f(keys[i], ws) {
+			return
+		}
+	}
+}
+
+// Kick 使用 code 和 reason 关闭 key 对应的连接并把它从 Registry 中移除，没有这个连接的时候返回 ErrConnectionNotFound
+func (r *Registry) Kick(key string, code uint16, reason string) error {
+	ws, ok := r.Get(key)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	r.Untrack(ws)
+	return ws.CloseWithCode(code, reason)
+}
+
+func (r *Registry) snapshot() []WebSocket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	connections := make([]WebSocket, 0, len(r.connections))
+	for _, ws := range r.connections {
+		connections = append(connections, ws)
+	}
+	return connections
+}
+
+var ErrCloseAllDeadlineExceeded = errors.New("deadline exceeded before all WebSocket connections were closed")
+
+// CloseAll 使用 code 和 reason 关闭 Registry 中的所有 WebSocket。
+// 到达 deadline 之后还没有关闭的连接，会直接关闭底层的流，并返回 ErrCloseAllDeadlineExceeded。
+// code 和 CloseWithCode 一样需要是可以发送的状态码，否则不关闭任何连接，返回 ErrInvalidCloseCode。
+func (r *Registry) CloseAll(code uint16, reason string, deadline time.Time) error {
+	if code != CloseNoStatusReceived && !validCloseCode(code) {
+		return ErrInvalidCloseCode
+	}
+	connections := r.snapshot()
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(len(connections))
+	for _, ws := range connections {
+		go func(ws WebSocket) {
+			defer wg.Done()
+			_ = ws.CloseWithCode(code, reason)
+			r.Untrack(ws)
+		}(ws)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+	for _, ws := range connections {
+		if w, ok := ws.(*webSocket); ok {
+			_ = w.closeStreams()
+		}
+	}
+	return ErrCloseAllDeadlineExceeded
+}
@@ -0,0 +1,259 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRegistryTrackKey(t *testing.T) {
+	registry := NewRegistry()
+	first, _ := newPipeWebSocket(t)
+	second, _ := newPipeWebSocket(t)
+
+	registry.Track(first)
+	if key, ok := registry.Key(first); !ok || key != first.ID() {
+		t.Fatalf("Key() = %q, %v, want the connection ID", key, ok)
+	}
+	// 再次加入的时候使用新的 key，旧的 key 被移除
+	registry.TrackKey("alice", first)
+	if _, ok := registry.Get(first.ID()); ok {
+		t.Fatal("the old key is still tracked after TrackKey")
+	}
+	if ws, ok := registry.Get("alice"); !ok || ws != first {
+		t.Fatalf("Get(alice) = %v, %v, want the first connection", ws, ok)
+	}
+
+	// 同一个 key 的新连接替换之前的连接，之前的连接不会被关闭
+	registry.TrackKey("alice", second)
+	if ws, _ := registry.Get("alice"); ws != second {
+		t.Fatalf("Get(alice) = %v, want the second connection", ws)
+	}
+	if _, ok := registry.Key(first); ok {
+		t.Fatal("the replaced connection still has a key")
+	}
+	if first.Status() != OPEN {
+		t.Fatal("the replaced connection was closed")
+	}
+	if registry.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", registry.Len())
+	}
+	// 被替换的连接离开的时候不会移除新的连接
+	registry.Untrack(first)
+	if ws, _ := registry.Get("alice"); ws != second {
+		t.Fatal("Untrack of the replaced connection removed the new one")
+	}
+	if err := registry.Send("bob", &Message{OpCode: TextFrame}); err != ErrConnectionNotFound {
+		t.Fatalf("Send() to an unknown key error = %v, want %v", err, ErrConnectionNotFound)
+	}
+	if err := registry.Kick("bob", ClosePolicyViolation, "banned"); err != ErrConnectionNotFound {
+		t.Fatalf("Kick() an unknown key error = %v, want %v", err, ErrConnectionNotFound)
+	}
+}
+
+func TestRegistryUntracksClosedConnections(t *testing.T) {
+	registry := NewRegistry()
+	first, _ := newPipeWebSocket(t)
+	second, _ := newPipeWebSocket(t)
+	registry.TrackKey("alice", first)
+	registry.Track(second)
+
+	_ = first.(*webSocket).closeStreams()
+	if _, ok := registry.Get("alice"); ok {
+		t.Fatal("the closed connection is still tracked")
+	}
+	if registry.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", registry.Len())
+	}
+	// 关闭之后再加入，会马上被移除
+	registry.TrackKey("alice", first)
+	if registry.Len() != 1 {
+		t.Fatalf("Len() after tracking a closed connection = %d, want 1", registry.Len())
+	}
+
+	keys := map[string]bool{}
+	registry.Range(func(key string, ws WebSocket) bool {
+		keys[key] = true
+		registry.Untrack(ws)
+		return true
+	})
+	if len(keys) != 1 || !keys[second.ID()] || registry.Len() != 0 {
+		t.Fatalf("Range() visited %v and left %d connections, want only the second connection", keys, registry.Len())
+	}
+}
+
+func TestRegistryRekeyAddsOneCloseHook(t *testing.T) {
+	registry := NewRegistry()
+	ws, _ := newPipeWebSocket(t)
+	w := ws.(*webSocket)
+	hooks := func() int {
+		w.closeHooksLock.Lock()
+		defer w.closeHooksLock.Unlock()
+		return len(w.closeHooks)
+	}
+	before := hooks()
+	registry.Track(ws)
+	registry.TrackKey("alice", ws)
+	registry.TrackKey("bob", ws)
+	registry.Untrack(ws)
+	registry.TrackKey("carol", ws)
+	if added := hooks() - before; added != 1 {
+		t.Fatalf("tracking the same connection added %d close hooks, want 1", added)
+	}
+	for _, key := range []string{ws.ID(), "alice", "bob"} {
+		if _, ok := registry.Get(key); ok {
+			t.Fatalf("the old key %q is still tracked", key)
+		}
+	}
+	if key, ok := registry.Key(ws); !ok || key != "carol" {
+		t.Fatalf("Key() = %q, %v, want carol", key, ok)
+	}
+
+	// 关闭的时候按照最后的 key 移除，之后再加入会重新添加回调并马上被移除
+	_ = w.closeStreams()
+	if registry.Len() != 0 {
+		t.Fatalf("Len() = %d after close, want 0", registry.Len())
+	}
+	registry.TrackKey("dave", ws)
+	if registry.Len() != 0 {
+		t.Fatalf("Len() = %d after tracking a closed connection, want 0", registry.Len())
+	}
+}
+
+func TestUpgraderRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		dial func(t *testing.T, upgrader *Upgrader) WebSocket
+	}{
+		{name: "Upgrade", dial: func(t *testing.T, upgrader *Upgrader) WebSocket {
+			_, url := handlerServer(t, upgrader.Handler(func(ws WebSocket) {
+				_, _ = ws.ReadMessage()
+			}))
+			ws, err := DefaultDialer.Dial(context.Background(), url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ws
+		}},
+		{name: "Pair", dial: func(t *testing.T, upgrader *Upgrader) WebSocket {
+			original := DefaultUpgrader
+			DefaultUpgrader = upgrader
+			t.Cleanup(func() {
+				DefaultUpgrader = original
+			})
+			_, url := handlerServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := Pair(w, r)
+				if err != nil {
+					return
+				}
+				_, _ = ws.ReadMessage()
+			}))
+			ws, err := DefaultDialer.Dial(context.Background(), url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ws
+		}},
+		{name: "UpgradeStream", dial: func(t *testing.T, upgrader *Upgrader) WebSocket {
+			a, b := net.Pipe()
+			t.Cleanup(func() {
+				_ = a.Close()
+				_ = b.Close()
+			})
+			go func() {
+				ws, err := upgrader.UpgradeStream(a, a)
+				if err != nil {
+					return
+				}
+				_, _ = ws.ReadMessage()
+			}()
+			dialer := &Dialer{NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return b, nil
+			}}
+			ws, err := dialer.Dial(context.Background(), "ws://example.com/ws")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ws
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := NewRegistry()
+			ws := test.dial(t, &Upgrader{Registry: registry})
+			waitFor(t, "the server connection to be tracked", func() bool {
+				return registry.Len() == 1
+			})
+			// 客户端关闭之后服务端的连接也会关闭，并从 Registry 中移除
+			_ = ws.Close()
+			waitFor(t, "the server connection to be untracked", func() bool {
+				return registry.Len() == 0
+			})
+		})
+	}
+}
+
+func TestRegistryCloseAll(t *testing.T) {
+	registry := NewRegistry()
+	ws, peer := newPipeWebSocket(t)
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+	registry.Track(ws)
+	if err := registry.CloseAll(CloseGoingAway, "server shutdown", time.Now().Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if ws.Status() != CLOSED || registry.Len() != 0 {
+		t.Fatalf("Status() = %d and Len() = %d, want a closed and untracked connection", ws.Status(), registry.Len())
+	}
+	if info := ws.CloseReason(); info == nil || info.Initiator != CloseByLocal || info.Code != CloseGoingAway || info.Reason != "server shutdown" {
+		t.Fatalf("CloseReason() = %+v, want a local going away", info)
+	}
+}
+
+func TestRegistryCloseAllDeadline(t *testing.T) {
+	registry := NewRegistry()
+	// 对方不读取，ConnectionClose 一直写不出去
+	stalled, _ := newPipeWebSocket(t)
+	healthy, peer := newPipeWebSocket(t)
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+	registry.Track(stalled)
+	registry.Track(healthy)
+
+	start := time.Now()
+	err := registry.CloseAll(CloseGoingAway, "server shutdown", time.Now().Add(100*time.Millisecond))
+	if err != ErrCloseAllDeadlineExceeded {
+		t.Fatalf("CloseAll() error = %v, want %v", err, ErrCloseAllDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("CloseAll() returned after %v, want shortly after the deadline", elapsed)
+	}
+	for _, ws := range []WebSocket{stalled, healthy} {
+		if ws.Status() != CLOSED {
+			t.Fatalf("Status() = %d, want %d", ws.Status(), CLOSED)
+		}
+	}
+	waitFor(t, "the stalled connection to be untracked", func() bool {
+		return registry.Len() == 0
+	})
+}
+
+func TestRegistryCloseAllInvalidCode(t *testing.T) {
+	registry := NewRegistry()
+	ws, _ := newPipeWebSocket(t)
+	registry.Track(ws)
+	// 1006 和 1015 只能在本地使用，0 和 1004 不是有效的状态码
+	for _, code := range []uint16{0, 1004, CloseAbnormalClosure, CloseTLSHandshake, 5000} {
+		if err := registry.CloseAll(code, "server shutdown", time.Now().Add(time.Second)); err != ErrInvalidCloseCode {
+			t.Fatalf("CloseAll(%d) error = %v, want %v", code, err, ErrInvalidCloseCode)
+		}
+	}
+	if ws.Status() != OPEN || registry.Len() != 1 || ws.CloseReason() != nil {
+		t.Fatalf("Status() = %d, Len() = %d, CloseReason() = %+v, want an untouched connection", ws.Status(), registry.Len(), ws.CloseReason())
+	}
+}
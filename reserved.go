@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+)
+
+// ReservedOpCodeHandler 处理收到的一个保留 OpCode 的 Message，返回错误会使用 CloseProtocolError 关闭连接。
+// 处理函数返回之后，Message 中没有读取的内容会被丢弃。
+type ReservedOpCodeHandler func(message *Message) error
+
+var ErrNotReservedOpCode = errors.New("opcode is not reserved")
+
+// reservedOpCode 是通过 AllowReservedOpCode 允许的一个保留 OpCode
+type reservedOpCode struct {
+	handler ReservedOpCodeHandler
+}
+
+// AllowReservedOpCode 允许收发一个 RFC 6455 保留的 OpCode，用于通信双方事先约定的私有信令。
+// 默认情况下收到保留的 OpCode 会使用 CloseProtocolError 关闭连接，发送保留的 OpCode 会返回 ErrReservedOpCode。
+//
+// handler 不为空时，收到的 Message 会交给 handler 处理，不会从 ReadMessage 返回；
+// handler 为空时，收到的 Message 会和数据 Message 一样从 ReadMessage 返回。
+// 保留的控制帧 OpCode 仍然需要满足控制帧的要求：不能分片，内容不能超过 125 字节。
+func (w *webSocket) AllowReservedOpCode(opCode OpCode, handler ReservedOpCodeHandler) error {
+	if !opCode.IsReserved() || opCode > 0xf {
+		return ErrNotReservedOpCode
+	}
+	w.reservedLock.Lock()
+	defer w.reservedLock.Unlock()
+	if w.reserved == nil {
+		w.reserved = map[OpCode]reservedOpCode{}
+	}
+	w.reserved[opCode] = reservedOpCode{handler: handler}
+	return nil
+}
+
+// reservedAllowed 判断一个保留的 OpCode 是否允许使用，返回它的处理函数
+func (w *webSocket) reservedAllowed(opCode OpCode) (ReservedOpCodeHandler, bool) {
+	w.reservedLock.Lock()
+	defer w.reservedLock.Unlock()
+	r, ok := w.reserved[opCode]
+	return r.handler, ok
+}
+
+// handleReserved 把保留 OpCode 的 Message 交给处理函数，然后丢弃没有读取的内容
+func (w *webSocket) handleReserved(handler ReservedOpCodeHandler, message *Message) error {
+	err := handler(message)
+	if err != nil {
+		_ = w.fail(CloseProtocolError, err.Error())
+		return err
+	}
+	_, err = io.Copy(blackHole, message)
+	return err
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// closeCode 返回 frames 中唯一的关闭帧的状态码
+func closeCode(t *testing.T, frames []sentFrame) uint16 {
+	t.Helper()
+	if len(frames) != 1 || frames[0].OpCode != ConnectionClose || len(frames[0].Payload) < 2 {
+		t.Fatalf("sent frames = %v, want a single close frame", frames)
+	}
+	return uint16(frames[0].Payload[0])<<8 | uint16(frames[0].Payload[1])
+}
+
+func TestAllowReservedOpCodeRejectsDefinedOpCodes(t *testing.T) {
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	for _, opCode := range []OpCode{ContinuationFrame, TextFrame, BinaryFrame, ConnectionClose, Ping, Pong, 0x10} {
+		if err := ws.AllowReservedOpCode(opCode, nil); err != ErrNotReservedOpCode {
+			t.Fatalf("AllowReservedOpCode(%d) error = %v, want %v", opCode, err, ErrNotReservedOpCode)
+		}
+	}
+}
+
+func TestReservedOpCodeNotAllowed(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader([]byte{0x83, 2, 'h', 'i'})), false)
+	if err := ws.SendMessage(&Message{Reader: bytes.NewReader(nil), OpCode: ReservedNonControlFrame1}); err != ErrReservedOpCode {
+		t.Fatalf("SendMessage() error = %v, want %v", err, ErrReservedOpCode)
+	}
+	if message, err := ws.ReadMessage(); err != ErrReservedOpCode {
+		t.Fatalf("ReadMessage() = %v, %v, want %v", message, err, ErrReservedOpCode)
+	}
+	if code := closeCode(t, decodeFrames(t, output.Bytes())); code != CloseProtocolError {
+		t.Fatalf("close code = %d, want %d", code, CloseProtocolError)
+	}
+}
+
+func TestReservedOpCodeWithoutHandler(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader([]byte{0x83, 2, 'h', 'i'})), false)
+	if err := ws.AllowReservedOpCode(ReservedNonControlFrame1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 没有处理函数的时候，Message 从 ReadMessage 返回
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(message)
+	if message.OpCode != ReservedNonControlFrame1 || string(data) != "hi" {
+		t.Fatalf("ReadMessage() = %d %q, want %d hi", message.OpCode, data, ReservedNonControlFrame1)
+	}
+	if err = ws.SendMessage(&Message{Reader: bytes.NewReader([]byte("ok")), OpCode: ReservedNonControlFrame1}); err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 1 || frames[0].OpCode != ReservedNonControlFrame1 || string(frames[0].Payload) != "ok" {
+		t.Fatalf("sent frames = %v, want a reserved frame with ok", frames)
+	}
+}
+
+func TestReservedOpCodeHandler(t *testing.T) {
+	input := []byte{0x8b, 3, 's', 'i', 'g', 0x81, 2, 'o', 'k'}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	var received []string
+	err := ws.AllowReservedOpCode(ReservedControlFrame1, func(message *Message) error {
+		data, err := io.ReadAll(message)
+		received = append(received, string(data))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 交给处理函数的 Message 不会从 ReadMessage 返回
+	if data := readText(t, ws); data != "ok" {
+		t.Fatalf("ReadMessage() = %q, want ok", data)
+	}
+	if len(received) != 1 || received[0] != "sig" {
+		t.Fatalf("handler received %q, want [sig]", received)
+	}
+}
+
+func TestReservedOpCodeHandlerError(t *testing.T) {
+	output := &bytes.Buffer{}
+	input := []byte{0x8b, 3, 's', 'i', 'g', 0x81, 2, 'o', 'k'}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+	errSignal := errors.New("bad signal")
+	err := ws.AllowReservedOpCode(ReservedControlFrame1, func(message *Message) error {
+		return errSignal
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, err := ws.ReadMessage(); err == nil {
+		t.Fatalf("ReadMessage() = %v, want an error", message)
+	}
+	if code := closeCode(t, decodeFrames(t, output.Bytes())); code != CloseProtocolError {
+		t.Fatalf("close code = %d, want %d", code, CloseProtocolError)
+	}
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrTooManyRedirects    = errors.New("stopped after too many redirects")
+	ErrUnsupportedRedirect = errors.New("redirect location has an unsupported scheme")
+)
+
+// RetryPolicy 是建立连接失败时的重试策略。只有建立 TCP、TLS 或者代理连接失败的时候才会重试，
+// 服务器拒绝握手不会重试。重试等待的时间也算在握手的超时时间里。
+type RetryPolicy struct {
+	// Attempts 是最多尝试建立连接的次数，包括第一次，小于 2 时不重试
+	Attempts int
+
+	// Backoff 是第一次重试之前的等待时间，之后每次重试翻倍，为 0 时使用 100 毫秒
+	Backoff time.Duration
+
+	// MaxBackoff 是每次等待时间的上限，为 0 时不限制
+	MaxBackoff time.Duration
+
+	// Retryable 判断建立连接的错误是否需要重试，为空时除了 ctx 结束以外的错误都会重试
+	Retryable func(err error) bool
+}
+
+// retryable 判断 err 是否需要按照策略重试
+func (p *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return true
+}
+
+// dialRetry 使用 dial 连接 network 中的 address，失败的时候按照 d.Retry 重试
+func (d *Dialer) dialRetry(ctx context.Context, dial dialFunc, network, address string) (net.Conn, error) {
+	policy := d.Retry
+	conn, err := dial(ctx, network, address)
+	if err == nil || policy == nil {
+		return conn, err
+	}
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 1; attempt < policy.Attempts && policy.retryable(ctx, err); attempt++ {
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		conn, err = dial(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		backoff *= 2
+	}
+	return nil, err
+}
+
+// redirectError 表示服务器用重定向响应了握手，location 是重定向的目标
+type redirectError struct {
+	response *http.Response
+	location *url.URL
+}
+
+func (e *redirectError) Error() string {
+	return e.response.Status
+}
+
+// isRedirect 判断状态码是否 Dialer 可以跟随的重定向
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectRequest 创建重定向之后的握手请求。http 和 https 会被转换成 ws 和 wss，
+// header 是调用者最初传入的请求头，目标的主机变化或者从 wss 降级到 ws 的时候不会带上 Authorization 和 Cookie。
+func redirectRequest(request *http.Request, location *url.URL, header http.Header) (*http.Request, error) {
+	target := *location
+	switch target.Scheme {
+	case "http":
+		target.Scheme = "ws"
+	case "https":
+		target.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil, ErrUnsupportedRedirect
+	}
+	next := request.Clone(request.Context())
+	next.URL = &target
+	next.Host = target.Host
+	next.RemoteAddr = ""
+	next.Header = header.Clone()
+	if target.Hostname() != request.URL.Hostname() || (isSecureScheme(request.URL.Scheme) && target.Scheme == "ws") {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next, nil
+}
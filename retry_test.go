@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRedirectRequest(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=1"},
+		"X-Client":      {"test"},
+	}
+	tests := []struct {
+		name        string
+		from        string
+		location    string
+		want        string
+		credentials bool
+		err         error
+	}{
+		{name: "http becomes ws", from: "ws://example.com/a", location: "http://example.com/b", want: "ws://example.com/b", credentials: true},
+		{name: "https becomes wss", from: "ws://example.com/a", location: "https://example.com/b", want: "wss://example.com/b", credentials: true},
+		{name: "upgrade to wss", from: "ws://example.com/a", location: "wss://example.com:8443/b", want: "wss://example.com:8443/b", credentials: true},
+		{name: "same host on another port", from: "wss://example.com/a", location: "wss://example.com:8443/b", want: "wss://example.com:8443/b", credentials: true},
+		{name: "another host", from: "wss://example.com/a", location: "wss://other.example.com/b", want: "wss://other.example.com/b"},
+		{name: "downgrade to ws", from: "wss://example.com/a", location: "ws://example.com/b", want: "ws://example.com/b"},
+		{name: "downgrade to http", from: "wss://example.com/a", location: "http://example.com/b", want: "ws://example.com/b"},
+		{name: "unsupported scheme", from: "ws://example.com/a", location: "ftp://example.com/b", err: ErrUnsupportedRedirect},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, test.from, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			location, err := url.Parse(test.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, err := redirectRequest(request, location, header)
+			if err != test.err {
+				t.Fatalf("redirectRequest() error = %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if next.URL.String() != test.want || next.Host != next.URL.Host {
+				t.Fatalf("redirected to %s with Host %q, want %s", next.URL, next.Host, test.want)
+			}
+			for _, key := range []string{"Authorization", "Cookie"} {
+				if got := len(next.Header.Get(key)) > 0; got != test.credentials {
+					t.Fatalf("%s forwarded = %v, want %v", key, got, test.credentials)
+				}
+			}
+			if next.Header.Get("X-Client") != "test" {
+				t.Fatal("other headers were not forwarded")
+			}
+		})
+	}
+}
+
+// redirectServer 返回一个在 /ws 上接受 WebSocket 握手的服务器，其他路径重定向到 redirects 中对应的地址
+func redirectServer(t *testing.T, redirects map[string]string, headers chan<- http.Header) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if location, ok := redirects[r.URL.Path]; ok {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		if headers != nil {
+			headers <- r.Header.Clone()
+		}
+		ws, err := (&Upgrader{}).Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		_ = ws.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDialFollowsRedirects(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	target := redirectServer(t, nil, headers)
+	// 网页的 URL 重定向到另一个主机，http 会被转换成 ws
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/ws"
+	server := redirectServer(t, map[string]string{
+		"/first":  "/second",
+		"/second": targetURL,
+	}, nil)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/first"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	header := http.Header{"Authorization": {"Bearer token"}, "Cookie": {"session=1"}, "X-Client": {"test"}}
+	ws, err := (&Dialer{MaxRedirects: 2, Header: header}).Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	got := <-headers
+	if len(got.Get("Authorization")) > 0 || len(got.Get("Cookie")) > 0 {
+		t.Fatalf("credentials were forwarded to another host: %v", got)
+	}
+	if got.Get("X-Client") != "test" {
+		t.Fatalf("X-Client = %q, want the original header", got.Get("X-Client"))
+	}
+
+	_, err = (&Dialer{MaxRedirects: 1}).Dial(ctx, url)
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Dial() with too many redirects error = %v, want %v", err, ErrTooManyRedirects)
+	}
+	var responseErr *ResponseError
+	if !errors.As(err, &responseErr) || responseErr.Response.StatusCode != http.StatusFound {
+		t.Fatalf("Dial() error = %v, want the redirect response", err)
+	}
+	// 没有设置 MaxRedirects 的时候不跟随重定向
+	if _, err = (&Dialer{}).Dial(ctx, url); errors.Is(err, ErrTooManyRedirects) || !errors.As(err, &responseErr) || responseErr.Response.StatusCode != http.StatusFound {
+		t.Fatalf("Dial() without MaxRedirects error = %v, want the redirect response", err)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	server := redirectServer(t, nil, nil)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	// flaky 在前 failures 次连接的时候返回 refused，attempts 记录连接的次数
+	flaky := func(failures int32, attempts *atomic.Int32) func(ctx context.Context, network, address string) (net.Conn, error) {
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			if attempts.Add(1) <= failures {
+				return nil, refused
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	attempts := &atomic.Int32{}
+	dialer := &Dialer{
+		NetDialContext: flaky(2, attempts),
+		Retry:          &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+	}
+	ws, err := dialer.Dial(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	if attempts.Load() != 3 {
+		t.Fatalf("dialed %d times, want 3", attempts.Load())
+	}
+
+	attempts.Store(0)
+	dialer.NetDialContext = flaky(3, attempts)
+	if _, err = dialer.Dial(ctx, url); !errors.Is(err, syscall.ECONNREFUSED) || attempts.Load() != 3 {
+		t.Fatalf("Dial() = %v after %d attempts, want the dial error after 3 attempts", err, attempts.Load())
+	}
+
+	attempts.Store(0)
+	dialer.Retry.Retryable = func(err error) bool {
+		return false
+	}
+	if _, err = dialer.Dial(ctx, url); err == nil || attempts.Load() != 1 {
+		t.Fatalf("Dial() = %v after %d attempts, want no retry", err, attempts.Load())
+	}
+}
@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidRoom = errors.New("invalid room name")
+
+// Join 让 ws 加入 room，ws 还不在 Hub 中的时候会先调用 Register，ws 关闭之后会自动离开所有的房间。
+//
+// 房间的名字是用 . 分隔的多个部分，例如 chat.general。加入房间的时候可以使用通配符：
+// * 匹配一个部分，例如 chat.* 匹配 chat.general，但是不匹配 chat.general.pinned；
+// > 只能是最后一个部分，匹配剩下的一个或者多个部分，例如 chat.> 匹配 chat.general 和 chat.general.pinned。
+// Publish 的房间是具体的名字，不能包含通配符。
+func (h *Hub) Join(ws WebSocket, room string) error {
+	if !validRoom(room, true) {
+		return ErrInvalidRoom
+	}
+	err := h.Register(ws)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	m, ok := h.members[ws.ID()]
+	if !ok {
+		// 连接在 Register 之后马上被关闭了
+		return ErrNotRegistered
+	}
+	m.rooms[room] = struct{}{}
+	members, ok := h.rooms[room]
+	if !ok {
+		members = map[string]*hubMember{}
+		h.rooms[room] = members
+		if isPattern(room) {
+			h.patterns[room] = struct{}{}
+		}
+	}
+	members[ws.ID()] = m
+	return nil
+}
+
+// Leave 让 ws 离开 room，ws 仍然在 Hub 中，可以收到 Broadcast
+func (h *Hub) Leave(ws WebSocket, room string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	m, ok := h.members[ws.ID()]
+	if !ok {
+		return ErrNotRegistered
+	}
+	h.removeFromRoom(m, room)
+	return nil
+}
+
+// Publish 把内容是 data 的 Message 放入 room 以及匹配 room 的通配符房间中所有连接的发送队列，
+// 同时匹配多个房间的连接只会收到一次，不等待发送完成，data 在之后不能被修改
+func (h *Hub) Publish(room string, opCode OpCode, data []byte) (BroadcastResult, error) {
+	pm, err := NewPreparedMessage(opCode, data)
+	if err != nil {
+		return BroadcastResult{}, err
+	}
+	return h.PublishPrepared(room, pm)
+}
+
+// PublishPrepared 和 Publish 一样，发送的是 pm
+func (h *Hub) PublishPrepared(room string, pm *PreparedMessage) (BroadcastResult, error) {
+	if !validRoom(room, false) {
+		return BroadcastResult{}, ErrInvalidRoom
+	}
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return BroadcastResult{}, ErrHubClosed
+	}
+	seen := map[string]struct{}{}
+	var members []*hubMember
+	add := func(room string) {
+		for id, m := range h.rooms[room] {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				members = append(members, m)
+			}
+		}
+	}
+	add(room)
+	for pattern := range h.patterns {
+		if matchRoom(pattern, room) {
+			add(pattern)
+		}
+	}
+	h.lock.Unlock()
+	return h.deliver(members, pm), nil
+}
+
+// Rooms 返回 ws 加入的房间，按照名字排序
+func (h *Hub) Rooms(ws WebSocket) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	m, ok := h.members[ws.ID()]
+	if !ok {
+		return nil
+	}
+	rooms := make([]string, 0, len(m.rooms))
+	for room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Members 返回加入了 room 的连接，room 按照名字比较，不会匹配通配符。
+// 需要知道哪些连接会收到发往 room 的 Message 的时候使用 Subscribers。
+func (h *Hub) Members(room string) []WebSocket {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	members := make([]WebSocket, 0, len(h.rooms[room]))
+	for _, m := range h.rooms[room] {
+		members = append(members, m.ws)
+	}
+	return members
+}
+
+// Subscribers 返回会收到 Publish(room, ...) 的连接，包括加入了匹配 room 的通配符房间的连接
+func (h *Hub) Subscribers(room string) []WebSocket {
+	if !validRoom(room, false) {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	seen := map[string]struct{}{}
+	var subscribers []WebSocket
+	for name, members := range h.rooms {
+		if name != room && !(isPattern(name) && matchRoom(name, room)) {
+			continue
+		}
+		for id, m := range members {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				subscribers = append(subscribers, m.ws)
+			}
+		}
+	}
+	return subscribers
+}
+
+// removeFromRoom 把 m 从 room 中移除，需要持有 h.lock
+func (h *Hub) removeFromRoom(m *hubMember, room string) {
+	delete(m.rooms, room)
+	members, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, m.ws.ID())
+	if len(members) < 1 {
+		delete(h.rooms, room)
+		delete(h.patterns, room)
+	}
+}
+
+func isPattern(room string) bool {
+	return strings.ContainsAny(room, "*>")
+}
+
+// validRoom 检查 room 的每个部分都不为空，wildcard 为 false 时不能包含通配符，> 只能是最后一个部分
+func validRoom(room string, wildcard bool) bool {
+	if len(room) < 1 {
+		return false
+	}
+	parts := strings.Split(room, ".")
+	for i, part := range parts {
+		switch {
+		case len(part) < 1:
+			return false
+		case part == "*":
+			if !wildcard {
+				return false
+			}
+		case part == ">":
+			if !wildcard || i != len(parts)-1 {
+				return false
+			}
+		case strings.ContainsAny(part, "*>"):
+			return false
+		}
+	}
+	return true
+}
+
+// matchRoom 返回通配符房间 pattern 是否匹配 room
+func matchRoom(pattern, room string) bool {
+	for {
+		patternPart, patternRest, patternMore := strings.Cut(pattern, ".")
+		roomPart, roomRest, roomMore := strings.Cut(room, ".")
+		switch patternPart {
+		case ">":
+			return true
+		case "*", roomPart:
+		default:
+			return false
+		}
+		if !patternMore || !roomMore {
+			return patternMore == roomMore
+		}
+		pattern, room = patternRest, roomRest
+	}
+}
@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestValidRoom(t *testing.T) {
+	tests := []struct {
+		room     string
+		wildcard bool
+		want     bool
+	}{
+		{room: "chat", want: true},
+		{room: "chat.general", want: true},
+		{room: "", want: false},
+		{room: "chat.", want: false},
+		{room: ".chat", want: false},
+		{room: "chat..general", want: false},
+		{room: "chat.*", want: false},
+		{room: "chat.>", want: false},
+		{room: "chat.*", wildcard: true, want: true},
+		{room: "*.general", wildcard: true, want: true},
+		{room: "chat.>", wildcard: true, want: true},
+		{room: ">", wildcard: true, want: true},
+		{room: "*", wildcard: true, want: true},
+		// > 只能是最后一个部分
+		{room: "chat.>.pinned", wildcard: true, want: false},
+		{room: ">.chat", wildcard: true, want: false},
+		// 通配符必须是完整的一个部分
+		{room: "chat.gen*", wildcard: true, want: false},
+		{room: "chat.a>", wildcard: true, want: false},
+		{room: "chat.**", wildcard: true, want: false},
+	}
+	for _, test := range tests {
+		if got := validRoom(test.room, test.wildcard); got != test.want {
+			t.Errorf("validRoom(%q, %v) = %v, want %v", test.room, test.wildcard, got, test.want)
+		}
+	}
+}
+
+func TestMatchRoom(t *testing.T) {
+	tests := []struct {
+		pattern string
+		room    string
+		want    bool
+	}{
+		{pattern: "chat.*", room: "chat.general", want: true},
+		{pattern: "chat.*", room: "chat.general.pinned", want: false},
+		{pattern: "chat.*", room: "chat", want: false},
+		{pattern: "chat.*", room: "news.general", want: false},
+		{pattern: "*.general", room: "chat.general", want: true},
+		{pattern: "*.general", room: "chat.random", want: false},
+		{pattern: "*.*", room: "chat.general", want: true},
+		{pattern: "*", room: "chat", want: true},
+		{pattern: "*", room: "chat.general", want: false},
+		{pattern: "chat.>", room: "chat.general", want: true},
+		{pattern: "chat.>", room: "chat.general.pinned", want: true},
+		// > 匹配一个或者多个部分，不匹配零个
+		{pattern: "chat.>", room: "chat", want: false},
+		{pattern: ">", room: "chat", want: true},
+		{pattern: ">", room: "chat.general.pinned", want: true},
+		{pattern: "chat.*.>", room: "chat.general.pinned", want: true},
+		{pattern: "chat.*.>", room: "chat.general", want: false},
+		{pattern: "chat.general", room: "chat.general", want: true},
+		{pattern: "chat.general", room: "chat.generally", want: false},
+	}
+	for _, test := range tests {
+		if got := matchRoom(test.pattern, test.room); got != test.want {
+			t.Errorf("matchRoom(%q, %q) = %v, want %v", test.pattern, test.room, got, test.want)
+		}
+	}
+}
+
+func TestPublishDeduplicatesOverlappingRooms(t *testing.T) {
+	hub := NewHub(HubConfig{})
+	defer hub.Close()
+
+	// received 记录每个连接收到的 Message
+	type member struct {
+		ws       WebSocket
+		received chan string
+	}
+	newMember := func(rooms ...string) member {
+		ws, conn := newPipeWebSocket(t)
+		peer := NewWebSocketWithRole(conn, conn, RoleClient)
+		m := member{ws: ws, received: make(chan string, 16)}
+		go func() {
+			for {
+				_, data, err := peer.ReadAllMessage()
+				if err != nil {
+					return
+				}
+				m.received <- string(data)
+			}
+		}()
+		for _, room := range rooms {
+			if err := hub.Join(ws, room); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m
+	}
+	overlapping := newMember("chat.general", "chat.*", "chat.>", ">")
+	exact := newMember("chat.general")
+	deep := newMember("chat.>")
+	other := newMember("news.*")
+
+	if err := hub.Join(overlapping.ws, "chat.>.x"); err != ErrInvalidRoom {
+		t.Fatalf("Join() with > in the middle error = %v, want %v", err, ErrInvalidRoom)
+	}
+	if _, err := hub.Publish("chat.*", TextFrame, nil); err != ErrInvalidRoom {
+		t.Fatalf("Publish() to a pattern error = %v, want %v", err, ErrInvalidRoom)
+	}
+
+	result, err := hub.Publish("chat.general", TextFrame, []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同时匹配四个房间的连接只收到一次
+	if result.Queued != 3 {
+		t.Fatalf("Publish() = %+v, want 3 queued", result)
+	}
+	if result, err = hub.Publish("chat.general.pinned", TextFrame, []byte("two")); err != nil || result.Queued != 2 {
+		t.Fatalf("Publish() = %+v, %v, want 2 queued", result, err)
+	}
+
+	expect := func(m member, want ...string) {
+		t.Helper()
+		for _, message := range want {
+			select {
+			case got := <-m.received:
+				if got != message {
+					t.Fatalf("received %q, want %q", got, message)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("did not receive %q", message)
+			}
+		}
+		select {
+		case got := <-m.received:
+			t.Fatalf("received an extra message %q", got)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	expect(overlapping, "one", "two")
+	expect(exact, "one")
+	expect(deep, "one", "two")
+	expect(other)
+
+	ids := func(members []WebSocket) []string {
+		var ids []string
+		for _, ws := range members {
+			ids = append(ids, ws.ID())
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	want := ids([]WebSocket{overlapping.ws, exact.ws, deep.ws})
+	if got := ids(hub.Subscribers("chat.general")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Subscribers() = %v, want %v", got, want)
+	}
+	if got := ids(hub.Members("chat.general")); !reflect.DeepEqual(got, ids([]WebSocket{overlapping.ws, exact.ws})) {
+		t.Fatalf("Members() = %v, want only the exact room", got)
+	}
+	if got := hub.Rooms(overlapping.ws); !reflect.DeepEqual(got, []string{">", "chat.*", "chat.>", "chat.general"}) {
+		t.Fatalf("Rooms() = %v", got)
+	}
+
+	// 离开之后不再匹配通配符房间，没有连接的通配符房间被删除
+	hasPattern := func(room string) bool {
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		_, ok := hub.patterns[room]
+		return ok
+	}
+	if err = hub.Leave(deep.ws, "chat.>"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPattern("chat.>") {
+		t.Fatal("chat.> was removed while another connection is still in it")
+	}
+	if result, err = hub.Publish("chat.general.pinned", TextFrame, []byte("three")); err != nil || result.Queued != 1 {
+		t.Fatalf("Publish() after Leave = %+v, %v, want 1 queued", result, err)
+	}
+	expect(overlapping, "three")
+	expect(deep)
+	if err = hub.Leave(overlapping.ws, "chat.>"); err != nil {
+		t.Fatal(err)
+	}
+	if hasPattern("chat.>") {
+		t.Fatal("chat.> was kept after every connection left it")
+	}
+}
@@ -0,0 +1,250 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxPendingUpgrades      = 128
+	DefaultMaxConcurrentHandshakes = 32
+)
+
+const (
+	// minAcceptBackoff 和 maxAcceptBackoff 是 Accept 返回临时错误之后重试的等待时间范围，和 net/http 一样
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+
+	// shedWorkers 是发送 503 响应的 goroutine 数量，等待发送的连接最多有 MaxPendingUpgrades 个，超过之后直接关闭
+	shedWorkers = 4
+	// shedWriteTimeout 是发送 503 响应的最长时间，对方不读取的时候不会占用 shedWorkers
+	shedWriteTimeout = time.Second
+)
+
+// Server 是一个基于 net.Listener 和 ServerPair 的独立 WebSocket 服务端。
+// 接收到的连接会先进入一个有界的等待队列，再由固定数量的握手 goroutine 完成握手，
+// 队列满了或者等待超时的连接会收到 503 响应并被关闭，这样在握手洪泛的时候服务可以平滑地降级。
+// 503 响应由固定数量的 goroutine 发送，来不及发送的连接会被直接关闭，所以拒绝连接也不会创建无限多的 goroutine。
+//
+// 使用例子：
+//
+//	server := &websocket.Server{
+//		Handler: func(ws websocket.WebSocket) {
+//			_ = ws.Send("Hi")
+//		},
+//	}
+//	listener, _ := net.Listen("tcp", "0.0.0.0:8080")
+//	server.Serve(listener)
+type Server struct {
+	// Handler 在握手成功之后，会在一个独立的 goroutine 中被调用，返回之后 WebSocket 会被关闭
+	Handler func(ws WebSocket)
+
+	// MaxPendingUpgrades 是等待握手的连接队列的长度，为 0 时使用 DefaultMaxPendingUpgrades
+	MaxPendingUpgrades int
+
+	// MaxConcurrentHandshakes 是同时进行握手的最大数量，为 0 时使用 DefaultMaxConcurrentHandshakes
+	MaxConcurrentHandshakes int
+
+	// PendingTimeout 是连接在队列中等待握手的最长时间，超过之后连接会被拒绝，为 0 时不限制
+	PendingTimeout time.Duration
+
+	// HandshakeTimeout 是单个连接完成握手（包括 TLS 握手）的最长时间，为 0 时不限制。
+	// 它代替 Upgrader 的 HandshakeTimeout 和 Timeouts 中的 Handshake，Upgrader 的其他超时配置仍然有效。
+	HandshakeTimeout time.Duration
+
+	// Upgrader 用于完成握手，为空时使用 DefaultUpgrader
+	Upgrader *Upgrader
+
+	// TLSConfig 不为空时，会先在连接上完成 TLS 握手，用于提供 wss 服务
+	TLSConfig *tls.Config
+
+	// Registry 不为空时，握手成功的 WebSocket 对象会被加入到 Registry 中
+	Registry *Registry
+
+	// RetryAfter 是负载过高时，503 响应中 Retry-After 头的秒数，为 0 时不发送这个头
+	RetryAfter int
+
+	// Limiter 不为空时，接收到的连接在进入等待队列之前会按照它限制连接数量和接收新连接的速度，
+	// 超过限制的连接会收到 503 响应，Retry-After 头使用 ConnectionLimits.RetryAfter。
+	// 连接数量包括等待握手的连接，IP 来自连接的对端地址。
+	Limiter *ConnectionLimiter
+}
+
+type shedConn struct {
+	conn       net.Conn
+	retryAfter int
+}
+
+type pendingConn struct {
+	conn     net.Conn
+	acceptAt time.Time
+	// release 在连接握手失败或者关闭之后调用，用于释放 Limiter 中的名额
+	release func()
+}
+
+// ListenAndServe 监听 TCP 地址，然后使用 handler 处理每一个 WebSocket 连接
+func ListenAndServe(address string, handler func(ws WebSocket)) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	server := &Server{Handler: handler}
+	return server.Serve(listener)
+}
+
+// Serve 从 listener 接收连接并处理，直到 listener 被关闭或者 listener.Accept 返回不是临时的错误。
+// 文件描述符用完（EMFILE、ENFILE）这类临时错误会在等待之后重试，等待时间从 5 毫秒开始翻倍，最多 1 秒，
+// 这样握手洪泛的时候服务不会因为一次 Accept 失败就停止，哪些错误是临时的见 isTemporaryAcceptError。
+func (s *Server) Serve(listener net.Listener) error {
+	maxPending := s.MaxPendingUpgrades
+	if maxPending < 1 {
+		maxPending = DefaultMaxPendingUpgrades
+	}
+	maxHandshakes := s.MaxConcurrentHandshakes
+	if maxHandshakes < 1 {
+		maxHandshakes = DefaultMaxConcurrentHandshakes
+	}
+
+	shedding := make(chan shedConn, maxPending)
+	for i := 0; i < shedWorkers; i++ {
+		go s.shedWorker(shedding)
+	}
+	pending := make(chan pendingConn, maxPending)
+	workers := &sync.WaitGroup{}
+	workers.Add(maxHandshakes)
+	for i := 0; i < maxHandshakes; i++ {
+		go func() {
+			defer workers.Done()
+			s.handshakeWorker(pending, shedding)
+		}()
+	}
+	defer func() {
+		close(pending)
+		// 握手 goroutine 还可能拒绝队列中等待超时的连接，全部退出之后才能关闭 shedding
+		go func() {
+			workers.Wait()
+			close(shedding)
+		}()
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isTemporaryAcceptError(err) {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		release := func() {}
+		if s.Limiter != nil {
+			if release, err = s.Limiter.Acquire(conn.RemoteAddr().String()); err != nil {
+				shed(shedding, conn, s.Limiter.limits.RetryAfter)
+				continue
+			}
+		}
+		select {
+		case pending <- pendingConn{conn: conn, acceptAt: time.Now(), release: release}:
+		default:
+			release()
+			shed(shedding, conn, s.RetryAfter)
+		}
+	}
+}
+
+func (s *Server) handshakeWorker(pending <-chan pendingConn, shedding chan<- shedConn) {
+	for p := range pending {
+		if s.PendingTimeout > 0 && time.Since(p.acceptAt) > s.PendingTimeout {
+			p.release()
+			shed(shedding, p.conn, s.RetryAfter)
+			continue
+		}
+		if s.HandshakeTimeout > 0 {
+			_ = p.conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		}
+		ws, err := s.pair(p.conn)
+		if err != nil {
+			p.release()
+			_ = p.conn.Close()
+			continue
+		}
+		releaseOnClose(ws, p.release)
+		_ = p.conn.SetDeadline(time.Time{})
+		if s.Registry != nil {
+			s.Registry.Track(ws)
+		}
+		go s.serve(ws)
+	}
+}
+
+func (s *Server) pair(conn net.Conn) (WebSocket, error) {
+	upgrader := s.Upgrader
+	if upgrader == nil {
+		upgrader = DefaultUpgrader
+	}
+	// 握手的截止时间由 handshakeWorker 按照 HandshakeTimeout 设置，为 0 时不限制，所以不使用 Upgrader 的握手超时
+	timeouts := upgrader.timeouts()
+	timeouts.Handshake = 0
+	if s.TLSConfig != nil {
+		return upgrader.upgradeStreamTLS(conn, conn, s.TLSConfig, timeouts)
+	}
+	return upgrader.upgradeStream(conn, conn, timeouts)
+}
+
+func (s *Server) serve(ws WebSocket) {
+	defer ws.Close()
+	if s.Handler != nil {
+		s.Handler(ws)
+	}
+}
+
+// shed 用于在负载过高时拒绝连接，等待发送 503 响应的连接太多的时候直接关闭连接
+func shed(shedding chan<- shedConn, conn net.Conn, retryAfter int) {
+	select {
+	case shedding <- shedConn{conn: conn, retryAfter: retryAfter}:
+	default:
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) shedWorker(shedding <-chan shedConn) {
+	for c := range shedding {
+		header := http.Header{}
+		if c.retryAfter > 0 {
+			header.Set("Retry-After", strconv.Itoa(c.retryAfter))
+		}
+		_ = c.conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+		_ = writeHTTPError(c.conn, http.StatusServiceUnavailable, header)
+		_ = c.conn.Close()
+	}
+}
+
+// isTemporaryAcceptError 判断 Accept 返回的错误是否可以重试。
+// net/http 的 Server.Serve 使用 net.Error.Temporary 判断，但是 Temporary 已经废弃，
+// 这里直接判断系统调用的错误码：资源暂时用完，或者连接在 Accept 之前就被对方中断，另外超时也可以重试
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// errorListener 的 Accept 依次返回 errs 中的错误，用完之后返回 net.ErrClosed
+type errorListener struct {
+	errs    []error
+	accepts int
+}
+
+func (l *errorListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if len(l.errs) < 1 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func (l *errorListener) Close() error {
+	return nil
+}
+
+func (l *errorListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestServeRetriesTemporaryErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	enfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.ENFILE)}
+	listener := &errorListener{errs: []error{emfile, enfile, emfile}}
+	start := time.Now()
+	err := (&Server{}).Serve(listener)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() error = %v, want %v", err, net.ErrClosed)
+	}
+	if listener.accepts != 4 {
+		t.Fatalf("Accept called %d times, want 4", listener.accepts)
+	}
+	// 5ms、10ms、20ms
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("Serve() retried after %v, want a backoff of at least 35ms", elapsed)
+	}
+}
+
+func TestServeReturnsPermanentErrors(t *testing.T) {
+	permanent := errors.New("listener is broken")
+	listener := &errorListener{errs: []error{permanent}}
+	err := (&Server{}).Serve(listener)
+	if err != permanent {
+		t.Fatalf("Serve() error = %v, want %v", err, permanent)
+	}
+	if listener.accepts != 1 {
+		t.Fatalf("Accept called %d times, want 1", listener.accepts)
+	}
+}
+
+// connListener 的 Accept 返回 conns 中的连接，conns 被关闭之后返回 net.ErrClosed
+type connListener struct {
+	conns chan net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func TestServeShedsWithBoundedGoroutines(t *testing.T) {
+	const flood = 200
+	listener := &connListener{conns: make(chan net.Conn)}
+	server := &Server{MaxPendingUpgrades: 1, MaxConcurrentHandshakes: 1}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	before := runtime.NumGoroutine()
+	peers := make([]net.Conn, 0, flood)
+	defer func() {
+		for _, peer := range peers {
+			_ = peer.Close()
+		}
+	}()
+	// 对方既不发送握手请求也不读取 503 响应，握手和发送 503 的 goroutine 都会阻塞
+	for i := 0; i < flood; i++ {
+		conn, peer := net.Pipe()
+		peers = append(peers, peer)
+		listener.conns <- conn
+	}
+	if grown := runtime.NumGoroutine() - before; grown > 20 {
+		t.Fatalf("%d goroutines were created to shed %d connections", grown, flood)
+	}
+
+	// 来不及发送 503 的连接被直接关闭
+	closed := 0
+	for _, peer := range peers {
+		_ = peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := peer.Read(make([]byte, 1)); err == io.EOF {
+			closed++
+		}
+	}
+	if closed < flood-10 {
+		t.Fatalf("%d of %d shed connections were closed, want at least %d", closed, flood, flood-10)
+	}
+
+	close(listener.conns)
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}, want: true},
+		{err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.ECONNABORTED)}, want: true},
+		{err: os.ErrDeadlineExceeded, want: true},
+		{err: net.ErrClosed, want: false},
+		{err: &net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EBADF)}, want: false},
+		{err: errors.New("listener is broken"), want: false},
+	}
+	for _, test := range tests {
+		if got := isTemporaryAcceptError(test.err); got != test.want {
+			t.Errorf("isTemporaryAcceptError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+		ok     bool
+	}{
+		// HandshakeTimeout 为 0 时不限制握手的时间，Upgrader 的握手超时不会生效
+		{name: "unlimited", server: &Server{Upgrader: &Upgrader{HandshakeTimeout: 50 * time.Millisecond}}, ok: true},
+		{name: "server timeout", server: &Server{HandshakeTimeout: 50 * time.Millisecond, Upgrader: &Upgrader{HandshakeTimeout: time.Minute}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				_ = test.server.Serve(listener)
+			}()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			// 过一段时间才发送握手请求
+			time.Sleep(200 * time.Millisecond)
+			_, _ = io.WriteString(conn, rawUpgradeRequest)
+			response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			switched := err == nil && response.StatusCode == http.StatusSwitchingProtocols
+			if switched != test.ok {
+				t.Fatalf("handshake after 200ms switched protocols = %v (%v), want %v", switched, err, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrSOCKS5Version         = errors.New("unsupported SOCKS version")
+	ErrSOCKS5NoMethod        = errors.New("no acceptable SOCKS5 authentication method")
+	ErrSOCKS5AuthFailed      = errors.New("SOCKS5 authentication failed")
+	ErrSOCKS5Command         = errors.New("unsupported SOCKS5 command")
+	ErrSOCKS5AddressType     = errors.New("unsupported SOCKS5 address type")
+	ErrSOCKS5TargetForbidden = errors.New("SOCKS5 target is not allowed")
+)
+
+const (
+	socks5Version = 5
+
+	socks5NoAuth       = 0x00
+	socks5UserPassAuth = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5UserPassVersion = 1
+
+	socks5Connect = 0x01
+
+	socks5IPv4   = 0x01
+	socks5Domain = 0x03
+	socks5IPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5GeneralFailure     = 0x01
+	socks5NotAllowed         = 0x02
+	socks5HostUnreachable    = 0x04
+	socks5ConnectionRefused  = 0x05
+	socks5CommandUnsupported = 0x07
+	socks5AddressUnsupported = 0x08
+)
+
+// SOCKS5Gateway 是一个传输层是 WebSocket 的 SOCKS5 服务端，实现了 http.Handler 接口。
+// 每个 WebSocket 连接上运行一次 SOCKS5 协商（RFC 1928，支持无认证和 RFC 1929 的用户名密码认证，只支持 CONNECT），
+// 之后 WebSocket 的 BinaryFrame Message 和目标 TCP 连接之间会双向转发数据。
+// WebSocket 可以穿过只允许 HTTP 的防火墙和反向代理，配合 SOCKS5Client 可以在网络之间搭建代理。
+//
+// 使用例子：
+//
+//	gateway := &websocket.SOCKS5Gateway{
+//		Authenticate: func(username, password string) bool {
+//			return username == "user" && password == "pass"
+//		},
+//		Logf: log.Printf,
+//	}
+//	http.Handle("/socks", gateway)
+//	http.ListenAndServe("0.0.0.0:8080", nil)
+type SOCKS5Gateway struct {
+	// Upgrader 用于完成 WebSocket 握手，为空时使用 DefaultUpgrader
+	Upgrader *Upgrader
+
+	// Authenticate 不为空时要求客户端使用用户名密码认证，返回 false 会拒绝连接。为空时不做认证。
+	Authenticate func(username, password string) bool
+
+	// AllowTarget 不为空时用于检查 CONNECT 的目标地址，返回 false 会响应 connection not allowed by ruleset，
+	// 网关在公网上的时候应该用它限制可以访问的网络。为空时允许所有的目标。
+	//
+	// 注意：address 总是已经解析好的 ip:port。目标是域名的时候，网关会先用 Resolver 解析，依次检查每个 IP，
+	// 然后直接连接第一个允许的 IP，而不是连接域名，这样客户端不能用一个解析到内网地址的域名绕过按 IP 的限制，
+	// 也不会因为连接的时候重新解析而受到 DNS rebinding 的影响。所有的 IP 都不允许的时候拒绝连接。
+	AllowTarget func(address string) bool
+
+	// Resolver 用于在 AllowTarget 不为空时解析目标的域名，为空时使用 net.DefaultResolver。
+	// AllowTarget 为空时不解析，域名原样交给 Dialer。
+	Resolver *net.Resolver
+
+	// Dialer 用于连接目标服务器，为空时使用默认的拨号方式（支持 ALL_PROXY 环境变量）。
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Logf 用于输出网关的日志，为空时不输出。
+	Logf func(format string, v ...any)
+}
+
+func (g *SOCKS5Gateway) logf(format string, v ...any) {
+	if g.Logf != nil {
+		g.Logf(format, v...)
+	}
+}
+
+func (g *SOCKS5Gateway) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	upgrader := g.Upgrader
+	if upgrader == nil {
+		upgrader = DefaultUpgrader
+	}
+	ws, err := upgrader.Upgrade(w, request)
+	if err != nil {
+		g.logf("socks5: upgrade from %s: %v", request.RemoteAddr, err)
+		return
+	}
+	g.serve(request.Context(), NewConn(ws), request.RemoteAddr)
+}
+
+// serve 在 conn 上完成 SOCKS5 协商，然后在 conn 和目标连接之间转发数据
+func (g *SOCKS5Gateway) serve(ctx context.Context, conn net.Conn, remoteAddr string) {
+	reader := bufio.NewReader(conn)
+	err := g.negotiate(reader, conn)
+	if err != nil {
+		g.logf("socks5: from %s: %v", remoteAddr, err)
+		_ = conn.Close()
+		return
+	}
+	address, err := readSOCKS5Request(reader)
+	if err != nil {
+		g.logf("socks5: from %s: %v", remoteAddr, err)
+		_ = writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+		_ = conn.Close()
+		return
+	}
+	dialAddress := address
+	if g.AllowTarget != nil {
+		if dialAddress, err = g.resolveTarget(ctx, address); err != nil {
+			g.logf("socks5: CONNECT %s from %s: %v", address, remoteAddr, err)
+			_ = writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+			_ = conn.Close()
+			return
+		}
+	}
+	target, err := g.dial(ctx, "tcp", dialAddress)
+	if err != nil {
+		g.logf("socks5: CONNECT %s from %s: %v", address, remoteAddr, err)
+		_ = writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+		_ = conn.Close()
+		return
+	}
+	err = writeSOCKS5Reply(conn, socks5Succeeded, target.LocalAddr())
+	if err != nil {
+		_ = target.Close()
+		_ = conn.Close()
+		return
+	}
+	g.logf("socks5: CONNECT %s from %s: tunnel established", address, remoteAddr)
+	pipe(target, conn, reader)
+	g.logf("socks5: CONNECT %s from %s: tunnel closed", address, remoteAddr)
+}
+
+// resolveTarget 解析 address 中的域名，返回第一个 AllowTarget 允许的 ip:port，都不允许的时候返回 ErrSOCKS5TargetForbidden
+func (g *SOCKS5Gateway) resolveTarget(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		if !g.AllowTarget(address) {
+			return "", ErrSOCKS5TargetForbidden
+		}
+		return address, nil
+	}
+	resolver := g.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		resolved := net.JoinHostPort(addr.IP.String(), port)
+		if g.AllowTarget(resolved) {
+			return resolved, nil
+		}
+	}
+	return "", ErrSOCKS5TargetForbidden
+}
+
+func (g *SOCKS5Gateway) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if g.Dialer != nil {
+		return g.Dialer(ctx, network, address)
+	}
+	return tcpDialer(ctx, network, address)
+}
+
+// negotiate 读取客户端支持的认证方式，并完成认证
+func (g *SOCKS5Gateway) negotiate(reader *bufio.Reader, conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return ErrSOCKS5Version
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	method := byte(socks5NoAuth)
+	if g.Authenticate != nil {
+		method = socks5UserPassAuth
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return ErrSOCKS5NoMethod
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5NoAuth {
+		return nil
+	}
+
+	// RFC 1929：VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != socks5UserPassVersion {
+		return ErrSOCKS5Version
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, username); err != nil {
+		return err
+	}
+	length, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	password := make([]byte, length)
+	if _, err = io.ReadFull(reader, password); err != nil {
+		return err
+	}
+	if !g.Authenticate(string(username), string(password)) {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, 0x01})
+		return ErrSOCKS5AuthFailed
+	}
+	_, err = conn.Write([]byte{socks5UserPassVersion, 0x00})
+	return err
+}
+
+// readSOCKS5Request 读取 VER CMD RSV ATYP DST.ADDR DST.PORT，返回目标地址
+func readSOCKS5Request(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", ErrSOCKS5Version
+	}
+	if header[1] != socks5Connect {
+		return "", ErrSOCKS5Command
+	}
+	var host string
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5Domain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, length)
+		if _, err = io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", ErrSOCKS5AddressType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply 发送 VER REP RSV ATYP BND.ADDR BND.PORT，bound 不是 *net.TCPAddr 的时候使用 0.0.0.0:0
+func writeSOCKS5Reply(conn net.Conn, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	reply := []byte{socks5Version, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socks5IPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socks5IPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socks5ReplyCode 返回 err 对应的 SOCKS5 响应码
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrSOCKS5Command):
+		return socks5CommandUnsupported
+	case errors.Is(err, ErrSOCKS5AddressType):
+		return socks5AddressUnsupported
+	case errors.Is(err, ErrSOCKS5TargetForbidden):
+		return socks5NotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5HostUnreachable
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+// SOCKS5Client 是 SOCKS5Gateway 的客户端，每个连接会先和网关建立一个 WebSocket，然后在上面完成 SOCKS5 协商。
+// DialContext 可以直接作为 http.Transport.DialContext 或者 Dialer.NetDial 这类拨号函数使用；
+// Serve 在本地提供一个普通的 SOCKS5 服务，把本地程序的连接原样转发到网关，本地程序的协商和认证由网关完成。
+//
+// 使用例子：
+//
+//	client := &websocket.SOCKS5Client{URL: "wss://gateway.example.com/socks", Username: "user", Password: "pass"}
+//	transport := &http.Transport{DialContext: client.DialContext}
+//	...
+//	listener, _ := net.Listen("tcp", "127.0.0.1:1080")
+//	err := client.Serve(listener)
+type SOCKS5Client struct {
+	// URL 是网关的 WebSocket 地址
+	URL string
+
+	// Dialer 用于连接网关，为空时使用 DefaultDialer
+	Dialer *Dialer
+
+	// Username 和 Password 是 DialContext 使用的用户名和密码，Username 为空时不认证
+	Username string
+	Password string
+
+	// Logf 用于输出 Serve 的日志，为空时不输出。
+	Logf func(format string, v ...any)
+}
+
+func (c *SOCKS5Client) logf(format string, v ...any) {
+	if c.Logf != nil {
+		c.Logf(format, v...)
+	}
+}
+
+func (c *SOCKS5Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext 通过网关连接 address，network 只支持 tcp、tcp4 和 tcp6
+func (c *SOCKS5Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var auth *proxy.Auth
+	if len(c.Username) > 0 {
+		auth = &proxy.Auth{User: c.Username, Password: c.Password}
+	}
+	forward := dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return conn, nil
+	})
+	dialer, err := proxy.SOCKS5("tcp", c.URL, auth, forward)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	target, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// Serve 从 listener 接收本地 SOCKS5 客户端的连接，并把每个连接转发到网关，直到 listener.Accept 返回错误
+func (c *SOCKS5Client) Serve(listener net.Listener) error {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			remote, err := c.connect(context.Background())
+			if err != nil {
+				c.logf("socks5: relay from %s: %v", local.RemoteAddr(), err)
+				_ = local.Close()
+				return
+			}
+			pipe(remote, local, bufio.NewReader(local))
+		}()
+	}
+}
+
+func (c *SOCKS5Client) connect(ctx context.Context) (net.Conn, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	ws, err := dialer.Dial(ctx, c.URL)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(ws), nil
+}
@@ -0,0 +1,257 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socks5Exchange 在 g.serve 上运行一次 SOCKS5 会话，发送 request 之后读取 replyLength 字节的响应
+func socks5Exchange(t *testing.T, g *SOCKS5Gateway, request []byte, replyLength int) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go g.serve(context.Background(), server, "test")
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	go func() {
+		_, _ = client.Write(request)
+	}()
+	reply := make([]byte, replyLength)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return reply
+}
+
+// socks5ConnectRequest 返回 CONNECT 请求，host 是 IPv4 地址或者域名
+func socks5ConnectRequest(command byte, host string, port uint16) []byte {
+	request := []byte{socks5Version, command, 0x00}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(request, socks5IPv4)
+		request = append(request, ip...)
+	} else {
+		request = append(request, socks5Domain, byte(len(host)))
+		request = append(request, host...)
+	}
+	return append(request, byte(port>>8), byte(port))
+}
+
+// pipeDialer 返回一个记录目标地址的 Dialer，连接的另一端会把收到的数据原样发回
+func pipeDialer(addresses chan<- string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		addresses <- address
+		a, b := net.Pipe()
+		go func() {
+			_, _ = io.Copy(b, b)
+			_ = b.Close()
+		}()
+		return a, nil
+	}
+}
+
+func TestSOCKS5Negotiation(t *testing.T) {
+	noAuth := []byte{socks5Version, 1, socks5NoAuth}
+	userPass := func(username, password string) []byte {
+		request := []byte{socks5Version, 1, socks5UserPassAuth, socks5UserPassVersion, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		return append(request, password...)
+	}
+	authenticate := func(username, password string) bool {
+		return username == "user" && password == "pass"
+	}
+	tests := []struct {
+		name         string
+		authenticate func(username, password string) bool
+		request      []byte
+		want         []byte
+	}{
+		{
+			name:    "no auth",
+			request: noAuth,
+			want:    []byte{socks5Version, socks5NoAuth},
+		},
+		{
+			name:         "auth required but not offered",
+			authenticate: authenticate,
+			request:      noAuth,
+			want:         []byte{socks5Version, socks5NoAcceptable},
+		},
+		{
+			name:         "auth failed",
+			authenticate: authenticate,
+			request:      userPass("user", "wrong"),
+			want:         []byte{socks5Version, socks5UserPassAuth, socks5UserPassVersion, 0x01},
+		},
+		{
+			name:         "auth succeeded",
+			authenticate: authenticate,
+			request:      userPass("user", "pass"),
+			want:         []byte{socks5Version, socks5UserPassAuth, socks5UserPassVersion, 0x00},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := &SOCKS5Gateway{Authenticate: test.authenticate}
+			if reply := socks5Exchange(t, g, test.request, len(test.want)); !bytes.Equal(reply, test.want) {
+				t.Fatalf("reply = % x, want % x", reply, test.want)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ReplyCodes(t *testing.T) {
+	refused := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	unreachable := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: address, IsNotFound: true}}
+	}
+	loopbackOnly := func(address string) bool {
+		return strings.HasPrefix(address, "127.0.0.1:")
+	}
+	tests := []struct {
+		name        string
+		gateway     *SOCKS5Gateway
+		request     []byte
+		code        byte
+		wantAddress string
+	}{
+		{
+			name:        "succeeded",
+			gateway:     &SOCKS5Gateway{},
+			request:     socks5ConnectRequest(socks5Connect, "10.0.0.1", 80),
+			code:        socks5Succeeded,
+			wantAddress: "10.0.0.1:80",
+		},
+		{
+			name:        "domain is not resolved without AllowTarget",
+			gateway:     &SOCKS5Gateway{},
+			request:     socks5ConnectRequest(socks5Connect, "example.invalid", 443),
+			code:        socks5Succeeded,
+			wantAddress: "example.invalid:443",
+		},
+		{
+			name:    "unsupported command",
+			gateway: &SOCKS5Gateway{},
+			request: socks5ConnectRequest(0x02, "10.0.0.1", 80),
+			code:    socks5CommandUnsupported,
+		},
+		{
+			name:    "unsupported address type",
+			gateway: &SOCKS5Gateway{},
+			request: []byte{socks5Version, socks5Connect, 0x00, 0x05},
+			code:    socks5AddressUnsupported,
+		},
+		{
+			name:    "connection refused",
+			gateway: &SOCKS5Gateway{Dialer: refused},
+			request: socks5ConnectRequest(socks5Connect, "10.0.0.1", 80),
+			code:    socks5ConnectionRefused,
+		},
+		{
+			name:    "host unreachable",
+			gateway: &SOCKS5Gateway{Dialer: unreachable},
+			request: socks5ConnectRequest(socks5Connect, "10.0.0.1", 80),
+			code:    socks5HostUnreachable,
+		},
+		{
+			name:    "IP not allowed",
+			gateway: &SOCKS5Gateway{AllowTarget: loopbackOnly},
+			request: socks5ConnectRequest(socks5Connect, "10.0.0.1", 80),
+			code:    socks5NotAllowed,
+		},
+		{
+			name:        "domain is checked by its resolved IP",
+			gateway:     &SOCKS5Gateway{AllowTarget: loopbackOnly},
+			request:     socks5ConnectRequest(socks5Connect, "localhost", 80),
+			code:        socks5Succeeded,
+			wantAddress: "127.0.0.1:80",
+		},
+		{
+			name: "domain resolving to a forbidden IP",
+			gateway: &SOCKS5Gateway{AllowTarget: func(address string) bool {
+				return !loopbackOnly(address) && !strings.HasPrefix(address, "[::1]:")
+			}},
+			request: socks5ConnectRequest(socks5Connect, "localhost", 80),
+			code:    socks5NotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addresses := make(chan string, 1)
+			if test.gateway.Dialer == nil {
+				test.gateway.Dialer = pipeDialer(addresses)
+			}
+			request := append([]byte{socks5Version, 1, socks5NoAuth}, test.request...)
+			// 方法选择 2 字节，加上 IPv4 的 CONNECT 响应 10 字节
+			reply := socks5Exchange(t, test.gateway, request, 2+10)
+			if reply[2] != socks5Version || reply[3] != test.code {
+				t.Fatalf("reply = % x, want code %#x", reply, test.code)
+			}
+			if len(test.wantAddress) > 0 {
+				if address := <-addresses; address != test.wantAddress {
+					t.Fatalf("dialed %q, want %q", address, test.wantAddress)
+				}
+			}
+		})
+	}
+}
+
+func TestSOCKS5ClientThroughGateway(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	gateway := &SOCKS5Gateway{
+		Authenticate: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client := &SOCKS5Client{URL: url, Username: "user", Password: "pass"}
+	conn, err := client.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Read() = %q, %v, want %q", buf, err, "hello")
+	}
+
+	client.Password = "wrong"
+	if _, err = client.DialContext(ctx, "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("DialContext() with a wrong password succeeded")
+	}
+}
@@ -0,0 +1,595 @@
+// Package stomp 是运行在 WebSocket 上的 STOMP 1.2 客户端（同时兼容 1.0 和 1.1），
+// 用于连接 ActiveMQ、RabbitMQ Web-STOMP、Spring 这类提供 STOMP over WebSocket 端点的消息服务。
+//
+// 每个帧作为一个 WebSocket Message 发送，读取的时候帧也可以被拆分到多个 Message 中。
+// 协商出来的心跳会被映射到连接的保活：客户端发送心跳的间隔由 Client 定时发送换行，
+// 服务端发送心跳的间隔会设置成 websocket.Keepalive 的 ReadIdleTimeout，超过之后连接会被关闭。
+//
+// 使用例子：
+//
+//	client, err := stomp.Dial(ctx, "ws://127.0.0.1:15674/ws", &stomp.Config{
+//		Login:    "guest",
+//		Passcode: "guest",
+//	})
+//	sub, err := client.Subscribe("/queue/orders", stomp.AckClientIndividual, nil)
+//	go func() {
+//		for message := range sub.C {
+//			fmt.Println(string(message.Body))
+//			_ = message.Ack()
+//		}
+//	}()
+//	err = client.Send("/queue/orders", "text/plain", []byte("hello"), nil)
+//	err = client.Disconnect(ctx)
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/RommHui/websocket"
+)
+
+// Subprotocols 是 STOMP over WebSocket 使用的子协议，按照版本从高到低排列
+var Subprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// DefaultSubscriptionBuffer 是 Config 没有设置 SubscriptionBuffer 时每个订阅的缓冲长度
+const DefaultSubscriptionBuffer = 64
+
+// heartBeatGrace 是等待服务端心跳时在协商出来的间隔上乘的倍数，用于容忍网络延迟
+const heartBeatGrace = 2
+
+var (
+	ErrClientClosed       = errors.New("stomp client is closed")
+	ErrUnexpectedFrame    = errors.New("unexpected STOMP frame")
+	ErrSubscriptionClosed = errors.New("stomp subscription is closed")
+	ErrNoAck              = errors.New("stomp message does not need to be acknowledged")
+)
+
+// AckMode 是 SUBSCRIBE 的 ack 头
+type AckMode string
+
+const (
+	// AckAuto 表示服务端发送之后就认为 Message 已经被处理，不需要 Ack
+	AckAuto AckMode = "auto"
+	// AckClient 表示 Ack 一个 Message 的时候同时确认这个订阅之前的所有 Message
+	AckClient AckMode = "client"
+	// AckClientIndividual 表示每个 Message 需要单独 Ack
+	AckClientIndividual AckMode = "client-individual"
+)
+
+// Config 是 Client 的配置，为空时使用默认值
+type Config struct {
+	// Host 是 CONNECT 帧的 host 头，也就是消息服务的虚拟主机，为空时使用 URL 中的主机名
+	Host string
+
+	// Login 和 Passcode 是 CONNECT 帧的用户名和密码，Login 为空时不发送
+	Login    string
+	Passcode string
+
+	// Header 是 CONNECT 帧中额外的头
+	Header Header
+
+	// SendHeartBeat 是客户端发送心跳的间隔，ReceiveHeartBeat 是希望服务端发送心跳的间隔，为 0 时不使用心跳。
+	// 实际使用的间隔是和服务端协商之后的结果。
+	SendHeartBeat    time.Duration
+	ReceiveHeartBeat time.Duration
+
+	// Keepalive 是连接原来的保活配置，协商出服务端的心跳之后会在它的基础上设置 ReadIdleTimeout
+	Keepalive websocket.Keepalive
+
+	// SubscriptionBuffer 是每个订阅的 Message 缓冲长度，小于 1 时使用 DefaultSubscriptionBuffer。
+	// 缓冲满了的时候 Client 会等待订阅被读取，这期间其他订阅也收不到 Message。
+	SubscriptionBuffer int
+
+	// MaxFrameSize 是收到的帧的 Body 的最大长度，也是命令和所有头加起来的最大长度，为 0 时不限制
+	MaxFrameSize int
+}
+
+// Error 是服务端发送的 ERROR 帧，Client 收到之后会被关闭
+type Error struct {
+	Message string
+	Frame   *Frame
+}
+
+func (e *Error) Error() string {
+	if len(e.Frame.Body) > 0 {
+		return "stomp error: " + e.Message + ": " + string(e.Frame.Body)
+	}
+	return "stomp error: " + e.Message
+}
+
+// Message 是订阅收到的 MESSAGE 帧
+type Message struct {
+	*Frame
+	Destination  string
+	Subscription *Subscription
+}
+
+// Ack 确认这个 Message 已经被处理，订阅是 AckAuto 模式的时候返回 ErrNoAck
+func (m *Message) Ack() error {
+	return m.Subscription.client.ack(CommandAck, m)
+}
+
+// Nack 告诉服务端这个 Message 没有被处理，STOMP 1.0 不支持 NACK
+func (m *Message) Nack() error {
+	return m.Subscription.client.ack(CommandNack, m)
+}
+
+// Subscription 是一个订阅，收到的 Message 会放入 C，订阅取消或者 Client 关闭之后 C 会被关闭
+type Subscription struct {
+	ID          string
+	Destination string
+	Ack         AckMode
+	C           <-chan *Message
+
+	client *Client
+	c      chan *Message
+	once   *sync.Once
+	// done 在订阅取消之后被关闭，用于唤醒正在等待放入 Message 的 deliver
+	done chan struct{}
+	// lock 保证 c 被关闭之后不会再放入 Message
+	lock   *sync.Mutex
+	closed bool
+}
+
+// Unsubscribe 取消订阅，之后 C 会被关闭
+func (s *Subscription) Unsubscribe() error {
+	if !s.client.removeSubscription(s) {
+		return ErrSubscriptionClosed
+	}
+	return s.client.send(&Frame{Command: CommandUnsubscribe, Header: Header{"id": s.ID}})
+}
+
+// Client 是一个 STOMP 连接，所有的方法都可以在多个 goroutine 中同时调用
+type Client struct {
+	ws      websocket.WebSocket
+	config  Config
+	version string
+	server  Header
+	reader  *frameReader
+
+	lock          *sync.Mutex
+	nextID        uint64
+	subscriptions map[string]*Subscription
+	receipts      map[string]chan error
+
+	done      chan struct{}
+	err       error
+	closeOnce *sync.Once
+}
+
+// Dial 连接 url 上的 STOMP over WebSocket 端点，然后完成 STOMP 的 CONNECT，config 为空时使用默认值
+func Dial(ctx context.Context, url string, config *Config) (*Client, error) {
+	dialer := &websocket.Dialer{Subprotocols: Subprotocols}
+	ws, err := dialer.Dial(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(ctx, ws, config)
+	if err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClient 在已经建立的 ws 上发送 CONNECT 并等待 CONNECTED，config 为空时使用默认值。
+// 创建之后 ws 只能由 Client 读取。服务端返回 ERROR 的时候返回 *Error。
+func NewClient(ctx context.Context, ws websocket.WebSocket, config *Config) (*Client, error) {
+	c := &Client{
+		ws:            ws,
+		lock:          &sync.Mutex{},
+		nextID:        1,
+		subscriptions: map[string]*Subscription{},
+		receipts:      map[string]chan error{},
+		done:          make(chan struct{}),
+		closeOnce:     &sync.Once{},
+	}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.SubscriptionBuffer < 1 {
+		c.config.SubscriptionBuffer = DefaultSubscriptionBuffer
+	}
+	c.reader = &frameReader{
+		reader:   bufio.NewReader(websocket.NewConn(ws)),
+		maxSize:  c.config.MaxFrameSize,
+		unescape: true,
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ws.Close()
+		case <-stop:
+		}
+	}()
+	connected, err := c.connect()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.server = connected.Header
+	c.version = connected.Header["version"]
+	if len(c.version) < 1 {
+		c.version = "1.0"
+	}
+	c.reader.unescape = c.version != "1.0"
+
+	send, receive := c.heartBeats(connected.Header["heart-beat"])
+	if receive > 0 {
+		keepalive := c.config.Keepalive
+		keepalive.ReadIdleTimeout = receive * heartBeatGrace
+		ws.SetKeepalive(keepalive)
+	}
+	if send > 0 {
+		go c.sendHeartBeats(send)
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// connect 发送 CONNECT 帧，然后读取 CONNECTED 帧
+func (c *Client) connect() (*Frame, error) {
+	header := Header{
+		"accept-version": "1.0,1.1,1.2",
+		"heart-beat":     strconv.FormatInt(c.config.SendHeartBeat.Milliseconds(), 10) + "," + strconv.FormatInt(c.config.ReceiveHeartBeat.Milliseconds(), 10),
+	}
+	for key, value := range c.config.Header {
+		header[key] = value
+	}
+	header["host"] = c.config.Host
+	if len(header["host"]) < 1 {
+		header["host"] = hostOf(c.ws)
+	}
+	if len(c.config.Login) > 0 {
+		header["login"] = c.config.Login
+		header["passcode"] = c.config.Passcode
+	}
+	err := c.ws.WriteMessage(websocket.TextFrame, (&Frame{Command: CommandConnect, Header: header}).encode(false))
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.reader.read()
+	if err != nil {
+		return nil, err
+	}
+	switch f.Command {
+	case CommandConnected:
+		return f, nil
+	case CommandError:
+		return nil, &Error{Message: f.Header["message"], Frame: f}
+	default:
+		return nil, ErrUnexpectedFrame
+	}
+}
+
+// heartBeats 按照 STOMP 的规则协商心跳间隔，返回客户端发送和服务端发送心跳的间隔
+func (c *Client) heartBeats(serverHeartBeat string) (send, receive time.Duration) {
+	sx, sy, found := strings.Cut(serverHeartBeat, ",")
+	if !found {
+		return 0, 0
+	}
+	serverSend, err1 := strconv.ParseInt(strings.TrimSpace(sx), 10, 64)
+	serverReceive, err2 := strconv.ParseInt(strings.TrimSpace(sy), 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0
+	}
+	negotiate := func(local time.Duration, remote int64) time.Duration {
+		if local < 1 || remote < 1 {
+			return 0
+		}
+		if remoteInterval := time.Duration(remote) * time.Millisecond; remoteInterval > local {
+			return remoteInterval
+		}
+		return local
+	}
+	return negotiate(c.config.SendHeartBeat, serverReceive), negotiate(c.config.ReceiveHeartBeat, serverSend)
+}
+
+func hostOf(ws websocket.WebSocket) string {
+	if request := ws.HandshakeRequest(); request != nil {
+		return request.URL.Hostname()
+	}
+	return "/"
+}
+
+// Version 返回协商出来的 STOMP 版本
+func (c *Client) Version() string {
+	return c.version
+}
+
+// ServerHeader 返回服务端的 CONNECTED 帧的头，例如 server 和 session
+func (c *Client) ServerHeader() Header {
+	return c.server
+}
+
+// Send 发送一个 SEND 帧，contentType 为空时不设置 content-type，header 是额外的头
+func (c *Client) Send(destination, contentType string, body []byte, header Header) error {
+	return c.send(sendFrame(destination, contentType, body, header))
+}
+
+// SendWithReceipt 和 Send 一样发送 SEND 帧，并等待服务端的 RECEIPT，用于确认服务端已经收到
+func (c *Client) SendWithReceipt(ctx context.Context, destination, contentType string, body []byte, header Header) error {
+	return c.sendWithReceipt(ctx, sendFrame(destination, contentType, body, header))
+}
+
+func sendFrame(destination, contentType string, body []byte, header Header) *Frame {
+	f := &Frame{Command: CommandSend, Header: Header{}, Body: body}
+	for key, value := range header {
+		f.Header[key] = value
+	}
+	f.Header["destination"] = destination
+	if len(contentType) > 0 {
+		f.Header["content-type"] = contentType
+	}
+	return f
+}
+
+// Subscribe 订阅 destination，header 是 SUBSCRIBE 帧中额外的头，例如 RabbitMQ 的 prefetch-count
+func (c *Client) Subscribe(destination string, ack AckMode, header Header) (*Subscription, error) {
+	if len(ack) < 1 {
+		ack = AckAuto
+	}
+	messages := make(chan *Message, c.config.SubscriptionBuffer)
+	s := &Subscription{
+		Destination: destination,
+		Ack:         ack,
+		C:           messages,
+		client:      c,
+		c:           messages,
+		once:        &sync.Once{},
+		done:        make(chan struct{}),
+		lock:        &sync.Mutex{},
+	}
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	s.ID = "sub-" + strconv.FormatUint(c.nextID, 10)
+	c.nextID++
+	c.subscriptions[s.ID] = s
+	c.lock.Unlock()
+
+	f := &Frame{Command: CommandSubscribe, Header: Header{}}
+	for key, value := range header {
+		f.Header[key] = value
+	}
+	f.Header["id"] = s.ID
+	f.Header["destination"] = destination
+	f.Header["ack"] = string(ack)
+	if err := c.send(f); err != nil {
+		c.removeSubscription(s)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Disconnect 发送 DISCONNECT 并等待服务端确认之前发送的帧都已经被处理，然后关闭连接
+func (c *Client) Disconnect(ctx context.Context) error {
+	err := c.sendWithReceipt(ctx, &Frame{Command: CommandDisconnect, Header: Header{}})
+	c.shutdown(ErrClientClosed)
+	closeErr := c.ws.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Close 直接关闭连接，不发送 DISCONNECT
+func (c *Client) Close() error {
+	c.shutdown(ErrClientClosed)
+	return c.ws.Close()
+}
+
+// Done 返回一个在 Client 关闭之后会被关闭的 channel
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err 返回 Client 关闭的原因，服务端发送了 ERROR 帧的时候是 *Error，没有关闭的时候返回 nil
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Client) send(f *Frame) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	data := f.encode(c.version != "1.0")
+	opCode := websocket.TextFrame
+	if !utf8.Valid(data) {
+		opCode = websocket.BinaryFrame
+	}
+	err := c.ws.WriteMessage(opCode, data)
+	if err != nil {
+		c.shutdown(err)
+	}
+	return err
+}
+
+func (c *Client) sendWithReceipt(ctx context.Context, f *Frame) error {
+	receipt := make(chan error, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return c.err
+	}
+	id := "receipt-" + strconv.FormatUint(c.nextID, 10)
+	c.nextID++
+	c.receipts[id] = receipt
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.receipts, id)
+		c.lock.Unlock()
+	}()
+
+	f.Header["receipt"] = id
+	if err := c.send(f); err != nil {
+		return err
+	}
+	select {
+	case err := <-receipt:
+		return err
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ack 发送 ACK 或者 NACK，1.2 使用 MESSAGE 帧的 ack 头，1.0 和 1.1 使用 message-id
+func (c *Client) ack(command string, m *Message) error {
+	if m.Subscription.Ack == AckAuto {
+		return ErrNoAck
+	}
+	header := Header{}
+	switch c.version {
+	case "1.0", "1.1":
+		header["message-id"] = m.Header["message-id"]
+		if c.version == "1.1" {
+			header["subscription"] = m.Subscription.ID
+		}
+	default:
+		header["id"] = m.Header["ack"]
+	}
+	return c.send(&Frame{Command: command, Header: header})
+}
+
+// sendHeartBeats 每隔 interval 发送一个换行作为心跳
+func (c *Client) sendHeartBeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.ws.WriteMessage(websocket.TextFrame, []byte{'\n'}) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	for {
+		f, err := c.reader.read()
+		if err != nil {
+			c.shutdown(c.readError(err))
+			return
+		}
+		switch f.Command {
+		case CommandMessage:
+			c.deliver(f)
+		case CommandReceipt:
+			c.receipt(f.Header["receipt-id"], nil)
+		case CommandError:
+			err := &Error{Message: f.Header["message"], Frame: f}
+			if id, ok := f.Header["receipt-id"]; ok {
+				c.receipt(id, err)
+			}
+			// 服务端发送 ERROR 之后会关闭连接
+			c.shutdown(err)
+			_ = c.ws.Close()
+			return
+		}
+	}
+}
+
+// readError 在连接是被本地关闭的时候（例如没有按时收到服务端的心跳）返回关闭的原因，而不是 NewConn 返回的 io.EOF
+func (c *Client) readError(err error) error {
+	if err != io.EOF {
+		return err
+	}
+	// 收到关闭帧之后连接还在 CLOSING 状态，等待进入 CLOSED 之后才能拿到关闭的原因
+	<-c.ws.Done()
+	if info := c.ws.CloseReason(); info != nil && info.Initiator == websocket.CloseByLocal && info.Err != nil {
+		return info.Err
+	}
+	return err
+}
+
+// deliver 把 MESSAGE 帧放入对应的订阅，已经取消的订阅的 Message 会被丢弃
+func (c *Client) deliver(f *Frame) {
+	c.lock.Lock()
+	s := c.subscriptions[f.Header["subscription"]]
+	c.lock.Unlock()
+	if s == nil {
+		return
+	}
+	m := &Message{Frame: f, Destination: f.Header["destination"], Subscription: s}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.c <- m:
+	case <-s.done:
+	}
+}
+
+func (c *Client) receipt(id string, err error) {
+	c.lock.Lock()
+	receipt, ok := c.receipts[id]
+	c.lock.Unlock()
+	if ok {
+		select {
+		case receipt <- err:
+		default:
+		}
+	}
+}
+
+// removeSubscription 移除 s 并关闭它的 C，返回 s 是否还在订阅中
+func (c *Client) removeSubscription(s *Subscription) bool {
+	c.lock.Lock()
+	_, ok := c.subscriptions[s.ID]
+	delete(c.subscriptions, s.ID)
+	c.lock.Unlock()
+	s.close()
+	return ok
+}
+
+// close 先唤醒等待中的 deliver，再关闭 C
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		s.closed = true
+		close(s.c)
+		s.lock.Unlock()
+	})
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		c.err = err
+		subscriptions := c.subscriptions
+		c.subscriptions = map[string]*Subscription{}
+		c.lock.Unlock()
+		close(c.done)
+		for _, s := range subscriptions {
+			s.close()
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RommHui/websocket"
+)
+
+// scriptedServer 是测试中的 STOMP 服务端，由测试按照顺序读取客户端的帧并回复
+type scriptedServer struct {
+	t      *testing.T
+	ws     websocket.WebSocket
+	reader *frameReader
+}
+
+// newScriptedClient 通过 net.Pipe 连接 Client 和 scriptedServer，connect 处理客户端的 CONNECT 帧
+func newScriptedClient(t *testing.T, config *Config, connect func(s *scriptedServer, f *Frame)) (*Client, *scriptedServer, error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	ws := websocket.NewWebSocketWithRole(b, b, websocket.RoleServer)
+	s := &scriptedServer{
+		t:      t,
+		ws:     ws,
+		reader: &frameReader{reader: bufio.NewReader(websocket.NewConn(ws)), unescape: true},
+	}
+	go func() {
+		f, err := s.reader.read()
+		if err != nil {
+			return
+		}
+		connect(s, f)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, websocket.NewWebSocketWithRole(a, a, websocket.RoleClient), config)
+	return client, s, err
+}
+
+// expect 读取客户端的下一个帧，并检查它的命令
+func (s *scriptedServer) expect(command string) *Frame {
+	s.t.Helper()
+	f, err := s.reader.read()
+	if err != nil {
+		s.t.Fatalf("reading %s: %v", command, err)
+	}
+	if f.Command != command {
+		s.t.Fatalf("got %s frame, want %s", f.Command, command)
+	}
+	return f
+}
+
+func (s *scriptedServer) send(f *Frame) {
+	s.t.Helper()
+	if err := s.ws.WriteMessage(websocket.TextFrame, f.encode(true)); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+func connected(version string) func(s *scriptedServer, f *Frame) {
+	return func(s *scriptedServer, f *Frame) {
+		_ = s.ws.WriteMessage(websocket.TextFrame, (&Frame{Command: CommandConnected, Header: Header{"version": version, "heart-beat": "0,0"}}).encode(false))
+	}
+}
+
+func TestClientConnectHeaders(t *testing.T) {
+	frames := make(chan *Frame, 1)
+	client, _, err := newScriptedClient(t, &Config{Host: "vhost", Login: "guest", Passcode: "a:b"}, func(s *scriptedServer, f *Frame) {
+		frames <- f
+		connected("1.2")(s, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := <-frames
+	want := Header{"accept-version": "1.0,1.1,1.2", "heart-beat": "0,0", "host": "vhost", "login": "guest", "passcode": "a:b"}
+	for key, value := range want {
+		if f.Header[key] != value {
+			t.Errorf("CONNECT header %s = %q, want %q", key, f.Header[key], value)
+		}
+	}
+	if client.Version() != "1.2" {
+		t.Fatalf("Version() = %q, want 1.2", client.Version())
+	}
+}
+
+func TestClientConnectError(t *testing.T) {
+	_, _, err := newScriptedClient(t, nil, func(s *scriptedServer, f *Frame) {
+		s.send(&Frame{Command: CommandError, Header: Header{"message": "bad login"}, Body: []byte("denied")})
+	})
+	var e *Error
+	if !errors.As(err, &e) || e.Message != "bad login" || string(e.Frame.Body) != "denied" {
+		t.Fatalf("NewClient() error = %v, want the ERROR frame", err)
+	}
+}
+
+func TestClientSubscribeAckAndReceipt(t *testing.T) {
+	client, s, err := newScriptedClient(t, nil, connected("1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed := make(chan *Subscription, 1)
+	go func() {
+		sub, err := client.Subscribe("/queue/a", AckClientIndividual, Header{"prefetch-count": "1"})
+		if err != nil {
+			t.Error(err)
+		}
+		subscribed <- sub
+	}()
+	f := s.expect(CommandSubscribe)
+	if f.Header["destination"] != "/queue/a" || f.Header["ack"] != string(AckClientIndividual) || f.Header["prefetch-count"] != "1" {
+		t.Fatalf("SUBSCRIBE header = %v", f.Header)
+	}
+	sub := <-subscribed
+	if f.Header["id"] != sub.ID {
+		t.Fatalf("SUBSCRIBE id = %q, want %q", f.Header["id"], sub.ID)
+	}
+
+	// 头中的特殊字符按照 1.2 转义
+	s.send(&Frame{Command: CommandMessage, Header: Header{
+		"subscription": sub.ID,
+		"destination":  "/queue/a",
+		"message-id":   "m:1",
+		"ack":          "ack-1",
+	}, Body: []byte("hello")})
+	var m *Message
+	select {
+	case m = <-sub.C:
+	case <-time.After(2 * time.Second):
+		t.Fatal("MESSAGE was not delivered")
+	}
+	if string(m.Body) != "hello" || m.Destination != "/queue/a" || m.Header["message-id"] != "m:1" {
+		t.Fatalf("got message %+v", m.Frame)
+	}
+	acked := make(chan error, 1)
+	go func() {
+		acked <- m.Ack()
+	}()
+	if f = s.expect(CommandAck); f.Header["id"] != "ack-1" {
+		t.Fatalf("ACK header = %v, want id ack-1", f.Header)
+	}
+	if err = <-acked; err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		received <- client.SendWithReceipt(ctx, "/queue/b", "text/plain", []byte("hi"), nil)
+	}()
+	f = s.expect(CommandSend)
+	if f.Header["destination"] != "/queue/b" || f.Header["content-type"] != "text/plain" || string(f.Body) != "hi" {
+		t.Fatalf("got SEND frame %+v", f)
+	}
+	s.send(&Frame{Command: CommandReceipt, Header: Header{"receipt-id": f.Header["receipt"]}})
+	if err = <-received; err != nil {
+		t.Fatalf("SendWithReceipt() error = %v", err)
+	}
+
+	disconnected := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		disconnected <- client.Disconnect(ctx)
+	}()
+	f = s.expect(CommandDisconnect)
+	s.send(&Frame{Command: CommandReceipt, Header: Header{"receipt-id": f.Header["receipt"]}})
+	// 继续读取，让服务端回复客户端的 ConnectionClose
+	go func() {
+		for {
+			if _, err := s.reader.read(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-disconnected:
+		if err != nil {
+			t.Fatalf("Disconnect() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Disconnect() did not return")
+	}
+	if _, ok := <-sub.C; ok {
+		t.Fatal("subscription is still open after Disconnect")
+	}
+}
+
+func TestClientAckVersion10(t *testing.T) {
+	client, s, err := newScriptedClient(t, nil, connected(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Version() != "1.0" {
+		t.Fatalf("Version() = %q, want 1.0", client.Version())
+	}
+	s.reader.unescape = false
+	subscribed := make(chan *Subscription, 1)
+	go func() {
+		sub, _ := client.Subscribe("/queue/a", AckClient, nil)
+		subscribed <- sub
+	}()
+	s.expect(CommandSubscribe)
+	sub := <-subscribed
+	// 1.0 不转义，头的值中可以直接包含冒号
+	if err = s.ws.WriteMessage(websocket.TextFrame, []byte("MESSAGE\nsubscription:"+sub.ID+"\nmessage-id:m:1\n\n\x00")); err != nil {
+		t.Fatal(err)
+	}
+	m := <-sub.C
+	go func() {
+		_ = m.Ack()
+	}()
+	if f := s.expect(CommandAck); f.Header["message-id"] != "m:1" {
+		t.Fatalf("ACK header = %v, want message-id m:1", f.Header)
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	client, s, err := newScriptedClient(t, nil, connected("1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.send(&Frame{Command: CommandError, Header: Header{"message": "queue deleted"}})
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Client is still open after an ERROR frame")
+	}
+	var e *Error
+	if !errors.As(client.Err(), &e) || e.Message != "queue deleted" {
+		t.Fatalf("Err() = %v, want the ERROR frame", client.Err())
+	}
+}
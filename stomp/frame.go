@@ -0,0 +1,184 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 客户端和服务端的帧命令
+const (
+	CommandConnect     = "CONNECT"
+	CommandConnected   = "CONNECTED"
+	CommandSend        = "SEND"
+	CommandSubscribe   = "SUBSCRIBE"
+	CommandUnsubscribe = "UNSUBSCRIBE"
+	CommandAck         = "ACK"
+	CommandNack        = "NACK"
+	CommandDisconnect  = "DISCONNECT"
+	CommandMessage     = "MESSAGE"
+	CommandReceipt     = "RECEIPT"
+	CommandError       = "ERROR"
+)
+
+var (
+	ErrInvalidFrame  = errors.New("invalid STOMP frame")
+	ErrFrameTooLarge = errors.New("STOMP frame is too large")
+)
+
+// Header 是帧的头，重复的 key 只保留第一个，和 STOMP 1.2 的要求一样
+type Header map[string]string
+
+// Frame 是一个 STOMP 帧
+type Frame struct {
+	Command string
+	Header  Header
+	Body    []byte
+}
+
+// encode 编码 f，有 Body 的时候会设置 content-length。
+// STOMP 1.2 中 CONNECT 和 CONNECTED 帧的头不转义，其他帧的头中的 \r、\n、: 和 \ 需要转义；1.0 没有转义。
+func (f *Frame) encode(escape bool) []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(f.Command)
+	buffer.WriteByte('\n')
+	escape = escape && f.Command != CommandConnect
+	for key, value := range f.Header {
+		if key == "content-length" {
+			continue
+		}
+		if escape {
+			key, value = headerEscaper.Replace(key), headerEscaper.Replace(value)
+		}
+		buffer.WriteString(key)
+		buffer.WriteByte(':')
+		buffer.WriteString(value)
+		buffer.WriteByte('\n')
+	}
+	if len(f.Body) > 0 {
+		buffer.WriteString("content-length:")
+		buffer.WriteString(strconv.Itoa(len(f.Body)))
+		buffer.WriteByte('\n')
+	}
+	buffer.WriteByte('\n')
+	buffer.Write(f.Body)
+	buffer.WriteByte(0)
+	return buffer.Bytes()
+}
+
+var (
+	headerEscaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	headerUnescaper = strings.NewReplacer("\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":")
+)
+
+// frameReader 从字节流中读取帧，帧可以被分成多个 WebSocket Message，帧之间的换行是心跳，会被跳过
+type frameReader struct {
+	reader *bufio.Reader
+	// maxSize 是 Body 的最大长度，也是命令和所有头加起来的最大长度，0 表示不限制
+	maxSize int
+	// unescape 表示是否需要还原头中的转义，协商出 1.0 之后为 false
+	unescape bool
+}
+
+func (r *frameReader) read() (*Frame, error) {
+	command, err := r.line()
+	for err == nil && len(command) < 1 {
+		// 心跳
+		command, err = r.line()
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := &Frame{Command: command, Header: Header{}}
+	unescape := r.unescape && command != CommandConnected
+	headerSize := len(command)
+	for {
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 1 {
+			break
+		}
+		if headerSize += len(line); r.maxSize > 0 && headerSize > r.maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, ErrInvalidFrame
+		}
+		if unescape {
+			key, value = headerUnescaper.Replace(key), headerUnescaper.Replace(value)
+		}
+		if _, ok := f.Header[key]; !ok {
+			f.Header[key] = value
+		}
+	}
+
+	if length, ok := f.Header["content-length"]; ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return nil, ErrInvalidFrame
+		}
+		if r.maxSize > 0 && n > r.maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		f.Body = make([]byte, n+1)
+		if _, err = io.ReadFull(r.reader, f.Body); err != nil {
+			return nil, err
+		}
+		if f.Body[n] != 0 {
+			return nil, ErrInvalidFrame
+		}
+		f.Body = f.Body[:n]
+		return f, nil
+	}
+	body, err := r.reader.ReadSlice(0)
+	if err == bufio.ErrBufferFull {
+		// 没有 content-length 的大帧，需要继续读取到 NUL
+		buffer := append([]byte(nil), body...)
+		for err == bufio.ErrBufferFull {
+			if r.maxSize > 0 && len(buffer) > r.maxSize {
+				return nil, ErrFrameTooLarge
+			}
+			body, err = r.reader.ReadSlice(0)
+			buffer = append(buffer, body...)
+		}
+		body = buffer
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.maxSize > 0 && len(body)-1 > r.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+	f.Body = append([]byte(nil), body[:len(body)-1]...)
+	return f, nil
+}
+
+// line 读取一行，去掉结尾的 \n 或者 \r\n，一行的长度超过 maxSize 的时候返回 ErrFrameTooLarge，
+// 这样对方不能用一个没有换行的命令或者头占用无限的内存
+func (r *frameReader) line() (string, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		buffer := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			if r.maxSize > 0 && len(buffer) > r.maxSize {
+				return "", ErrFrameTooLarge
+			}
+			line, err = r.reader.ReadSlice('\n')
+			buffer = append(buffer, line...)
+		}
+		line = buffer
+	}
+	if err != nil {
+		return "", err
+	}
+	if r.maxSize > 0 && len(line)-1 > r.maxSize {
+		return "", ErrFrameTooLarge
+	}
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
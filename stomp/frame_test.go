@@ -0,0 +1,217 @@
+package stomp
+
+import (
+	"bufio"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFrameReader(data string, bufferSize, maxSize int, unescape bool) *frameReader {
+	return &frameReader{
+		reader:   bufio.NewReaderSize(strings.NewReader(data), bufferSize),
+		maxSize:  maxSize,
+		unescape: unescape,
+	}
+}
+
+func TestFrameEncodeEscaping(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  *Frame
+		escape bool
+		want   string
+	}{
+		{
+			name:   "1.2 escapes headers",
+			frame:  &Frame{Command: CommandSend, Header: Header{"a:b": "line\r\nx\\y"}},
+			escape: true,
+			want:   "SEND\na\\cb:line\\r\\nx\\\\y\n\n\x00",
+		},
+		{
+			name:   "1.0 does not escape",
+			frame:  &Frame{Command: CommandSend, Header: Header{"destination": "/queue/a:b"}},
+			escape: false,
+			want:   "SEND\ndestination:/queue/a:b\n\n\x00",
+		},
+		{
+			name:   "CONNECT is never escaped",
+			frame:  &Frame{Command: CommandConnect, Header: Header{"passcode": "a:b"}},
+			escape: true,
+			want:   "CONNECT\npasscode:a:b\n\n\x00",
+		},
+		{
+			name:   "body sets content-length",
+			frame:  &Frame{Command: CommandSend, Header: Header{"content-length": "99"}, Body: []byte("a\x00b")},
+			escape: true,
+			want:   "SEND\ncontent-length:3\n\na\x00b\x00",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(test.frame.encode(test.escape)); got != test.want {
+				t.Fatalf("encode() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		{Command: CommandMessage, Header: Header{"destination": "/queue/a", "weird:key": "multi\nline\\value"}, Body: []byte("hello")},
+		{Command: CommandMessage, Header: Header{"destination": "/queue/a"}, Body: []byte("binary\x00body")},
+		{Command: CommandReceipt, Header: Header{"receipt-id": "1"}},
+	}
+	for _, f := range frames {
+		r := newFrameReader(string(f.encode(true)), 4096, 0, true)
+		got, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Frame{Command: f.Command, Header: Header{}, Body: f.Body}
+		for key, value := range f.Header {
+			want.Header[key] = value
+		}
+		if len(f.Body) > 0 {
+			want.Header["content-length"] = strconv.Itoa(len(f.Body))
+		}
+		if got.Command != want.Command || !reflect.DeepEqual(got.Header, want.Header) || string(got.Body) != string(want.Body) {
+			t.Fatalf("read() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFrameRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		unescape bool
+		want     []*Frame
+	}{
+		{
+			name: "NUL terminated",
+			data: "MESSAGE\ndestination:/a\n\nhello\x00",
+			want: []*Frame{{Command: CommandMessage, Header: Header{"destination": "/a"}, Body: []byte("hello")}},
+		},
+		{
+			name: "content-length with NUL in body",
+			data: "MESSAGE\ncontent-length:5\n\nhe\x00lo\x00",
+			want: []*Frame{{Command: CommandMessage, Header: Header{"content-length": "5"}, Body: []byte("he\x00lo")}},
+		},
+		{
+			name: "heart-beats and CRLF",
+			data: "\n\r\n\nRECEIPT\r\nreceipt-id:1\r\n\r\n\x00\n\nRECEIPT\nreceipt-id:2\n\n\x00",
+			want: []*Frame{
+				{Command: CommandReceipt, Header: Header{"receipt-id": "1"}},
+				{Command: CommandReceipt, Header: Header{"receipt-id": "2"}},
+			},
+		},
+		{
+			name: "duplicate headers keep the first",
+			data: "MESSAGE\nfoo:1\nfoo:2\n\n\x00",
+			want: []*Frame{{Command: CommandMessage, Header: Header{"foo": "1"}}},
+		},
+		{
+			name:     "1.2 unescapes headers",
+			data:     "MESSAGE\na\\cb:x\\ny\\\\z\n\n\x00",
+			unescape: true,
+			want:     []*Frame{{Command: CommandMessage, Header: Header{"a:b": "x\ny\\z"}}},
+		},
+		{
+			name: "1.0 keeps escapes and colons",
+			data: "MESSAGE\na\\cb:x:y\n\n\x00",
+			want: []*Frame{{Command: CommandMessage, Header: Header{"a\\cb": "x:y"}}},
+		},
+		{
+			name:     "CONNECTED is never unescaped",
+			data:     "CONNECTED\nserver:a\\cb\n\n\x00",
+			unescape: true,
+			want:     []*Frame{{Command: CommandConnected, Header: Header{"server": "a\\cb"}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newFrameReader(test.data, 4096, 0, test.unescape)
+			for _, want := range test.want {
+				got, err := r.read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("read() = %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameReadErrors(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	tests := []struct {
+		name    string
+		data    string
+		maxSize int
+		err     error
+	}{
+		{name: "header without colon", data: "MESSAGE\nfoo\n\n\x00", err: ErrInvalidFrame},
+		{name: "bad content-length", data: "MESSAGE\ncontent-length:x\n\n\x00", err: ErrInvalidFrame},
+		{name: "negative content-length", data: "MESSAGE\ncontent-length:-1\n\n\x00", err: ErrInvalidFrame},
+		{name: "content-length not followed by NUL", data: "MESSAGE\ncontent-length:2\n\nabc\x00", err: ErrInvalidFrame},
+		{name: "content-length too large", data: "MESSAGE\ncontent-length:65\n\n", maxSize: 64, err: ErrFrameTooLarge},
+		{name: "NUL terminated body too large", data: "MESSAGE\n\n" + long + "\x00", maxSize: 64, err: ErrFrameTooLarge},
+		{name: "command too long", data: long + "\n\n\x00", maxSize: 64, err: ErrFrameTooLarge},
+		{name: "command without newline", data: long + long, maxSize: 64, err: ErrFrameTooLarge},
+		{name: "header line too long", data: "MESSAGE\nfoo:" + long + "\n\n\x00", maxSize: 64, err: ErrFrameTooLarge},
+		{name: "headers too large", data: "MESSAGE\n" + strings.Repeat("foo:0123456789\n", 10) + "\n\x00", maxSize: 64, err: ErrFrameTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 缓冲区比最大长度小，检查需要多次读取的行和 Body
+			r := newFrameReader(test.data, 16, test.maxSize, false)
+			if _, err := r.read(); err != test.err {
+				t.Fatalf("read() error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestFrameReadLongLineWithinLimit(t *testing.T) {
+	value := strings.Repeat("v", 50)
+	r := newFrameReader("MESSAGE\nfoo:"+value+"\n\nbody\x00", 16, 64, false)
+	f, err := r.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header["foo"] != value || string(f.Body) != "body" {
+		t.Fatalf("read() = %+v", f)
+	}
+}
+
+func TestHeartBeatNegotiation(t *testing.T) {
+	tests := []struct {
+		name          string
+		send, receive time.Duration
+		server        string
+		wantSend      time.Duration
+		wantReceive   time.Duration
+	}{
+		{name: "disabled locally", server: "1000,1000"},
+		{name: "disabled by server", send: time.Second, receive: time.Second, server: "0,0"},
+		{name: "no header", send: time.Second, receive: time.Second, server: ""},
+		{name: "invalid header", send: time.Second, receive: time.Second, server: "a,b"},
+		{name: "larger interval wins", send: time.Second, receive: 2 * time.Second, server: "500, 3000", wantSend: 3 * time.Second, wantReceive: 2 * time.Second},
+		{name: "local interval wins", send: 5 * time.Second, receive: 5 * time.Second, server: "1000,1000", wantSend: 5 * time.Second, wantReceive: 5 * time.Second},
+		{name: "one direction", send: time.Second, server: "1000,1000", wantSend: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Client{config: Config{SendHeartBeat: test.send, ReceiveHeartBeat: test.receive}}
+			send, receive := c.heartBeats(test.server)
+			if send != test.wantSend || receive != test.wantReceive {
+				t.Fatalf("heartBeats(%q) = %v, %v, want %v, %v", test.server, send, receive, test.wantSend, test.wantReceive)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"io"
+)
+
+// MessageWriter 把一个 Message 作为 io.WriteCloser 使用，适合 gzip、tar、protobuf delimited 这类边编码边输出的流式编码。
+// 和 NextWriter 每次 Write 发送一个分片不同，MessageWriter 会把数据缓冲到 fragmentSize 再发送，
+// 流式编码的大量小 Write 不会变成大量的小分片；Flush 可以在任何位置主动结束当前分片，Close 把剩下的数据作为最后一个分片发送。
+// 在 Close 之前，其他的 SendMessage 和 NextWriter 会等待这个 Message 发送完成。
+//
+// 使用例子：
+//
+//	mw, err := websocket.NewMessageWriter(ws, websocket.BinaryFrame, 32*1024)
+//	gz := gzip.NewWriter(mw)
+//	_, err = io.Copy(gz, file)
+//	err = gz.Close()
+//	err = mw.Close()
+type MessageWriter struct {
+	writer io.WriteCloser
+	buffer []byte
+	err    error
+}
+
+// NewMessageWriter 开始发送一个 opCode 类型的 Message，fragmentSize 是每个分片的最大长度，小于 1 时使用 DefaultFragmentSize。
+// 控制帧不能分片，opCode 是控制帧的时候返回 ErrFragmentedControlFrame。
+func NewMessageWriter(ws WebSocket, opCode OpCode, fragmentSize int) (*MessageWriter, error) {
+	if opCode.IsControl() {
+		return nil, ErrFragmentedControlFrame
+	}
+	if fragmentSize < 1 {
+		fragmentSize = DefaultFragmentSize
+	}
+	writer, err := ws.NextWriter(opCode)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageWriter{
+		writer: writer,
+		buffer: make([]byte, 0, fragmentSize),
+	}, nil
+}
+
+// Write 缓冲 p，缓冲区满了之后发送一个分片
+func (mw *MessageWriter) Write(p []byte) (int, error) {
+	if mw.err != nil {
+		return 0, mw.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(mw.buffer[len(mw.buffer):cap(mw.buffer)], p)
+		mw.buffer = mw.buffer[:len(mw.buffer)+n]
+		written += n
+		p = p[n:]
+		if len(mw.buffer) == cap(mw.buffer) {
+			if err := mw.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush 把缓冲的数据作为一个分片发送，缓冲区为空的时候不发送
+func (mw *MessageWriter) Flush() error {
+	if mw.err != nil {
+		return mw.err
+	}
+	if len(mw.buffer) < 1 {
+		return nil
+	}
+	_, mw.err = mw.writer.Write(mw.buffer)
+	mw.buffer = mw.buffer[:0]
+	return mw.err
+}
+
+// Buffered 返回还没有发送的数据长度
+func (mw *MessageWriter) Buffered() int {
+	return len(mw.buffer)
+}
+
+// Close 把缓冲的数据作为最后一个分片发送，结束这个 Message，之后的 Write 返回 ErrWriterClosed
+func (mw *MessageWriter) Close() error {
+	if mw.err == ErrWriterClosed {
+		return mw.err
+	}
+	var err error
+	if w, ok := mw.writer.(*messageWriter); ok && mw.err == nil {
+		err = w.closeWith(mw.buffer)
+	} else {
+		flushErr := mw.Flush()
+		err = mw.writer.Close()
+		if flushErr != nil {
+			err = flushErr
+		}
+	}
+	mw.buffer = nil
+	mw.err = ErrWriterClosed
+	return err
+}
+
+// MessageReader 把收到的一个 Message 作为 io.ReadCloser 使用，Close 会丢弃没有读取的内容，之后可以读取下一个 Message。
+// 流式解码（例如 gzip.NewReader）通常不会把 Message 读到 io.EOF，使用 Close 可以结束这个 Message。
+//
+// 使用例子：
+//
+//	mr, err := websocket.NextMessageReader(ws)
+//	gz, err := gzip.NewReader(mr)
+//	_, err = io.Copy(file, gz)
+//	err = mr.Close()
+type MessageReader struct {
+	OpCode OpCode
+	reader io.Reader
+	closed bool
+}
+
+// NextMessageReader 读取 ws 的下一个 Message，调用方式和 NextReader 一样
+func NextMessageReader(ws WebSocket) (*MessageReader, error) {
+	opCode, reader, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	return &MessageReader{OpCode: opCode, reader: reader}, nil
+}
+
+func (mr *MessageReader) Read(p []byte) (int, error) {
+	if mr.closed {
+		return 0, io.EOF
+	}
+	return mr.reader.Read(p)
+}
+
+// Close 丢弃这个 Message 剩下的内容，可以重复调用
+func (mr *MessageReader) Close() error {
+	if mr.closed {
+		return nil
+	}
+	mr.closed = true
+	_, err := io.Copy(io.Discard, mr.reader)
+	return err
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if _, err := NewMessageWriter(ws, Ping, 0); err != ErrFragmentedControlFrame {
+		t.Fatalf("NewMessageWriter(Ping) error = %v, want %v", err, ErrFragmentedControlFrame)
+	}
+	mw, err := NewMessageWriter(ws, TextFrame, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 小的 Write 被缓冲，Flush 主动结束当前分片
+	_, _ = mw.Write([]byte("a"))
+	if mw.Buffered() != 1 || output.Len() != 0 {
+		t.Fatalf("Buffered() = %d with %d bytes sent, want 1 buffered byte", mw.Buffered(), output.Len())
+	}
+	if err = mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 缓冲区满了之后发送一个分片
+	for _, data := range []string{"bc", "defgh"} {
+		if n, err := mw.Write([]byte(data)); n != len(data) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", data, n, err)
+		}
+	}
+	if mw.Buffered() != 3 {
+		t.Fatalf("Buffered() = %d, want 3", mw.Buffered())
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 剩下的数据作为最后一个分片发送，不会再发送一个空的分片
+	want := []sentFrame{
+		{OpCode: TextFrame, Payload: []byte("a")},
+		{OpCode: ContinuationFrame, Payload: []byte("bcde")},
+		{OpCode: ContinuationFrame, Fin: true, Payload: []byte("fgh")},
+	}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+	if _, err = mw.Write([]byte("late")); err != ErrWriterClosed {
+		t.Fatalf("Write() after Close error = %v, want %v", err, ErrWriterClosed)
+	}
+	if err = mw.Close(); err != ErrWriterClosed {
+		t.Fatalf("Close() again error = %v, want %v", err, ErrWriterClosed)
+	}
+
+	// Close 之后可以发送下一个 Message
+	output.Reset()
+	if err = ws.Send("next"); err != nil {
+		t.Fatal(err)
+	}
+	want = []sentFrame{{OpCode: TextFrame, Fin: true, Payload: []byte("next")}}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+}
+
+func TestMessageWriterEmpty(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	mw, err := NewMessageWriter(ws, BinaryFrame, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []sentFrame{{OpCode: BinaryFrame, Fin: true, Payload: []byte{}}}
+	if frames := decodeFrames(t, output.Bytes()); !reflect.DeepEqual(frames, want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+}
+
+func TestMessageReader(t *testing.T) {
+	input := bytes.Join([][]byte{
+		rawFrame(false, BinaryFrame, 5, []byte("hello")),
+		rawFrame(true, ContinuationFrame, 6, []byte(" world")),
+		rawFrame(true, TextFrame, 4, []byte("next")),
+	}, nil)
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	mr, err := NextMessageReader(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if n, err := io.ReadFull(mr, buf); n != 5 || err != nil || mr.OpCode != BinaryFrame || string(buf) != "hello" {
+		t.Fatalf("Read() = %s %q %v, want BINARY hello", mr.OpCode, buf[:n], err)
+	}
+	// Close 丢弃剩下的内容，之后 Read 返回 io.EOF
+	if err = mr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := mr.Read(buf); n != 0 || err != io.EOF {
+		t.Fatalf("Read() after Close = %d, %v, want io.EOF", n, err)
+	}
+	if err = mr.Close(); err != nil {
+		t.Fatalf("Close() again error = %v", err)
+	}
+
+	mr, err = NextMessageReader(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	if data, err := io.ReadAll(mr); err != nil || mr.OpCode != TextFrame || string(data) != "next" {
+		t.Fatalf("ReadAll() = %s %q %v, want TEXT next", mr.OpCode, data, err)
+	}
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Timeouts 是一个连接使用的超时配置，为 0 的字段表示不限制
+type Timeouts struct {
+	// Handshake 是完成握手的最长时间
+	Handshake time.Duration
+
+	// ReadIdle 是等待并读取下一个帧头的最长时间，超时之后连接会被关闭
+	ReadIdle time.Duration
+
+	// Write 是写入一个帧的最长时间
+	Write time.Duration
+
+	// Close 是写入 ConnectionClose 帧的最长时间
+	Close time.Duration
+
+	// PingInterval 是自动发送 Ping 的间隔
+	PingInterval time.Duration
+
+	// PongWait 是发送 Ping 之后等待对方回复的最长时间。
+	// 如果发送 Ping 之后超过 PongWait 都没有收到对方的任何帧，连接会使用 CloseGoingAway 关闭。
+	// 需要空闲超时或者自定义关闭状态码的时候可以使用 SetKeepalive。
+	// 收到的帧只有在调用 ReadMessage 或者开启 BackgroundRead 之后才会被处理，长时间不读取的应用需要开启 BackgroundRead。
+	PongWait time.Duration
+}
+
+// DefaultTimeouts 是 Dialer 和 Upgrader 没有设置 Timeouts 时使用的超时配置。
+// 它只限制握手和发送 ConnectionClose 的时间，数据帧的写入默认不限制时间，对方读取得慢的时候 Send 会一直等待；
+// 需要限制的时候设置 Timeouts 的 Write。
+var DefaultTimeouts = Timeouts{
+	Handshake: 10 * time.Second,
+	Close:     5 * time.Second,
+}
+
+var ErrPongTimeout = errors.New("no frame received from the peer within the pong wait")
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// setReadDeadline 在流支持的时候设置读取的 deadline
+func setReadDeadline(stream any, t time.Time) error {
+	if d, ok := stream.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// setWriteDeadline 在流支持的时候设置写入的 deadline
+func setWriteDeadline(stream any, t time.Time) error {
+	if d, ok := stream.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+var ErrDeadlineNotSupported = errors.New("stream does not support deadlines")
+
+// SetReadDeadline 设置读取的截止时间，零值表示不限制。超时之后读取会返回错误，并且连接会被关闭。
+// 设置了 Timeouts 的 ReadIdle 的时候，使用两者中更早的时间。
+func (w *webSocket) SetReadDeadline(t time.Time) error {
+	if _, ok := w.reader.(readDeadliner); !ok {
+		return ErrDeadlineNotSupported
+	}
+	w.readDeadline.Store(deadlineNano(t))
+	return setReadDeadline(w.reader, t)
+}
+
+// SetWriteDeadline 设置写入的截止时间，零值表示不限制。超时之后写入会返回错误，并且连接会被关闭。
+// 设置了 Timeouts 的 Write 的时候，使用两者中更早的时间。
+func (w *webSocket) SetWriteDeadline(t time.Time) error {
+	if _, ok := w.writer.(writeDeadliner); !ok {
+		return ErrDeadlineNotSupported
+	}
+	w.writeDeadline.Store(deadlineNano(t))
+	return setWriteDeadline(w.writer, t)
+}
+
+// NetConn 返回底层的 net.Conn，使用 NewWebSocket 传入的流不是 net.Conn 的时候返回 nil
+func (w *webSocket) NetConn() net.Conn {
+	conn, _ := w.writer.(net.Conn)
+	return conn
+}
+
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// earlierDeadline 返回 nano 表示的截止时间和 t 中更早的一个，零值表示不限制
+func earlierDeadline(nano int64, t time.Time) time.Time {
+	if nano == 0 {
+		return t
+	}
+	deadline := time.Unix(0, nano)
+	if t.IsZero() || deadline.Before(t) {
+		return deadline
+	}
+	return t
+}
+
+// SetTimeouts 设置连接的超时配置，Handshake 在握手之后不会再使用。
+// 设置了 PingInterval 并且没有调用过 SetKeepalive 的时候，会启动一个后台 goroutine 定时发送 Ping，连接关闭之后自动退出。
+func (w *webSocket) SetTimeouts(timeouts Timeouts) {
+	w.timeouts.Store(&timeouts)
+	w.startKeepalive(w.getKeepalive())
+}
+
+func (w *webSocket) getTimeouts() Timeouts {
+	if timeouts := w.timeouts.Load(); timeouts != nil {
+		return *timeouts
+	}
+	return Timeouts{}
+}
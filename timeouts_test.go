@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEarlierDeadline(t *testing.T) {
+	early := time.Unix(100, 0)
+	late := time.Unix(200, 0)
+	tests := []struct {
+		name string
+		nano int64
+		t    time.Time
+		want time.Time
+	}{
+		{name: "no limit", want: time.Time{}},
+		{name: "only nano", nano: early.UnixNano(), want: early},
+		{name: "only time", t: late, want: late},
+		{name: "nano earlier", nano: early.UnixNano(), t: late, want: early},
+		{name: "time earlier", nano: late.UnixNano(), t: early, want: early},
+	}
+	for _, test := range tests {
+		if got := earlierDeadline(test.nano, test.t); !got.Equal(test.want) {
+			t.Fatalf("%s: earlierDeadline() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDeadlinesNotSupported(t *testing.T) {
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.SetReadDeadline(time.Now()); err != ErrDeadlineNotSupported {
+		t.Fatalf("SetReadDeadline() error = %v, want %v", err, ErrDeadlineNotSupported)
+	}
+	if err := ws.SetWriteDeadline(time.Now()); err != ErrDeadlineNotSupported {
+		t.Fatalf("SetWriteDeadline() error = %v, want %v", err, ErrDeadlineNotSupported)
+	}
+	if conn := ws.NetConn(); conn != nil {
+		t.Fatalf("NetConn() = %v, want nil", conn)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if conn := NewWebSocket(a, a, false).NetConn(); conn != a {
+		t.Fatalf("NetConn() = %v, want the net.Conn passed to NewWebSocket", conn)
+	}
+}
+
+func TestSetReadDeadline(t *testing.T) {
+	for _, timeouts := range []Timeouts{{}, {ReadIdle: time.Minute}} {
+		a, b := net.Pipe()
+		ws := NewWebSocket(a, a, false)
+		// 设置了 ReadIdle 的时候使用更早的截止时间
+		ws.SetTimeouts(timeouts)
+		if err := ws.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := ws.ReadMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("ReadMessage() error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("ReadMessage() returned after %v", elapsed)
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}
+}
+
+func TestSetWriteDeadline(t *testing.T) {
+	for _, timeouts := range []Timeouts{{}, {Write: time.Minute}} {
+		a, b := net.Pipe()
+		ws := NewWebSocket(a, a, false)
+		ws.SetTimeouts(timeouts)
+		if err := ws.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		// 对方不读取数据，写入在截止时间之后失败
+		start := time.Now()
+		if err := ws.Send("hello"); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Send() error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("Send() returned after %v", elapsed)
+		}
+		_ = a.Close()
+		_ = b.Close()
+	}
+}
+
+func TestTimeoutsPlumbing(t *testing.T) {
+	custom := Timeouts{Handshake: time.Minute, ReadIdle: time.Minute, Write: 2 * time.Second, Close: time.Second}
+	overridden := custom
+	overridden.Handshake = time.Second
+	tests := []struct {
+		name     string
+		dialer   *Dialer
+		upgrader *Upgrader
+		want     Timeouts
+	}{
+		{name: "default", dialer: &Dialer{}, upgrader: &Upgrader{}, want: DefaultTimeouts},
+		{name: "custom", dialer: &Dialer{Timeouts: &custom}, upgrader: &Upgrader{Timeouts: &custom}, want: custom},
+		// HandshakeTimeout 覆盖 Timeouts 中的 Handshake，其他字段不变
+		{
+			name:     "handshake timeout",
+			dialer:   &Dialer{Timeouts: &custom, HandshakeTimeout: time.Second},
+			upgrader: &Upgrader{Timeouts: &custom, HandshakeTimeout: time.Second},
+			want:     overridden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			accepted := make(chan WebSocket, 1)
+			go func() {
+				ws, err := test.upgrader.UpgradeStream(a, a)
+				if err != nil {
+					accepted <- nil
+					return
+				}
+				accepted <- ws
+			}()
+			test.dialer.NetDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				return b, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client, err := test.dialer.Dial(ctx, "ws://example.com/ws")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := <-accepted
+			if server == nil {
+				t.Fatal("UpgradeStream() failed")
+			}
+			if got := client.(*webSocket).getTimeouts(); got != test.want {
+				t.Fatalf("client timeouts = %+v, want %+v", got, test.want)
+			}
+			if got := server.(*webSocket).getTimeouts(); got != test.want {
+				t.Fatalf("server timeouts = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutsWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	ws.SetTimeouts(Timeouts{Write: 50 * time.Millisecond})
+	// 对方不读取数据，写入在 Write 之后失败
+	start := time.Now()
+	if err := ws.Send("hello"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Send() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Send() returned after %v", elapsed)
+	}
+}
+
+func TestDefaultTimeouts(t *testing.T) {
+	// 默认只限制握手和 ConnectionClose，写入数据帧不限制时间
+	if DefaultTimeouts.Write != 0 || DefaultTimeouts.Handshake <= 0 || DefaultTimeouts.Close <= 0 {
+		t.Fatalf("DefaultTimeouts = %+v, want only Handshake and Close", DefaultTimeouts)
+	}
+}
+
+func TestTimeoutsClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ws := NewWebSocket(a, a, false)
+	ws.SetTimeouts(Timeouts{Close: 50 * time.Millisecond})
+	// 对方不读取数据，ConnectionClose 在 Close 之后放弃发送，流仍然会被关闭
+	start := time.Now()
+	_ = ws.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Close() returned after %v", elapsed)
+	}
+	if ws.Status() != CLOSED {
+		t.Fatalf("Status() = %d, want %d", ws.Status(), CLOSED)
+	}
+}
@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testTLSConfigs 返回使用 httptest 证书的服务端 TLS 配置，和信任这个证书的客户端 TLS 配置
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return &tls.Config{Certificates: server.TLS.Certificates}, &tls.Config{RootCAs: pool, ServerName: "example.com"}
+}
+
+// tlsDialerWith 返回使用 config 完成 TLS 握手的 dialer，dial 提供底层的连接
+func tlsDialerWith(config *tls.Config, dial func() (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		rawConn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(rawConn, config)
+		if err = conn.HandshakeContext(ctx); err != nil {
+			_ = rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func TestServerPairTLS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		ws, err := ServerPairTLS(a, a, serverConfig)
+		if err != nil {
+			return
+		}
+		_ = ws.Send("hello")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequest(http.MethodGet, "wss://example.com/ws", nil)
+	ws, err := ConnectWithDialer(ctx, tlsDialerWith(clientConfig, func() (net.Conn, error) {
+		return b, nil
+	}), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(message); err != nil || string(data) != "hello" {
+		t.Fatalf("ReadMessage() = %q, %v, want hello", data, err)
+	}
+}
+
+func TestServerPairTLSRejectsPlainText(t *testing.T) {
+	serverConfig, _ := testTLSConfigs(t)
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		_, _ = b.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		_, _ = io.Copy(io.Discard, b)
+	}()
+	if ws, err := ServerPairTLS(a, a, serverConfig); err == nil {
+		t.Fatalf("ServerPairTLS() = %v for a plain text request, want an error", ws)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := &Server{
+		TLSConfig: serverConfig,
+		Handler: func(ws WebSocket) {
+			_ = ws.Send("hello")
+		},
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequest(http.MethodGet, "wss://example.com/ws", nil)
+	ws, err := ConnectWithDialer(ctx, tlsDialerWith(clientConfig, func() (net.Conn, error) {
+		return net.Dial("tcp", listener.Addr().String())
+	}), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(message); err != nil || string(data) != "hello" {
+		t.Fatalf("ReadMessage() = %q, %v, want hello", data, err)
+	}
+}
+
+func TestDialerTLSConfig(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	serverNames := make(chan string, 8)
+	serverConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = (&Server{TLSConfig: serverConfig, Handler: func(ws WebSocket) {
+			_ = ws.Send("hello")
+		}}).Serve(listener)
+	}()
+	// 所有的地址都连接到 listener，URL 中的主机名只用于 TLS 的 ServerName
+	netDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, listener.Addr().String())
+	}
+	rootsOnly := &tls.Config{RootCAs: clientConfig.RootCAs}
+	tests := []struct {
+		name       string
+		config     *tls.Config
+		url        string
+		serverName string
+		ok         bool
+	}{
+		{name: "server name", config: clientConfig, url: "wss://other.test/ws", serverName: "example.com", ok: true},
+		// 没有设置 ServerName 的时候使用 URL 中的主机名
+		{name: "host from url", config: rootsOnly, url: "wss://example.com:8443/ws", serverName: "example.com", ok: true},
+		{name: "host mismatch", config: rootsOnly, url: "wss://other.test/ws", serverName: "other.test"},
+		{name: "default roots", url: "wss://example.com/ws", serverName: "example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			dialer := &Dialer{NetDialContext: netDial, TLSConfig: test.config}
+			ws, err := dialer.Dial(ctx, test.url)
+			if test.ok != (err == nil) {
+				t.Fatalf("Dial() error = %v, want success %v", err, test.ok)
+			}
+			if serverName := <-serverNames; serverName != test.serverName {
+				t.Fatalf("server name = %q, want %q", serverName, test.serverName)
+			}
+			if ws == nil {
+				return
+			}
+			defer ws.Close()
+			message, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := io.ReadAll(message); err != nil || string(data) != "hello" {
+				t.Fatalf("ReadMessage() = %q, %v, want hello", data, err)
+			}
+		})
+	}
+	// TLSConfig 会被复制，连接时不会修改调用者的配置
+	if len(rootsOnly.ServerName) > 0 {
+		t.Fatalf("TLSConfig.ServerName was changed to %q", rootsOnly.ServerName)
+	}
+}
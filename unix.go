@@ -0,0 +1,65 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrInvalidUnixURL = errors.New("ws+unix URL must contain a socket path")
+
+// unixSchemes 是连接 Unix socket 的 scheme 对应的握手请求的 scheme
+var unixSchemes = map[string]string{
+	"ws+unix":  "ws",
+	"wss+unix": "wss",
+}
+
+// target 返回连接 request 使用的 network 和地址，override 表示地址不是 URL 中的主机和端口，这时不会使用代理。
+//
+// ws+unix:///path/to.sock:/ws 形式的 URL（wss+unix 会在 Unix socket 上完成 TLS 握手）会被改写成 ws://localhost/ws，
+// 连接 Unix socket /path/to.sock，第一个冒号之后是请求的路径，没有的时候是 /；ws+unix:relative.sock:/ws 使用相对路径。
+// Dialer.Address 不为空时代替 URL 中的地址。
+func (d *Dialer) target(request *http.Request) (network, address string, override bool, err error) {
+	network = "tcp"
+	if scheme, ok := unixSchemes[request.URL.Scheme]; ok {
+		path := request.URL.Path
+		if len(request.URL.Opaque) > 0 {
+			path = request.URL.Opaque
+		}
+		socket, requestPath, found := strings.Cut(path, ":")
+		if !found || len(requestPath) < 1 {
+			requestPath = "/"
+		}
+		if len(socket) < 1 {
+			return "", "", false, ErrInvalidUnixURL
+		}
+		target := *request.URL
+		target.Scheme = scheme
+		target.Opaque = ""
+		target.Host = "localhost"
+		target.Path = requestPath
+		target.RawPath = ""
+		request.URL = &target
+		request.Host = target.Host
+		network, address, override = "unix", socket, true
+	} else {
+		if len(request.RemoteAddr) < 1 {
+			request.RemoteAddr = request.Host
+			if len(request.URL.Port()) < 1 {
+				if isSecureScheme(request.URL.Scheme) {
+					request.RemoteAddr += ":443"
+				} else {
+					request.RemoteAddr += ":80"
+				}
+			}
+		}
+		address = request.RemoteAddr
+	}
+	if len(d.Network) > 0 {
+		network = d.Network
+	}
+	if len(d.Address) > 0 {
+		address, override = d.Address, true
+	}
+	return network, address, override, nil
+}
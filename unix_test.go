@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDialerTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialer   Dialer
+		url      string
+		network  string
+		address  string
+		override bool
+		request  string
+	}{
+		{name: "tcp", url: "ws://example.com/chat", network: "tcp", address: "example.com:80", request: "ws://example.com/chat"},
+		{name: "tcp tls", url: "wss://example.com/chat", network: "tcp", address: "example.com:443", request: "wss://example.com/chat"},
+		{name: "tcp port", url: "ws://example.com:8080/chat", network: "tcp", address: "example.com:8080", request: "ws://example.com:8080/chat"},
+		{name: "unix", url: "ws+unix:///run/ws.sock:/chat?room=1", network: "unix", address: "/run/ws.sock", override: true, request: "ws://localhost/chat?room=1"},
+		{name: "unix tls", url: "wss+unix:///run/ws.sock:/chat", network: "unix", address: "/run/ws.sock", override: true, request: "wss://localhost/chat"},
+		{name: "unix without path", url: "ws+unix:///run/ws.sock", network: "unix", address: "/run/ws.sock", override: true, request: "ws://localhost/"},
+		{name: "unix relative", url: "ws+unix:ws.sock:/chat", network: "unix", address: "ws.sock", override: true, request: "ws://localhost/chat"},
+		{name: "address", dialer: Dialer{Network: "unix", Address: "/run/ws.sock"}, url: "ws://example.com/chat", network: "unix", address: "/run/ws.sock", override: true, request: "ws://example.com/chat"},
+		{name: "address tcp", dialer: Dialer{Address: "127.0.0.1:9000"}, url: "wss://example.com/chat", network: "tcp", address: "127.0.0.1:9000", override: true, request: "wss://example.com/chat"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			network, address, override, err := test.dialer.target(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network != test.network || address != test.address || override != test.override {
+				t.Fatalf("target() = %s, %s, %v, want %s, %s, %v", network, address, override, test.network, test.address, test.override)
+			}
+			if request.URL.String() != test.request || request.Host != request.URL.Host {
+				t.Fatalf("request URL = %s with Host %s, want %s", request.URL, request.Host, test.request)
+			}
+		})
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, "ws+unix::/chat", nil)
+	if _, _, _, err := (&Dialer{}).target(request); err != ErrInvalidUnixURL {
+		t.Fatalf("target() error = %v, want %v", err, ErrInvalidUnixURL)
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ws.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	requests := make(chan *http.Request, 1)
+	server := &http.Server{Handler: (&Upgrader{}).Handler(func(ws WebSocket) {
+		requests <- ws.HandshakeRequest()
+	})}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	// Address 替换了连接的地址，设置了代理也不会使用
+	proxied := func(*http.Request) (*url.URL, error) {
+		return nil, errors.New("proxy used")
+	}
+	tests := []struct {
+		name   string
+		dialer *Dialer
+		url    string
+		host   string
+		path   string
+	}{
+		{name: "ws+unix", dialer: &Dialer{Proxy: proxied}, url: "ws+unix://" + socket + ":/chat?room=1", host: "localhost", path: "/chat?room=1"},
+		{name: "address", dialer: &Dialer{Network: "unix", Address: socket, Proxy: proxied}, url: "ws://example.com/chat", host: "example.com", path: "/chat"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ws, err := test.dialer.Dial(ctx, test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = ws.Close()
+			request := <-requests
+			if request.Host != test.host || request.URL.RequestURI() != test.path {
+				t.Fatalf("handshake to %s%s, want %s%s", request.Host, request.URL.RequestURI(), test.host, test.path)
+			}
+		})
+	}
+}
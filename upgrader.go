@@ -0,0 +1,467 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upgrader 用于配置服务端如何接收 WebSocket 连接
+type Upgrader struct {
+	// Timeouts 是握手和连接使用的超时配置，为空时使用 DefaultTimeouts
+	Timeouts *Timeouts
+
+	// Keepalive 不为空时，握手成功之后会使用它调用 SetKeepalive
+	Keepalive *Keepalive
+
+	// HandshakeTimeout 是完成握手的最长时间，大于 0 时会覆盖 Timeouts 中的 Handshake
+	HandshakeTimeout time.Duration
+
+	// ReadBufferSize 大于 0 时，读取连接使用这个大小的缓冲区，可以减少读取小帧时的系统调用。
+	// WriteBufferSize 大于 0 时，每个帧会先写入这个大小的缓冲区，再一次性写入连接。
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// FragmentSize 不为 0 时，握手成功之后会使用它调用 SetFragmentSize
+	FragmentSize int
+
+	// BackgroundRead 为 true 时，握手成功之后会开启后台读取模式，BackgroundQueueSize 是数据 Message 队列的长度。
+	// 这样即使应用长时间不调用 ReadMessage，对方的 Ping 和 ConnectionClose 也会被及时处理。
+	BackgroundRead      bool
+	BackgroundQueueSize int
+
+	// Error 用于在 Upgrade 拒绝握手的时候写入 HTTP 错误响应，status 是响应的状态码，reason 是拒绝的原因。
+	// 为空时使用 http.Error 写入纯文本的响应。UpgradeStream 没有 http.ResponseWriter，不会调用这个函数。
+	Error func(w http.ResponseWriter, request *http.Request, status int, reason error)
+
+	// CheckOrigin 用于校验请求的 Origin 头，返回 false 的请求会收到 403 响应。
+	// 为空时只允许没有 Origin 头，或者 Origin 的 host 和请求的 Host 相同的请求。
+	CheckOrigin func(request *http.Request) bool
+
+	// MaxHeaderBytes 是 UpgradeStream 读取的握手请求中，请求行和请求头的最大总长度，为 0 时使用 DefaultMaxHeaderBytes。
+	// 超过之后会响应 431，握手超时会响应 408。
+	// Upgrade 使用的是 http.Server 已经读取的请求，需要设置 http.Server 的 MaxHeaderBytes 和 ReadHeaderTimeout。
+	MaxHeaderBytes int
+
+	// Subprotocols 是服务端支持的子协议，会按照客户端请求的顺序选择第一个支持的子协议
+	Subprotocols []string
+
+	// SelectProtocol 不为空时用于代替 Subprotocols 选择子协议，offered 是客户端请求的子协议。
+	// 返回空字符串表示不使用子协议，返回客户端没有请求的子协议也会被忽略。
+	SelectProtocol func(request *http.Request, offered []string) string
+
+	// EnableCompression 为 true 时，如果客户端请求了 permessage-deflate，会同意并压缩数据 Message
+	EnableCompression bool
+
+	// Extensions 是服务端可以同意的自定义扩展，为空时使用 RegisterExtension 注册的扩展
+	Extensions []Extension
+
+	// Limiter 不为空时，Upgrade 会在校验握手请求之后按照它限制连接数量和接收新连接的速度，超过限制的请求会收到 503 响应，
+	// 返回的错误是 *HandshakeError。UpgradeStream 不使用 Limiter，Server 有自己的 Limiter。
+	Limiter *ConnectionLimiter
+
+	// Authenticate 不为空时，会在校验握手请求之后、hijack 之前被调用，返回的 Principal 会保存在 WebSocket 对象中，可以通过 PrincipalOf 获取。
+	// 返回错误的时候拒绝握手：错误是 *HandshakeError 时使用它的 Status 和 Header（例如 WWW-Authenticate），
+	// errors.Is(err, ErrForbidden) 时响应 403，其他的错误响应 401。
+	Authenticate func(request *http.Request) (Principal, error)
+
+	// Middleware 会按照顺序包装 Upgrade，第一个在最外层，可以用于认证、日志、限流这类检查，参考 UpgradeMiddleware。
+	// UpgradeStream 没有 http.ResponseWriter，不会使用 Middleware。
+	Middleware []UpgradeMiddleware
+
+	// MessageInterceptors 不为空时，握手成功之后会使用它们调用 Intercept
+	MessageInterceptors []MessageInterceptor
+
+	// Registry 不为空时，Upgrade 和 UpgradeStream 握手成功的 WebSocket 对象会被加入到 Registry 中
+	Registry *Registry
+}
+
+// DefaultUpgrader 是 Pair、ServerPair 和 ServerPairTLS 使用的 Upgrader
+var DefaultUpgrader = &Upgrader{}
+
+var (
+	ErrHijackResponseWriterFailed = errors.New("hijack the http.ResponseWriter failed")
+	ErrBadOrigin                  = errors.New("request origin is not allowed")
+	ErrHandshakeBadMethod         = errors.New("handshake request method is not GET")
+	ErrHandshakeBadProtocol       = errors.New("handshake request is not HTTP/1.1 or later")
+	ErrHandshakeMissingHost       = errors.New("handshake request has no host")
+	ErrHandshakeNotUpgrade        = errors.New("request header `connection` does not contain 'upgrade'")
+	ErrHandshakeNotWebSocket      = errors.New("request header `upgrade` does not contain 'websocket'")
+	ErrHandshakeBadVersion        = errors.New("request header `sec-websocket-version` is not equal to '13'")
+)
+
+// HandshakeError 表示服务端拒绝了握手请求，Status 和 Header 是发送给客户端的 HTTP 响应，Err 是拒绝的原因。
+// 可以使用 errors.Is 判断 Err，例如客户端的版本不是 13 的时候是 ErrHandshakeBadVersion，响应是 426 Upgrade Required。
+type HandshakeError struct {
+	Status int
+	Header http.Header
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return "WebSocket handshake rejected with " + strconv.Itoa(e.Status) + ": " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// check 校验握手请求，不合法的时候返回需要发送给客户端的 *HandshakeError
+func (u *Upgrader) check(request *http.Request) *HandshakeError {
+	reject := func(status int, err error) *HandshakeError {
+		return &HandshakeError{Status: status, Err: err}
+	}
+	switch {
+	case request.Method != http.MethodGet:
+		e := reject(http.StatusMethodNotAllowed, ErrHandshakeBadMethod)
+		e.Header = http.Header{"Allow": {http.MethodGet}}
+		return e
+	case !request.ProtoAtLeast(1, 1):
+		return reject(http.StatusBadRequest, ErrHandshakeBadProtocol)
+	case len(request.Host) < 1:
+		return reject(http.StatusBadRequest, ErrHandshakeMissingHost)
+	case !headerContainsToken(request.Header, "connection", "upgrade"):
+		return reject(http.StatusBadRequest, ErrHandshakeNotUpgrade)
+	case !headerContainsToken(request.Header, "upgrade", "websocket"):
+		return reject(http.StatusBadRequest, ErrHandshakeNotWebSocket)
+	case !headerContainsToken(request.Header, "sec-websocket-version", "13"):
+		// 告诉客户端服务端支持的版本，参考 RFC 6455 4.4
+		e := reject(http.StatusUpgradeRequired, ErrHandshakeBadVersion)
+		e.Header = http.Header{"Sec-Websocket-Version": {"13"}}
+		return e
+	case !validSecWebsocketKey(request.Header.Get("sec-websocket-key")):
+		return reject(http.StatusBadRequest, ErrInvalidSecWebsocketKey)
+	case !u.checkOrigin(request):
+		return reject(http.StatusForbidden, ErrBadOrigin)
+	}
+	return nil
+}
+
+// Pair 用于 HTTP 服务端接收一个 WebSocket 对象
+//
+// 使用例子：
+//
+//	http.HandleFunc("/ws",func(w http.ResponseWriter,request *http.Request){
+//		ws,err := websocket.Pair(w,request)
+//		if err != nil {
+//			return
+//		}
+//		fmt.Println(ws)
+//	})
+//	http.ListenAndServe("0.0.0.0:8080")
+func Pair(w http.ResponseWriter, req *http.Request) (WebSocket, error) {
+	return DefaultUpgrader.Upgrade(w, req)
+}
+
+// ServerPair 用于传入 io.WriteCloser 和 io.ReadCloser 来创建 WebSocket。
+// 可以用于自己编写的 WEB 服务来创建一个 WebSocket 对象。
+// 握手请求会被严格校验，不合法的请求会收到对应的错误响应。
+func ServerPair(writer io.WriteCloser, reader io.ReadCloser) (WebSocket, error) {
+	return DefaultUpgrader.UpgradeStream(writer, reader)
+}
+
+// ServerPairTLS 和 ServerPair 一样，但是会先用 config 在流上完成 TLS 握手，再读取 HTTP 请求。
+// 可以用于自己编写的 WEB 服务来提供 wss 服务。
+func ServerPairTLS(writer io.WriteCloser, reader io.ReadCloser, config *tls.Config) (WebSocket, error) {
+	return DefaultUpgrader.UpgradeStreamTLS(writer, reader, config)
+}
+
+func (u *Upgrader) timeouts() Timeouts {
+	timeouts := DefaultTimeouts
+	if u.Timeouts != nil {
+		timeouts = *u.Timeouts
+	}
+	if u.HandshakeTimeout > 0 {
+		timeouts.Handshake = u.HandshakeTimeout
+	}
+	return timeouts
+}
+
+// writeError 在 Upgrade 拒绝握手的时候写入 HTTP 错误响应
+func (u *Upgrader) writeError(w http.ResponseWriter, request *http.Request, status int, reason error) {
+	if u.Error != nil {
+		u.Error(w, request, status, reason)
+		return
+	}
+	http.Error(w, reason.Error(), status)
+}
+
+func (u *Upgrader) checkOrigin(request *http.Request) bool {
+	if u.CheckOrigin != nil {
+		return u.CheckOrigin(request)
+	}
+	return sameOrigin(request)
+}
+
+// switchingResponse 把发送的 101 响应的每一行转换成 *http.Response
+func switchingResponse(lines []string, request *http.Request) *http.Response {
+	header := http.Header{}
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ": ")
+		if ok {
+			header.Add(key, value)
+		}
+	}
+	return &http.Response{
+		Status:     "101 Switching Protocols",
+		StatusCode: http.StatusSwitchingProtocols,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    request,
+	}
+}
+
+// selectProtocol 选择响应中的子协议，没有可以使用的子协议时返回空字符串
+func (u *Upgrader) selectProtocol(request *http.Request) string {
+	offered := headerList(request.Header, "sec-websocket-protocol")
+	if len(offered) < 1 {
+		return ""
+	}
+	if u.SelectProtocol != nil {
+		selected := u.SelectProtocol(request, offered)
+		for _, protocol := range offered {
+			if protocol == selected {
+				return selected
+			}
+		}
+		return ""
+	}
+	for _, protocol := range offered {
+		for _, supported := range u.Subprotocols {
+			if protocol == supported {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// sameOrigin 用于判断请求是否没有 Origin 头，或者 Origin 的 host 和请求的 Host 相同
+func sameOrigin(request *http.Request) bool {
+	origin := request.Header.Get("origin")
+	if len(origin) < 1 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, request.Host)
+}
+
+// Upgrade 把 HTTP 服务端收到的请求升级成 WebSocket。
+// 不合法的请求会在 hijack 之前通过 w 收到对应的错误响应，返回的错误是 *HandshakeError。
+// 设置了 Middleware 的时候会经过 Middleware 再握手。
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (WebSocket, error) {
+	if len(u.Middleware) > 0 {
+		return chainUpgrade(u.upgrade, u.Middleware)(w, req)
+	}
+	return u.upgrade(w, req)
+}
+
+func (u *Upgrader) upgrade(w http.ResponseWriter, req *http.Request) (WebSocket, error) {
+	reject := func(e *HandshakeError) (WebSocket, error) {
+		for key, values := range e.Header {
+			w.Header()[key] = values
+		}
+		u.writeError(w, req, e.Status, e.Err)
+		return nil, e
+	}
+	if e := u.check(req); e != nil {
+		return reject(e)
+	}
+	release := func() {}
+	if u.Limiter != nil {
+		var e *HandshakeError
+		if release, e = u.Limiter.acquireFor(req); e != nil {
+			return reject(e)
+		}
+	}
+	principal, e := u.authenticate(req)
+	if e != nil {
+		release()
+		return reject(e)
+	}
+	hijack, ok := w.(http.Hijacker)
+	if !ok {
+		release()
+		u.writeError(w, req, http.StatusInternalServerError, ErrHijackResponseWriterFailed)
+		return nil, ErrHijackResponseWriterFailed
+	}
+	conn, buffered, err := hijack.Hijack()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	timeouts := u.timeouts()
+	if timeouts.Handshake > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeouts.Handshake))
+	}
+	var reader *bufio.Reader
+	if buffered != nil {
+		reader = buffered.Reader
+	}
+	ws, err := u.pair(conn, reuseReadBuffer(reader, conn, u.ReadBufferSize), req)
+	if err != nil {
+		release()
+		_ = conn.Close()
+		return nil, err
+	}
+	ws.addCloseHook(release)
+	_ = conn.SetDeadline(time.Time{})
+	u.configure(ws, timeouts, principal)
+	return ws, nil
+}
+
+// UpgradeStream 从 reader 读取握手请求，然后在 writer 和 reader 上创建 WebSocket。
+// 握手请求会被严格校验，不合法的请求会收到对应的错误响应，返回的错误是 *HandshakeError。
+func (u *Upgrader) UpgradeStream(writer io.WriteCloser, reader io.ReadCloser) (WebSocket, error) {
+	return u.upgradeStream(writer, reader, u.timeouts())
+}
+
+// upgradeStream 使用 timeouts 完成 UpgradeStream，timeouts.Handshake 为 0 时不设置握手的截止时间
+func (u *Upgrader) upgradeStream(writer io.WriteCloser, reader io.ReadCloser, timeouts Timeouts) (WebSocket, error) {
+	if timeouts.Handshake > 0 {
+		deadline := time.Now().Add(timeouts.Handshake)
+		_ = setWriteDeadline(writer, deadline)
+		_ = setReadDeadline(reader, deadline)
+	}
+	maxHeaderBytes := u.MaxHeaderBytes
+	if maxHeaderBytes < 1 {
+		maxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	req, buf, err := readHandshakeRequest(reader, maxHeaderBytes)
+	if err != nil {
+		_ = setWriteDeadline(writer, time.Now().Add(time.Second))
+		_ = writeHTTPError(writer, handshakeErrorStatus(err), nil)
+		return nil, err
+	}
+	if e := u.check(req); e != nil {
+		_ = writeHTTPError(writer, e.Status, e.Header)
+		return nil, e
+	}
+	principal, e := u.authenticate(req)
+	if e != nil {
+		_ = writeHTTPError(writer, e.Status, e.Header)
+		return nil, e
+	}
+	ws, err := u.pair(writer, withReadBuffer(bufferedReadCloser(buf, reader), u.ReadBufferSize), req)
+	if err != nil {
+		return nil, err
+	}
+	_ = setWriteDeadline(writer, time.Time{})
+	_ = setReadDeadline(reader, time.Time{})
+	u.configure(ws, timeouts, principal)
+	return ws, nil
+}
+
+// UpgradeStreamTLS 和 UpgradeStream 一样，但是会先用 config 在流上完成 TLS 握手，再读取 HTTP 请求
+func (u *Upgrader) UpgradeStreamTLS(writer io.WriteCloser, reader io.ReadCloser, config *tls.Config) (WebSocket, error) {
+	return u.upgradeStreamTLS(writer, reader, config, u.timeouts())
+}
+
+func (u *Upgrader) upgradeStreamTLS(writer io.WriteCloser, reader io.ReadCloser, config *tls.Config, timeouts Timeouts) (WebSocket, error) {
+	conn := tls.Server(newStreamConn(writer, reader), config)
+	if timeouts.Handshake > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeouts.Handshake))
+	}
+	err := conn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return u.upgradeStream(conn, conn, timeouts)
+}
+
+// configure 在握手成功之后按照 Upgrader 的配置设置 ws，Upgrade 和 UpgradeStream 共用
+func (u *Upgrader) configure(ws *webSocket, timeouts Timeouts, principal Principal) {
+	ws.SetTimeouts(timeouts)
+	if u.Keepalive != nil {
+		ws.SetKeepalive(*u.Keepalive)
+	}
+	if u.FragmentSize != 0 {
+		ws.SetFragmentSize(u.FragmentSize)
+	}
+	if principal != nil {
+		ws.Set(principalKey{}, principal)
+	}
+	if len(u.MessageInterceptors) > 0 {
+		ws.Intercept(u.MessageInterceptors...)
+	}
+	if u.BackgroundRead {
+		ws.BackgroundRead(u.BackgroundQueueSize)
+	}
+	if u.Registry != nil {
+		u.Registry.Track(ws)
+	}
+}
+
+func (u *Upgrader) pair(writer io.WriteCloser, reader io.ReadCloser, request *http.Request) (*webSocket, error) {
+	secAcceptKey, err := getSecAcceptKey(request.Header.Get("sec-websocket-key"))
+	if err != nil {
+		return nil, err
+	}
+	response := []string{
+		"HTTP/1.1 101 Switching Protocols",
+		"Sec-Websocket-Accept: " + secAcceptKey,
+		"Upgrade: websocket",
+		"Connection: upgrade",
+	}
+	subprotocol := u.selectProtocol(request)
+	if len(subprotocol) > 0 {
+		response = append(response, "Sec-Websocket-Protocol: "+subprotocol)
+	}
+	checksum := containsFold(extensionNames(request.Header), ChecksumExtension)
+	if checksum {
+		response = append(response, "Sec-Websocket-Extensions: "+ChecksumExtension)
+	}
+	var deflate *deflateParams
+	if u.EnableCompression {
+		var value string
+		var ok bool
+		value, deflate, ok = acceptDeflate(request.Header)
+		if ok {
+			response = append(response, "Sec-Websocket-Extensions: "+value)
+		}
+	}
+	var usedRsv byte
+	if deflate != nil {
+		usedRsv = 0b100
+	}
+	exts := u.Extensions
+	if exts == nil {
+		exts = registeredExtensions()
+	}
+	extResponses, negotiated := acceptExtensions(request.Header, exts, usedRsv)
+	for _, value := range extResponses {
+		response = append(response, "Sec-Websocket-Extensions: "+value)
+	}
+	response = append(response, "\r\n")
+	_, err = writer.Write([]byte(strings.Join(response, "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	ws := NewWebSocketWithRole(writer, reader, RoleServer).(*webSocket)
+	ws.setWriteBufferSize(u.WriteBufferSize)
+	ws.subprotocol = subprotocol
+	ws.handshakeRequest = request
+	ws.handshakeResponse = switchingResponse(response, request)
+	ws.checksum = checksum
+	if deflate != nil {
+		ws.enableDeflate(*deflate)
+	}
+	ws.extensions = negotiated
+	for _, ext := range negotiated {
+		ws.allowedRsv |= ext.Rsv()
+	}
+	return ws, nil
+}
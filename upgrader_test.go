@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawUpgradeRequest 是一个合法的原始握手请求
+const rawUpgradeRequest = "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+
+func TestUpgraderError(t *testing.T) {
+	type rejection struct {
+		status int
+		reason error
+	}
+	rejections := make(chan rejection, 1)
+	tests := []struct {
+		name     string
+		upgrader *Upgrader
+		body     string
+	}{
+		{name: "default", upgrader: &Upgrader{}, body: ErrHandshakeBadMethod.Error() + "\n"},
+		{name: "callback", upgrader: &Upgrader{Error: func(w http.ResponseWriter, request *http.Request, status int, reason error) {
+			rejections <- rejection{status: status, reason: reason}
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, `{"error":"rejected"}`)
+		}}, body: `{"error":"rejected"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "http://example.com/ws", nil)
+			if ws, err := test.upgrader.Upgrade(recorder, request); ws != nil || !errors.Is(err, ErrHandshakeBadMethod) {
+				t.Fatalf("Upgrade() = %v, %v, want %v", ws, err, ErrHandshakeBadMethod)
+			}
+			if recorder.Code != http.StatusMethodNotAllowed || recorder.Body.String() != test.body {
+				t.Fatalf("response = %d %q, want %d %q", recorder.Code, recorder.Body.String(), http.StatusMethodNotAllowed, test.body)
+			}
+		})
+	}
+	if r := <-rejections; r.status != http.StatusMethodNotAllowed || !errors.Is(r.reason, ErrHandshakeBadMethod) {
+		t.Fatalf("Error() called with %d %v", r.status, r.reason)
+	}
+
+	// 不能 hijack 的 http.ResponseWriter 也会通过 Error 响应
+	upgrader := &Upgrader{Error: func(w http.ResponseWriter, request *http.Request, status int, reason error) {
+		rejections <- rejection{status: status, reason: reason}
+	}}
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/ws", strings.NewReader(""))
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if _, err := upgrader.Upgrade(httptest.NewRecorder(), request); err != ErrHijackResponseWriterFailed {
+		t.Fatalf("Upgrade() error = %v, want %v", err, ErrHijackResponseWriterFailed)
+	}
+	if r := <-rejections; r.status != http.StatusInternalServerError || r.reason != ErrHijackResponseWriterFailed {
+		t.Fatalf("Error() called with %d %v", r.status, r.reason)
+	}
+}
+
+func TestUpgraderHandshakeTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		// 不发送握手请求，只读取错误响应
+		_, _ = io.Copy(io.Discard, b)
+	}()
+	// HandshakeTimeout 覆盖 Timeouts 中的 Handshake
+	upgrader := &Upgrader{HandshakeTimeout: 50 * time.Millisecond, Timeouts: &Timeouts{Handshake: time.Minute}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := upgrader.UpgradeStream(a, a)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("UpgradeStream() succeeded without a request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpgradeStream() did not time out")
+	}
+}
+
+func TestUpgraderBufferSizes(t *testing.T) {
+	// 紧跟在握手请求之后的帧，掩码 key 是 0
+	raw := rawUpgradeRequest + "\x81\x82\x00\x00\x00\x00hi"
+	output := &bytes.Buffer{}
+	upgrader := &Upgrader{ReadBufferSize: 8192, WriteBufferSize: 4096, FragmentSize: 1000}
+	ws, err := upgrader.UpgradeStream(discardCloser{output}, io.NopCloser(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := ws.(*webSocket).writeBuffer.Size(); size != 4096 {
+		t.Fatalf("write buffer size = %d, want 4096", size)
+	}
+	if size := ws.(*webSocket).fragmentSize.Load(); size != 1000 {
+		t.Fatalf("fragment size = %d, want 1000", size)
+	}
+	if data := readText(t, ws); data != "hi" {
+		t.Fatalf("ReadMessage() = %q, want hi", data)
+	}
+	output.Reset()
+	text := strings.Repeat("a", 10000)
+	if err = ws.Send(text); err != nil {
+		t.Fatal(err)
+	}
+	var sent []byte
+	for _, frame := range decodeFrames(t, output.Bytes()) {
+		sent = append(sent, frame.Payload...)
+	}
+	if string(sent) != text {
+		t.Fatalf("sent %d bytes, want %d", len(sent), len(text))
+	}
+}
+
+func TestUpgradeKeepsFramesAfterRequest(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&Upgrader{}).Upgrade(w, r)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer ws.Close()
+		message, err := ws.ReadMessage()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		data, _ := io.ReadAll(message)
+		received <- string(data)
+	}))
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 帧和握手请求一起发送，会被 http.Server 读入 Hijack 返回的缓冲区
+	if _, err = io.WriteString(conn, rawUpgradeRequest+"\x81\x82\x00\x00\x00\x00hi"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if data != "hi" {
+			t.Fatalf("ReadMessage() = %q, want hi", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the frame sent with the request was lost")
+	}
+}
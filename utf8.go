@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var ErrInvalidUTF8 = errors.New("text message is not valid UTF-8")
+
+// utf8Validator 在读取 TextFrame Message 的时候逐段校验 UTF-8 编码。
+// 一个字符可能被分在两次读取之间，所以末尾不完整的字节会保留到下一次读取再校验，读到 EOF 的时候仍然不完整就是不合法的。
+type utf8Validator struct {
+	reader  io.Reader
+	partial []byte
+	invalid func() error
+}
+
+func (v *utf8Validator) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	data := p[:n]
+	if len(v.partial) > 0 {
+		data = append(v.partial, data...)
+	}
+	v.partial = nil
+	// 从末尾往前找到最后一个字符的起始字节，如果这个字符还不完整，就留到下一次读取
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				v.partial = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	if !utf8.Valid(data) {
+		return n, v.invalid()
+	}
+	if err == io.EOF && len(v.partial) > 0 {
+		return n, v.invalid()
+	}
+	return n, err
+}
+
+// SetUTF8Validation 设置是否校验收到的 TextFrame Message 的 UTF-8 编码，默认开启。
+// 不合法的 Message 会使用 CloseInvalidFramePayloadData 关闭连接，读取时返回 ErrInvalidUTF8。
+// 确定对方发送的数据都是合法的时候，可以关闭校验来提高性能。
+func (w *webSocket) SetUTF8Validation(enabled bool) {
+	w.skipUTF8.Store(!enabled)
+}
+
+// validateUTF8 用于在开启校验的时候校验收到的 TextFrame Message
+func (w *webSocket) validateUTF8(reader io.Reader) io.Reader {
+	return &utf8Validator{
+		reader: reader,
+		invalid: func() error {
+			_ = w.fail(CloseInvalidFramePayloadData, ErrInvalidUTF8.Error())
+			return ErrInvalidUTF8
+		},
+	}
+}
@@ -2,15 +2,16 @@ package websocket
 
 import (
 	"bufio"
+	"compress/flate"
 	"context"
-	"crypto/tls"
 	"errors"
-	"golang.org/x/net/proxy"
 	"io"
 	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type OpCode byte
@@ -54,9 +55,38 @@ var OpCodeName = []string{
 }
 
 func (o OpCode) String() string {
-	return OpCodeName[o]
+	if int(o) < len(OpCodeName) {
+		return OpCodeName[o]
+	}
+	return "OpCode(" + strconv.Itoa(int(o)) + ")"
+}
+
+// IsReserved 用于判断是否 RFC 6455 保留的操作码，超出 4 个比特的值也当作保留的
+func (o OpCode) IsReserved() bool {
+	switch o {
+	case ContinuationFrame, TextFrame, BinaryFrame, ConnectionClose, Ping, Pong:
+		return false
+	default:
+		return true
+	}
 }
 
+// IsControl 用于判断是否控制帧
+func (o OpCode) IsControl() bool {
+	return o&0b1000 > 0
+}
+
+// WebSocket 表示一个 WebSocket 连接。
+//
+// 所有的发送方法都可以在多个 goroutine 中同时调用：
+// Send、SendMessage、WriteMessage、Ping 和 NextWriter 按 Message 排队发送，
+// 一个 Message 的所有分片发送完之后才会发送下一个 Message，所以不同 Message 的分片不会交错；
+// WriteControl、Close、CloseWithCode 以及自动回复的 Pong 只等待正在写入的帧，
+// 可以插入到一个正在发送的大 Message 的分片之间，不需要等待它发送完。
+//
+// 读取同一时间只能有一个 goroutine 进行：ReadMessage、NextReader、ReadAllMessage 不能同时调用。
+// 没有开启 BackgroundRead 的时候，Ping 会自己读取连接来等待 Pong，也不能和它们同时调用。
+// 设置类的方法（Set 开头的方法、EnableWriteCompression 等）可以在任何时候调用，对之后的帧生效。
 type WebSocket interface {
 	// Send 发送文本数据
 	Send(text string) error
@@ -66,10 +96,21 @@ type WebSocket interface {
 	// 否则就代表连接一切正常。
 	Ping() error
 
-	// Close 用于关闭 WebSocket 对象的流
+	// PingContext 发送 Ping 并等待对应的 Pong，返回往返时间，等待期间收到的数据 Message 不会丢失
+	PingContext(ctx context.Context) (time.Duration, error)
+
+	// Close 用于关闭 WebSocket 对象的流，可以重复调用，已经关闭的时候返回 nil。
+	// 正在等待的读取和写入会返回关闭的错误：读取返回 *CloseError 或者 ErrClosedStatus，写入返回 ErrClosedStatus。
 	Close() error
 
-	// Status 用于获取 WebSocket 对象的状态
+	// CloseContext 发送 ConnectionClose 之后等待对方回复，再关闭流，对方在 ctx 结束之前回复了才返回 nil
+	CloseContext(ctx context.Context, code uint16, reason string) error
+
+	// CloseWithCode 发送带有状态码和原因的 ConnectionClose 帧，然后关闭 WebSocket 对象的流。
+	// 对方关闭连接的状态码和原因可以通过 ReadMessage 返回的 *CloseError 或者 CloseReason 获取。
+	CloseWithCode(code uint16, reason string) error
+
+	// Status 用于获取 WebSocket 对象的状态，是 CONNECTING、OPEN、CLOSING、CLOSED 中的一个
 	Status() uint8
 
 	// ReadMessage 用于接收 Message 数据
@@ -77,273 +118,762 @@ type WebSocket interface {
 
 	// SendMessage 用于发送 Message 数据
 	SendMessage(message *Message) error
+
+	// WriteControl 发送一个控制帧，deadline 是写入的截止时间，为零值时使用 Timeouts 中的 Write。
+	// 它不需要等待正在发送的数据 Message 结束，所以可以在其他 goroutine 发送 Message 的时候用于心跳。
+	// 发送 ConnectionClose 之后 WebSocket 会被关闭，和 CloseWithCode 一样。
+	WriteControl(opCode OpCode, payload []byte, deadline time.Time) error
+
+	// WritePreparedMessage 发送一个 PreparedMessage，同一种连接只需要编码一次，适合广播
+	WritePreparedMessage(pm *PreparedMessage) error
+
+	// WriteMessage 发送一个内容是 data 的 Message
+	WriteMessage(opCode OpCode, data []byte) error
+
+	// WriteMessageContext 和 WriteMessage 一样，但是发送的时间由 ctx 限制：
+	// 在等待其他 Message 发送完的时候 ctx 结束，直接返回 ctx.Err()，连接不受影响；
+	// 已经开始写入之后 ctx 结束，写入会被打断，因为 Message 只发送了一部分，连接会被关闭，同样返回 ctx.Err()。
+	WriteMessageContext(ctx context.Context, opCode OpCode, data []byte) error
+
+	// Intercept 添加在应用读取到 Message 之前检查、修改或者拒绝 Message 的 MessageInterceptor，按照添加的顺序调用
+	Intercept(interceptors ...MessageInterceptor)
+
+	// ReadAllMessage 读取下一个 Message 的全部内容，适合内容比较小的 Message
+	ReadAllMessage() (OpCode, []byte, error)
+
+	// SendAsync 把 Message 放入发送队列，不等待发送完成
+	SendAsync(message *Message) error
+
+	// SetWriteQueue 设置 SendAsync 使用的队列长度和队列满了之后的处理方式
+	SetWriteQueue(queue WriteQueue)
+
+	// Incoming 返回收到的 Message 的 channel，连接关闭之后 channel 会被关闭
+	Incoming() <-chan *Message
+
+	// Outgoing 返回发送 Message 的 channel，放入的 Message 会按照顺序发送
+	Outgoing() chan<- *Message
+
+	// Done 返回一个在 WebSocket 关闭之后被关闭的 channel
+	Done() <-chan struct{}
+
+	// SetChannelBuffers 设置 Incoming 和 Outgoing 的缓冲长度，需要在使用它们之前调用
+	SetChannelBuffers(incoming, outgoing int)
+
+	// Serve 在后台循环读取 Message 并调用 handler 中的回调，直到连接关闭或者 ctx 结束
+	Serve(ctx context.Context, handler EventHandlers) error
+
+	// NextWriter 返回一个用于边写边发送 Message 的 io.WriteCloser，每次 Write 发送一个分片，Close 发送最后一个分片
+	NextWriter(opCode OpCode) (io.WriteCloser, error)
+
+	// NextReader 读取下一个 Message，返回它的 OpCode 和边读边接收的内容
+	NextReader() (OpCode, io.Reader, error)
+
+	// BackgroundRead 用于开启后台读取模式，开启之后 Ping 和 ReadMessage 可以并发使用
+	BackgroundRead(queueSize int)
+
+	// SendPong 发送一个不需要回复的 Pong 帧，payload 不能超过 125 字节
+	SendPong(payload []byte) error
+
+	// PongKeepalive 每隔 interval 发送一个不需要回复的 Pong 帧作为单向心跳，
+	// 用于对方不会回复 Ping，但是中间设备会断开空闲连接的场景。
+	// 调用返回的 stop 函数可以停止发送，连接出错之后也会自动停止；interval 不大于 0 时不会发送。
+	PongKeepalive(interval time.Duration) (stop func())
+
+	// SetPingPolicy 用于配置收到 Ping 之后自动回复 Pong 的行为，例如关闭自动回复、修改内容或者限制回复频率
+	SetPingPolicy(policy PingPolicy)
+
+	// SetPingHandler 设置收到 Ping 时的回调，设置之后不会再自动回复 Pong，为空时恢复自动回复
+	SetPingHandler(handler func(payload []byte) error)
+
+	// SetPongHandler 设置收到 Pong 时的回调，例如用于记录连接的活跃时间
+	SetPongHandler(handler func(payload []byte) error)
+
+	// SetCloseHandler 设置收到 ConnectionClose 时的回调，例如用于记录关闭原因，回调之后仍然会回复并关闭连接
+	SetCloseHandler(handler func(code uint16, reason string) error)
+
+	// CloseReason 用于在 WebSocket 对象进入 CLOSED 状态之后，获取是谁关闭了连接、关闭状态码和导致关闭的错误。
+	// 在进入 CLOSED 状态之前返回 nil。
+	CloseReason() *CloseInfo
+
+	// ID 返回这个 WebSocket 对象的唯一 ID，可以用于日志和追踪
+	ID() string
+
+	// Set 在 WebSocket 对象上保存 key 对应的值，用于保存用户身份、会话状态这类数据，value 为 nil 时删除 key。
+	// key 的要求和 context.WithValue 一样，应该使用自己定义的类型，避免和其他代码冲突。
+	Set(key, value any)
+	// Value 返回 Set 保存的 key 对应的值，没有的时候返回 nil
+	Value(key any) any
+
+	// LocalAddr 和 RemoteAddr 返回连接两端的地址，底层的流不是 net.Conn 的时候返回表示流的地址，它的 Network 是 "stream"
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+
+	// Subprotocol 返回握手时协商出来的子协议，没有协商子协议时返回空字符串
+	Subprotocol() string
+
+	// Extensions 返回握手时协商出来的扩展，也就是握手响应中的 Sec-WebSocket-Extensions
+	Extensions() []ExtensionOffer
+
+	// HandshakeRequest 返回握手请求，客户端是发送的请求，服务端是收到的请求，使用 NewWebSocket 创建时返回 nil
+	HandshakeRequest() *http.Request
+
+	// HandshakeResponse 返回 101 握手响应，客户端是收到的响应，服务端是发送的响应，使用 NewWebSocket 创建时返回 nil
+	HandshakeResponse() *http.Response
+
+	// SetTransferKeepalive 设置发送大 Message 的时候，在分片之间插入 Ping 帧的间隔，为 0 时不插入
+	SetTransferKeepalive(interval time.Duration)
+	// SetFragmentSize 设置发送 Message 时每个分片的最大长度，NoFragmentation 表示长度已知的 Message 作为一个帧发送
+	SetFragmentSize(size int)
+
+	// SetBandwidth 用于限制上传和下载的带宽，可以用于共享网关上的公平性，或者在集成测试中模拟慢速的客户端
+	SetBandwidth(upload Bandwidth, download Bandwidth)
+
+	// SetInboundLimit 设置收到的帧的频率和流量限制，超过之后延迟读取，或者使用 ClosePolicyViolation 关闭连接
+	SetInboundLimit(limit InboundLimit)
+
+	// SetFrameLimit 设置收到的单个帧的最大长度，为 0 时不限制。
+	// 超过限制的帧在读取内容之前就会被拒绝，并使用 CloseMessageTooBig 关闭连接。
+	SetFrameLimit(limit int64)
+
+	// SetReadLimit 设置收到的单个 Message 的最大长度，包括所有的分片，为 0 时不限制。
+	// 超过限制之后会使用 CloseMessageTooBig 关闭连接，读取时返回 ErrReadLimitExceeded。
+	SetReadLimit(limit int64)
+
+	// SetCloseMode 设置关闭 WebSocket 的时候，是否关闭输出流和输入流，默认两条流都会关闭
+	SetCloseMode(mode CloseMode)
+
+	// SetUTF8Validation 设置是否校验收到的 TextFrame Message 的 UTF-8 编码，默认开启
+	SetUTF8Validation(enabled bool)
+
+	// SetMaskKeySource 设置发送帧时使用的掩码 key 来源，为空时使用 DefaultMaskKeySource
+	SetMaskKeySource(source MaskKeySource)
+
+	// SetCompressionLevel 设置压缩数据 Message 使用的 flate 压缩级别，范围是 flate.HuffmanOnly 到 flate.BestCompression，
+	// 默认是 flate.DefaultCompression。只有协商了 permessage-deflate 的时候才会生效。
+	SetCompressionLevel(level int) error
+
+	// EnableWriteCompression 设置是否压缩发送的数据 Message，默认开启，Message.Compress 可以覆盖这个设置
+	EnableWriteCompression(enable bool)
+
+	// SetCompressionThreshold 设置压缩的最小长度，小于 size 字节的数据 Message 不会被压缩，为 0 时总是压缩
+	SetCompressionThreshold(size int)
+
+	// AllowReservedOpCode 允许收发一个 RFC 6455 保留的 OpCode，handler 不为空时收到的 Message 会交给 handler 处理，
+	// 否则会从 ReadMessage 返回。默认情况下保留的 OpCode 会导致连接使用 CloseProtocolError 关闭。
+	AllowReservedOpCode(opCode OpCode, handler ReservedOpCodeHandler) error
+
+	// SetReadDeadline 设置读取的截止时间，零值表示不限制，超时之后连接会被关闭
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline 设置写入的截止时间，零值表示不限制，超时之后连接会被关闭
+	SetWriteDeadline(t time.Time) error
+
+	// NetConn 返回底层的 net.Conn，可以用于设置 socket 选项，底层的流不是 net.Conn 的时候返回 nil。
+	// 直接读写这个连接会破坏 WebSocket 的帧。
+	NetConn() net.Conn
+
+	// SetTimeouts 设置连接的超时配置，设置了 PingInterval 的时候会自动定时发送 Ping
+	SetTimeouts(timeouts Timeouts)
+
+	// SetKeepalive 设置自动发送 Ping 的间隔、等待 Pong 的超时和空闲超时，超时之后关闭连接
+	SetKeepalive(keepalive Keepalive)
 }
 
+// WebSocket 对象的状态，状态只会按照 CONNECTING、OPEN、CLOSING、CLOSED 的顺序变化
 const (
-	OPEN uint8 = iota + 1
+	// CONNECTING 表示握手还没有完成，创建出来的 WebSocket 对象都已经完成了握手，所以不会处于这个状态
+	CONNECTING uint8 = iota
+	// OPEN 表示可以收发 Message
+	OPEN
+	// CLOSING 表示已经发送了 ConnectionClose 或者正在关闭流，不能再发送任何帧，但是还可以读取对方回复的 ConnectionClose
 	CLOSING
+	// CLOSED 表示流已经被关闭
 	CLOSED
 )
 
 type webSocket struct {
-	writer   io.WriteCloser
-	reader   io.ReadCloser
-	mask     bool
-	status   uint8
+	id     string
+	writer io.WriteCloser
+	reader io.ReadCloser
+	mask   bool
+	role   Role
+	// status 是 CONNECTING、OPEN、CLOSING、CLOSED 中的一个，会被多个 goroutine 同时读写
+	status   atomic.Uint32
 	readLock *sync.Mutex
 	sendLock *sync.Mutex
+	// frameLock 保证每个帧都是完整写入的，控制帧只需要这个锁，所以可以插在一个 Message 的分片之间发送
+	frameLock *sync.Mutex
+	// writeBuffer 不为空时，每个帧会先写入缓冲区再写入连接，只能在持有 frameLock 的时候使用
+	writeBuffer *bufio.Writer
+	// decoder 只能在持有 readLock 的时候使用
+	decoder frameDecoder
+	// encoder 只能在持有 sendLock 的时候使用
+	encoder frameEncoder
+
+	background *backgroundReader
+	pings      *pingTracker
+
+	// pending 是等待 Pong 的时候收到的数据 Message，会在下一次 ReadMessage 的时候优先返回
+	pending     []*Message
+	pendingLock *sync.Mutex
+
+	pingPolicy     PingPolicy
+	pingPolicyLock *sync.Mutex
+	lastAutoPong   time.Time
+
+	closeInfo     *CloseInfo
+	closeInfoLock *sync.Mutex
+
+	handlers     controlHandlers
+	handlersLock *sync.Mutex
+
+	channels     messageChannels
+	channelsLock *sync.Mutex
+
+	queue     *writeQueue
+	queueLock *sync.Mutex
+
+	// fragmentSize 是 SetFragmentSize 设置的分片长度，fragment 是长度不是默认值时 sendMessage 使用的缓冲区，只能在持有 sendLock 的时候使用
+	fragmentSize atomic.Int64
+	fragment     []byte
+
+	// transferKeepalive 是 time.Duration，SetTransferKeepalive 可能和正在发送的 Message 同时调用
+	transferKeepalive atomic.Int64
+
+	// subprotocol 是握手时协商出来的子协议
+	subprotocol string
+
+	handshakeRequest  *http.Request
+	handshakeResponse *http.Response
+
+	// checksum 表示是否协商了 ChecksumExtension
+	checksum bool
+
+	// allowedRsv 是协商出来的扩展允许使用的保留标志位，格式和 Frame.rsv 一样
+	allowedRsv byte
+
+	// deflate 不为空表示协商了 permessage-deflate
+	deflate *deflateState
+
+	compressionLevel     atomic.Int32
+	compressionThreshold atomic.Int64
+	writeCompressionOff  atomic.Bool
+
+	// extensions 是协商出来的自定义扩展，按照协商的顺序排列
+	extensions []NegotiatedExtension
+
+	// reserved 是通过 AllowReservedOpCode 允许的保留 OpCode
+	reserved     map[OpCode]reservedOpCode
+	reservedLock *sync.Mutex
+
+	uploadLimit   atomic.Pointer[tokenBucket]
+	downloadLimit atomic.Pointer[tokenBucket]
+	inboundLimit  atomic.Pointer[inboundLimiter]
+
+	frameLimit atomic.Int64
+	readLimit  atomic.Int64
+	closeMode  atomic.Uint32
+	// streamsClosed 表示 closeStreams 已经被调用过，closeReceived 表示收到了对方的 ConnectionClose
+	streamsClosed atomic.Bool
+	closeReceived atomic.Bool
+	// writeInterrupted 表示 Close 或者 WriteMessageContext 打断了一个正在阻塞的写入，见 breakWrite
+	writeInterrupted atomic.Bool
+	skipUTF8         atomic.Bool
+
+	maskKeySource atomic.Pointer[MaskKeySource]
+
+	timeouts      atomic.Pointer[Timeouts]
+	keepalive     atomic.Pointer[Keepalive]
+	keepaliveOnce *sync.Once
+	// keepaliveWake 用于在配置变化的时候唤醒保活的 goroutine
+	keepaliveWake chan struct{}
+	// lastRead 是最近一次收到帧的时间，lastData 是最近一次收发数据帧的时间，单位都是纳秒
+	lastRead atomic.Int64
+	lastData atomic.Int64
+	// readDeadline 和 writeDeadline 是 SetReadDeadline 和 SetWriteDeadline 设置的截止时间，单位是纳秒，0 表示不限制
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+	// writingData 表示正在写入一个数据帧，WriteMessageContext 的 ctx 结束的时候只打断数据帧
+	writingData atomic.Bool
+	// sendContext 是 WriteMessageContext 正在发送的 Message 的 ctx，只能在持有 sendLock 的时候使用
+	sendContext context.Context
+
+	closeHooks     []func()
+	closeHooksLock *sync.Mutex
+	closeHooksDone bool
+
+	// interceptors 是 Intercept 添加的 MessageInterceptor，ReadMessage 每次读取的时候使用，不需要加锁
+	interceptors atomic.Pointer[[]MessageInterceptor]
+
+	// values 是 Set 保存的值，第一次调用 Set 的时候创建
+	values     map[any]any
+	valuesLock *sync.Mutex
 }
 
+// Role 表示 WebSocket 对象在连接中的角色，决定了发送的帧是否要掩码，以及收到的帧是否必须掩码
+type Role uint8
+
+const (
+	// RoleRaw 不检查收到的帧是否掩码，NewWebSocket 创建的 WebSocket 对象使用这个角色
+	RoleRaw Role = iota
+	// RoleClient 发送的帧都会掩码，收到掩码过的帧会使用 CloseProtocolError 关闭连接
+	RoleClient
+	// RoleServer 发送的帧不会掩码，收到没有掩码的帧会使用 CloseProtocolError 关闭连接
+	RoleServer
+)
+
 // NewWebSocket 使用 io.WriteCloser 和 io.ReadCloser 创建一个 WebSocket 对象。
 // io.WriteCloser 是输出流，io.ReadCloser 是输入流，不一定要同一条双向流的 io.WriteCloser 和 io.ReadCloser。
 // 这样的好处就是，可以使用 2 条单向的流，模拟成 1 条双向的流。
 // 使用 NewWebSocket 这个函数，就可以单独的去使用 WebSocket 协议，无需经过 HTTP 的 Connection Upgrade 到 WebSocket ，也就是可以让一条纯 TCP 连接去使用。
+// NewWebSocket 不会检查收到的帧是否掩码，需要按照 RFC 6455 检查的时候使用 NewWebSocketWithRole。
 func NewWebSocket(writer io.WriteCloser, reader io.ReadCloser, mask bool) WebSocket {
-	return &webSocket{
-		writer:   writer,
-		reader:   reader,
-		mask:     mask,
-		status:   OPEN,
-		readLock: &sync.Mutex{},
-		sendLock: &sync.Mutex{},
-	}
+	return newWebSocket(writer, reader, mask)
 }
 
-var tcpDialer = proxy.Dial
-var tlsDialer = func(ctx context.Context, network, address string) (net.Conn, error) {
-	rawConn, err := tcpDialer(ctx, network, address)
-	if err != nil {
-		return nil, err
-	}
-	conn := tls.Client(rawConn, &tls.Config{
-		ServerName: address[:strings.LastIndex(address, ":")],
-	})
-	err = conn.HandshakeContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-	return conn, nil
+// NewWebSocketWithRole 和 NewWebSocket 一样，但是由 role 决定发送的帧是否掩码，
+// 并且按照 RFC 6455 5.1 拒绝掩码方向不对的帧。
+func NewWebSocketWithRole(writer io.WriteCloser, reader io.ReadCloser, role Role) WebSocket {
+	w := newWebSocket(writer, reader, role == RoleClient)
+	w.role = role
+	return w
 }
 
-// New 使用 url 链接来创建一个 WebSocket 对象。
-// 可以通过设置环境变量 ALL_PROXY 来使用代理服务器。
-//
-// 例子1：wss://ws.postman-echo.com/raw/
-// 例子2：http://example.com/ws
-func New(url string) (WebSocket, error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+// NewBufferedWebSocket 和 NewWebSocketWithRole 一样，但是通过 buffered 读写，
+// 用于在 Hijack 或者自己读取握手请求之后继续使用同一对 bufio.Reader 和 bufio.Writer：
+// buffered.Reader 中已经缓冲的数据会先被读取，buffered.Writer 中还没有写出去的数据会先被写出，之后用作发送帧的缓冲区。
+// buffered 中为空的一边直接使用 writer 或者 reader。
+func NewBufferedWebSocket(writer io.WriteCloser, reader io.ReadCloser, buffered *bufio.ReadWriter, role Role) (WebSocket, error) {
+	if buffered != nil && buffered.Reader != nil {
+		reader = reuseReadBuffer(buffered.Reader, reader, 0)
+	}
+	w := newWebSocket(writer, reader, role == RoleClient)
+	w.role = role
+	if buffered != nil && buffered.Writer != nil {
+		err := buffered.Writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+		w.writeBuffer = buffered.Writer
 	}
-	return Connect(context.Background(), req)
+	return w, nil
 }
 
-// Connect 使用一个 HTTP 请求来创建 WebSocket 对象。
-// 可以通过设置环境变量 ALL_PROXY 来使用代理服务器。
-// 传入 HTTP 请求的方法，可以用于需要验证的 WebSocket 连接，自定义添加验证信息到请求头中。
-func Connect(ctx context.Context, request *http.Request) (WebSocket, error) {
-	dialer := tcpDialer
-	if request.URL.Scheme == "https" || request.URL.Scheme == "wss" {
-		dialer = tlsDialer
+func newWebSocket(writer io.WriteCloser, reader io.ReadCloser, mask bool) *webSocket {
+	w := &webSocket{
+		id:        newConnectionID(),
+		writer:    writer,
+		reader:    reader,
+		mask:      mask,
+		readLock:  &sync.Mutex{},
+		sendLock:  &sync.Mutex{},
+		frameLock: &sync.Mutex{},
+
+		pings:       newPingTracker(),
+		pendingLock: &sync.Mutex{},
+
+		pingPolicyLock: &sync.Mutex{},
+		closeInfoLock:  &sync.Mutex{},
+		closeHooksLock: &sync.Mutex{},
+		keepaliveOnce:  &sync.Once{},
+		keepaliveWake:  make(chan struct{}, 1),
+		reservedLock:   &sync.Mutex{},
+		handlersLock:   &sync.Mutex{},
+		channelsLock:   &sync.Mutex{},
+		queueLock:      &sync.Mutex{},
+		valuesLock:     &sync.Mutex{},
 	}
-	return ConnectWithDialer(ctx, dialer, request)
+	w.status.Store(uint32(OPEN))
+	w.lastRead.Store(time.Now().UnixNano())
+	w.lastData.Store(w.lastRead.Load())
+	w.compressionLevel.Store(flate.DefaultCompression)
+	return w
 }
 
-// ConnectWithDialer 传入自定义 dialer，然后创建一个 WebSocket 。
-// 这个函数主要考虑是用于自定义代理方法来连接目标 WebSocket。
-func ConnectWithDialer(ctx context.Context, dialer func(context.Context, string, string) (net.Conn, error), request *http.Request) (WebSocket, error) {
+func (w *webSocket) Send(text string) error {
+	return w.SendMessage(&Message{
+		Reader: newBytesBuffer([]byte(text)),
+		OpCode: TextFrame,
+	})
+}
 
-	if len(request.RemoteAddr) < 1 {
-		request.RemoteAddr = request.Host
-		if len(request.URL.Port()) < 1 {
-			if request.URL.Scheme == "https" || request.URL.Scheme == "wss" {
-				request.RemoteAddr += ":443"
-			} else {
-				request.RemoteAddr += ":80"
-			}
-		}
-	}
-	conn, err := dialer(ctx, "tcp", request.RemoteAddr)
-	if err != nil {
-		return nil, err
-	}
+func (w *webSocket) Ping() error {
+	_, err := w.PingContext(context.Background())
+	return err
+}
 
-	request.Header.Set("sec-websocket-key", getSecWebsocketKey())
-	request.Header.Set("sec-websocket-version", "13")
-	request.Header.Set("connection", "upgrade")
-	request.Header.Set("upgrade", "websocket")
+func (w *webSocket) Close() error {
+	return w.CloseWithCode(CloseNoStatusReceived, "")
+}
 
-	err = request.Write(conn)
-	if err != nil {
-		return nil, err
+// closeWithCode 发送带有关闭状态码的 ConnectionClose 帧，然后关闭流。
+// code 为 CloseNoStatusReceived 时，发送的 ConnectionClose 帧不带内容。
+// 已经发送过 ConnectionClose 或者已经关闭的时候只会关闭流，所以重复关闭不会返回错误。
+func (w *webSocket) closeWithCode(code uint16, reason string) error {
+	w.interruptWrite()
+	err := w.sendControl(ConnectionClose, closePayload(code, reason))
+	if err != nil && !errors.Is(err, ErrClosedStatus) {
+		return err
 	}
+	return w.closeStreams()
+}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), request)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 101 {
-		return nil, errors.New(resp.Status)
-	}
-	if !strings.Contains(strings.ToLower(resp.Header.Get("connection")), "upgrade") {
-		return nil, errors.New("WebSocket connection to '" + request.URL.String() + "' failed")
+// interruptWrite 在有其他 goroutine 正在写入帧的时候打断它，否则 Close 要等到它写完，
+// 对方不读取的时候会一直等待，或者等到 Timeouts 的 Write 超时。
+// 写入流支持截止时间的时候设置一个已经过去的截止时间，否则直接关闭流。
+// 被打断的帧只写入了一部分，之后的数据对方已经无法解析，所以被打断的写入会关闭流并返回 ErrClosedStatus。
+func (w *webSocket) interruptWrite() {
+	if w.frameLock.TryLock() {
+		w.frameLock.Unlock()
+		return
 	}
-	if !strings.Contains(strings.ToLower(resp.Header.Get("upgrade")), "websocket") {
-		return nil, errors.New("WebSocket connection to '" + request.URL.String() + "' failed")
+	w.breakWrite()
+}
+
+// state 返回 WebSocket 对象当前的状态
+func (w *webSocket) state() uint8 {
+	return uint8(w.status.Load())
+}
+
+// closeStreams 按照 CloseMode 关闭 WebSocket 的输入输出流，之后 WebSocket 就进入 CLOSED 状态。
+// 只有第一次调用会关闭流，之后的调用直接返回 nil。
+func (w *webSocket) closeStreams() error {
+	if !w.streamsClosed.CompareAndSwap(false, true) {
+		return nil
 	}
-	secAcceptKey, err := getSecAcceptKey(request.Header.Get("sec-websocket-key"))
-	if err != nil {
-		return nil, err
+	w.status.Store(uint32(CLOSING))
+	defer w.runCloseHooks()
+	closeErr := &StreamCloseError{}
+	switch CloseMode(w.closeMode.Load()) {
+	case CloseBothStreams:
+		closeErr.Writer = closeStream(w.writer)
+		closeErr.Reader = closeStream(w.reader)
+	case CloseWriterOnly:
+		closeErr.Writer = closeStream(w.writer)
 	}
-	if secAcceptKey != resp.Header.Get("sec-websocket-accept") {
-		return nil, errors.New("WebSocket connection to '" + request.URL.String() + "' failed")
+	w.status.Store(uint32(CLOSED))
+	if closeErr.Writer != nil || closeErr.Reader != nil {
+		return closeErr
 	}
-	return NewWebSocket(conn, conn, true), nil
+	return nil
 }
 
-var ErrHijackResponseWriterFailed = errors.New("hijack the http.ResponseWriter failed")
-
-// Pair 用于 HTTP 服务端接收一个 WebSocket 对象
-//
-// 使用例子：
-//
-//	http.HandleFunc("/ws",func(w http.ResponseWriter,request *http.Request){
-//		ws,err := websocket.Pair(w,request)
-//		if err != nil {
-//			return
-//		}
-//		fmt.Println(ws)
-//	})
-//	http.ListenAndServe("0.0.0.0:8080")
-func Pair(w http.ResponseWriter, req *http.Request) (WebSocket, error) {
-	hijack, ok := w.(http.Hijacker)
-	if !ok {
-		return nil, ErrHijackResponseWriterFailed
-	}
-	conn, _, err := hijack.Hijack()
-	if err != nil {
-		return nil, err
+// closeStream 关闭一条流，流已经被关闭的错误会被忽略
+func closeStream(closer io.Closer) error {
+	err := closer.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		return err
 	}
-	return pair(conn, conn, req)
+	return nil
 }
 
-// ServerPair 用于传入 io.WriteCloser 和 io.ReadCloser 来创建 WebSocket。
-// 可以用于自己编写的 WEB 服务来创建一个 WebSocket 对象。
-func ServerPair(writer io.WriteCloser, reader io.ReadCloser) (WebSocket, error) {
-	req, err := http.ReadRequest(bufio.NewReader(reader))
-	if err != nil {
-		return nil, err
+// addCloseHook 添加一个在 WebSocket 关闭之后执行的函数，如果已经关闭就会立刻执行
+func (w *webSocket) addCloseHook(hook func()) {
+	w.closeHooksLock.Lock()
+	if !w.closeHooksDone {
+		w.closeHooks = append(w.closeHooks, hook)
+		w.closeHooksLock.Unlock()
+		return
 	}
-	return pair(writer, reader, req)
+	w.closeHooksLock.Unlock()
+	hook()
 }
 
-func pair(writer io.WriteCloser, reader io.ReadCloser, request *http.Request) (WebSocket, error) {
-	if !strings.Contains(strings.ToLower(request.Header.Get("connection")), "upgrade") {
-		return nil, errors.New("request header `connection` is not equal to 'upgrade'")
-	}
-	if !strings.Contains(strings.ToLower(request.Header.Get("upgrade")), "websocket") {
-		return nil, errors.New("request header `upgrade` is not equal to 'websocket'")
+func (w *webSocket) runCloseHooks() {
+	w.closeHooksLock.Lock()
+	if w.closeHooksDone {
+		w.closeHooksLock.Unlock()
+		return
 	}
-	if request.Header.Get("sec-websocket-version") != "13" {
-		return nil, errors.New("request header `sec-websocket-version` is not equal to '13'")
+	w.closeHooksDone = true
+	hooks := w.closeHooks
+	w.closeHooks = nil
+	w.closeHooksLock.Unlock()
+	for _, hook := range hooks {
+		hook()
 	}
+}
 
-	secAcceptKey, err := getSecAcceptKey(request.Header.Get("sec-websocket-key"))
-	if err != nil {
-		return nil, err
-	}
-	response := []string{
-		"HTTP/1.1 101 Switching Protocols",
-		"Sec-Websocket-Accept: " + secAcceptKey,
-		"Upgrade: websocket",
-		"Connection: upgrade",
-		"\r\n",
+func (w *webSocket) ID() string {
+	return w.id
+}
+
+func (w *webSocket) Set(key, value any) {
+	w.valuesLock.Lock()
+	defer w.valuesLock.Unlock()
+	if value == nil {
+		delete(w.values, key)
+		return
 	}
-	_, err = writer.Write([]byte(strings.Join(response, "\r\n")))
-	if err != nil {
-		return nil, err
+	if w.values == nil {
+		w.values = map[any]any{}
 	}
-	return NewWebSocket(writer, reader, false), nil
+	w.values[key] = value
 }
 
-func (w *webSocket) Send(text string) error {
-	return w.SendMessage(&Message{
-		Reader: newBytesBuffer([]byte(text)),
-		OpCode: TextFrame,
-	})
+func (w *webSocket) Value(key any) any {
+	w.valuesLock.Lock()
+	defer w.valuesLock.Unlock()
+	return w.values[key]
 }
 
-func (w *webSocket) Ping() error {
-	return w.ping()
+// LocalAddr 返回本地地址，底层的流不是 net.Conn 的时候返回一个表示流的地址
+func (w *webSocket) LocalAddr() net.Addr {
+	if conn := w.NetConn(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return streamAddr("local")
 }
 
-func (w *webSocket) Close() error {
-	err := w.SendMessage(&Message{
-		OpCode: ConnectionClose,
-	})
-	if err != nil {
-		return err
+// RemoteAddr 返回对方的地址，底层的流不是 net.Conn 的时候返回一个表示流的地址
+func (w *webSocket) RemoteAddr() net.Addr {
+	if conn := w.NetConn(); conn != nil {
+		return conn.RemoteAddr()
 	}
-	w.status = CLOSING
-	for _, closeFn := range []func() error{w.writer.Close, w.reader.Close} {
-		if closeErr := closeFn(); closeErr != nil && errors.Is(err, net.ErrClosed) {
-			return closeErr
-		}
+	return streamAddr("remote")
+}
+
+func (w *webSocket) Subprotocol() string {
+	return w.subprotocol
+}
+
+func (w *webSocket) Extensions() []ExtensionOffer {
+	if w.handshakeResponse == nil {
+		return nil
 	}
-	w.status = CLOSED
-	return nil
+	return ParseExtensions(w.handshakeResponse.Header)
+}
+
+func (w *webSocket) HandshakeRequest() *http.Request {
+	return w.handshakeRequest
+}
+
+func (w *webSocket) HandshakeResponse() *http.Response {
+	return w.handshakeResponse
 }
 
 func (w *webSocket) Status() uint8 {
-	return w.status
+	return w.state()
 }
 
 var (
-	ErrClosedStatus = errors.New("WebSocket is already in CLOSING or CLOSED state")
+	ErrClosedStatus  = errors.New("WebSocket is already in CLOSING or CLOSED state")
+	ErrFrameTooLarge = errors.New("frame payload exceeds the frame limit")
+
+	ErrFragmentedControlFrame = errors.New("control frame must not be fragmented")
+	ErrReservedBitsSet        = errors.New("frame has reserved bits set that no negotiated extension defines")
+	ErrReservedOpCode         = errors.New("frame uses a reserved opcode")
+	ErrInvalidPayloadLength   = errors.New("frame payload length has the most significant bit set")
+	ErrUnexpectedContinuation = errors.New("continuation frame without a message in progress")
+	ErrUnmaskedClientFrame    = errors.New("server received an unmasked frame from the client")
+	ErrMaskedServerFrame      = errors.New("client received a masked frame from the server")
 )
 
-func (w *webSocket) ping() error {
-	message := &Message{
-		OpCode: Ping,
-	}
-	err := w.SendMessage(message)
-	if err != nil {
+func (w *webSocket) SetFrameLimit(limit int64) {
+	w.frameLimit.Store(limit)
+}
+
+func (w *webSocket) sendFrame(ctx context.Context, frame *Frame) error {
+	return w.sendFrameDeadline(ctx, frame, time.Time{})
+}
+
+// sendFrameDeadline 发送一个帧，deadline 不为零值时代替 Timeouts 作为写入的截止时间
+func (w *webSocket) sendFrameDeadline(ctx context.Context, frame *Frame, deadline time.Time) error {
+	return w.writeFrame(frame.OpCode, deadline, func(output io.Writer) error {
+		if frame.Mask {
+			// 每个帧都要使用新的掩码 key
+			frame.maskKey = w.maskKey()
+			frame.MaskKey = frame.maskKey[:]
+		}
+		if frame.data != nil && w.writeBuffer == nil {
+			return writeFrameData(output, frame)
+		}
+		if w.writeBuffer != nil {
+			// 帧头和内容先写入缓冲区，再一次性写入连接
+			w.writeBuffer.Reset(output)
+			_, err := io.Copy(w.writeBuffer, encodeFrame(ctx, frame))
+			if err != nil {
+				return err
+			}
+			return w.writeBuffer.Flush()
+		}
+		_, err := io.Copy(output, encodeFrame(ctx, frame))
 		return err
+	})
+}
+
+// writeFrame 在持有 frameLock 的时候设置写入的截止时间，然后使用 write 写入一个 opCode 类型的帧，
+// 写入出错的时候关闭连接。deadline 不为零值时代替 Timeouts 作为写入的截止时间。
+func (w *webSocket) writeFrame(opCode OpCode, deadline time.Time, write func(output io.Writer) error) error {
+	w.frameLock.Lock()
+	defer w.frameLock.Unlock()
+	if w.state() > OPEN {
+		return ErrClosedStatus
 	}
-	for {
-		message, err = w.ReadMessage()
-		if err != nil {
-			return err
+	if !opCode.IsControl() {
+		// 数据帧只会由持有 sendLock 的 goroutine 写入，所以可以读取 sendContext。
+		// 先设置 writingData 再检查 ctx，这样 ctx 在这之后结束的时候，WriteMessageContext 一定能看到 writingData 并打断写入
+		w.writingData.Store(true)
+		defer w.writingData.Store(false)
+		if ctx := w.sendContext; ctx != nil && ctx.Err() != nil {
+			return w.abort(ctx.Err())
 		}
-		if message.OpCode != Pong {
-			continue
-		} else if _, err = io.Copy(blackHole, message); err != nil {
-			return err
-		} else {
-			return nil
+	}
+	if w.writeInterrupted.Load() {
+		// interruptWrite 设置的截止时间已经过去，只有 ConnectionClose 会在被打断的写入正好完成的时候执行到这里，
+		// 需要恢复原来的截止时间
+		_ = setWriteDeadline(w.writer, earlierDeadline(w.writeDeadline.Load(), time.Time{}))
+	}
+	if deadline.IsZero() {
+		timeouts := w.getTimeouts()
+		timeout := timeouts.Write
+		if opCode == ConnectionClose && timeouts.Close > 0 {
+			timeout = timeouts.Close
 		}
+		if timeout > 0 {
+			deadline = earlierDeadline(w.writeDeadline.Load(), time.Now().Add(timeout))
+		}
+	} else {
+		// WriteControl 指定的截止时间只用于这个帧，之后恢复 SetWriteDeadline 设置的截止时间
+		defer func() {
+			_ = setWriteDeadline(w.writer, earlierDeadline(w.writeDeadline.Load(), time.Time{}))
+		}()
+	}
+	if !deadline.IsZero() {
+		_ = setWriteDeadline(w.writer, deadline)
+	}
+	err := write(w.output())
+	if err != nil {
+		// 写入被 Close 打断的时候返回确定的错误，而不是底层的流被关闭或者超时的错误
+		if w.writeInterrupted.Load() {
+			// 被 WriteMessageContext 的 ctx 打断的时候 Message 只发送了一部分，连接不能再使用
+			if ctx := w.sendContext; !opCode.IsControl() && ctx != nil && ctx.Err() != nil {
+				return w.abort(ctx.Err())
+			}
+			_ = w.closeStreams()
+			return ErrClosedStatus
+		}
+		if w.state() > OPEN {
+			return ErrClosedStatus
+		}
+		return w.abort(err)
+	}
+	if !opCode.IsControl() {
+		w.lastData.Store(time.Now().UnixNano())
+	}
+	if opCode == ConnectionClose {
+		w.status.CompareAndSwap(uint32(OPEN), uint32(CLOSING))
 	}
+	return nil
 }
 
-func (w *webSocket) responsePong(ping *Message) error {
-	ping.OpCode = Pong
-	return w.SendMessage(ping)
+// breakWrite 让正在阻塞的写入返回错误：写入流支持截止时间的时候设置一个已经过去的截止时间，否则直接关闭流
+func (w *webSocket) breakWrite() {
+	w.writeInterrupted.Store(true)
+	if _, ok := w.writer.(writeDeadliner); !ok || setWriteDeadline(w.writer, time.Unix(1, 0)) != nil {
+		_ = w.closeStreams()
+	}
 }
 
-func (w *webSocket) sendFrame(ctx context.Context, frame *Frame) error {
-	if w.status > OPEN {
-		return ErrClosedStatus
+// setWriteBufferSize 设置发送帧使用的缓冲区大小，为 0 时不使用缓冲区
+func (w *webSocket) setWriteBufferSize(size int) {
+	if size > 0 {
+		w.writeBuffer = bufio.NewWriterSize(nil, size)
 	}
-	_, err := io.Copy(w.writer, contextReader(ctx, frame.Encode()))
-	return err
+}
+
+// encodeFrame 编码 frame，ctx 不会结束的时候直接返回 Frame.Encode 的结果，这样 io.Copy 可以使用它的 WriteTo
+func encodeFrame(ctx context.Context, frame *Frame) io.Reader {
+	if ctx.Done() == nil {
+		return frame.Encode()
+	}
+	return contextReader(ctx, frame.Encode())
+}
+
+// sendControl 发送一个控制帧。它不需要等待正在发送的 Message 结束，
+// 所以在读取 Message 的时候（例如边读边转发的时候）也可以回复 Pong 或者关闭连接。
+func (w *webSocket) sendControl(opCode OpCode, payload []byte) error {
+	return w.sendControlDeadline(opCode, payload, time.Time{})
+}
+
+func (w *webSocket) sendControlDeadline(opCode OpCode, payload []byte, deadline time.Time) error {
+	if len(payload) > maxControlPayloadLength {
+		return ErrControlPayloadTooLong
+	}
+	return w.sendFrameDeadline(context.Background(), &Frame{
+		Payload: &io.LimitedReader{
+			R: newBytesBuffer(payload),
+			N: int64(len(payload)),
+		},
+		Fin:    true,
+		Mask:   w.mask,
+		OpCode: opCode,
+	}, deadline)
 }
 
 func (w *webSocket) readFrame(ctx context.Context) (*Frame, error) {
-	if w.status > OPEN {
-		return nil, ErrClosedStatus
+	// CLOSING 状态下还需要读取对方回复的 ConnectionClose
+	if w.state() == CLOSED {
+		return nil, w.closedError()
+	}
+	if timeout := w.getTimeouts().ReadIdle; timeout > 0 {
+		_ = setReadDeadline(w.reader, earlierDeadline(w.readDeadline.Load(), time.Now().Add(timeout)))
+	}
+	frame, err := w.decoder.decode(ctx, w.input(ctx))
+	if err != nil {
+		// 读取被 Close 打断，或者对方在关闭握手的过程中断开的时候，返回确定的关闭错误
+		if w.state() > OPEN {
+			_ = w.closeStreams()
+			return nil, w.closedError()
+		}
+		return nil, w.abort(err)
+	}
+	w.lastRead.Store(time.Now().UnixNano())
+	if !frame.OpCode.IsControl() {
+		w.lastData.Store(w.lastRead.Load())
+	}
+	if frame.rsv()&^w.allowedRsv != 0 {
+		_ = w.fail(CloseProtocolError, ErrReservedBitsSet.Error())
+		return nil, ErrReservedBitsSet
+	}
+	// permessage-deflate 只能在 Message 的第一个数据帧上设置 Rsv1，参考 RFC 7692 6
+	if w.deflate != nil && frame.Rsv1 && (frame.OpCode.IsControl() || frame.OpCode == ContinuationFrame) {
+		_ = w.fail(CloseProtocolError, ErrReservedBitsSet.Error())
+		return nil, ErrReservedBitsSet
+	}
+	// 64 位的长度最高位必须是 0，参考 RFC 6455 5.2
+	if frame.Payload.N < 0 {
+		_ = w.fail(CloseProtocolError, ErrInvalidPayloadLength.Error())
+		return nil, ErrInvalidPayloadLength
+	}
+	if w.role == RoleServer && !frame.Mask {
+		_ = w.fail(CloseProtocolError, ErrUnmaskedClientFrame.Error())
+		return nil, ErrUnmaskedClientFrame
+	}
+	if w.role == RoleClient && frame.Mask {
+		_ = w.fail(CloseProtocolError, ErrMaskedServerFrame.Error())
+		return nil, ErrMaskedServerFrame
+	}
+	if _, ok := w.reservedAllowed(frame.OpCode); frame.OpCode.IsReserved() && !ok {
+		_ = w.fail(CloseProtocolError, ErrReservedOpCode.Error())
+		return nil, ErrReservedOpCode
+	}
+	// 控制帧不能分片，内容不能超过 125 字节，参考 RFC 6455 5.5
+	if frame.OpCode.IsControl() {
+		if !frame.Fin {
+			_ = w.fail(CloseProtocolError, ErrFragmentedControlFrame.Error())
+			return nil, ErrFragmentedControlFrame
+		}
+		if frame.Payload.N > maxControlPayloadLength {
+			_ = w.fail(CloseProtocolError, ErrControlPayloadTooLong.Error())
+			return nil, ErrControlPayloadTooLong
+		}
+	}
+	if limit := w.frameLimit.Load(); limit > 0 && frame.Payload.N > limit {
+		_ = w.fail(CloseMessageTooBig, ErrFrameTooLarge.Error())
+		return nil, ErrFrameTooLarge
 	}
-	frame := &Frame{}
-	err := frame.Decode(ctx, w.reader)
+	err = w.limitInbound(ctx, frame)
 	if err != nil {
 		return nil, err
 	}
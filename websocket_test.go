@@ -0,0 +1,578 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// rawFrame 按照 RFC 6455 5.2 手动编码一个没有掩码的帧头，lengthCode 是第二个字节中的 7 位长度，
+// 为 126 和 127 时后面分别跟 16 位和 64 位的扩展长度
+func rawFrame(fin bool, opCode OpCode, lengthCode byte, payload []byte) []byte {
+	first := byte(opCode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, lengthCode}
+	switch lengthCode {
+	case 126:
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	case 127:
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+type discardCloser struct {
+	io.Writer
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+// maskedFrame 编码一个使用掩码的完整帧，用于模拟客户端发送给服务端的帧
+func maskedFrame(opCode OpCode, payload []byte) []byte {
+	frame := &Frame{
+		Fin:     true,
+		Mask:    true,
+		MaskKey: []byte{1, 2, 3, 4},
+		OpCode:  opCode,
+		Payload: &io.LimitedReader{R: bytes.NewReader(payload), N: int64(len(payload))},
+	}
+	encoded, _ := io.ReadAll(frame.Encode())
+	return encoded
+}
+
+// sentFrame 是从 WebSocket 写出的数据中解码出来的一个帧
+type sentFrame struct {
+	OpCode  OpCode
+	Fin     bool
+	Mask    bool
+	Payload []byte
+}
+
+// decodeFrames 解码 data 中的所有帧，掩码过的内容会被还原
+func decodeFrames(t *testing.T, data []byte) []sentFrame {
+	t.Helper()
+	reader := bytes.NewReader(data)
+	decoder := &frameDecoder{}
+	var frames []sentFrame
+	for reader.Len() > 0 {
+		frame, err := decoder.decode(context.Background(), reader)
+		if err != nil {
+			t.Fatalf("decode sent frames % x: %v", data, err)
+		}
+		payload, err := io.ReadAll(frame.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, sentFrame{OpCode: frame.OpCode, Fin: frame.Fin, Mask: frame.Mask, Payload: payload})
+	}
+	return frames
+}
+
+func sentCloseCode(t *testing.T, data []byte) uint16 {
+	t.Helper()
+	frames := decodeFrames(t, data)
+	if len(frames) < 1 || frames[len(frames)-1].OpCode != ConnectionClose {
+		t.Fatalf("sent frames %+v, want a close frame at the end", frames)
+	}
+	payload := frames[len(frames)-1].Payload
+	if len(payload) < 2 {
+		return CloseNoStatusReceived
+	}
+	return binary.BigEndian.Uint16(payload)
+}
+
+func TestConnectionID(t *testing.T) {
+	const count = 1000
+	ids := make(chan string, count)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false).ID()
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := map[string]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %q was assigned twice", id)
+		}
+		// 同一个进程中的 ID 使用相同的前缀
+		if !strings.HasPrefix(id, connectionIDPrefix+"-") {
+			t.Fatalf("ID %q does not start with the process prefix %q", id, connectionIDPrefix)
+		}
+		seen[id] = true
+	}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	if ws.ID() != ws.ID() {
+		t.Fatal("ID() changed between calls")
+	}
+}
+
+func TestConnectionAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	defer server.Close()
+
+	ws := NewWebSocket(server, server, false)
+	if ws.LocalAddr().String() != listener.Addr().String() || ws.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("LocalAddr() = %v, RemoteAddr() = %v, want %v and %v", ws.LocalAddr(), ws.RemoteAddr(), listener.Addr(), client.LocalAddr())
+	}
+
+	// 不是 net.Conn 的流返回表示流的地址
+	ws = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	local, remote := ws.LocalAddr(), ws.RemoteAddr()
+	if local.Network() != "stream" || remote.Network() != "stream" || local.String() != "local" || remote.String() != "remote" {
+		t.Fatalf("LocalAddr() = %s %s, RemoteAddr() = %s %s, want stream addresses", local.Network(), local, remote.Network(), remote)
+	}
+}
+
+func TestNewBufferedWebSocket(t *testing.T) {
+	// 已经缓冲的帧先被读取，之后继续从 reader 读取
+	input := bufio.NewReader(io.MultiReader(strings.NewReader("\x81\x05first"), strings.NewReader("\x81\x06second")))
+	if _, err := input.Peek(7); err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	buffered := bufio.NewReadWriter(input, bufio.NewWriterSize(output, 4096))
+	_, _ = buffered.WriteString("pending")
+	ws, err := NewBufferedWebSocket(discardCloser{output}, io.NopCloser(strings.NewReader("")), buffered, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if data := readText(t, ws); data != want {
+			t.Fatalf("ReadMessage() = %q, want %q", data, want)
+		}
+	}
+	// 还没有写出去的数据先被写出，之后的帧使用 buffered.Writer 作为缓冲区
+	if output.String() != "pending" {
+		t.Fatalf("output = %q, want pending", output.String())
+	}
+	if err = ws.Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, output.Bytes()[len("pending"):])
+	if len(frames) != 1 || string(frames[0].Payload) != "hello" {
+		t.Fatalf("sent frames %+v, want hello", frames)
+	}
+	if ws.(*webSocket).writeBuffer != buffered.Writer {
+		t.Fatal("NewBufferedWebSocket() did not reuse buffered.Writer")
+	}
+}
+
+func TestReuseReadBuffer(t *testing.T) {
+	rc := io.NopCloser(strings.NewReader("rest"))
+	buffered := bufio.NewReaderSize(strings.NewReader("head"), 16)
+	if _, err := buffered.Peek(4); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		buffered *bufio.Reader
+		size     int
+		direct   bool
+	}{
+		{name: "no buffered reader", size: 0, direct: true},
+		{name: "empty buffered reader", buffered: bufio.NewReader(strings.NewReader("")), direct: true},
+		{name: "buffered data", buffered: buffered},
+		{name: "larger buffer", buffered: bufio.NewReaderSize(strings.NewReader(""), 16), size: 4096},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := reuseReadBuffer(test.buffered, rc, test.size)
+			if (reader == rc) != test.direct {
+				t.Fatalf("reuseReadBuffer() returned %T, want direct %v", reader, test.direct)
+			}
+		})
+	}
+	// 已经缓冲的数据在 rc 的数据之前
+	data, err := io.ReadAll(reuseReadBuffer(buffered, io.NopCloser(strings.NewReader("rest")), 0))
+	if err != nil || string(data) != "head" {
+		t.Fatalf("ReadAll() = %q, %v, want head", data, err)
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	type userKey struct{}
+	type roomKey struct{}
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	if v := ws.Value(userKey{}); v != nil {
+		t.Fatalf("Value() before Set = %v, want nil", v)
+	}
+	ws.Set(userKey{}, "alice")
+	ws.Set(roomKey{}, 7)
+	if v := ws.Value(userKey{}); v != "alice" {
+		t.Fatalf("Value(userKey) = %v, want alice", v)
+	}
+	// 不同类型的 key 不会冲突
+	if v := ws.Value(roomKey{}); v != 7 {
+		t.Fatalf("Value(roomKey) = %v, want 7", v)
+	}
+	ws.Set(userKey{}, nil)
+	if v := ws.Value(userKey{}); v != nil {
+		t.Fatalf("Value() after deleting = %v, want nil", v)
+	}
+
+	// 可以在多个 goroutine 中同时使用
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.Set(i, i)
+			_ = ws.Value(i)
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if v := ws.Value(i); v != i {
+			t.Fatalf("Value(%d) = %v, want %d", i, v, i)
+		}
+	}
+}
+
+func TestInvalidControlFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{
+			name:  "fragmented ping",
+			frame: rawFrame(false, Ping, 5, []byte("hello")),
+			err:   ErrFragmentedControlFrame,
+		},
+		{
+			name:  "close with 126 bytes",
+			frame: rawFrame(true, ConnectionClose, 126, append([]byte{0x03, 0xe8}, bytes.Repeat([]byte{'a'}, 124)...)),
+			err:   ErrControlPayloadTooLong,
+		},
+		{
+			name:  "pong with 64 bit length",
+			frame: rawFrame(true, Pong, 127, bytes.Repeat([]byte{'a'}, 127)),
+			err:   ErrControlPayloadTooLong,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(test.frame)), false)
+			_, _, err := ws.ReadAllMessage()
+			if err != test.err {
+				t.Fatalf("ReadAllMessage() error = %v, want %v", err, test.err)
+			}
+			info := ws.CloseReason()
+			if info == nil || info.Code != CloseProtocolError {
+				t.Fatalf("CloseReason() = %+v, want code %d", info, CloseProtocolError)
+			}
+			// 发送的 ConnectionClose：FIN 和 OpCode，长度，状态码 1002
+			sent := output.Bytes()
+			if len(sent) < 4 || sent[0] != 0x88 || binary.BigEndian.Uint16(sent[2:4]) != CloseProtocolError {
+				t.Fatalf("sent close frame % x, want status code %d", sent, CloseProtocolError)
+			}
+		})
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	// 帧头声明了 2 GB 的内容，但是后面没有任何内容，超过限制的帧需要在读取内容之前被拒绝
+	header := binary.BigEndian.AppendUint64([]byte{0x82, 127}, 2<<30)
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(header)), false)
+	ws.SetFrameLimit(1024)
+	if _, err := ws.ReadMessage(); err != ErrFrameTooLarge {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if code := sentCloseCode(t, output.Bytes()); code != CloseMessageTooBig {
+		t.Fatalf("sent close code %d, want %d", code, CloseMessageTooBig)
+	}
+
+	// 限制的是单个帧，每个分片都没有超过限制的 Message 可以正常读取
+	input := append(rawFrame(false, BinaryFrame, 4, []byte("abcd")), rawFrame(true, ContinuationFrame, 4, []byte("efgh"))...)
+	ws = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetFrameLimit(4)
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "abcdefgh" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want abcdefgh", data, err)
+	}
+}
+
+func TestUTF8Validation(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		disable bool
+		err     error
+	}{
+		{name: "valid", input: rawFrame(true, TextFrame, 7, []byte("héllo!"))},
+		// 一个字符被分在两个分片中
+		{name: "split between fragments", input: append(rawFrame(false, TextFrame, 2, []byte{'h', 0xc3}), rawFrame(true, ContinuationFrame, 1, []byte{0xa9})...)},
+		{name: "invalid byte", input: rawFrame(true, TextFrame, 3, []byte{'h', 0xff, 'i'}), err: ErrInvalidUTF8},
+		{name: "truncated character", input: rawFrame(true, TextFrame, 2, []byte{'h', 0xc3}), err: ErrInvalidUTF8},
+		{name: "surrogate", input: rawFrame(true, TextFrame, 3, []byte{0xed, 0xa0, 0x80}), err: ErrInvalidUTF8},
+		{name: "disabled", input: rawFrame(true, TextFrame, 3, []byte{'h', 0xff, 'i'}), disable: true},
+		{name: "binary", input: rawFrame(true, BinaryFrame, 3, []byte{'h', 0xff, 'i'})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(test.input)), false)
+			ws.SetUTF8Validation(!test.disable)
+			message, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 每次只读取 1 个字节，字符总是被分在多次读取之间
+			_, err = io.ReadAll(iotest.OneByteReader(message))
+			if err != test.err {
+				t.Fatalf("read error = %v, want %v", err, test.err)
+			}
+			if test.err == nil {
+				if output.Len() != 0 {
+					t.Fatalf("sent % x for a valid message", output.Bytes())
+				}
+				return
+			}
+			if code := sentCloseCode(t, output.Bytes()); code != CloseInvalidFramePayloadData {
+				t.Fatalf("sent close code %d, want %d", code, CloseInvalidFramePayloadData)
+			}
+		})
+	}
+}
+
+func TestReservedBits(t *testing.T) {
+	for _, rsv := range []byte{0b100, 0b010, 0b001} {
+		input := rawFrame(true, TextFrame, 2, []byte("hi"))
+		input[0] |= rsv << 4
+		// Decode 把保留标志位交给扩展使用
+		frame := &Frame{}
+		if err := frame.Decode(context.Background(), bytes.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		if frame.rsv() != rsv {
+			t.Fatalf("decoded rsv %03b, want %03b", frame.rsv(), rsv)
+		}
+
+		// 没有协商扩展的时候，设置了保留标志位的帧需要使用 1002 拒绝
+		output := &bytes.Buffer{}
+		ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+		if _, err := ws.ReadMessage(); err != ErrReservedBitsSet {
+			t.Fatalf("rsv %03b: ReadMessage() error = %v, want %v", rsv, err, ErrReservedBitsSet)
+		}
+		if code := sentCloseCode(t, output.Bytes()); code != CloseProtocolError {
+			t.Fatalf("rsv %03b: sent close code %d, want %d", rsv, code, CloseProtocolError)
+		}
+	}
+}
+
+func TestReservedOpCodes(t *testing.T) {
+	for _, opCode := range []OpCode{ReservedNonControlFrame1, ReservedNonControlFrame5, ReservedControlFrame1, ReservedControlFrame5} {
+		output := &bytes.Buffer{}
+		ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(rawFrame(true, opCode, 0, nil))), false)
+		if _, err := ws.ReadMessage(); err != ErrReservedOpCode {
+			t.Fatalf("%s: ReadMessage() error = %v, want %v", opCode, err, ErrReservedOpCode)
+		}
+		if code := sentCloseCode(t, output.Bytes()); code != CloseProtocolError {
+			t.Fatalf("%s: sent close code %d, want %d", opCode, code, CloseProtocolError)
+		}
+	}
+	// 保留的 OpCode 也不能发送
+	ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(nil)), false)
+	if err := ws.SendMessage(&Message{OpCode: ReservedNonControlFrame1}); err != ErrReservedOpCode {
+		t.Fatalf("SendMessage() error = %v, want %v", err, ErrReservedOpCode)
+	}
+
+	names := map[OpCode]string{
+		TextFrame:             "TextFrame",
+		ReservedControlFrame5: "ReservedControlFrame5",
+		16:                    "OpCode(16)",
+		255:                   "OpCode(255)",
+	}
+	for opCode, name := range names {
+		if opCode.String() != name {
+			t.Errorf("OpCode(%d).String() = %q, want %q", byte(opCode), opCode.String(), name)
+		}
+	}
+	if !OpCode(16).IsReserved() {
+		t.Error("OpCode(16).IsReserved() = false")
+	}
+}
+
+func TestMaskingDirection(t *testing.T) {
+	unmasked := rawFrame(true, TextFrame, 2, []byte("hi"))
+	masked := maskedFrame(TextFrame, []byte("hi"))
+	tests := []struct {
+		name  string
+		role  Role
+		input []byte
+		err   error
+	}{
+		{name: "server receives unmasked", role: RoleServer, input: unmasked, err: ErrUnmaskedClientFrame},
+		{name: "server receives masked", role: RoleServer, input: masked},
+		{name: "client receives masked", role: RoleClient, input: masked, err: ErrMaskedServerFrame},
+		{name: "client receives unmasked", role: RoleClient, input: unmasked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			ws := NewWebSocketWithRole(discardCloser{output}, io.NopCloser(bytes.NewReader(test.input)), test.role)
+			_, data, err := ws.ReadAllMessage()
+			if err != test.err {
+				t.Fatalf("ReadAllMessage() error = %v, want %v", err, test.err)
+			}
+			if err == nil {
+				if string(data) != "hi" {
+					t.Fatalf("ReadAllMessage() = %q, want hi", data)
+				}
+				return
+			}
+			if code := sentCloseCode(t, output.Bytes()); code != CloseProtocolError {
+				t.Fatalf("sent close code %d, want %d", code, CloseProtocolError)
+			}
+		})
+	}
+
+	// NewWebSocket 不检查掩码方向
+	for _, input := range [][]byte{unmasked, masked} {
+		ws := NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+		if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "hi" {
+			t.Fatalf("NewWebSocket ReadAllMessage() = %q, %v, want hi", data, err)
+		}
+	}
+
+	// 客户端发送的帧都要掩码，服务端发送的帧都不掩码
+	for _, role := range []Role{RoleClient, RoleServer} {
+		output := &bytes.Buffer{}
+		ws := NewWebSocketWithRole(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), role)
+		if err := ws.Send("hi"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range decodeFrames(t, output.Bytes()) {
+			if frame.Mask != (role == RoleClient) {
+				t.Fatalf("role %d sent %s with mask %v", role, frame.OpCode, frame.Mask)
+			}
+		}
+	}
+}
+
+func TestInterleavedControlFrames(t *testing.T) {
+	input := bytes.Join([][]byte{
+		rawFrame(false, TextFrame, 3, []byte("Hel")),
+		rawFrame(true, Ping, 1, []byte("p")),
+		rawFrame(true, Pong, 1, []byte("q")),
+		rawFrame(false, ContinuationFrame, 1, []byte("l")),
+		rawFrame(true, Ping, 1, []byte("r")),
+		rawFrame(true, ContinuationFrame, 1, []byte("o")),
+		rawFrame(true, TextFrame, 4, []byte("next")),
+	}, nil)
+
+	t.Run("auto pong", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+		if opCode, data, err := ws.ReadAllMessage(); err != nil || opCode != TextFrame || string(data) != "Hello" {
+			t.Fatalf("ReadAllMessage() = %s %q %v, want TEXT Hello", opCode, data, err)
+		}
+		// 分片之间的 Ping 都被回复了
+		frames := decodeFrames(t, output.Bytes())
+		if len(frames) != 2 || frames[0].OpCode != Pong || string(frames[0].Payload) != "p" || string(frames[1].Payload) != "r" {
+			t.Fatalf("sent frames %+v, want pongs p and r", frames)
+		}
+		if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "next" {
+			t.Fatalf("ReadAllMessage() = %q, %v, want next", data, err)
+		}
+	})
+
+	t.Run("pings handled by the application", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+		ws.SetPingPolicy(PingPolicy{Disable: true})
+		// 不自动回复的 Ping 在数据 Message 之后按照收到的顺序返回
+		want := []struct {
+			opCode OpCode
+			data   string
+		}{{TextFrame, "Hello"}, {Ping, "p"}, {Ping, "r"}, {TextFrame, "next"}}
+		for _, w := range want {
+			opCode, data, err := ws.ReadAllMessage()
+			if err != nil || opCode != w.opCode || string(data) != w.data {
+				t.Fatalf("ReadAllMessage() = %s %q %v, want %s %q", opCode, data, err, w.opCode, w.data)
+			}
+		}
+		if output.Len() != 0 {
+			t.Fatalf("sent % x, want no automatic pong", output.Bytes())
+		}
+	})
+}
+
+func TestReadLimit(t *testing.T) {
+	// 单个帧超过限制的时候，ReadMessage 在读取内容之前就返回错误
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(rawFrame(true, BinaryFrame, 9, []byte("123456789")))), false)
+	ws.SetReadLimit(8)
+	if _, err := ws.ReadMessage(); err != ErrReadLimitExceeded {
+		t.Fatalf("ReadMessage() error = %v, want %v", err, ErrReadLimitExceeded)
+	}
+	if code := sentCloseCode(t, output.Bytes()); code != CloseMessageTooBig {
+		t.Fatalf("sent close code %d, want %d", code, CloseMessageTooBig)
+	}
+
+	// 每个分片都没有超过限制，但是总长度超过了
+	output.Reset()
+	input := append(rawFrame(false, BinaryFrame, 5, []byte("12345")), rawFrame(true, ContinuationFrame, 5, []byte("67890"))...)
+	ws = NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetReadLimit(8)
+	if _, _, err := ws.ReadAllMessage(); err != ErrReadLimitExceeded {
+		t.Fatalf("ReadAllMessage() error = %v, want %v", err, ErrReadLimitExceeded)
+	}
+	if code := sentCloseCode(t, output.Bytes()); code != CloseMessageTooBig {
+		t.Fatalf("sent close code %d, want %d", code, CloseMessageTooBig)
+	}
+	if info := ws.CloseReason(); info == nil || info.Code != CloseMessageTooBig {
+		t.Fatalf("CloseReason() = %+v, want code %d", info, CloseMessageTooBig)
+	}
+
+	// 正好等于限制的 Message 可以读取
+	input = append(rawFrame(false, BinaryFrame, 4, []byte("1234")), rawFrame(true, ContinuationFrame, 4, []byte("5678"))...)
+	ws = NewWebSocket(discardCloser{io.Discard}, io.NopCloser(bytes.NewReader(input)), false)
+	ws.SetReadLimit(8)
+	if _, data, err := ws.ReadAllMessage(); err != nil || string(data) != "12345678" {
+		t.Fatalf("ReadAllMessage() = %q, %v, want 12345678", data, err)
+	}
+}
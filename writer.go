@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrWriterClosed = errors.New("message writer is closed")
+
+// NextWriter 返回一个用于发送 opCode 类型 Message 的 io.WriteCloser，每次 Write 会直接发送一个分片，
+// Close 会发送带有 FIN 标志的最后一个分片。在 Close 之前，其他的 SendMessage 和 NextWriter 会等待这个 Message 发送完成。
+//
+// 控制帧不能分片，所以控制帧的数据会在 Close 的时候一次性发送。
+// 协商了压缩、校验或者自定义扩展的时候，数据需要先经过处理再分片，这时会和 SendMessage 一样分片发送。
+func (w *webSocket) NextWriter(opCode OpCode) (io.WriteCloser, error) {
+	if _, ok := w.reservedAllowed(opCode); opCode.IsReserved() && !ok {
+		return nil, ErrReservedOpCode
+	}
+	if opCode == ContinuationFrame {
+		return nil, ErrUnexpectedContinuation
+	}
+	w.sendLock.Lock()
+	if w.state() > OPEN {
+		w.sendLock.Unlock()
+		return nil, ErrClosedStatus
+	}
+	mw := &messageWriter{
+		ws:     w,
+		opCode: opCode,
+	}
+	if !opCode.IsControl() && w.transformsOutgoing() {
+		reader, writer := io.Pipe()
+		mw.pipe = writer
+		mw.done = make(chan error, 1)
+		go func() {
+			err := w.sendMessage(&Message{
+				Reader: reader,
+				OpCode: opCode,
+			})
+			_ = reader.CloseWithError(err)
+			mw.done <- err
+		}()
+	}
+	return mw, nil
+}
+
+// transformsOutgoing 判断发送的数据 Message 是否需要经过扩展、校验或者压缩的处理
+func (w *webSocket) transformsOutgoing() bool {
+	if w.checksum || len(w.extensions) > 0 {
+		return true
+	}
+	return w.deflate != nil && w.deflate.canCompress() && !w.writeCompressionOff.Load()
+}
+
+// messageWriter 是 NextWriter 返回的 io.WriteCloser
+type messageWriter struct {
+	ws *webSocket
+	// opCode 是下一个分片的 OpCode，发送第一个分片之后变成 ContinuationFrame
+	opCode OpCode
+	closed bool
+	err    error
+
+	// control 是控制帧在 Close 之前收到的数据
+	control []byte
+
+	// pipe 不为空时，数据会通过 pipe 交给后台的 sendMessage 发送，done 返回发送的结果
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, ErrWriterClosed
+	}
+	if mw.err != nil {
+		return 0, mw.err
+	}
+	if mw.opCode.IsControl() {
+		if len(mw.control)+len(p) > maxControlPayloadLength {
+			return 0, ErrControlPayloadTooLong
+		}
+		mw.control = append(mw.control, p...)
+		return len(p), nil
+	}
+	if mw.pipe != nil {
+		n, err := mw.pipe.Write(p)
+		if err != nil {
+			mw.err = err
+		}
+		return n, err
+	}
+	if len(p) < 1 {
+		return 0, nil
+	}
+	mw.err = mw.sendFrame(p, false)
+	if mw.err != nil {
+		return 0, mw.err
+	}
+	mw.opCode = ContinuationFrame
+	return len(p), nil
+}
+
+// Close 发送最后一个分片，然后允许发送下一个 Message
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return ErrWriterClosed
+	}
+	mw.closed = true
+	defer mw.ws.sendLock.Unlock()
+	switch {
+	case mw.pipe != nil:
+		_ = mw.pipe.Close()
+		err := <-mw.done
+		if mw.err == nil {
+			mw.err = err
+		}
+		return mw.err
+	case mw.err != nil:
+		return mw.err
+	default:
+		return mw.sendFrame(mw.control, true)
+	}
+}
+
+// closeWith 把 p 作为带有 FIN 标志的最后一个分片发送，避免 Close 再发送一个空的分片
+func (mw *messageWriter) closeWith(p []byte) error {
+	if mw.closed || mw.pipe != nil || mw.opCode.IsControl() {
+		_, err := mw.Write(p)
+		closeErr := mw.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+	mw.closed = true
+	defer mw.ws.sendLock.Unlock()
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.sendFrame(p, true)
+}
+
+func (mw *messageWriter) sendFrame(payload []byte, fin bool) error {
+	return mw.ws.sendFrame(context.Background(), &Frame{
+		Fin:    fin,
+		Mask:   mw.ws.mask,
+		OpCode: mw.opCode,
+		Payload: &io.LimitedReader{
+			R: newBytesBuffer(payload),
+			N: int64(len(payload)),
+		},
+	})
+}
+
+// NextReader 读取下一个 Message，返回它的 OpCode 和内容。
+// 内容是一边读取一边从连接中接收的，读取完之前不能调用下一次 NextReader 或者 ReadMessage。
+func (w *webSocket) NextReader() (OpCode, io.Reader, error) {
+	message, err := w.ReadMessage()
+	if err != nil {
+		return 0, nil, err
+	}
+	return message.OpCode, message.Reader, nil
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNextWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	if _, err := ws.NextWriter(ContinuationFrame); err != ErrUnexpectedContinuation {
+		t.Fatalf("NextWriter(ContinuationFrame) error = %v, want %v", err, ErrUnexpectedContinuation)
+	}
+	writer, err := ws.NextWriter(TextFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每次 Write 发送一个分片，Close 发送带有 FIN 的最后一个分片
+	for _, part := range []string{"ab", "cd"} {
+		if _, err = io.WriteString(writer, part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != ErrWriterClosed {
+		t.Fatalf("second Close() error = %v, want %v", err, ErrWriterClosed)
+	}
+	if _, err = writer.Write([]byte("x")); err != ErrWriterClosed {
+		t.Fatalf("Write() after Close error = %v, want %v", err, ErrWriterClosed)
+	}
+
+	// 控制帧不能分片，内容在 Close 的时候一起发送
+	ping, err := ws.NextWriter(Ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(ping, "p")
+	_, _ = io.WriteString(ping, "q")
+	if err = ping.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sentFrame{
+		{OpCode: TextFrame, Payload: []byte("ab")},
+		{OpCode: ContinuationFrame, Payload: []byte("cd")},
+		{OpCode: ContinuationFrame, Fin: true, Payload: []byte{}},
+		{OpCode: Ping, Fin: true, Payload: []byte("pq")},
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != len(want) {
+		t.Fatalf("sent frames %+v, want %+v", frames, want)
+	}
+	for i, frame := range frames {
+		if frame.OpCode != want[i].OpCode || frame.Fin != want[i].Fin || !bytes.Equal(frame.Payload, want[i].Payload) {
+			t.Fatalf("frame %d = %+v, want %+v", i, frame, want[i])
+		}
+	}
+}
+
+func TestNextWriterBlocksNextMessage(t *testing.T) {
+	output := &bytes.Buffer{}
+	ws := NewWebSocket(discardCloser{output}, io.NopCloser(bytes.NewReader(nil)), false)
+	writer, err := ws.NextWriter(BinaryFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = writer.Write([]byte("first"))
+	sent := make(chan error, 1)
+	go func() {
+		sent <- ws.WriteMessage(BinaryFrame, []byte("second"))
+	}()
+	// 另一个 Message 要等到 NextWriter 的 Message 结束才能发送，分片不会交错
+	select {
+	case err = <-sent:
+		t.Fatalf("WriteMessage() returned %v before the writer was closed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-sent; err != nil {
+		t.Fatal(err)
+	}
+	frames := decodeFrames(t, output.Bytes())
+	if len(frames) != 3 || !frames[1].Fin || string(frames[2].Payload) != "second" {
+		t.Fatalf("sent frames %+v, want the second message after the first one", frames)
+	}
+}
+
+func TestNextReaderStreams(t *testing.T) {
+	reader, peer := io.Pipe()
+	defer peer.Close()
+	ws := NewWebSocket(discardCloser{io.Discard}, reader, false)
+	go func() {
+		_, _ = peer.Write(rawFrame(false, TextFrame, 3, []byte("Hel")))
+	}()
+	// 第二个分片还没有发送，NextReader 已经可以返回并读取第一个分片
+	opCode, message, err := ws.NextReader()
+	if err != nil || opCode != TextFrame {
+		t.Fatalf("NextReader() = %s, %v, want TEXT", opCode, err)
+	}
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(message, buf); err != nil || string(buf) != "Hel" {
+		t.Fatalf("read %q, %v, want Hel", buf, err)
+	}
+	go func() {
+		_, _ = peer.Write(rawFrame(true, ContinuationFrame, 2, []byte("lo")))
+	}()
+	rest, err := io.ReadAll(message)
+	if err != nil || string(rest) != "lo" {
+		t.Fatalf("read the rest %q, %v, want lo", rest, err)
+	}
+}